@@ -0,0 +1,142 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerThreshold is the default number of consecutive failures after which
+	// requests to a node fail fast.
+	DefaultBreakerThreshold = 5
+
+	// DefaultBreakerCooldown is the default time requests to a node fail fast for before
+	// the node is probed again.
+	DefaultBreakerCooldown = 10 * time.Second
+)
+
+// ErrNodeUnavailable is returned when a request isn't sent to a node because recent requests
+// to it have failed.
+var ErrNodeUnavailable = errors.New("node unavailable")
+
+// breakerState is the state of the circuit breaker of a node.
+type breakerState int
+
+const (
+	// Requests are sent to the node.
+	breakerClosed breakerState = iota
+
+	// Requests fail fast until the cooldown has elapsed.
+	breakerOpen
+
+	// A single request is sent to probe whether the node has recovered.
+	breakerHalfOpen
+)
+
+// nodeBreaker tracks consecutive request failures for each node. Once a node has failed
+// threshold times in a row its breaker opens and requests to it fail fast for the cooldown.
+// After the cooldown the breaker half-opens and lets a single request through: if that
+// succeeds the breaker closes, otherwise it opens for another cooldown.
+type nodeBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	nodes     map[uint64]*nodeBreakerState
+
+	now func() time.Time
+}
+
+type nodeBreakerState struct {
+	state    breakerState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // the time the breaker last opened
+}
+
+// newNodeBreaker returns a breaker that opens after threshold consecutive failures.
+// A threshold of zero disables the breaker.
+func newNodeBreaker(threshold int, cooldown time.Duration) *nodeBreaker {
+	return &nodeBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		nodes:     make(map[uint64]*nodeBreakerState),
+		now:       time.Now,
+	}
+}
+
+// allow returns ErrNodeUnavailable if a request shouldn't be sent to the node. Otherwise the
+// result of the request must be reported with success or failure.
+func (b *nodeBreaker) allow(nodeID uint64) error {
+	if b.threshold <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.nodes[nodeID]
+	if n == nil {
+		return nil
+	}
+
+	switch n.state {
+	case breakerOpen:
+		if b.now().Sub(n.openedAt) < b.cooldown {
+			return ErrNodeUnavailable
+		}
+		// Let this request probe the node. Others fail fast until it reports back.
+		n.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		return ErrNodeUnavailable
+	}
+	return nil
+}
+
+// success closes the breaker of the node.
+func (b *nodeBreaker) success(nodeID uint64) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	delete(b.nodes, nodeID)
+	b.mu.Unlock()
+}
+
+// failure records a failed request to the node, opening its breaker if it has failed
+// too many times in a row or if it failed a probe.
+func (b *nodeBreaker) failure(nodeID uint64) {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := b.nodes[nodeID]
+	if n == nil {
+		n = &nodeBreakerState{}
+		b.nodes[nodeID] = n
+	}
+
+	switch n.state {
+	case breakerClosed:
+		if n.failures++; n.failures >= b.threshold {
+			n.state, n.openedAt = breakerOpen, b.now()
+		}
+	case breakerHalfOpen:
+		n.state, n.openedAt = breakerOpen, b.now()
+	}
+}
+
+// state returns the state of the breaker of the node.
+func (b *nodeBreaker) state(nodeID uint64) breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n := b.nodes[nodeID]; n != nil {
+		return n.state
+	}
+	return breakerClosed
+}
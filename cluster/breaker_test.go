@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+// Ensure the breaker of a node opens after consecutive failures, half-opens after the
+// cooldown, and closes once a probe succeeds.
+func TestNodeBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newNodeBreaker(2, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	// A success resets the consecutive failures.
+	b.failure(1)
+	b.success(1)
+	b.failure(1)
+	if err := b.allow(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if s := b.state(1); s != breakerClosed {
+		t.Fatalf("unexpected state: %d", s)
+	}
+
+	// The breaker opens on the second consecutive failure, only for that node.
+	b.failure(1)
+	if s := b.state(1); s != breakerOpen {
+		t.Fatalf("unexpected state: %d", s)
+	} else if err := b.allow(1); err != ErrNodeUnavailable {
+		t.Fatalf("unexpected error: %v", err)
+	} else if err := b.allow(2); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// After the cooldown a single probe is allowed. A failed probe reopens the breaker.
+	now = now.Add(10 * time.Second)
+	if err := b.allow(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if s := b.state(1); s != breakerHalfOpen {
+		t.Fatalf("unexpected state: %d", s)
+	} else if err := b.allow(1); err != ErrNodeUnavailable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.failure(1)
+	if s := b.state(1); s != breakerOpen {
+		t.Fatalf("unexpected state: %d", s)
+	} else if err := b.allow(1); err != ErrNodeUnavailable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A successful probe closes the breaker.
+	now = now.Add(10 * time.Second)
+	if err := b.allow(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b.success(1)
+	if s := b.state(1); s != breakerClosed {
+		t.Fatalf("unexpected state: %d", s)
+	} else if err := b.allow(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a breaker with a zero threshold never opens.
+func TestNodeBreaker_Disabled(t *testing.T) {
+	b := newNodeBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.failure(1)
+	}
+	if err := b.allow(1); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
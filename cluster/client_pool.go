@@ -3,6 +3,8 @@ package cluster
 import (
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"gopkg.in/fatih/pool.v2"
 )
@@ -41,11 +43,31 @@ func (c *clientPool) size() int {
 	return size
 }
 
-func (c *clientPool) conn(nodeID uint64) (net.Conn, error) {
+// conn returns a connection to the node from its pool. If idleTimeout is set, pooled connections
+// that haven't been used for longer than it are discarded, since the node may have closed them.
+func (c *clientPool) conn(nodeID uint64, idleTimeout time.Duration) (net.Conn, error) {
 	c.mu.RLock()
-	conn, err := c.pool[nodeID].Get()
+	p := c.pool[nodeID]
 	c.mu.RUnlock()
-	return conn, err
+
+	for {
+		conn, err := p.Get()
+		if err != nil {
+			return nil, err
+		}
+
+		pc, ok := conn.(*pool.PoolConn)
+		if !ok || idleTimeout == 0 {
+			return conn, nil
+		}
+		if tc, ok := pc.Conn.(*timedConn); !ok || tc.idle() < idleTimeout {
+			return conn, nil
+		}
+
+		// close the connection rather than returning it to the pool
+		pc.MarkUnusable()
+		pc.Close()
+	}
 }
 
 func (c *clientPool) close() {
@@ -55,3 +77,28 @@ func (c *clientPool) close() {
 	}
 	c.mu.Unlock()
 }
+
+// timedConn is a connection that keeps track of when it was last used.
+type timedConn struct {
+	net.Conn
+	lastUsed int64 // unix nano, accessed atomically
+}
+
+func newTimedConn(conn net.Conn) *timedConn {
+	return &timedConn{Conn: conn, lastUsed: time.Now().UnixNano()}
+}
+
+func (c *timedConn) Read(b []byte) (int, error) {
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+	return c.Conn.Read(b)
+}
+
+func (c *timedConn) Write(b []byte) (int, error) {
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+	return c.Conn.Write(b)
+}
+
+// idle returns how long it's been since the connection was last used.
+func (c *timedConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastUsed)))
+}
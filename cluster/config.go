@@ -9,16 +9,26 @@ import (
 const (
 	// DefaultShardWriterTimeout is the default timeout set on shard writers.
 	DefaultShardWriterTimeout = 5 * time.Second
+
+	// DefaultPoolMaxConnections is the default number of idle connections kept open to each node.
+	DefaultPoolMaxConnections = 3
 )
 
 // Config represents the configuration for the the clustering service.
 type Config struct {
 	ShardWriterTimeout toml.Duration `toml:"shard-writer-timeout"`
+	PoolMaxConnections int           `toml:"pool-max-connections"`
+	PoolIdleTimeout    toml.Duration `toml:"pool-idle-timeout"`
+	BreakerThreshold   int           `toml:"breaker-threshold"`
+	BreakerCooldown    toml.Duration `toml:"breaker-cooldown"`
 }
 
 // NewConfig returns an instance of Config with defaults.
 func NewConfig() Config {
 	return Config{
 		ShardWriterTimeout: toml.Duration(DefaultShardWriterTimeout),
+		PoolMaxConnections: DefaultPoolMaxConnections,
+		BreakerThreshold:   DefaultBreakerThreshold,
+		BreakerCooldown:    toml.Duration(DefaultBreakerCooldown),
 	}
 }
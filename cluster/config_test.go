@@ -13,6 +13,10 @@ func TestConfig_Parse(t *testing.T) {
 	var c cluster.Config
 	if _, err := toml.Decode(`
 shard-writer-timeout = "10s"
+pool-max-connections = 5
+pool-idle-timeout = "1m"
+breaker-threshold = 3
+breaker-cooldown = "30s"
 `, &c); err != nil {
 		t.Fatal(err)
 	}
@@ -20,5 +24,13 @@ shard-writer-timeout = "10s"
 	// Validate configuration.
 	if time.Duration(c.ShardWriterTimeout) != 10*time.Second {
 		t.Fatalf("unexpected bind address: %s", c.ShardWriterTimeout)
+	} else if c.PoolMaxConnections != 5 {
+		t.Fatalf("unexpected pool max connections: %d", c.PoolMaxConnections)
+	} else if time.Duration(c.PoolIdleTimeout) != time.Minute {
+		t.Fatalf("unexpected pool idle timeout: %s", c.PoolIdleTimeout)
+	} else if c.BreakerThreshold != 3 {
+		t.Fatalf("unexpected breaker threshold: %d", c.BreakerThreshold)
+	} else if time.Duration(c.BreakerCooldown) != 30*time.Second {
+		t.Fatalf("unexpected breaker cooldown: %s", c.BreakerCooldown)
 	}
 }
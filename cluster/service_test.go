@@ -3,6 +3,7 @@ package cluster_test
 import (
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/influxdb/influxdb/cluster"
@@ -22,6 +23,28 @@ func (m *metaStore) Node(nodeID uint64) (*meta.NodeInfo, error) {
 	}, nil
 }
 
+// dialCountingMetaStore is a metaStore that counts the lookups of nodes, which the shard writer
+// makes each time it dials a node.
+type dialCountingMetaStore struct {
+	metaStore
+	mu    sync.Mutex
+	dialN int
+}
+
+func (m *dialCountingMetaStore) Node(nodeID uint64) (*meta.NodeInfo, error) {
+	m.mu.Lock()
+	m.dialN++
+	m.mu.Unlock()
+	return m.metaStore.Node(nodeID)
+}
+
+// n returns the number of nodes looked up.
+func (m *dialCountingMetaStore) n() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dialN
+}
+
 type testService struct {
 	nodeID          uint64
 	ln              net.Listener
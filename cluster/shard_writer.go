@@ -3,6 +3,7 @@ package cluster
 import (
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/influxdb/influxdb/meta"
@@ -20,6 +21,24 @@ type ShardWriter struct {
 	pool    *clientPool
 	timeout time.Duration
 
+	breakerOnce sync.Once
+	breaker     *nodeBreaker
+
+	// The maximum number of idle connections kept open to each node.
+	PoolMaxConnections int
+
+	// If set, pooled connections that have been idle for longer than this are closed
+	// instead of being reused.
+	PoolIdleTimeout time.Duration
+
+	// The number of consecutive failures to reach a node after which writes to it fail fast
+	// with ErrNodeUnavailable. Zero disables failing fast.
+	BreakerThreshold int
+
+	// The time writes to a failing node fail fast for. Afterwards a single write is sent to
+	// the node to probe whether it has recovered.
+	BreakerCooldown time.Duration
+
 	MetaStore interface {
 		Node(id uint64) (ni *meta.NodeInfo, err error)
 	}
@@ -28,14 +47,36 @@ type ShardWriter struct {
 // NewShardWriter returns a new instance of ShardWriter.
 func NewShardWriter(timeout time.Duration) *ShardWriter {
 	return &ShardWriter{
-		pool:    newClientPool(),
-		timeout: timeout,
+		pool:               newClientPool(),
+		timeout:            timeout,
+		PoolMaxConnections: DefaultPoolMaxConnections,
+		BreakerThreshold:   DefaultBreakerThreshold,
+		BreakerCooldown:    DefaultBreakerCooldown,
 	}
 }
 
 func (w *ShardWriter) WriteShard(shardID, ownerID uint64, points []tsdb.Point) error {
+	// Build write request.
+	var request WriteShardRequest
+	request.SetShardID(shardID)
+	request.AddPoints(points)
+
+	// Marshal into protocol buffers.
+	buf, err := request.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// Fail fast if the owner has been failing. Otherwise every outcome below reports whether
+	// the owner could be reached.
+	b := w.nodeBreaker()
+	if err := b.allow(ownerID); err != nil {
+		return err
+	}
+
 	c, err := w.dial(ownerID)
 	if err != nil {
+		b.failure(ownerID)
 		return err
 	}
 
@@ -47,21 +88,11 @@ func (w *ShardWriter) WriteShard(shardID, ownerID uint64, points []tsdb.Point) e
 		conn.Close() // return to pool
 	}(conn)
 
-	// Build write request.
-	var request WriteShardRequest
-	request.SetShardID(shardID)
-	request.AddPoints(points)
-
-	// Marshal into protocol buffers.
-	buf, err := request.MarshalBinary()
-	if err != nil {
-		return err
-	}
-
 	// Write request.
 	conn.SetWriteDeadline(time.Now().Add(w.timeout))
 	if err := WriteTLV(conn, writeShardRequestMessage, buf); err != nil {
 		conn.MarkUnusable()
+		b.failure(ownerID)
 		return err
 	}
 
@@ -70,9 +101,13 @@ func (w *ShardWriter) WriteShard(shardID, ownerID uint64, points []tsdb.Point) e
 	_, buf, err = ReadTLV(conn)
 	if err != nil {
 		conn.MarkUnusable()
+		b.failure(ownerID)
 		return err
 	}
 
+	// The owner responded, so errors from here on aren't failures to reach it.
+	b.success(ownerID)
+
 	// Unmarshal response.
 	var response WriteShardResponse
 	if err := response.UnmarshalBinary(buf); err != nil {
@@ -86,6 +121,13 @@ func (w *ShardWriter) WriteShard(shardID, ownerID uint64, points []tsdb.Point) e
 	return nil
 }
 
+// nodeBreaker returns the breaker tracking failures to reach each node. It's created on first
+// use so the breaker settings can be changed after the writer is created.
+func (w *ShardWriter) nodeBreaker() *nodeBreaker {
+	w.breakerOnce.Do(func() { w.breaker = newNodeBreaker(w.BreakerThreshold, w.BreakerCooldown) })
+	return w.breaker
+}
+
 func (c *ShardWriter) dial(nodeID uint64) (net.Conn, error) {
 	// If we don't have a connection pool for that addr yet, create one
 	_, ok := c.pool.getPool(nodeID)
@@ -93,13 +135,13 @@ func (c *ShardWriter) dial(nodeID uint64) (net.Conn, error) {
 		factory := &connFactory{nodeID: nodeID, clientPool: c.pool, timeout: c.timeout}
 		factory.metaStore = c.MetaStore
 
-		p, err := pool.NewChannelPool(1, 3, factory.dial)
+		p, err := pool.NewChannelPool(1, c.PoolMaxConnections, factory.dial)
 		if err != nil {
 			return nil, err
 		}
 		c.pool.setPool(nodeID, p)
 	}
-	return c.pool.conn(nodeID)
+	return c.pool.conn(nodeID, c.PoolIdleTimeout)
 }
 
 func (w *ShardWriter) Close() error {
@@ -157,5 +199,5 @@ func (c *connFactory) dial() (net.Conn, error) {
 		return nil, err
 	}
 
-	return conn, nil
+	return newTimedConn(conn), nil
 }
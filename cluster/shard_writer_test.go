@@ -184,3 +184,118 @@ func TestShardWriter_Write_ErrReadTimeout(t *testing.T) {
 		t.Fatalf("unexpected error: %s", err)
 	}
 }
+
+// Ensure the shard writer fails fast once a node has failed repeatedly.
+func TestShardWriter_Write_ErrNodeUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+
+	w := cluster.NewShardWriter(time.Second)
+	w.MetaStore = &metaStore{host: ln.Addr().String()}
+	w.BreakerThreshold = 2
+	w.BreakerCooldown = time.Minute
+
+	var points []tsdb.Point
+	points = append(points, tsdb.NewPoint(
+		"cpu", tsdb.Tags{"host": "server01"}, map[string]interface{}{"value": int64(100)}, time.Now(),
+	))
+
+	for i := 0; i < 2; i++ {
+		if err := w.WriteShard(1, 2, points); err == nil || err == cluster.ErrNodeUnavailable {
+			t.Fatalf("%d. unexpected error: %v", i, err)
+		}
+	}
+	if err := w.WriteShard(1, 2, points); err != cluster.ErrNodeUnavailable {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the shard writer reuses pooled connections, and replaces those that have been idle for
+// longer than the idle timeout.
+func TestShardWriter_WriteShard_PoolIdleTimeout(t *testing.T) {
+	ts := newTestService(writeShardSuccess)
+	s := cluster.NewService(cluster.Config{})
+	s.Listener = ts.muxln
+	s.TSDBStore = ts
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer ts.Close()
+
+	// Each connection the pool dials looks up the node.
+	ms := &dialCountingMetaStore{metaStore: metaStore{host: ts.ln.Addr().String()}}
+	w := cluster.NewShardWriter(time.Minute)
+	w.MetaStore = ms
+	w.PoolIdleTimeout = 100 * time.Millisecond
+	defer w.Close()
+
+	var points []tsdb.Point
+	points = append(points, tsdb.NewPoint("cpu", tsdb.Tags{"host": "server01"}, map[string]interface{}{"value": int64(100)}, time.Now()))
+
+	// The connection is reused while it's used within the idle timeout.
+	for i := 0; i < 2; i++ {
+		if err := w.WriteShard(1, 2, points); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := ms.n(); n != 1 {
+		t.Fatalf("unexpected dial count: %d", n)
+	}
+
+	// Once it has been idle for longer, it's closed and another is dialed.
+	time.Sleep(2 * w.PoolIdleTimeout)
+	if err := w.WriteShard(1, 2, points); err != nil {
+		t.Fatal(err)
+	} else if n := ms.n(); n != 2 {
+		t.Fatalf("unexpected dial count: %d", n)
+	}
+
+	if _, err := ts.ResponseN(3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// BenchmarkShardWriter_WriteShard_Pooled writes small requests to a node over pooled connections.
+func BenchmarkShardWriter_WriteShard_Pooled(b *testing.B) {
+	benchmarkShardWriterWriteShard(b, 0)
+}
+
+// BenchmarkShardWriter_WriteShard_Unpooled writes the same requests, with an idle timeout that
+// makes every request dial a new connection.
+func BenchmarkShardWriter_WriteShard_Unpooled(b *testing.B) {
+	benchmarkShardWriterWriteShard(b, time.Nanosecond)
+}
+
+// benchmarkShardWriterWriteShard writes a single point to a node b.N times, with pooled connections
+// idle for longer than idleTimeout discarded, if it's set.
+func benchmarkShardWriterWriteShard(b *testing.B, idleTimeout time.Duration) {
+	ts := newTestService(func(shardID uint64, points []tsdb.Point) error { return nil })
+	s := cluster.NewService(cluster.Config{})
+	s.Listener = ts.muxln
+	s.TSDBStore = ts
+	if err := s.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+	defer ts.Close()
+
+	w := cluster.NewShardWriter(time.Minute)
+	w.MetaStore = &metaStore{host: ts.ln.Addr().String()}
+	w.PoolIdleTimeout = idleTimeout
+	defer w.Close()
+
+	var points []tsdb.Point
+	points = append(points, tsdb.NewPoint("cpu", tsdb.Tags{"host": "server01"}, map[string]interface{}{"value": int64(100)}, time.Now()))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := w.WriteShard(1, 2, points); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -97,6 +97,8 @@ func (c *Config) Validate() error {
 		return errors.New("Data.Dir must be specified")
 	} else if c.HintedHandoff.Dir == "" {
 		return errors.New("HintedHandoff.Dir must be specified")
+	} else if c.Data.ReservedInteractiveQueries > 0 && c.Data.ReservedInteractiveQueries >= c.Data.MaxConcurrentQueries {
+		return errors.New("Data.ReservedInteractiveQueries must be less than Data.MaxConcurrentQueries")
 	}
 
 	for _, g := range c.Graphites {
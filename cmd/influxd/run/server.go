@@ -88,10 +88,37 @@ func NewServer(c *Config, version string) (*Server, error) {
 	s.QueryExecutor = tsdb.NewQueryExecutor(s.TSDBStore)
 	s.QueryExecutor.MetaStore = s.MetaStore
 	s.QueryExecutor.MetaStatementExecutor = &meta.StatementExecutor{Store: s.MetaStore}
+	s.QueryExecutor.RequireTimeBound = c.Data.QueryRequireTimeBound
+	s.QueryExecutor.DefaultQueryWindow = time.Duration(c.Data.QueryDefaultWindow)
+	s.QueryExecutor.MaxSeriesPerQuery = c.Data.MaxSeriesPerQuery
+	s.QueryExecutor.SkipNonFinite = c.Data.QuerySkipNonFinite
+	s.QueryExecutor.MaxChunkSize = c.Data.MaxChunkSize
+	s.QueryExecutor.DefaultChunkSize = c.Data.QueryDefaultChunkSize
+	s.QueryExecutor.PrefetchDepth = c.Data.PrefetchDepth
+	s.QueryExecutor.MaxResponseBytes = c.Data.MaxResponseBytes
+	s.QueryExecutor.ShardOpenTimeout = time.Duration(c.Data.QueryShardOpenTimeout)
+	s.QueryExecutor.IdleTimeout = time.Duration(c.Data.QueryIdleTimeout)
+	s.QueryExecutor.TolerateMissingShards = c.Data.QueryTolerateMissingShards
+	s.QueryExecutor.UnifyColumns = c.Data.QueryUnifyColumns
+	s.QueryExecutor.MaxSeriesIntervals = c.Data.QueryMaxSeriesIntervals
+	s.QueryExecutor.PartialOverBudget = c.Data.QueryPartialOverBudget
+	s.QueryExecutor.MaxConcatBytes = c.Data.QueryMaxConcatBytes
+	s.QueryExecutor.MaxConcurrentQueries = c.Data.MaxConcurrentQueries
+	s.QueryExecutor.ReservedInteractiveQueries = c.Data.ReservedInteractiveQueries
+
+	// The query executor has no RemoteMapper, as the cluster service only serves writes, so shards
+	// are only read on this node and the one read consistency level only works on the primary
+	// owner's node. See tsdb.QueryExecutor.ReadConsistency.
 
 	// Set the shard writer
 	s.ShardWriter = cluster.NewShardWriter(time.Duration(c.Cluster.ShardWriterTimeout))
 	s.ShardWriter.MetaStore = s.MetaStore
+	if c.Cluster.PoolMaxConnections > 0 {
+		s.ShardWriter.PoolMaxConnections = c.Cluster.PoolMaxConnections
+	}
+	s.ShardWriter.PoolIdleTimeout = time.Duration(c.Cluster.PoolIdleTimeout)
+	s.ShardWriter.BreakerThreshold = c.Cluster.BreakerThreshold
+	s.ShardWriter.BreakerCooldown = time.Duration(c.Cluster.BreakerCooldown)
 
 	// Create the hinted handoff service
 	s.HintedHandoff = hh.NewService(c.HintedHandoff, s.ShardWriter)
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"regexp"
 	"sort"
 	"strconv"
@@ -69,6 +70,73 @@ func (d DataType) String() string {
 	return "unknown"
 }
 
+// ErrFieldTypeCoercion is returned when the value of a field can't be coerced to the type it's
+// forced to, e.g. a non-numeric string to a float.
+func ErrFieldTypeCoercion(field string, v interface{}, t DataType) error {
+	return fmt.Errorf("can't coerce %s value %#v of field %s to %s", InspectDataType(v), v, field, t)
+}
+
+// CoerceFieldValue converts the value of a field to the given type. It's used to read fields
+// whose type is inconsistent across shards, e.g. because of a historical write bug, as a single
+// type. Integers and floats are converted to each other, with floats truncated toward zero, and
+// booleans to 1 or 0. Strings are parsed as numbers or booleans, and any value is formatted as a
+// string. Other conversions, and strings that don't parse, return ErrFieldTypeCoercion, as do
+// NaN, infinite and out of range floats converted to integers. Nil values are returned as is.
+func CoerceFieldValue(field string, v interface{}, t DataType) (interface{}, error) {
+	if v == nil || InspectDataType(v) == t {
+		return v, nil
+	}
+
+	switch t {
+	case Float:
+		switch v := v.(type) {
+		case int64:
+			return float64(v), nil
+		case bool:
+			if v {
+				return float64(1), nil
+			}
+			return float64(0), nil
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				return f, nil
+			}
+		}
+	case Integer:
+		switch v := v.(type) {
+		case float64:
+			if v >= math.MinInt64 && v < math.MaxInt64 {
+				return int64(v), nil
+			}
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case string:
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return i, nil
+			}
+		}
+	case Boolean:
+		if s, ok := v.(string); ok {
+			if b, err := strconv.ParseBool(s); err == nil {
+				return b, nil
+			}
+		}
+	case String:
+		switch v := v.(type) {
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	}
+	return nil, ErrFieldTypeCoercion(field, v, t)
+}
+
 // Node represents a node in the InfluxDB abstract syntax tree.
 type Node interface {
 	node()
@@ -238,6 +306,43 @@ type Source interface {
 
 func (*Measurement) source() {}
 
+// ErrUnsupportedSource is returned when a statement reads from a kind of source that can't be
+// used where it appears, e.g. a regex measurement that reaches the planner without being expanded.
+type ErrUnsupportedSource struct {
+	Kind   string // the kind of source, e.g. "regex measurement"
+	Source string // the source as it appears in the statement
+	Reason string // why the source isn't supported, e.g. "not supported yet"
+}
+
+// NewErrUnsupportedSource returns an error describing why src isn't supported.
+func NewErrUnsupportedSource(src Source) *ErrUnsupportedSource {
+	e := &ErrUnsupportedSource{Reason: "not supported yet"}
+	switch src := src.(type) {
+	case *Measurement:
+		if src.Regex != nil {
+			e.Kind = "regex measurement"
+			e.Reason = "regex measurements must be expanded into measurements before planning"
+		} else {
+			e.Kind = "measurement"
+		}
+	case nil:
+		e.Kind, e.Source = "empty source", ""
+		return e
+	default:
+		e.Kind = strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", src), "*influxql."))
+	}
+	e.Source = src.String()
+	return e
+}
+
+// Error returns a string representation of the error.
+func (e *ErrUnsupportedSource) Error() string {
+	if e.Source == "" {
+		return fmt.Sprintf("unsupported source: %s: %s", e.Kind, e.Reason)
+	}
+	return fmt.Sprintf("unsupported source %s (%s): %s", e.Source, e.Kind, e.Reason)
+}
+
 // Sources represents a list of sources.
 type Sources []Source
 
@@ -268,9 +373,15 @@ type SortField struct {
 // String returns a string representation of a sort field
 func (field *SortField) String() string {
 	var buf bytes.Buffer
-	_, _ = buf.WriteString(field.Name)
-	_, _ = buf.WriteString(" ")
-	_, _ = buf.WriteString(strconv.FormatBool(field.Ascending))
+	if field.Name != "" {
+		_, _ = buf.WriteString(field.Name)
+		_, _ = buf.WriteString(" ")
+	}
+	if field.Ascending {
+		_, _ = buf.WriteString("ASC")
+	} else {
+		_, _ = buf.WriteString("DESC")
+	}
 	return buf.String()
 }
 
@@ -619,6 +730,137 @@ const (
 	PreviousFill
 )
 
+// Priority represents the scheduling class of a query when queries contend for execution slots.
+type Priority int
+
+const (
+	// InteractivePriority is for queries a user is waiting on, such as those of a dashboard.
+	InteractivePriority Priority = iota
+	// BatchPriority is for background queries, such as continuous queries and downsampling jobs.
+	BatchPriority
+)
+
+// ParsePriority returns the priority with the given name.
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(s) {
+	case "", "interactive":
+		return InteractivePriority, nil
+	case "batch":
+		return BatchPriority, nil
+	}
+	return 0, fmt.Errorf("invalid priority: %s", s)
+}
+
+// String returns the name of the priority.
+func (p Priority) String() string {
+	switch p {
+	case InteractivePriority:
+		return "interactive"
+	case BatchPriority:
+		return "batch"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// Hints disable optimizations of the query engine for a single statement, so a regression in one
+// of them can be isolated. They're written as a comment starting with a plus sign directly after
+// SELECT, e.g. SELECT /*+ no_field_pruning no_prefetch */ value FROM cpu. The results are the
+// same with or without them. Each field below names the hint that sets it and what the engine
+// does instead of the optimization it disables.
+//
+// The fast path of count(), sum(), mean(), min() and max(), which computes them from the rollups
+// of blocks of points, is disabled by no_rollups, or its alias no_count_fastpath. Unknown hints
+// are parse errors rather than being ignored, so a hint that has no effect isn't mistaken for one
+// that does.
+type Hints struct {
+	NoFieldPruning     bool // no_field_pruning: mappers decode every field of points rather than those the query reads
+	NoLastOptimization bool // no_last_optimization: last() reads every point rather than seeking the end of each series
+	NoPrefetch         bool // no_prefetch: raw queries don't read ahead from their mappers
+	NoStreamAggregates bool // no_stream_aggregates: the intervals of aggregates are sent once they're all reduced
+	NoCoalesce         bool // no_coalesce: every shard is read by its own mapper
+	NoDownsample       bool // no_downsample: aggregates are read from the raw measurement only
+	NoRollups          bool // no_rollups: aggregates read the points of blocks rather than their rollups
+}
+
+// hint is the name of a hint and the field of the hints it sets.
+type hint struct {
+	name string
+	v    *bool
+}
+
+// hints returns each hint of h.
+func (h *Hints) hints() []hint {
+	return []hint{
+		{"no_field_pruning", &h.NoFieldPruning},
+		{"no_last_optimization", &h.NoLastOptimization},
+		{"no_prefetch", &h.NoPrefetch},
+		{"no_stream_aggregates", &h.NoStreamAggregates},
+		{"no_coalesce", &h.NoCoalesce},
+		{"no_downsample", &h.NoDownsample},
+		{"no_rollups", &h.NoRollups},
+	}
+}
+
+// hintAliases are the other names of hints, by the name of the hint they set.
+var hintAliases = map[string]string{
+	"no_count_fastpath": "no_rollups",
+}
+
+// ParseHints parses the text of a hint comment, without its delimiters. It starts with a plus sign
+// and is followed by hint names separated by whitespace or commas, each of which may also start
+// with a plus sign.
+func ParseHints(s string) (Hints, error) {
+	var h Hints
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "+") {
+		return h, fmt.Errorf("hints must start with +: %s", s)
+	}
+
+	names := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || isWhitespace(r) })
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimPrefix(name, "+"))
+		if name == "" {
+			continue
+		} else if alias, ok := hintAliases[name]; ok {
+			name = alias
+		}
+		found := false
+		for _, hn := range h.hints() {
+			if hn.name == name {
+				*hn.v, found = true, true
+			}
+		}
+		if !found {
+			return Hints{}, fmt.Errorf("unknown query hint: %s", name)
+		}
+	}
+	return h, nil
+}
+
+// String returns the hint comment of the hints, or an empty string if none are set.
+func (h Hints) String() string {
+	var names []string
+	for _, hn := range h.hints() {
+		if *hn.v {
+			names = append(names, hn.name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return "/*+ " + strings.Join(names, " ") + " */"
+}
+
+// JoinType represents how the rows of joined sources are combined.
+type JoinType int
+
+const (
+	// NoJoin means that each source returns its own rows.
+	NoJoin JoinType = iota
+	// InnerJoin means that rows are only returned for the tag sets and times present in every source.
+	InnerJoin
+)
+
 // SelectStatement represents a command for extracting data from the database.
 type SelectStatement struct {
 	// Expressions returned from the selection.
@@ -633,6 +875,9 @@ type SelectStatement struct {
 	// Data sources that fields are extracted from.
 	Sources Sources
 
+	// How the rows of the sources are combined, if they are joined.
+	Join JoinType
+
 	// An expression evaluated on data point.
 	Condition Expr
 
@@ -662,6 +907,12 @@ type SelectStatement struct {
 
 	// The value to fill empty aggregate buckets with, if any
 	FillValue interface{}
+
+	// The scheduling class of the statement. It's set by the caller rather than parsed.
+	Priority Priority
+
+	// The optimizations disabled for the statement by a hint comment, if any.
+	Hints Hints
 }
 
 // HasDerivative returns true if one of the function calls in the statement is a
@@ -689,12 +940,46 @@ func (s *SelectStatement) IsSimpleDerivative() bool {
 	return false
 }
 
+// HasDifference returns true if one of the function calls in the statement is difference
+func (s *SelectStatement) HasDifference() bool {
+	for _, f := range s.FunctionCalls() {
+		if f.Name == "difference" {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSimpleDifference returns true if one of the function calls is a difference with a variable
+// ref as its arg, rather than a nested aggregate
+func (s *SelectStatement) IsSimpleDifference() bool {
+	for _, f := range s.FunctionCalls() {
+		if f.Name == "difference" {
+			if _, ok := f.Args[0].(*VarRef); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// HasHoltWinters returns true if one of the function calls in the statement is holt_winters
+func (s *SelectStatement) HasHoltWinters() bool {
+	for _, f := range s.FunctionCalls() {
+		if f.Name == "holt_winters" {
+			return true
+		}
+	}
+	return false
+}
+
 // Clone returns a deep copy of the statement.
 func (s *SelectStatement) Clone() *SelectStatement {
 	clone := &SelectStatement{
 		Fields:     make(Fields, 0, len(s.Fields)),
 		Dimensions: make(Dimensions, 0, len(s.Dimensions)),
 		Sources:    cloneSources(s.Sources),
+		Join:       s.Join,
 		SortFields: make(SortFields, 0, len(s.SortFields)),
 		Condition:  CloneExpr(s.Condition),
 		Limit:      s.Limit,
@@ -704,6 +989,8 @@ func (s *SelectStatement) Clone() *SelectStatement {
 		Fill:       s.Fill,
 		FillValue:  s.FillValue,
 		IsRawQuery: s.IsRawQuery,
+		Priority:   s.Priority,
+		Hints:      s.Hints,
 	}
 	if s.Target != nil {
 		clone.Target = &Target{
@@ -753,8 +1040,9 @@ func cloneSource(s Source) Source {
 }
 
 // RewriteWildcards returns the re-written form of the select statement. Any wildcard query
-// fields are replaced with the supplied fields, and any wildcard GROUP BY fields are replaced
-// with the supplied dimensions.
+// fields are replaced with the supplied fields, any field regexes are replaced with the supplied
+// fields whose names match, and any wildcard GROUP BY fields are replaced with the supplied
+// dimensions. The fields are sorted by name.
 func (s *SelectStatement) RewriteWildcards(fields Fields, dimensions Dimensions) *SelectStatement {
 	other := s.Clone()
 	selectWildcard, groupWildcard := false, false
@@ -762,12 +1050,21 @@ func (s *SelectStatement) RewriteWildcards(fields Fields, dimensions Dimensions)
 	// Rewrite all wildcard query fields
 	rwFields := make(Fields, 0, len(s.Fields))
 	for _, f := range s.Fields {
-		switch f.Expr.(type) {
+		switch expr := f.Expr.(type) {
 		case *Wildcard:
 			// Sort wildcard fields for consistent output
 			sort.Sort(fields)
 			rwFields = append(rwFields, fields...)
 			selectWildcard = true
+		case *RegexLiteral:
+			var matches Fields
+			for _, field := range fields {
+				if expr.Val.MatchString(field.Name()) {
+					matches = append(matches, field)
+				}
+			}
+			sort.Sort(matches)
+			rwFields = append(rwFields, matches...)
 		default:
 			rwFields = append(rwFields, f)
 		}
@@ -809,6 +1106,10 @@ func (s *SelectStatement) RewriteDistinct() {
 func (s *SelectStatement) String() string {
 	var buf bytes.Buffer
 	_, _ = buf.WriteString("SELECT ")
+	if hints := s.Hints.String(); hints != "" {
+		_, _ = buf.WriteString(hints)
+		_, _ = buf.WriteString(" ")
+	}
 	_, _ = buf.WriteString(s.Fields.String())
 
 	if s.Target != nil {
@@ -817,7 +1118,16 @@ func (s *SelectStatement) String() string {
 	}
 	if len(s.Sources) > 0 {
 		_, _ = buf.WriteString(" FROM ")
-		_, _ = buf.WriteString(s.Sources.String())
+		if s.Join == InnerJoin {
+			for i, src := range s.Sources {
+				if i > 0 {
+					_, _ = buf.WriteString(" JOIN ")
+				}
+				_, _ = buf.WriteString(src.String())
+			}
+		} else {
+			_, _ = buf.WriteString(s.Sources.String())
+		}
 	}
 	if s.Condition != nil {
 		_, _ = buf.WriteString(" WHERE ")
@@ -849,9 +1159,24 @@ func (s *SelectStatement) String() string {
 	return buf.String()
 }
 
-// RequiredPrivileges returns the privilege required to execute the SelectStatement.
+// RequiredPrivileges returns the privilege required to execute the SelectStatement. Read is
+// required on the database of each source, or the default database for sources that don't name one.
 func (s *SelectStatement) RequiredPrivileges() ExecutionPrivileges {
-	ep := ExecutionPrivileges{{Name: "", Privilege: ReadPrivilege}}
+	var ep ExecutionPrivileges
+	seen := make(map[string]bool)
+	for _, src := range s.Sources {
+		var name string
+		if m, ok := src.(*Measurement); ok {
+			name = m.Database
+		}
+		if !seen[name] {
+			seen[name] = true
+			ep = append(ep, ExecutionPrivilege{Name: name, Privilege: ReadPrivilege})
+		}
+	}
+	if len(ep) == 0 {
+		ep = ExecutionPrivileges{{Name: "", Privilege: ReadPrivilege}}
+	}
 
 	if s.Target != nil {
 		p := ExecutionPrivilege{Name: s.Target.Measurement.Database, Privilege: WritePrivilege}
@@ -885,11 +1210,12 @@ func (s *SelectStatement) walkForTime(node Node) bool {
 	}
 }
 
-// HasWildcard returns whether or not the select statement has at least 1 wildcard
+// HasWildcard returns whether or not the select statement has at least 1 wildcard, or a
+// regex matching the names of fields, which is expanded like one.
 func (s *SelectStatement) HasWildcard() bool {
 	for _, f := range s.Fields {
-		_, ok := f.Expr.(*Wildcard)
-		if ok {
+		switch f.Expr.(type) {
+		case *Wildcard, *RegexLiteral:
 			return true
 		}
 	}
@@ -941,9 +1267,108 @@ func (s *SelectStatement) validate(tr targetRequirement) error {
 		return err
 	}
 
+	if err := s.validateDifference(); err != nil {
+		return err
+	}
+
+	if err := s.validateHoltWinters(); err != nil {
+		return err
+	}
+
+	if err := s.validateValueBucket(); err != nil {
+		return err
+	}
+
+	if err := s.validateWindow(); err != nil {
+		return err
+	}
+
+	if err := s.validateTransforms(); err != nil {
+		return err
+	}
+
+	if err := s.validateOrderBy(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// TimeAscending returns false if the results of the statement are sorted by descending time.
+func (s *SelectStatement) TimeAscending() bool {
+	return len(s.SortFields) == 0 || s.SortFields[0].Ascending
+}
+
+func (s *SelectStatement) validateOrderBy() error {
+	if s.TimeAscending() {
+		return nil
+	}
+
+	// Derivatives and differences of raw points are taken going forward in time.
+	if s.IsSimpleDerivative() || s.IsSimpleDifference() {
+		return fmt.Errorf("%s does not support ORDER BY time DESC", s.FunctionCalls()[0].Name)
+	}
 	return nil
 }
 
+// HasTransforms returns true if the statement computes a field from the values of each point, by
+// applying a scalar function like abs() or, in a raw query, by arithmetic like value_a / value_b.
+func (s *SelectStatement) HasTransforms() bool {
+	for _, f := range s.Fields {
+		switch expr := f.Expr.(type) {
+		case *Call:
+			if IsTransformCall(expr) {
+				return true
+			}
+		case *BinaryExpr, *ParenExpr:
+			if s.IsRawQuery {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *SelectStatement) validateTransforms() error {
+	if !s.HasTransforms() {
+		return nil
+	}
+
+	var err error
+	for _, f := range s.Fields {
+		WalkFunc(f.Expr, func(n Node) {
+			if err != nil {
+				return
+			}
+			switch n := n.(type) {
+			case *BinaryExpr:
+				if s.IsRawQuery && !isArithmeticOperator(n.Op) {
+					err = fmt.Errorf("invalid operator %s in field %s, expected +, -, * or /", n.Op, f.Expr)
+				}
+			case *Call:
+				if !IsTransformCall(n) {
+					return
+				}
+
+				// Scalar functions are applied to each raw value, so they can't be mixed with aggregates.
+				if !s.IsRawQuery {
+					err = fmt.Errorf("%s cannot be used with aggregate functions", n.Name)
+				} else if exp, got := transformArgN(n.Name), len(n.Args); got != exp {
+					err = fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", n.Name, exp, got)
+				} else if len(walkNames(n)) == 0 {
+					err = fmt.Errorf("%s requires a field argument", n.Name)
+				}
+			}
+		})
+	}
+	return err
+}
+
+// isArithmeticOperator returns true if the operator can combine the values of fields.
+func isArithmeticOperator(op Token) bool {
+	return op == ADD || op == SUB || op == MUL || op == DIV
+}
+
 func (s *SelectStatement) validateAggregates(tr targetRequirement) error {
 	// First, determine if specific calls have at least one and only one argument
 	for _, f := range s.Fields {
@@ -957,6 +1382,20 @@ func (s *SelectStatement) validateAggregates(tr targetRequirement) error {
 				if exp, got := 2, len(c.Args); got != exp {
 					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", c.Name, exp, got)
 				}
+			case "atan2", "pow":
+				if exp, got := 2, len(c.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", c.Name, exp, got)
+				}
+			case "holt_winters":
+				if exp, got := 3, len(c.Args); got != exp {
+					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", c.Name, exp, got)
+				}
+			case "concat":
+				if min, max, got := 1, 2, len(c.Args); got > max || got < min {
+					return fmt.Errorf("invalid number of arguments for %s, expected at least %d but no more than %d, got %d", c.Name, min, max, got)
+				} else if _, err := concatSeparator(c); err != nil {
+					return err
+				}
 			default:
 				if exp, got := 1, len(c.Args); got != exp {
 					return fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", c.Name, exp, got)
@@ -971,13 +1410,13 @@ func (s *SelectStatement) validateAggregates(tr targetRequirement) error {
 	groupByDuration, _ := s.GroupByInterval()
 
 	// If we have a group by interval, but no aggregate function, it's an invalid statement
-	if s.IsRawQuery && groupByDuration > 0 {
+	if s.IsRawQuery && (groupByDuration > 0 || s.IsAutoInterval()) {
 		return fmt.Errorf("GROUP BY requires at least one aggregate function")
 	}
 
 	// If we have an aggregate function with a group by time without a where clause, it's an invalid statement
 	if tr == targetNotRequired { // ignore create continuous query statements
-		if !s.IsRawQuery && groupByDuration > 0 && !s.hasTimeDimensions(s.Condition) {
+		if !s.IsRawQuery && (groupByDuration > 0 || s.IsAutoInterval()) && !s.hasTimeDimensions(s.Condition) {
 			return fmt.Errorf("aggregate functions with GROUP BY time require a WHERE time clause")
 		}
 	}
@@ -1117,6 +1556,169 @@ func (s *SelectStatement) validateDerivative() error {
 	return nil
 }
 
+func (s *SelectStatement) validateDifference() error {
+	if !s.HasDifference() {
+		return nil
+	}
+
+	// difference transforms the whole series, so it must be the only field in the query.
+	if len(s.Fields) != 1 || len(s.FunctionCalls()) != 1 {
+		return fmt.Errorf("difference cannot be used with other fields")
+	}
+
+	// The differences of raw points are taken, or the differences of aggregated intervals if the
+	// query is grouped by time.
+	c := s.FunctionCalls()[0]
+	switch c.Args[0].(type) {
+	case *VarRef:
+		if d, _ := s.GroupByInterval(); d > 0 || s.IsAutoInterval() {
+			return fmt.Errorf("difference requires an aggregate function argument with GROUP BY time")
+		}
+	case *Call:
+	default:
+		return fmt.Errorf("difference requires a field argument")
+	}
+
+	return nil
+}
+
+func (s *SelectStatement) validateHoltWinters() error {
+	if !s.HasHoltWinters() {
+		return nil
+	}
+
+	// holt_winters transforms the whole series, so it must be the only field in the query.
+	if len(s.Fields) != 1 || len(s.FunctionCalls()) != 1 {
+		return fmt.Errorf("holt_winters cannot be used with other fields")
+	}
+
+	c := s.FunctionCalls()[0]
+	if _, ok := c.Args[0].(*Call); !ok {
+		return fmt.Errorf("holt_winters requires an aggregate function argument")
+	}
+
+	// The number of points to forecast and the season length must be non-negative integers.
+	for i, name := range []string{"number of points", "season length"} {
+		lit, ok := c.Args[i+1].(*NumberLiteral)
+		if !ok || lit.Val < 0 || lit.Val != float64(int(lit.Val)) {
+			return fmt.Errorf("holt_winters %s must be a non-negative integer", name)
+		}
+	}
+
+	// Only evenly-spaced series are supported.
+	if d, _ := s.GroupByInterval(); d == 0 && !s.IsAutoInterval() {
+		return fmt.Errorf("holt_winters requires a GROUP BY time interval")
+	}
+
+	return nil
+}
+
+func (s *SelectStatement) validateValueBucket() error {
+	if w, err := s.ValueBucketWidth(); err != nil {
+		return err
+	} else if w == 0 {
+		return nil
+	}
+
+	// The points are counted in each bin of the values of a field.
+	if len(s.Fields) != 1 {
+		return fmt.Errorf("value_bucket() requires a single count() of a field")
+	}
+	c, ok := s.Fields[0].Expr.(*Call)
+	if !ok || c.Name != "count" || len(c.Args) != 1 {
+		return fmt.Errorf("value_bucket() requires a single count() of a field")
+	} else if _, ok := c.Args[0].(*VarRef); !ok {
+		return fmt.Errorf("value_bucket() requires a single count() of a field")
+	}
+	return nil
+}
+
+// ValueBucketWidth returns the width of the bins of a statement grouped by value_bucket(), e.g.
+// 10 for GROUP BY value_bucket(10), or zero if it isn't grouped by value_bucket(). Such statements
+// count the points whose values are in each bin of the field they count, rather than all of them.
+func (s *SelectStatement) ValueBucketWidth() (float64, error) {
+	for _, d := range s.Dimensions {
+		if call, ok := d.Expr.(*Call); ok && call.Name == "value_bucket" {
+			return valueBucketWidth(call)
+		}
+	}
+	return 0, nil
+}
+
+// valueBucketWidth returns the width of the bins of a value_bucket() dimension.
+func valueBucketWidth(call *Call) (float64, error) {
+	if len(call.Args) != 1 {
+		return 0, errors.New("value_bucket dimension expected one argument")
+	}
+	lit, ok := call.Args[0].(*NumberLiteral)
+	if !ok || lit.Val <= 0 {
+		return 0, errors.New("value_bucket dimension must have a positive number argument")
+	}
+	return lit.Val, nil
+}
+
+func (s *SelectStatement) validateWindow() error {
+	size, err := s.WindowSize()
+	if err != nil {
+		return err
+	} else if size == 0 {
+		return nil
+	}
+
+	// The outputs of the mappers for each interval are combined into every window it's part of,
+	// which only aggregates whose outputs can be combined again support.
+	calls := s.FunctionCalls()
+	if len(calls) == 0 {
+		return fmt.Errorf("window() requires an aggregate")
+	}
+	for _, c := range calls {
+		switch c.Name {
+		case "mean", "sum", "count":
+			if !isCountDistinct(c) {
+				continue
+			}
+		}
+		return fmt.Errorf("window() only supports mean(), sum() and count(), not %s", c.String())
+	}
+
+	// The windows slide by the GROUP BY time interval, so they're made of whole intervals. The
+	// interval of time(auto) is checked once the planner has chosen it.
+	interval, err := s.GroupByInterval()
+	if err != nil {
+		return err
+	} else if interval == 0 && !s.IsAutoInterval() {
+		return fmt.Errorf("window() requires a GROUP BY time interval")
+	} else if interval > 0 && size%interval != 0 {
+		return fmt.Errorf("window size %s must be a multiple of the GROUP BY time interval %s", FormatDuration(size), FormatDuration(interval))
+	}
+	return nil
+}
+
+// WindowSize returns the size of the sliding windows of a statement grouped by window(), e.g. 5m
+// for GROUP BY time(1m), window(5m), or zero if it isn't grouped by window(). Such statements
+// aggregate the points of the window ending with each GROUP BY time interval, rather than only the
+// points of the interval, so the windows of consecutive intervals overlap.
+func (s *SelectStatement) WindowSize() (time.Duration, error) {
+	for _, d := range s.Dimensions {
+		if call, ok := d.Expr.(*Call); ok && call.Name == "window" {
+			return windowSize(call)
+		}
+	}
+	return 0, nil
+}
+
+// windowSize returns the size of the windows of a window() dimension.
+func windowSize(call *Call) (time.Duration, error) {
+	if len(call.Args) != 1 {
+		return 0, errors.New("window dimension expected one argument")
+	}
+	lit, ok := call.Args[0].(*DurationLiteral)
+	if !ok || lit.Val <= 0 {
+		return 0, errors.New("window dimension must have a positive duration argument")
+	}
+	return lit.Val, nil
+}
+
 // GroupByIterval extracts the time interval, if specified.
 func (s *SelectStatement) GroupByInterval() (time.Duration, error) {
 	// return if we've already pulled it out
@@ -1131,9 +1733,9 @@ func (s *SelectStatement) GroupByInterval() (time.Duration, error) {
 
 	for _, d := range s.Dimensions {
 		if call, ok := d.Expr.(*Call); ok && call.Name == "time" {
-			// Make sure there is exactly one argument.
-			if len(call.Args) != 1 {
-				return 0, errors.New("time dimension expected one argument")
+			// Make sure there is an interval and at most an offset.
+			if len(call.Args) != 1 && len(call.Args) != 2 {
+				return 0, errors.New("time dimension expected one or two arguments")
 			}
 
 			// Ensure the argument is a duration.
@@ -1148,6 +1750,67 @@ func (s *SelectStatement) GroupByInterval() (time.Duration, error) {
 	return 0, nil
 }
 
+// IsAutoInterval returns true if the statement is grouped by time(auto). The interval of
+// such a statement is chosen by the planner from its time range, using SetGroupByInterval.
+func (s *SelectStatement) IsAutoInterval() bool {
+	for _, d := range s.Dimensions {
+		if call, ok := d.Expr.(*Call); ok && call.Name == "time" && len(call.Args) > 0 {
+			ref, ok := call.Args[0].(*VarRef)
+			return ok && strings.ToLower(ref.Val) == "auto"
+		}
+	}
+	return false
+}
+
+// SetGroupByInterval sets the interval of the GROUP BY time dimension, keeping its offset.
+// It's a no-op if the statement isn't grouped by time.
+func (s *SelectStatement) SetGroupByInterval(d time.Duration) {
+	for _, dim := range s.Dimensions {
+		if call, ok := dim.Expr.(*Call); ok && call.Name == "time" && len(call.Args) > 0 {
+			call.Args[0] = &DurationLiteral{Val: d}
+			s.groupByInterval = d
+			return
+		}
+	}
+}
+
+// SetGroupByOffset sets the offset of the GROUP BY time dimension, adding one if there's none.
+// It's a no-op if the statement isn't grouped by time.
+func (s *SelectStatement) SetGroupByOffset(d time.Duration) {
+	for _, dim := range s.Dimensions {
+		if call, ok := dim.Expr.(*Call); ok && call.Name == "time" && len(call.Args) > 0 {
+			call.Args = append(call.Args[:1], &DurationLiteral{Val: d})
+			return
+		}
+	}
+}
+
+// GroupByOffset extracts the offset of the GROUP BY time interval, e.g. 15m for
+// GROUP BY time(1h, 15m). Intervals start on the offset plus a multiple of the interval.
+// The offset is always less than the interval, and is zero if there is no offset.
+func (s *SelectStatement) GroupByOffset() (time.Duration, error) {
+	interval, err := s.GroupByInterval()
+	if err != nil || interval == 0 {
+		return 0, err
+	}
+
+	for _, d := range s.Dimensions {
+		if call, ok := d.Expr.(*Call); ok && call.Name == "time" {
+			if len(call.Args) != 2 {
+				return 0, nil
+			}
+
+			// Ensure the offset is a duration.
+			lit, ok := call.Args[1].(*DurationLiteral)
+			if !ok {
+				return 0, errors.New("time dimension offset must be a duration")
+			}
+			return lit.Val % interval, nil
+		}
+	}
+	return 0, nil
+}
+
 // SetTimeRange sets the start and end time of the select statement to [start, end). i.e. start inclusive, end exclusive.
 // This is used commonly for continuous queries so the start and end are in buckets.
 func (s *SelectStatement) SetTimeRange(start, end time.Time) error {
@@ -1272,12 +1935,48 @@ func (s *SelectStatement) NamesInSelect() []string {
 	return a
 }
 
+// NamesOutsideFunctionCalls returns the field and tag names (idents) in the select clause
+// that aren't arguments to a function call
+func (s *SelectStatement) NamesOutsideFunctionCalls() []string {
+	var a []string
+	for _, f := range s.Fields {
+		a = append(a, walkNamesOutsideFunctionCalls(f.Expr)...)
+	}
+	return a
+}
+
+// walkNamesOutsideFunctionCalls will walk the Expr and return the names that aren't inside of a call
+func walkNamesOutsideFunctionCalls(exp Expr) []string {
+	switch expr := exp.(type) {
+	case *VarRef:
+		return []string{expr.Val}
+	case *BinaryExpr:
+		var ret []string
+		ret = append(ret, walkNamesOutsideFunctionCalls(expr.LHS)...)
+		ret = append(ret, walkNamesOutsideFunctionCalls(expr.RHS)...)
+		return ret
+	case *ParenExpr:
+		return walkNamesOutsideFunctionCalls(expr.Expr)
+	}
+
+	return nil
+}
+
 // walkNames will walk the Expr and return the database fields
 func walkNames(exp Expr) []string {
 	switch expr := exp.(type) {
 	case *VarRef:
 		return []string{expr.Val}
 	case *Call:
+		// the arguments of scalar functions can be fields, numbers or expressions of both
+		if IsTransformCall(expr) {
+			var ret []string
+			for _, arg := range expr.Args {
+				ret = append(ret, walkNames(arg)...)
+			}
+			return ret
+		}
+
 		if len(expr.Args) == 0 {
 			return nil
 		}
@@ -1314,6 +2013,10 @@ func walkFunctionCalls(exp Expr) []*Call {
 	case *VarRef:
 		return nil
 	case *Call:
+		// scalar functions are applied to raw values, they aren't aggregates
+		if IsTransformCall(expr) {
+			return nil
+		}
 		return []*Call{expr}
 	case *BinaryExpr:
 		var ret []*Call
@@ -1969,18 +2672,43 @@ func (a Dimensions) String() string {
 func (a Dimensions) Normalize() (time.Duration, []string, error) {
 	var dur time.Duration
 	var tags []string
+	var buckets, windows bool
 
 	for _, dim := range a {
 		switch expr := dim.Expr.(type) {
 		case *Call:
+			// Bins of field values aren't a time or a tag dimension.
+			if expr.Name == "value_bucket" {
+				if _, err := valueBucketWidth(expr); err != nil {
+					return 0, nil, err
+				} else if buckets {
+					return 0, nil, errors.New("multiple value_bucket dimensions not allowed")
+				}
+				buckets = true
+				continue
+			}
+
+			// Sliding windows are made of time intervals rather than being a dimension of their own.
+			if expr.Name == "window" {
+				if _, err := windowSize(expr); err != nil {
+					return 0, nil, err
+				} else if windows {
+					return 0, nil, errors.New("multiple window dimensions not allowed")
+				}
+				windows = true
+				continue
+			}
+
 			// Ensure the call is time() and it only has one duration argument.
 			// If we already have a duration
 			if expr.Name != "time" {
-				return 0, nil, errors.New("only time() calls allowed in dimensions")
-			} else if len(expr.Args) != 1 {
-				return 0, nil, errors.New("time dimension expected one argument")
+				return 0, nil, errors.New("only time(), value_bucket() and window() calls allowed in dimensions")
+			} else if len(expr.Args) != 1 && len(expr.Args) != 2 {
+				return 0, nil, errors.New("time dimension expected one or two arguments")
 			} else if lit, ok := expr.Args[0].(*DurationLiteral); !ok {
 				return 0, nil, errors.New("time dimension must have one duration argument")
+			} else if _, ok := expr.Args[len(expr.Args)-1].(*DurationLiteral); !ok {
+				return 0, nil, errors.New("time dimension offset must be a duration")
 			} else if dur != 0 {
 				return 0, nil, errors.New("multiple time dimensions not allowed")
 			} else {
@@ -2262,9 +2990,44 @@ func CloneExpr(expr Expr) Expr {
 	panic("unreachable")
 }
 
-// TimeRange returns the minimum and maximum times specified by an expression.
-// Returns zero times if there is no bound.
+// TimeRange returns the minimum and maximum times specified by an expression, both inclusive.
+// Returns zero times if there is no bound. Exclusive bounds are moved inward by a nanosecond, the
+// precision of timestamps, so a point exactly at the time of a bound is only in the range if the
+// bound is inclusive, e.g. time <= x rather than time < x.
 func TimeRange(expr Expr) (min, max time.Time) {
+	lo, hi := TimeBounds(expr)
+	min, max = lo.Time, hi.Time
+	if lo.Exclusive {
+		min = min.Add(time.Nanosecond)
+	}
+	if hi.Exclusive {
+		max = max.Add(-time.Nanosecond)
+	}
+	return
+}
+
+// TimeBound is the lower or upper bound of the time range specified by an expression.
+type TimeBound struct {
+	Time      time.Time
+	Exclusive bool // if true, the bound excludes its time, e.g. time > x
+}
+
+// IsZero returns true if there is no bound.
+func (b TimeBound) IsZero() bool { return b.Time.IsZero() }
+
+// tighten returns the tighter of the bound and the one at t: the later of two lower bounds, or the
+// earlier of two upper bounds, and the exclusive one of bounds at the same time.
+func (b TimeBound) tighten(t time.Time, exclusive, lower bool) TimeBound {
+	if b.IsZero() || (lower && t.After(b.Time)) || (!lower && t.Before(b.Time)) || (t.Equal(b.Time) && exclusive) {
+		return TimeBound{Time: t, Exclusive: exclusive}
+	}
+	return b
+}
+
+// TimeBounds returns the lower and upper bounds of the time range specified by an expression, and
+// whether they exclude their times. If several comparisons bound the same side of the range, the
+// tightest one is returned. Returns zero bounds if there is no bound.
+func TimeBounds(expr Expr) (min, max TimeBound) {
 	WalkFunc(expr, func(n Node) {
 		if n, ok := n.(*BinaryExpr); ok {
 			// Extract literal expression & operator on LHS.
@@ -2286,31 +3049,18 @@ func TimeRange(expr Expr) (min, max time.Time) {
 			}
 
 			// Update the min/max depending on the operator.
-			// The GT & LT update the value by +/- 1µs not make them "not equal".
 			switch op {
 			case GT:
-				if min.IsZero() || value.After(min) {
-					min = value.Add(time.Microsecond)
-				}
+				min = min.tighten(value, true, true)
 			case GTE:
-				if min.IsZero() || value.After(min) {
-					min = value
-				}
+				min = min.tighten(value, false, true)
 			case LT:
-				if max.IsZero() || value.Before(max) {
-					max = value.Add(-time.Microsecond)
-				}
+				max = max.tighten(value, true, false)
 			case LTE:
-				if max.IsZero() || value.Before(max) {
-					max = value
-				}
+				max = max.tighten(value, false, false)
 			case EQ:
-				if min.IsZero() || value.After(min) {
-					min = value
-				}
-				if max.IsZero() || value.Before(max) {
-					max = value
-				}
+				min = min.tighten(value, false, true)
+				max = max.tighten(value, false, false)
 			}
 		}
 	})
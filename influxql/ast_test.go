@@ -2,7 +2,9 @@ package influxql_test
 
 import (
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
@@ -25,6 +27,39 @@ func TestInspectDataType(t *testing.T) {
 	}
 }
 
+// Ensure field values are coerced to forced types, and impossible coercions return an error.
+func TestCoerceFieldValue(t *testing.T) {
+	for i, tt := range []struct {
+		v   interface{}
+		typ influxql.DataType
+		exp interface{}
+		err string
+	}{
+		{v: int64(2), typ: influxql.Float, exp: float64(2)},
+		{v: float64(2.7), typ: influxql.Integer, exp: int64(2)},
+		{v: float64(-2.7), typ: influxql.Integer, exp: int64(-2)},
+		{v: true, typ: influxql.Integer, exp: int64(1)},
+		{v: false, typ: influxql.Float, exp: float64(0)},
+		{v: "1.5", typ: influxql.Float, exp: float64(1.5)},
+		{v: "3", typ: influxql.Integer, exp: int64(3)},
+		{v: "true", typ: influxql.Boolean, exp: true},
+		{v: float64(1.5), typ: influxql.String, exp: "1.5"},
+		{v: float64(1.5), typ: influxql.Float, exp: float64(1.5)},
+		{v: nil, typ: influxql.Float, exp: nil},
+		{v: "idle", typ: influxql.Float, err: `can't coerce string value "idle" of field value to float`},
+		{v: "1.5", typ: influxql.Integer, err: `can't coerce string value "1.5" of field value to integer`},
+		{v: int64(1), typ: influxql.Boolean, err: `can't coerce integer value 1 of field value to boolean`},
+		{v: math.Inf(1), typ: influxql.Integer, err: `can't coerce float value +Inf of field value to integer`},
+	} {
+		v, err := influxql.CoerceFieldValue("value", tt.v, tt.typ)
+		if errstring(err) != tt.err {
+			t.Errorf("%d. %#v (%s): unexpected error: %v", i, tt.v, tt.typ, err)
+		} else if err == nil && !reflect.DeepEqual(v, tt.exp) {
+			t.Errorf("%d. %#v (%s): exp %#v, got %#v", i, tt.v, tt.typ, tt.exp, v)
+		}
+	}
+}
+
 // Ensure the SELECT statement can extract substatements.
 func TestSelectStatement_Substatement(t *testing.T) {
 	var tests = []struct {
@@ -96,6 +131,26 @@ func TestSelectStatement_Substatement(t *testing.T) {
 	}
 }
 
+// Ensure unsupported sources are described by kind.
+func TestNewErrUnsupportedSource(t *testing.T) {
+	for i, tt := range []struct {
+		src  influxql.Source
+		kind string
+		err  string
+	}{
+		{src: &influxql.Measurement{Name: "cpu"}, kind: "measurement", err: `unsupported source cpu (measurement): not supported yet`},
+		{src: &influxql.Measurement{Regex: &influxql.RegexLiteral{Val: regexp.MustCompile(`^cpu`)}}, kind: "regex measurement", err: `unsupported source /^cpu/ (regex measurement): regex measurements must be expanded into measurements before planning`},
+		{src: nil, kind: "empty source", err: `unsupported source: empty source: not supported yet`},
+	} {
+		err := influxql.NewErrUnsupportedSource(tt.src)
+		if err.Kind != tt.kind {
+			t.Errorf("%d. unexpected kind: %s", i, err.Kind)
+		} else if err.Error() != tt.err {
+			t.Errorf("%d. unexpected error: %s", i, err)
+		}
+	}
+}
+
 // Ensure the SELECT statement can extract GROUP BY interval.
 func TestSelectStatement_GroupByInterval(t *testing.T) {
 	q := "SELECT sum(value) from foo  where time < now() GROUP BY time(10m)"
@@ -114,6 +169,55 @@ func TestSelectStatement_GroupByInterval(t *testing.T) {
 	}
 }
 
+// Ensure the SELECT statement can extract the GROUP BY interval offset.
+func TestSelectStatement_GroupByOffset(t *testing.T) {
+	for i, tt := range []struct {
+		s      string
+		offset time.Duration
+		err    string
+	}{
+		{s: `SELECT sum(value) FROM foo WHERE time < now() GROUP BY time(1h)`},
+		{s: `SELECT sum(value) FROM foo WHERE time < now() GROUP BY time(1h, 15m)`, offset: 15 * time.Minute},
+		{s: `SELECT sum(value) FROM foo WHERE time < now() GROUP BY time(1h, 75m)`, offset: 15 * time.Minute},
+		{s: `SELECT sum(value) FROM foo WHERE time < now() GROUP BY time(1h, 'a')`, err: `time dimension offset must be a duration`},
+	} {
+		stmt, err := influxql.NewParser(strings.NewReader(tt.s)).ParseStatement()
+		if err != nil {
+			t.Fatalf("%d. invalid statement: %q: %s", i, tt.s, err)
+		}
+
+		offset, err := stmt.(*influxql.SelectStatement).GroupByOffset()
+		if errstring(err) != tt.err {
+			t.Errorf("%d. unexpected error: exp=%s, got=%v", i, tt.err, err)
+		} else if offset != tt.offset {
+			t.Errorf("%d. unexpected offset: exp=%s, got=%s", i, tt.offset, offset)
+		}
+	}
+}
+
+// Ensure the interval of a time(auto) SELECT statement can be set.
+func TestSelectStatement_SetGroupByInterval(t *testing.T) {
+	stmt, err := influxql.NewParser(strings.NewReader(`SELECT sum(value) FROM foo WHERE time < now() GROUP BY time(auto, 15m), host`)).ParseStatement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := stmt.(*influxql.SelectStatement)
+	if !s.IsAutoInterval() {
+		t.Fatal("expected auto interval")
+	}
+
+	s.SetGroupByInterval(time.Hour)
+	if s.IsAutoInterval() {
+		t.Fatal("unexpected auto interval")
+	} else if d, err := s.GroupByInterval(); err != nil || d != time.Hour {
+		t.Fatalf("unexpected interval: %s, %v", d, err)
+	} else if offset, err := s.GroupByOffset(); err != nil || offset != 15*time.Minute {
+		t.Fatalf("unexpected offset: %s, %v", offset, err)
+	} else if str := s.String(); str != `SELECT sum(value) FROM foo WHERE time < now() GROUP BY time(1h, 15m), host` {
+		t.Fatalf("unexpected string: %s", str)
+	}
+}
+
 // Ensure the SELECT statment can have its start and end time set
 func TestSelectStatement_SetTimeRange(t *testing.T) {
 	q := "SELECT sum(value) from foo where time < now() GROUP BY time(10m)"
@@ -132,8 +236,8 @@ func TestSelectStatement_SetTimeRange(t *testing.T) {
 	if min != start {
 		t.Fatalf("start time wasn't set properly.\n  exp: %s\n  got: %s", start, min)
 	}
-	// the end range is actually one microsecond before the given one since end is exclusive
-	end = end.Add(-time.Microsecond)
+	// the end range is actually one nanosecond before the given one since end is exclusive
+	end = end.Add(-time.Nanosecond)
 	if max != end {
 		t.Fatalf("end time wasn't set properly.\n  exp: %s\n  got: %s", end, max)
 	}
@@ -165,8 +269,8 @@ func TestSelectStatement_SetTimeRange(t *testing.T) {
 	if min != start {
 		t.Fatalf("start time wasn't set properly.\n  exp: %s\n  got: %s", start, min)
 	}
-	// the end range is actually one microsecond before the given one since end is exclusive
-	end = end.Add(-time.Microsecond)
+	// the end range is actually one nanosecond before the given one since end is exclusive
+	end = end.Add(-time.Nanosecond)
 	if max != end {
 		t.Fatalf("end time wasn't set properly.\n  exp: %s\n  got: %s", end, max)
 	}
@@ -189,8 +293,8 @@ func TestSelectStatement_SetTimeRange(t *testing.T) {
 	if min != start {
 		t.Fatalf("start time wasn't set properly.\n  exp: %s\n  got: %s", start, min)
 	}
-	// the end range is actually one microsecond before the given one since end is exclusive
-	end = end.Add(-time.Microsecond)
+	// the end range is actually one nanosecond before the given one since end is exclusive
+	end = end.Add(-time.Nanosecond)
 	if max != end {
 		t.Fatalf("end time wasn't set properly.\n  exp: %s\n  got: %s", end, max)
 	}
@@ -224,6 +328,15 @@ func TestSelect_NamesInSelect(t *testing.T) {
 	}
 }
 
+// Ensure the idents outside of function calls in the select clause can come out
+func TestSelect_NamesOutsideFunctionCalls(t *testing.T) {
+	s := MustParseSelectStatement("select count(asdf), bar, (baz + mean(foo)) * 2 from cpu")
+	a := s.NamesOutsideFunctionCalls()
+	if !reflect.DeepEqual(a, []string{"bar", "baz"}) {
+		t.Fatalf("exp: bar,baz\ngot: %s\n", strings.Join(a, ","))
+	}
+}
+
 // Ensure the idents from the where clause can come out
 func TestSelect_NamesInWhere(t *testing.T) {
 	s := MustParseSelectStatement("select * from cpu where time > 23s AND (asdf = 'jkl' OR (foo = 'bar' AND baz = 'bar'))")
@@ -256,6 +369,12 @@ func TestSelectStatement_HasWildcard(t *testing.T) {
 			wildcard: false,
 		},
 
+		// Field regex
+		{
+			stmt:     `SELECT /bytes_.*/ FROM net`,
+			wildcard: true,
+		},
+
 		// No GROUP BY wildcards, time only
 		{
 			stmt:     `SELECT mean(value) FROM cpu where time < now() GROUP BY time(5ms)`,
@@ -356,6 +475,20 @@ func TestSelectStatement_RewriteWildcards(t *testing.T) {
 			rewrite: `SELECT value FROM cpu GROUP BY host`,
 		},
 
+		// Field regexes, which don't group by every tag
+		{
+			stmt:    `SELECT /^value/ FROM cpu`,
+			rewrite: `SELECT value1, value2 FROM cpu`,
+		},
+		{
+			stmt:    `SELECT /2$/, value FROM cpu GROUP BY host`,
+			rewrite: `SELECT value2, value FROM cpu GROUP BY host`,
+		},
+		{
+			stmt:    `SELECT value1, /^other/ FROM cpu`,
+			rewrite: `SELECT value1 FROM cpu`,
+		},
+
 		// No GROUP BY wildcards, time only
 		{
 			stmt:    `SELECT mean(value) FROM cpu where time < now() GROUP BY time(5ms)`,
@@ -465,6 +598,44 @@ func TestSelectStatement_IsRawQuerySet(t *testing.T) {
 	}
 }
 
+// Ensure a select statement requires read on the database of each of its sources.
+func TestSelectStatement_RequiredPrivileges(t *testing.T) {
+	var tests = []struct {
+		stmt string
+		exp  influxql.ExecutionPrivileges
+	}{
+		{
+			stmt: `SELECT value FROM cpu`,
+			exp:  influxql.ExecutionPrivileges{{Name: "", Privilege: influxql.ReadPrivilege}},
+		},
+		{
+			stmt: `SELECT value FROM "db2".."cpu"`,
+			exp:  influxql.ExecutionPrivileges{{Name: "db2", Privilege: influxql.ReadPrivilege}},
+		},
+		{
+			stmt: `SELECT value FROM cpu, "db2".."cpu", "db2".."mem", "db3"."rp".mem`,
+			exp: influxql.ExecutionPrivileges{
+				{Name: "", Privilege: influxql.ReadPrivilege},
+				{Name: "db2", Privilege: influxql.ReadPrivilege},
+				{Name: "db3", Privilege: influxql.ReadPrivilege},
+			},
+		},
+		{
+			stmt: `SELECT mean(value) INTO "db4".."cpu_mean" FROM "db2".."cpu" WHERE time > now() - 1h GROUP BY time(1m)`,
+			exp: influxql.ExecutionPrivileges{
+				{Name: "db2", Privilege: influxql.ReadPrivilege},
+				{Name: "db4", Privilege: influxql.WritePrivilege},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		if ep := MustParseSelectStatement(tt.stmt).RequiredPrivileges(); !reflect.DeepEqual(ep, tt.exp) {
+			t.Errorf("%d. %s: unexpected privileges: %v", i, tt.stmt, ep)
+		}
+	}
+}
+
 // Ensure the time range of an expression can be extracted.
 func TestTimeRange(t *testing.T) {
 	for i, tt := range []struct {
@@ -472,22 +643,31 @@ func TestTimeRange(t *testing.T) {
 		min, max string
 	}{
 		// LHS VarRef
-		{expr: `time > '2000-01-01 00:00:00'`, min: `2000-01-01 00:00:00.000001`, max: `0001-01-01 00:00:00`},
+		{expr: `time > '2000-01-01 00:00:00'`, min: `2000-01-01 00:00:00.000000001`, max: `0001-01-01 00:00:00`},
 		{expr: `time >= '2000-01-01 00:00:00'`, min: `2000-01-01 00:00:00`, max: `0001-01-01 00:00:00`},
-		{expr: `time < '2000-01-01 00:00:00'`, min: `0001-01-01 00:00:00`, max: `1999-12-31 23:59:59.999999`},
+		{expr: `time < '2000-01-01 00:00:00'`, min: `0001-01-01 00:00:00`, max: `1999-12-31 23:59:59.999999999`},
 		{expr: `time <= '2000-01-01 00:00:00'`, min: `0001-01-01 00:00:00`, max: `2000-01-01 00:00:00`},
 
 		// RHS VarRef
-		{expr: `'2000-01-01 00:00:00' > time`, min: `0001-01-01 00:00:00`, max: `1999-12-31 23:59:59.999999`},
+		{expr: `'2000-01-01 00:00:00' > time`, min: `0001-01-01 00:00:00`, max: `1999-12-31 23:59:59.999999999`},
 		{expr: `'2000-01-01 00:00:00' >= time`, min: `0001-01-01 00:00:00`, max: `2000-01-01 00:00:00`},
-		{expr: `'2000-01-01 00:00:00' < time`, min: `2000-01-01 00:00:00.000001`, max: `0001-01-01 00:00:00`},
+		{expr: `'2000-01-01 00:00:00' < time`, min: `2000-01-01 00:00:00.000000001`, max: `0001-01-01 00:00:00`},
 		{expr: `'2000-01-01 00:00:00' <= time`, min: `2000-01-01 00:00:00`, max: `0001-01-01 00:00:00`},
 
 		// Equality
 		{expr: `time = '2000-01-01 00:00:00'`, min: `2000-01-01 00:00:00`, max: `2000-01-01 00:00:00`},
 
 		// Multiple time expressions.
-		{expr: `time >= '2000-01-01 00:00:00' AND time < '2000-01-02 00:00:00'`, min: `2000-01-01 00:00:00`, max: `2000-01-01 23:59:59.999999`},
+		{expr: `time >= '2000-01-01 00:00:00' AND time < '2000-01-02 00:00:00'`, min: `2000-01-01 00:00:00`, max: `2000-01-01 23:59:59.999999999`},
+
+		// Exclusive bounds at the same time as inclusive ones are tighter, whichever comes first.
+		{expr: `time >= '2000-01-01 00:00:00' AND time > '2000-01-01 00:00:00'`, min: `2000-01-01 00:00:00.000000001`, max: `0001-01-01 00:00:00`},
+		{expr: `time > '2000-01-01 00:00:00' AND time >= '2000-01-01 00:00:00'`, min: `2000-01-01 00:00:00.000000001`, max: `0001-01-01 00:00:00`},
+		{expr: `time <= '2000-01-01 00:00:00' AND time < '2000-01-01 00:00:00'`, min: `0001-01-01 00:00:00`, max: `1999-12-31 23:59:59.999999999`},
+		{expr: `time < '2000-01-01 00:00:00' AND time <= '2000-01-01 00:00:00'`, min: `0001-01-01 00:00:00`, max: `1999-12-31 23:59:59.999999999`},
+
+		// Bounds within a microsecond of each other.
+		{expr: `time > '2000-01-01T00:00:00.0000005Z' AND time >= '2000-01-01 00:00:00'`, min: `2000-01-01 00:00:00.000000501`, max: `0001-01-01 00:00:00`},
 
 		// Min/max crossover
 		{expr: `time >= '2000-01-01 00:00:00' AND time <= '1999-01-01 00:00:00'`, min: `2000-01-01 00:00:00`, max: `1999-01-01 00:00:00`},
@@ -505,18 +685,40 @@ func TestTimeRange(t *testing.T) {
 		expr := MustParseExpr(tt.expr)
 		min, max := influxql.TimeRange(expr)
 
-		// Compare with expected min/max.
-		if min := min.Format(influxql.DateTimeFormat); tt.min != min {
+		// Compare with expected min/max, to the nanosecond.
+		const format = "2006-01-02 15:04:05.999999999"
+		if min := min.Format(format); tt.min != min {
 			t.Errorf("%d. %s: unexpected min:\n\nexp=%s\n\ngot=%s\n\n", i, tt.expr, tt.min, min)
 			continue
 		}
-		if max := max.Format(influxql.DateTimeFormat); tt.max != max {
+		if max := max.Format(format); tt.max != max {
 			t.Errorf("%d. %s: unexpected max:\n\nexp=%s\n\ngot=%s\n\n", i, tt.expr, tt.max, max)
 			continue
 		}
 	}
 }
 
+// Ensure the bounds of time ranges record whether they're exclusive.
+func TestTimeBounds(t *testing.T) {
+	for _, tt := range []struct {
+		expr           string
+		minEx, maxEx   bool
+		minSet, maxSet bool
+	}{
+		{expr: `time > '2000-01-01 00:00:00' AND time < '2000-01-02 00:00:00'`, minEx: true, maxEx: true, minSet: true, maxSet: true},
+		{expr: `time >= '2000-01-01 00:00:00' AND time <= '2000-01-02 00:00:00'`, minSet: true, maxSet: true},
+		{expr: `time = '2000-01-01 00:00:00'`, minSet: true, maxSet: true},
+		{expr: `time >= '2000-01-01 00:00:00' AND time > '1999-01-01 00:00:00'`, minSet: true},
+		{expr: `'2000-01-01 00:00:00' > time`, maxEx: true, maxSet: true},
+		{expr: `value > 1`},
+	} {
+		min, max := influxql.TimeBounds(MustParseExpr(tt.expr))
+		if min.Exclusive != tt.minEx || max.Exclusive != tt.maxEx || min.IsZero() == tt.minSet || max.IsZero() == tt.maxSet {
+			t.Errorf("%s: unexpected bounds: min=%+v, max=%+v", tt.expr, min, max)
+		}
+	}
+}
+
 // Ensure that we see if a where clause has only time limitations
 func TestSelectStatement_OnlyTimeDimensions(t *testing.T) {
 	var tests = []struct {
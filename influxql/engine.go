@@ -2,11 +2,23 @@ package influxql
 
 import (
 	"bytes"
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"log"
 	"math"
+	"net"
+	"os"
+	"runtime/debug"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -25,30 +37,86 @@ const (
 
 	// IgnoredChunkSize is what gets passed into Mapper.Begin for aggregate queries as they don't chunk points out
 	IgnoredChunkSize = 0
+
+	// UseDefaultChunkSize is passed to the planner as the chunk size to use its DefaultChunkSize
+	UseDefaultChunkSize = -1
 )
 
 // Tx represents a transaction.
 // The Tx must be opened before being used.
 type Tx interface {
-	// Create MapReduceJobs for the given select statement. One MRJob will be created per unique tagset that matches the query
+	// Create MapReduceJobs for the given select statement. One MRJob will be created per unique tagset that matches the query.
+	// The jobs must be in ascending order of their keys, which the executor sends and merges the rows of tag sets in.
 	CreateMapReduceJobs(stmt *SelectStatement, tagKeys []string) ([]*MapReduceJob, error)
 }
 
 type MapReduceJob struct {
-	MeasurementName string
-	TagSet          *TagSet
-	Mappers         []Mapper         // the mappers to hit all shards for this MRJob
-	TMin            int64            // minimum time specified in the query
-	TMax            int64            // maximum time specified in the query
-	key             []byte           // a key that identifies the MRJob so it can be sorted
-	interval        int64            // the group by interval of the query
-	stmt            *SelectStatement // the select statement this job was created for
-	chunkSize       int              // the number of points to buffer in raw queries before returning a chunked response
+	MeasurementName  string
+	TagSet           *TagSet
+	Mappers          []Mapper            // the mappers to hit all shards for this MRJob
+	TMin             int64               // minimum time specified in the query
+	TMax             int64               // maximum time specified in the query
+	SeriesKeys       []string            // if set, the mappers only read these series of the tag set
+	key              []byte              // a key that identifies the MRJob so it can be sorted
+	interval         int64               // the group by interval of the query
+	offset           int64               // the offset of the group by interval boundaries, if any
+	stmt             *SelectStatement    // the select statement this job was created for
+	chunkSize        int                 // the number of points to buffer in raw queries before returning a chunked response
+	chunkSizeFunc    ChunkSizeFunc       // if set, used to scale the chunk size of each mapper in raw queries
+	maxChunkSize     int                 // if set, the chunk size of each mapper is capped at this
+	remapN           int                 // the number of mappers re-created after their shard moved
+	remapMu          sync.Mutex          // protects remapN and Mappers while the mappers of a raw query are prefetched
+	prefetchDepth    int                 // the number of chunks each mapper of a raw query reads ahead, if any
+	precision        int64               // the resolution of emitted timestamps in nanoseconds, if any
+	SkipNonFinite    bool                // if true, the mappers skip NaN and infinite float values
+	FieldTypes       map[string]DataType // if set, the types the mappers coerce the values of fields to
+	Scope            *Scope              // if set, the scope the mappers check the series they read against
+	partial          bool                // if true, aggregates return their partial state rather than final values
+	recordShardIDs   bool                // if true, rows record the IDs of the shards that contributed points to them
+	contributors     map[uint64]bool     // the shards whose mappers returned data for the aggregates of the job
+	aggregates       Aggregates          // the aggregate functions called by the job, the built-ins if nil
+	streamAggregates bool                // if true, the intervals of aggregates are sent as they're completed, when possible
+	openTimeout      time.Duration       // if set, mappers that aren't opened within this fail the job with ErrShardBusy
+	retryAttempts    int                 // the number of times a read failing with a transient error is retried
+	retryBackoff     time.Duration       // the time waited before the first retry of a read, doubled for each further attempt
+	conflictRes      ConflictResolution  // how raw queries resolve points of a series read at the same time from several shards
+	preferredRP      string              // the retention policy whose points ConflictPreferRetentionPolicy prefers
+	conflicts        *rawConflicts       // if set, resolves the conflicting points of the current execution of a raw query
+	outOfOrder       OutOfOrderHandling  // how raw queries handle mappers that return points out of time order
+	sortedRaw        []sortedRawOutputs  // the points of each mapper of a raw query whose job sorts them
+	sortedIntervals  []intervalReadahead // the outputs each mapper of an aggregate read ahead of their interval, if they're sorted
+
+	tolerateMissingShards bool            // if true, mappers whose shard isn't found are skipped
+	logger                *log.Logger     // if set, used to log the shards that are skipped
+	resume                *resumePosition // if set, raw queries skip the points up to and including this position
+	dropPartialIntervals  bool            // if true, GROUP BY time intervals cut by the time range aren't returned
+	maxBufferedPoints     int             // if set, the approximate maximum number of points of a raw query held at once
+	maxConcatBytes        int             // if set, the maximum total length of the strings concat() joins in an interval
+	deadline              *softDeadline   // if set, streamed aggregates send their complete intervals once it passes
+	progress              *progressShare  // if set, the part of the progress of the query the job hasn't completed
+	onPoint               *pointHook      // if set, called with every point the map functions of the job read
+	bucketWidth           float64         // if set, the width of the bins of the values counted by a query grouped by value_bucket()
+	windowN               int             // if more than one, the number of intervals in each window of a query grouped by window()
+	intervalTime          IntervalTime    // the time of each interval of a query grouped by time that its values are sent at
+	kill                  *killSwitch     // if set, stops the job once the executor is killed
+	profile               *stageProfile   // if set, the time spent in each stage of execution is added to it
+	timer                 *stageTimer     // times the stages of the current execution, if the job is profiled
+	maxIntervals          int             // if set, the most intervals of the series an aggregate query holds, MaxGroupByPoints otherwise
+	partialOverBudget     bool            // if true, a series with more intervals than it may hold sends those that fit as a partial row
+	overBudget            bool            // true if the current execution exceeded the intervals, so its rows are partial
+	strictIntervals       bool            // if true, the points read by the map functions are checked to be in their interval
+	intervals             *intervalCheck  // the interval being reduced by the current execution, if they're checked
+	opened                bool            // true from when the mappers are opened until they're closed, so they're closed once
 }
 
 func (m *MapReduceJob) Open() error {
-	for _, mm := range m.Mappers {
-		if err := mm.Open(); err != nil {
+	m.opened = true
+	for i := 0; i < len(m.Mappers); i++ {
+		err := m.openMapper(i)
+		if err == ErrShardNotFound && m.tolerateMissingShards {
+			m.skipMapper(i)
+			i--
+		} else if err != nil {
 			m.Close()
 			return err
 		}
@@ -56,12 +124,113 @@ func (m *MapReduceJob) Open() error {
 	return nil
 }
 
+// skipMapper closes the mapper at index i, whose shard wasn't found, and removes it from the job.
+func (m *MapReduceJob) skipMapper(i int) {
+	mm := m.Mappers[i]
+	mm.Close()
+	if m.logger != nil {
+		m.logger.Printf("skipping shard %d of %s: %s", mm.ShardID(), m.MeasurementName, ErrShardNotFound)
+	}
+
+	m.remapMu.Lock()
+	m.Mappers = append(m.Mappers[:i], m.Mappers[i+1:]...)
+	m.remapMu.Unlock()
+}
+
+// openMapper opens the mapper at index j and restricts it to the series keys of the job, if any.
+func (m *MapReduceJob) openMapper(j int) error {
+	mm := m.Mappers[j]
+	if err := m.openWithTimeout(j); err != nil {
+		return err
+	}
+	if m.SeriesKeys == nil {
+		return nil
+	}
+
+	s, ok := mm.(SeriesKeyMapper)
+	if !ok {
+		return ErrSeriesKeysNotSupported
+	}
+	return s.SetSeriesKeys(m.SeriesKeys)
+}
+
+// openWithTimeout opens the mapper at index j. If the job has an open timeout and the mapper isn't
+// opened within it, e.g. because its shard is locked by a compaction, ErrShardBusy is returned. The
+// mapper is then replaced by a busyMapper, so it's closed once its Open call eventually returns.
+func (m *MapReduceJob) openWithTimeout(j int) (err error) {
+	mm := m.Mappers[j]
+	if m.openTimeout <= 0 {
+		defer m.recoverPanic(&err)
+		return mm.Open()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+		defer m.recoverPanic(&err)
+		err = mm.Open()
+	}()
+
+	timer := time.NewTimer(m.openTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		m.remapMu.Lock()
+		m.Mappers[j] = &busyMapper{Mapper: mm, done: done}
+		m.remapMu.Unlock()
+		return ErrShardBusy(mm.ShardID(), m.openTimeout)
+	}
+}
+
+// busyMapper takes the place of a mapper that wasn't opened within the open timeout of its job.
+// Closing it closes the mapper in the background once the mapper's Open call has returned.
+type busyMapper struct {
+	Mapper
+	done <-chan error // receives the result of the mapper's Open call
+	once sync.Once
+}
+
+func (m *busyMapper) Close() {
+	m.once.Do(func() {
+		go func() {
+			<-m.done
+			m.Mapper.Close()
+		}()
+	})
+}
+
+// Close closes the mappers of the job, if they're open. Mappers are closed once for each time they're
+// opened, by the job that opened them, however many times Close is called.
 func (m *MapReduceJob) Close() {
+	if !m.opened {
+		return
+	}
+	m.opened = false
 	for _, mm := range m.Mappers {
 		mm.Close()
 	}
 }
 
+// recoverPanic recovers from a panic, e.g. a mapper failing to decode a point, and sets err to
+// ErrQueryPanic. It must be deferred directly by the function that calls into the mappers.
+func (m *MapReduceJob) recoverPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = m.panicError(r)
+	}
+}
+
+// panicError returns the error for a recovered panic. The stack of the panic is logged if the job
+// has a logger.
+func (m *MapReduceJob) panicError(r interface{}) error {
+	if m.logger != nil {
+		m.logger.Printf("panic executing query on %s: %v\n%s", m.MeasurementName, r, debug.Stack())
+	}
+	return ErrQueryPanic(r)
+}
+
 func (m *MapReduceJob) Key() []byte {
 	if m.key == nil {
 		m.key = append([]byte(m.MeasurementName), m.TagSet.Key...)
@@ -70,43 +239,85 @@ func (m *MapReduceJob) Key() []byte {
 }
 
 func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
+	// however the job ends, its part of the query is done
+	defer m.progress.complete()
+
+	// the executor reports the kill once its jobs have stopped
+	if m.kill.killed() {
+		return
+	}
+	m.overBudget = false
+
+	// time the stages of the execution, if the query is profiled. The job is transforming its
+	// results unless it's in another stage.
+	m.timer = m.profile.start(stageTransform)
+	defer m.timer.stop()
+
+	// fail the series rather than the process if a mapper panics. This runs after the mappers are closed.
+	defer func() {
+		if r := recover(); r != nil {
+			out <- &Row{Name: m.MeasurementName, Tags: m.TagSet.Tags, Err: m.panicError(r)}
+		}
+	}()
+
+	prev := m.timer.enter(stageRead)
 	if err := m.Open(); err != nil {
 		out <- &Row{Err: err}
-		m.Close()
 		return
 	}
+	m.timer.enter(prev)
 	defer m.Close()
 
-	// if it's a raw query or a non-nested derivative we handle processing differently
-	if m.stmt.IsRawQuery || m.stmt.IsSimpleDerivative() {
+	// if it's a raw query or a non-nested derivative or difference we handle processing differently
+	if m.stmt.IsRawQuery || m.stmt.IsSimpleDerivative() || m.stmt.IsSimpleDifference() {
 		m.processRawQuery(out, filterEmptyResults)
 		return
 	}
 
-	// get the aggregates and the associated reduce functions
+	// narrow the time range to the intervals it covers completely, if the planner's option is set
+	if m.dropPartialIntervals && m.TMin != 0 && m.interval > 0 {
+		m.trimPartialIntervals()
+	}
+
+	// get the aggregates and the associated reducers
 	aggregates := m.stmt.FunctionCalls()
-	reduceFuncs := make([]ReduceFunc, len(aggregates))
+	newReducers := make([]func() (Reducer, error), len(aggregates))
 	for i, c := range aggregates {
-		reduceFunc, err := InitializeReduceFunc(c)
+		newReducer, err := m.initializeReducer(c)
 		if err != nil {
 			out <- &Row{Err: err}
 			return
 		}
-		reduceFuncs[i] = reduceFunc
+		newReducers[i] = newReducer
+	}
+
+	// send the intervals of queries grouped by time as they're completed, if the planner's option is set
+	if m.canStreamAggregates(aggregates) {
+		m.streamAggregate(out, aggregates[0], newReducers[0], filterEmptyResults)
+		return
 	}
 
 	// we'll have a fixed number of points with times in buckets. Initialize those times and a slice to hold the associated values
 	var pointCountInResult int
 
-	// if the user didn't specify a start time or a group by interval, we're returning a single point that describes the entire range
-	if m.TMin == 0 || m.interval == 0 {
+	// if the user didn't specify a start time or a group by interval, we're returning a single point that describes the entire range.
+	// The implicit interval covers [TMin, TMax], so every point of the series is reduced into it.
+	singleInterval := m.TMin == 0 || m.interval == 0
+	if m.strictIntervals {
+		m.intervals = &intervalCheck{whole: singleInterval}
+	}
+	if singleInterval {
 		// they want a single aggregate point for the entire time range
 		m.interval = m.TMax - m.TMin
+		m.offset = 0
 		pointCountInResult = 1
 	} else {
-		intervalTop := m.TMax/m.interval*m.interval + m.interval
-		intervalBottom := m.TMin / m.interval * m.interval
+		intervalTop := IntervalStart(m.TMax, m.interval, m.offset) + m.interval
+		intervalBottom := IntervalStart(m.TMin, m.interval, m.offset)
 		pointCountInResult = int((intervalTop - intervalBottom) / m.interval)
+		if pointCountInResult < 0 {
+			pointCountInResult = 0
+		}
 	}
 
 	// For group by time queries, limit the number of data points returned by the limit and offset
@@ -124,21 +335,38 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 		}
 	}
 
-	// If we are exceeding our MaxGroupByPoints and we aren't a raw query, error out
-	if pointCountInResult > MaxGroupByPoints {
-		out <- &Row{
-			Err: errors.New("too many points in the group by interval. maybe you forgot to specify a where time clause?"),
+	// If we are exceeding our budget of intervals and we aren't a raw query, error out. With the
+	// planner's option set, the intervals that fit are reduced and sent as a partial row instead,
+	// unless they're forecasted, which would extrapolate from the middle of the series.
+	budget := m.intervalBudget()
+	if pointCountInResult > budget {
+		if !m.partialOverBudget || m.stmt.HasHoltWinters() {
+			out <- &Row{
+				Err: errors.New("too many points in the group by interval. maybe you forgot to specify a where time clause?"),
+			}
+			return
+		}
+		pointCountInResult, m.overBudget = budget, true
+	}
+
+	// holt_winters buffers the whole series along with the forecasted points, so those count against the limit too
+	if m.stmt.HasHoltWinters() {
+		if n, _ := m.holtWintersArgs(); pointCountInResult+n > budget {
+			out <- &Row{
+				Err: fmt.Errorf("too many points for holt_winters: %d points plus %d forecasted points exceeds the maximum of %d", pointCountInResult, n, budget),
+			}
+			return
 		}
-		return
 	}
 
 	// initialize the times of the aggregate points
 	resultValues := make([][]interface{}, pointCountInResult)
 
-	// ensure that the start time for the results is on the start of the window
+	// ensure that the start time for the results is on the start of the window. The single interval
+	// of the entire range starts at its start time.
 	startTimeBucket := m.TMin
-	if m.interval > 0 {
-		startTimeBucket = startTimeBucket / m.interval * m.interval
+	if m.interval > 0 && !singleInterval {
+		startTimeBucket = IntervalStart(startTimeBucket, m.interval, m.offset)
 	}
 
 	for i, _ := range resultValues {
@@ -166,9 +394,15 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 		m.TMin = resultValues[0][0].(time.Time).UnixNano()
 	}
 
+	if m.recordShardIDs {
+		m.contributors = make(map[uint64]bool)
+	}
+
 	// now loop through the aggregate functions and populate everything
 	for i, c := range aggregates {
-		if err := m.processAggregate(c, reduceFuncs[i], resultValues); err != nil {
+		if err := m.processAggregate(c, newReducers[i], resultValues); err == ErrQueryKilled {
+			return
+		} else if err != nil {
 			out <- &Row{
 				Name: m.MeasurementName,
 				Tags: m.TagSet.Tags,
@@ -191,6 +425,21 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 		columnNames[i+1] = f.Name()
 	}
 
+	// The counts of each bin of values are returned in a series of their own.
+	if m.bucketWidth > 0 {
+		m.sendValueBuckets(out, columnNames, resultValues)
+		return
+	}
+
+	// Partial states are returned as they are, and filled by the node that finalizes them.
+	if m.partial {
+		row := &Row{Name: m.MeasurementName, Tags: m.TagSet.Tags, Columns: columnNames, Values: resultValues, Partial: m.overBudget}
+		row.ShardIDs = sortedShardIDs(m.contributors)
+		m.truncateTimes(row)
+		m.send(out, row)
+		return
+	}
+
 	// processes the result values if there's any math in there
 	resultValues = m.processResults(resultValues)
 
@@ -200,31 +449,142 @@ func (m *MapReduceJob) Execute(out chan *Row, filterEmptyResults bool) {
 	// process derivatives
 	resultValues = m.processDerivative(resultValues)
 
+	// process differences. Filled nulls don't have a difference.
+	resultValues = m.processDifference(resultValues)
+
+	// forecast with holt_winters. This has to run after all buckets have been reduced and filled.
+	resultValues, err := m.processHoltWinters(resultValues)
+	if err != nil {
+		out <- &Row{
+			Name: m.MeasurementName,
+			Tags: m.TagSet.Tags,
+			Err:  err,
+		}
+		return
+	}
+
+	// the intervals are always reduced in time order, so they're reversed to sort them by descending time
+	if !m.stmt.TimeAscending() {
+		for i, j := 0, len(resultValues)-1; i < j; i, j = i+1, j-1 {
+			resultValues[i], resultValues[j] = resultValues[j], resultValues[i]
+		}
+	}
+
 	row := &Row{
-		Name:    m.MeasurementName,
-		Tags:    m.TagSet.Tags,
-		Columns: columnNames,
-		Values:  resultValues,
+		Name:     m.MeasurementName,
+		Tags:     m.TagSet.Tags,
+		Columns:  columnNames,
+		Values:   resultValues,
+		ShardIDs: sortedShardIDs(m.contributors),
+		Partial:  m.overBudget,
 	}
+	m.emitTimes(row)
 
 	// and we out
+	m.send(out, row)
+}
+
+// sendValueBuckets sends the counts of a query grouped by value_bucket(), which are reduced into a
+// map of the counts of each bin for every interval. A row is sent for each bin with points, in
+// order of the bins. It has the tags of the job, and the lower bound of the bin as its
+// value_bucket tag.
+func (m *MapReduceJob) sendValueBuckets(out chan *Row, columnNames []string, resultValues [][]interface{}) {
+	// the bins are sorted by their lower bounds, which are in the same order
+	var bounds []float64
+	bins := make(map[float64]int64)
+	for _, vals := range resultValues {
+		counts, _ := vals[1].(map[int64]int64)
+		for b := range counts {
+			lower := float64(b) * m.bucketWidth
+			if _, ok := bins[lower]; !ok {
+				bins[lower] = b
+				bounds = append(bounds, lower)
+			}
+		}
+	}
+	sort.Float64s(bounds)
+
+	for _, lower := range bounds {
+		b := bins[lower]
+		values := make([][]interface{}, len(resultValues))
+		for i, vals := range resultValues {
+			var v interface{}
+			if n, ok := vals[1].(map[int64]int64)[b]; ok {
+				v = float64(n)
+			}
+			values[i] = []interface{}{vals[0], v}
+		}
+		values = m.processFill(values)
+
+		// the intervals are always reduced in time order, so they're reversed to sort them by descending time
+		if !m.stmt.TimeAscending() {
+			for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+				values[i], values[j] = values[j], values[i]
+			}
+		}
+
+		tags := make(map[string]string, len(m.TagSet.Tags)+1)
+		for k, v := range m.TagSet.Tags {
+			tags[k] = v
+		}
+		tags[ValueBucketTag] = strconv.FormatFloat(lower, 'f', -1, 64)
+
+		row := &Row{
+			Name:     m.MeasurementName,
+			Tags:     tags,
+			Columns:  columnNames,
+			Values:   values,
+			ShardIDs: sortedShardIDs(m.contributors),
+			Partial:  m.overBudget,
+		}
+		m.emitTimes(row)
+		m.send(out, row)
+	}
+}
+
+// send sends a row of the job to out. The time until it's received is the time the consumer of the
+// query takes to encode and write the rows before it.
+func (m *MapReduceJob) send(out chan *Row, row *Row) {
+	defer m.timer.enter(m.timer.enter(stageEncode))
 	out <- row
 }
 
 // processRawQuery will handle running the mappers and then reducing their output
 // for queries that pull back raw data values without computing any kind of aggregates.
 func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
+	// the points are merged unless the job is in another stage
+	defer m.timer.enter(m.timer.enter(stageMerge))
+
 	// initialize the mappers
+	prev := m.timer.enter(stageRead)
 	for _, mm := range m.Mappers {
-		if err := mm.Begin(nil, m.TMin, m.chunkSize); err != nil {
+		if err := mm.Begin(nil, m.rawStartTime(), m.mapperChunkSize(mm)); err != nil {
 			out <- &Row{Err: err}
 			return
 		}
 	}
+	m.timer.enter(prev)
 
 	mapperOutputs := make([][]*rawQueryMapOutput, len(m.Mappers))
 	// markers for which mappers have been completely emptied
 	mapperComplete := make([]bool, len(m.Mappers))
+	// positions to resume each mapper from if its shard moves
+	checkpoints := make([]rawCheckpoint, len(m.Mappers))
+
+	// the points of each mapper, if they're sorted before they're merged
+	if m.outOfOrder == OutOfOrderSort {
+		m.sortedRaw = make([]sortedRawOutputs, len(m.Mappers))
+	}
+
+	// read ahead from the mappers while the current chunks are processed. The prefetching
+	// stops before the mappers are closed, however the query ends. Queries with a limit that
+	// fits in a chunk are usually done after a single read from each mapper, so they don't
+	// read ahead.
+	var prefetch *rawPrefetcher
+	if limit := m.rawLimit(); m.prefetchDepth > 0 && (limit == 0 || (m.chunkSize > 0 && limit > m.chunkSize)) {
+		prefetch = m.startRawPrefetch(checkpoints)
+		defer prefetch.stop()
+	}
 
 	// for limit and offset we need to track how many values we've swallowed for the offset and how many we've already set for the limit.
 	// we track the number set for the limit because they could be getting chunks. For instance if your limit is 10k, but chunk size is 1k
@@ -232,30 +592,65 @@ func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
 	valuesOffset := 0
 	valuesToReturn := make([]*rawQueryMapOutput, 0)
 
+	// the order the mappers return their points in
+	ascending := m.stmt.TimeAscending()
+
+	// look for points of a series read from several shards at the same time, if asked to
+	m.conflicts = m.newRawConflicts()
+
+	// the number of points sent in each row. It's the chunk size, unless that's more than the series may buffer.
+	flushSize := m.chunkSize
+	if m.maxBufferedPoints > 0 && flushSize > m.maxBufferedPoints {
+		flushSize = m.maxBufferedPoints
+	}
+
+	// the position the query was resumed from, until a point after it is read
+	var resume *resumePosition
+	if m.resume != nil {
+		pos := *m.resume
+		resume = &pos
+	}
+
 	var lastValueFromPreviousChunk *rawQueryMapOutput
+	// the last point of the previous chunk, to take the difference of the first point of a chunk
+	var lastDifferenceValue *rawQueryMapOutput
 	// loop until we've emptied out all the mappers and sent everything out
 	for {
 		// collect up to the limit for each mapper
-		for j, mm := range m.Mappers {
+		for j := range m.Mappers {
 			// only pull from mappers that potentially have more data and whose last output has been completely sent out.
 			if mapperOutputs[j] != nil || mapperComplete[j] {
 				continue
 			}
 
-			res, err := mm.NextInterval()
-			if err != nil {
+			var res []*rawQueryMapOutput
+			var err error
+			prev := m.timer.enter(stageRead)
+			if prefetch != nil {
+				res, err = prefetch.next(j)
+			} else {
+				res, err = m.nextRawInterval(j, &checkpoints[j])
+			}
+			m.timer.enter(prev)
+			if err == ErrQueryKilled {
+				return
+			} else if err != nil {
 				out <- &Row{Err: err}
 				return
 			}
 			if res != nil {
-				mapperOutputs[j] = res.([]*rawQueryMapOutput)
+				mapperOutputs[j] = res
 			} else { // if we got a nil from the mapper it means that we've emptied all data from it
 				mapperComplete[j] = true
 			}
 		}
 
-		// process the mapper outputs. we can send out everything up to the min of the last time in the mappers
+		// process the mapper outputs. we can send out everything up to the min of the last time in the mappers,
+		// or down to the max if they're read in descending order
 		min := int64(math.MaxInt64)
+		if !ascending {
+			min = math.MinInt64
+		}
 		for _, o := range mapperOutputs {
 			// some of the mappers could empty out before others so ignore them because they'll be nil
 			if o == nil {
@@ -264,25 +659,27 @@ func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
 
 			// find the min of the last point in each mapper
 			t := o[len(o)-1].Time
-			if t < min {
+			if rawBefore(t, min, ascending) {
 				min = t
 			}
 		}
 
 		// now empty out all the mapper outputs up to the min time
-		var values []*rawQueryMapOutput
+		var chunks [][]*rawQueryMapOutput
 		for j, o := range mapperOutputs {
 			// find the index of the point up to the min
 			ind := len(o)
 			for i, mo := range o {
-				if mo.Time > min {
+				if rawBefore(min, mo.Time, ascending) {
 					ind = i
 					break
 				}
 			}
 
 			// add up to the index to the values
-			values = append(values, o[:ind]...)
+			if ind > 0 {
+				chunks = append(chunks, o[:ind])
+			}
 
 			// clear out previously sent mapper output data
 			mapperOutputs[j] = mapperOutputs[j][ind:]
@@ -294,12 +691,27 @@ func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
 		}
 
 		// if we didn't pull out any values, we're done here
-		if values == nil {
+		if chunks == nil && !m.conflicts.pending() {
 			break
 		}
 
-		// sort the values by time first so we can then handle offset and limit
-		sort.Sort(rawOutputs(values))
+		// merge the values by time first so we can then handle offset and limit
+		values := mergeRawOutputs(chunks, ascending)
+
+		// resolve the conflicting points, holding back those at the last time until the rest of
+		// the points at that time have been read
+		if m.conflicts != nil {
+			if values = m.conflicts.resolve(values, chunks == nil); len(values) == 0 {
+				continue
+			}
+		}
+
+		// skip the points that were returned before the query was resumed
+		if resume != nil {
+			if values, resume = m.skipResumed(values, resume, ascending); len(values) == 0 {
+				continue
+			}
+		}
 
 		// get rid of any points that need to be offset
 		if valuesOffset < m.stmt.Offset {
@@ -327,16 +739,21 @@ func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
 		valuesToReturn = append(valuesToReturn, values...)
 
 		// hit the chunk size? Send out what has been accumulated, but keep
-		// processing.
-		if len(valuesToReturn) >= m.chunkSize {
+		// processing. The rest of the series follows in the next rows.
+		if len(valuesToReturn) >= flushSize {
 			lastValueFromPreviousChunk = valuesToReturn[len(valuesToReturn)-1]
+			shardIDs := m.rawShardIDs(valuesToReturn)
 
+			prev := m.timer.enter(stageTransform)
 			valuesToReturn = m.processRawQueryDerivative(lastValueFromPreviousChunk, valuesToReturn)
+			valuesToReturn, lastDifferenceValue = m.processRawQueryDifference(lastDifferenceValue, valuesToReturn)
 
 			row := m.processRawResults(valuesToReturn)
+			row.ShardIDs = shardIDs
 			// perform post-processing, such as math.
 			row.Values = m.processResults(row.Values)
-			out <- row
+			m.timer.enter(prev)
+			m.send(out, row)
 			valuesToReturn = make([]*rawQueryMapOutput, 0)
 		}
 
@@ -348,588 +765,5270 @@ func (m *MapReduceJob) processRawQuery(out chan *Row, filterEmptyResults bool) {
 
 	if len(valuesToReturn) == 0 {
 		if !filterEmptyResults {
-			out <- m.processRawResults(nil)
+			m.send(out, m.processRawResults(nil))
 		}
 	} else {
+		shardIDs := m.rawShardIDs(valuesToReturn)
+
+		prev := m.timer.enter(stageTransform)
 		valuesToReturn = m.processRawQueryDerivative(lastValueFromPreviousChunk, valuesToReturn)
+		valuesToReturn, _ = m.processRawQueryDifference(lastDifferenceValue, valuesToReturn)
 
 		row := m.processRawResults(valuesToReturn)
+		row.ShardIDs = shardIDs
 		// perform post-processing, such as math.
 		row.Values = m.processResults(row.Values)
-		out <- row
+		m.timer.enter(prev)
+		m.send(out, row)
 	}
 }
 
-// derivativeInterval returns the time interval for the one (and only) derivative func
-func (m *MapReduceJob) derivativeInterval() time.Duration {
-	if len(m.stmt.FunctionCalls()[0].Args) == 2 {
-		return m.stmt.FunctionCalls()[0].Args[1].(*DurationLiteral).Val
+// mergeRawOutputs merges time ordered chunks of raw mapper outputs into a single time ordered
+// slice. Most queries only hit a single shard, so a single chunk is returned as is and two chunks
+// are merged directly. A heap is only used to merge more chunks than that. The chunks are in
+// descending time order unless ascending is set.
+func mergeRawOutputs(chunks [][]*rawQueryMapOutput, ascending bool) []*rawQueryMapOutput {
+	switch len(chunks) {
+	case 0:
+		return nil
+	case 1:
+		return chunks[0]
+	case 2:
+		a, b := chunks[0], chunks[1]
+		values := make([]*rawQueryMapOutput, 0, len(a)+len(b))
+		for len(a) > 0 && len(b) > 0 {
+			if rawBefore(b[0].Time, a[0].Time, ascending) {
+				values, b = append(values, b[0]), b[1:]
+			} else {
+				values, a = append(values, a[0]), a[1:]
+			}
+		}
+		values = append(values, a...)
+		return append(values, b...)
 	}
-	if m.stmt.groupByInterval > 0 {
-		return m.stmt.groupByInterval
+	return mergeRawOutputsHeap(chunks, ascending)
+}
+
+// mergeRawOutputsHeap merges time ordered chunks of raw mapper outputs using a heap.
+func mergeRawOutputsHeap(chunks [][]*rawQueryMapOutput, ascending bool) []*rawQueryMapOutput {
+	var n int
+	h := &rawOutputsHeap{chunks: make([][]*rawQueryMapOutput, 0, len(chunks)), ascending: ascending}
+	for _, c := range chunks {
+		n += len(c)
+		h.chunks = append(h.chunks, c)
 	}
-	return time.Second
+	heap.Init(h)
+
+	values := make([]*rawQueryMapOutput, 0, n)
+	for len(h.chunks) > 0 {
+		c := h.chunks[0]
+		values = append(values, c[0])
+		if len(c) > 1 {
+			h.chunks[0] = c[1:]
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return values
 }
 
-func (m *MapReduceJob) isNonNegativeDerivative() bool {
-	return m.stmt.FunctionCalls()[0].Name == "non_negative_derivative"
+// rawOutputsHeap is a heap of non-empty, time ordered chunks of raw mapper outputs, ordered
+// by the time of the first output in each chunk. The earliest chunk is first unless the chunks
+// are in descending order, in which case the latest is.
+type rawOutputsHeap struct {
+	chunks    [][]*rawQueryMapOutput
+	ascending bool
 }
 
-func (m *MapReduceJob) processRawQueryDerivative(lastValueFromPreviousChunk *rawQueryMapOutput, valuesToReturn []*rawQueryMapOutput) []*rawQueryMapOutput {
-	// If we're called and do not have a derivative aggregate function, then return what was passed in
-	if !m.stmt.HasDerivative() {
-		return valuesToReturn
-	}
+func (h *rawOutputsHeap) Len() int { return len(h.chunks) }
+func (h *rawOutputsHeap) Less(i, j int) bool {
+	return rawBefore(h.chunks[i][0].Time, h.chunks[j][0].Time, h.ascending)
+}
+func (h *rawOutputsHeap) Swap(i, j int) { h.chunks[i], h.chunks[j] = h.chunks[j], h.chunks[i] }
 
-	if len(valuesToReturn) == 0 {
-		return valuesToReturn
-	}
+func (h *rawOutputsHeap) Push(x interface{}) { h.chunks = append(h.chunks, x.([]*rawQueryMapOutput)) }
 
-	// If we only have 1 value, then the value did not change, so return
-	// a single row with 0.0
-	if len(valuesToReturn) == 1 {
-		return []*rawQueryMapOutput{
-			&rawQueryMapOutput{
-				Time:   valuesToReturn[0].Time,
-				Values: 0.0,
-			},
-		}
-	}
+func (h *rawOutputsHeap) Pop() interface{} {
+	old := h.chunks
+	n := len(old)
+	x := old[n-1]
+	h.chunks = old[:n-1]
+	return x
+}
 
-	if lastValueFromPreviousChunk == nil {
-		lastValueFromPreviousChunk = valuesToReturn[0]
+// rawBefore returns true if a point at time a is returned before one at time b by a raw query.
+func rawBefore(a, b int64, ascending bool) bool {
+	if ascending {
+		return a < b
 	}
+	return a > b
+}
 
-	// Determines whether to drop negative differences
-	isNonNegative := m.isNonNegativeDerivative()
+// ConflictResolution is how a raw query resolves conflicting points, which are points of the same
+// series at the same nanosecond read from different shards, e.g. from shards whose time ranges
+// overlap after a botched restore. A series only has one value at each time, so they're a sign
+// of corrupt data.
+type ConflictResolution int
 
-	derivativeValues := []*rawQueryMapOutput{}
-	for i := 1; i < len(valuesToReturn); i++ {
-		v := valuesToReturn[i]
+const (
+	// ConflictIgnore returns every point as it's read, without looking for conflicts.
+	ConflictIgnore ConflictResolution = iota
 
-		// Calculate the derivative of successive points by dividing the difference
-		// of each value by the elapsed time normalized to the interval
-		diff := i64tof64(v.Values) - i64tof64(lastValueFromPreviousChunk.Values)
+	// ConflictKeepAll returns every point, and counts the conflicts in the stats of the query.
+	ConflictKeepAll
 
-		elapsed := v.Time - lastValueFromPreviousChunk.Time
+	// ConflictPreferHighestShard returns the point read from the shard with the highest ID.
+	ConflictPreferHighestShard
 
-		value := 0.0
-		if elapsed > 0 {
-			value = diff / (float64(elapsed) / float64(m.derivativeInterval()))
-		}
+	// ConflictPreferRetentionPolicy returns the point read from a shard of the preferred
+	// retention policy, or from the shard with the highest ID if none or several of them are.
+	ConflictPreferRetentionPolicy
+)
 
-		lastValueFromPreviousChunk = v
+// RetentionPolicyMapper is implemented by mappers that know the retention policy of the shard they
+// read, which ConflictPreferRetentionPolicy prefers points by. The points of other mappers are
+// never preferred.
+type RetentionPolicyMapper interface {
+	RetentionPolicy() string
+}
 
-		// Drop negative values for non-negative derivatives
-		if isNonNegative && diff < 0 {
-			continue
-		}
+// rawConflicts resolves the conflicting points of an execution of a raw query. The points of the
+// other mappers at the last time of a batch of merged points may only be read with the next batch,
+// so those points are held back until then.
+type rawConflicts struct {
+	resolution ConflictResolution
+	preferred  map[uint64]bool      // the shards of the preferred retention policy, by ID
+	held       []*rawQueryMapOutput // the points at the last time of the previous batch
+	n          int                  // the number of points that conflicted with a point read before them
+}
 
-		derivativeValues = append(derivativeValues, &rawQueryMapOutput{
-			Time:   v.Time,
-			Values: value,
-		})
+// newRawConflicts returns the conflict resolver for an execution of the job, or nil if the job
+// doesn't look for conflicts.
+func (m *MapReduceJob) newRawConflicts() *rawConflicts {
+	if m.conflictRes == ConflictIgnore {
+		return nil
 	}
 
-	return derivativeValues
+	c := &rawConflicts{resolution: m.conflictRes, preferred: make(map[uint64]bool)}
+	if m.conflictRes == ConflictPreferRetentionPolicy {
+		for _, mm := range m.Mappers {
+			mappers := []Mapper{mm}
+			if s, ok := mm.(*sequentialMapper); ok {
+				mappers = s.mappers
+			}
+			for _, mm := range mappers {
+				if rpm, ok := mm.(RetentionPolicyMapper); ok && rpm.RetentionPolicy() == m.preferredRP {
+					c.preferred[mm.ShardID()] = true
+				}
+			}
+		}
+	}
+	return c
 }
 
-// processDerivative returns the derivatives of the results
-func (m *MapReduceJob) processDerivative(results [][]interface{}) [][]interface{} {
-	// Return early if we're not supposed to process the derivatives
-	if !m.stmt.HasDerivative() {
-		return results
-	}
+// pending returns true if points are held back for the next batch.
+func (c *rawConflicts) pending() bool { return c != nil && len(c.held) > 0 }
 
-	// Return early if we can't calculate derivatives
-	if len(results) == 0 {
-		return results
+// resolve returns the time ordered points of a batch, and those held back from the previous one,
+// with their conflicts resolved. Unless the batch is the final one, the points at its last time are
+// held back. The returned points are a new slice, so the mapper outputs aren't modified.
+func (c *rawConflicts) resolve(values []*rawQueryMapOutput, final bool) []*rawQueryMapOutput {
+	if len(c.held) > 0 {
+		values = append(append(make([]*rawQueryMapOutput, 0, len(c.held)+len(values)), c.held...), values...)
+		c.held = nil
 	}
-
-	// If we only have 1 value, then the value did not change, so return
-	// a single row w/ 0.0
-	if len(results) == 1 {
-		return [][]interface{}{
-			[]interface{}{results[0][0], 0.0},
+	if !final && len(values) > 0 {
+		i := len(values) - 1
+		for i > 0 && values[i-1].Time == values[i].Time {
+			i--
 		}
+		values, c.held = values[:i], values[i:]
 	}
 
-	// Determines whether to drop negative differences
-	isNonNegative := m.isNonNegativeDerivative()
-
-	// Otherwise calculate the derivatives as the difference between consecutive
-	// points divided by the elapsed time.  Then normalize to the requested
-	// interval.
-	derivatives := [][]interface{}{}
-	for i := 1; i < len(results); i++ {
-		prev := results[i-1]
-		cur := results[i]
+	resolved := make([]*rawQueryMapOutput, 0, len(values))
+	for i := 0; i < len(values); {
+		// the points at a time are compared with those at the same time kept before them
+		start := len(resolved)
+		for t := values[i].Time; i < len(values) && values[i].Time == t; i++ {
+			v := values[i]
+			k := start
+			for ; k < len(resolved) && resolved[k].seriesKey != v.seriesKey; k++ {
+			}
+			if k == len(resolved) {
+				resolved = append(resolved, v)
+				continue
+			}
 
-		if cur[1] == nil || prev[1] == nil {
-			continue
+			c.n++
+			if c.resolution == ConflictKeepAll {
+				resolved = append(resolved, v)
+			} else if c.prefer(v, resolved[k]) {
+				resolved[k] = v
+			}
 		}
+	}
+	return resolved
+}
 
-		elapsed := cur[0].(time.Time).Sub(prev[0].(time.Time))
-		diff := i64tof64(cur[1]) - i64tof64(prev[1])
-		value := 0.0
-		if elapsed > 0 {
-			value = float64(diff) / (float64(elapsed) / float64(m.derivativeInterval()))
+// prefer returns true if the conflicting point a is returned rather than b.
+func (c *rawConflicts) prefer(a, b *rawQueryMapOutput) bool {
+	if c.resolution == ConflictPreferRetentionPolicy && c.preferred[a.shardID] != c.preferred[b.shardID] {
+		return c.preferred[a.shardID]
+	}
+	return a.shardID > b.shardID
+}
+
+// rawStartTime returns the time the mappers of a raw query start reading from. Queries sorted by
+// descending time are read backward from the end of their time range.
+// Resumed queries start from the time they were resumed at.
+func (m *MapReduceJob) rawStartTime() int64 {
+	if m.stmt.TimeAscending() {
+		if m.resume != nil && m.resume.Time > m.TMin {
+			return m.resume.Time
 		}
+		return m.TMin
+	}
 
-		// Drop negative values for non-negative derivatives
-		if isNonNegative && diff < 0 {
-			continue
+	if m.resume != nil {
+		// the position is at the precision of the query, so points up to the end of its time are read
+		t := m.resume.Time
+		if m.precision > 1 {
+			t += m.precision - 1
+		}
+		if t < m.TMax {
+			return t
 		}
+	}
+	return m.TMax
+}
 
-		val := []interface{}{
-			cur[0],
-			value,
+// skipResumed drops the points at or before the position a query was resumed from from the start
+// of time ordered values. It returns the remaining values, and the position with the number of
+// points at its time still to be skipped, or nil once a point after it has been reached.
+func (m *MapReduceJob) skipResumed(values []*rawQueryMapOutput, pos *resumePosition, ascending bool) ([]*rawQueryMapOutput, *resumePosition) {
+	for len(values) > 0 {
+		if t := m.truncateTime(values[0].Time); rawBefore(t, pos.Time, ascending) {
+			values = values[1:]
+		} else if t == pos.Time && pos.N > 0 {
+			values = values[1:]
+			pos.N--
+		} else {
+			return values, nil
 		}
-		derivatives = append(derivatives, val)
 	}
+	return values, pos
+}
 
-	return derivatives
+// rawCheckpoint is the position of a mapper in a raw query: the time of the last point read
+// from it and the number of points read at that time.
+type rawCheckpoint struct {
+	time int64
+	n    int
 }
 
-// processsResults will apply any math that was specified in the select statement against the passed in results
-func (m *MapReduceJob) processResults(results [][]interface{}) [][]interface{} {
-	hasMath := false
-	for _, f := range m.stmt.Fields {
-		if _, ok := f.Expr.(*BinaryExpr); ok {
-			hasMath = true
-		} else if _, ok := f.Expr.(*ParenExpr); ok {
-			hasMath = true
-		}
+// nextRawInterval returns the next interval of points from the mapper at index j for a raw query.
+// If the mapper's shard has moved, the mapper is re-created and resumed from the checkpoint. A panic
+// in the mapper is returned as an error, as the interval may be read in the background, and
+// ErrQueryKilled is returned once the executor of the job is killed. A point
+// before one the mapper returned earlier fails the series with ErrOutOfOrder, unless the job sorts
+// the points of its mappers, in which case every point of the mapper is read and sorted first.
+func (m *MapReduceJob) nextRawInterval(j int, cp *rawCheckpoint) (_ []*rawQueryMapOutput, err error) {
+	defer m.recoverPanic(&err)
+
+	if m.kill.killed() {
+		return nil, ErrQueryKilled
 	}
 
-	if !hasMath {
-		return results
+	if m.outOfOrder == OutOfOrderSort {
+		return m.nextSortedRawInterval(j, cp)
+	}
+	return m.readRawInterval(j, cp)
+}
+
+// nextSortedRawInterval returns the next chunk of the time ordered points of the mapper at index j.
+// The first call reads every point of the mapper into memory and sorts them.
+func (m *MapReduceJob) nextSortedRawInterval(j int, cp *rawCheckpoint) ([]*rawQueryMapOutput, error) {
+	s := &m.sortedRaw[j]
+	if !s.read {
+		for {
+			values, err := m.readRawInterval(j, cp)
+			if err != nil {
+				return nil, err
+			} else if len(values) == 0 {
+				break
+			}
+			s.values = append(s.values, values...)
+		}
+		a := rawOutputsByTime{values: s.values, ascending: m.stmt.TimeAscending()}
+		sort.Stable(a)
+		s.read = true
+	}
+	if len(s.values) == 0 {
+		return nil, nil
+	}
+
+	n := len(s.values)
+	if size := m.mapperChunkSize(m.Mappers[j]); size > 0 && size < n {
+		n = size
+	}
+	values := s.values[:n]
+	s.values = s.values[n:]
+	return values, nil
+}
+
+// sortedRawOutputs are the points of a mapper of a raw query whose job sorts them, which are
+// read in full before the first chunk is returned.
+type sortedRawOutputs struct {
+	values []*rawQueryMapOutput // the sorted points that haven't been returned yet
+	read   bool                 // true once every point of the mapper has been read
+}
+
+// rawOutputsByTime sorts raw mapper outputs in the order a raw query returns them.
+type rawOutputsByTime struct {
+	values    []*rawQueryMapOutput
+	ascending bool
+}
+
+func (a rawOutputsByTime) Len() int { return len(a.values) }
+func (a rawOutputsByTime) Less(i, j int) bool {
+	return rawBefore(a.values[i].Time, a.values[j].Time, a.ascending)
+}
+func (a rawOutputsByTime) Swap(i, j int) { a.values[i], a.values[j] = a.values[j], a.values[i] }
+
+// OutOfOrderHandling is how a query handles a mapper that returns a point before one it has
+// already returned, or the output of an aggregate for another interval than the one being reduced,
+// which breaks the contract of NextInterval, e.g. a buggy remote mapper. The outputs of the mappers
+// are merged assuming they're in time order, so they'd be merged wrongly. The intervals of an
+// aggregate are only checked for mappers that implement IntervalTimer.
+type OutOfOrderHandling int
+
+const (
+	// OutOfOrderError fails the series with ErrOutOfOrder, or ErrIntervalOutOfOrder for aggregates.
+	OutOfOrderError OutOfOrderHandling = iota
+
+	// OutOfOrderSort reads every point of each mapper into memory and sorts them before they're
+	// merged, so the points of a series are returned in order whatever order they're read in. The
+	// outputs of aggregates read ahead of their interval are kept until it's reduced.
+	OutOfOrderSort
+)
+
+// ErrOutOfOrder is returned when a mapper of a raw query returns a point at time t after one at
+// the later time last, or the earlier time for queries sorted by descending time.
+func ErrOutOfOrder(shardID uint64, t, last int64) error {
+	return fmt.Errorf("mapper of shard %d returned a point at %s after one at %s, out of time order",
+		shardID, time.Unix(0, t).UTC().Format(time.RFC3339Nano), time.Unix(0, last).UTC().Format(time.RFC3339Nano))
+}
+
+// readRawInterval reads the next interval of points from the mapper at index j, remapping or
+// retrying it if needed, and moves the checkpoint past them.
+func (m *MapReduceJob) readRawInterval(j int, cp *rawCheckpoint) ([]*rawQueryMapOutput, error) {
+	// the number of points at the checkpoint time that were already read before a remap or retry
+	var skip int
+	var attempt int
+
+	for {
+		res, err := m.Mappers[j].NextInterval()
+		if err == ErrShardMoved || (err != nil && m.canRetry(j, err, attempt)) {
+			// start the new mapper, or read the mapper again, from the time of the last point
+			// read. Points at that time that were already read are skipped.
+			startingTime := m.rawStartTime()
+			if cp.n > 0 {
+				startingTime = cp.time
+			}
+			if err == ErrShardMoved {
+				err = m.remap(j, nil, startingTime, 0)
+			} else {
+				err = m.retry(j, attempt, startingTime)
+				attempt++
+			}
+			if err != nil {
+				return nil, err
+			}
+			skip = cp.n
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if res == nil {
+			m.progress.advance(0, 1)
+			return nil, nil
+		}
+
+		values := res.([]*rawQueryMapOutput)
+		if skip > 0 {
+			n := len(values)
+			for skip > 0 && len(values) > 0 && values[0].Time == cp.time {
+				values = values[1:]
+				skip--
+			}
+
+			// read again if the whole interval had already been read
+			if len(values) == 0 && n > 0 {
+				continue
+			}
+			skip = 0
+		}
+
+		ascending := m.stmt.TimeAscending()
+		for _, v := range values {
+			if cp.n > 0 && rawBefore(v.Time, cp.time, ascending) && m.outOfOrder == OutOfOrderError {
+				return nil, ErrOutOfOrder(m.Mappers[j].ShardID(), v.Time, cp.time)
+			}
+			if v.Time == cp.time {
+				cp.n++
+			} else {
+				cp.time, cp.n = v.Time, 1
+			}
+			if m.recordShardIDs || m.conflictRes != ConflictIgnore {
+				v.shardID = m.Mappers[j].ShardID()
+			}
+		}
+		return values, nil
+	}
+}
+
+// rawPrefetcher reads the intervals of the mappers of a raw query in the background, each mapper
+// in its own goroutine, so the next chunk of a mapper is usually ready when it's needed.
+type rawPrefetcher struct {
+	job    *MapReduceJob
+	chunks []chan rawPrefetchResult // the chunks read ahead from each mapper
+	done   chan struct{}            // closed to stop reading
+	wg     sync.WaitGroup
+}
+
+// rawPrefetchResult is an interval read ahead from a mapper, or the error reading it.
+type rawPrefetchResult struct {
+	values []*rawQueryMapOutput
+	err    error
+}
+
+// startRawPrefetch starts reading ahead from each mapper of the job, up to the prefetch depth of the
+// job. Reading from a mapper stops once it's empty or returns an error, or when stop is called.
+func (m *MapReduceJob) startRawPrefetch(checkpoints []rawCheckpoint) *rawPrefetcher {
+	p := &rawPrefetcher{
+		job:    m,
+		chunks: make([]chan rawPrefetchResult, len(m.Mappers)),
+		done:   make(chan struct{}),
+	}
+	for j := range m.Mappers {
+		ch := make(chan rawPrefetchResult, m.prefetchDepth)
+		p.chunks[j] = ch
+
+		p.wg.Add(1)
+		go func(j int) {
+			defer p.wg.Done()
+			defer close(ch)
+
+			for {
+				values, err := m.nextRawInterval(j, &checkpoints[j])
+				select {
+				case ch <- rawPrefetchResult{values: values, err: err}:
+				case <-p.done:
+					return
+				}
+				if err != nil || values == nil {
+					return
+				}
+			}
+		}(j)
+	}
+	return p
+}
+
+// next returns the next interval of the mapper at index j, waiting for it to be read if it
+// hasn't been yet. It returns nil once the mapper is empty.
+func (p *rawPrefetcher) next(j int) ([]*rawQueryMapOutput, error) {
+	r, ok := <-p.chunks[j]
+	if !ok {
+		return nil, nil
+	}
+	return r.values, r.err
+}
+
+// stop stops reading ahead and waits for any reads in progress, so the mappers can be closed.
+// Mappers that implement Canceler are cancelled so their reads in progress return promptly.
+func (p *rawPrefetcher) stop() {
+	close(p.done)
+
+	p.job.remapMu.Lock()
+	for _, mm := range p.job.Mappers {
+		if c, ok := mm.(Canceler); ok {
+			c.Cancel()
+		}
+	}
+	p.job.remapMu.Unlock()
+
+	p.wg.Wait()
+}
+
+// remap replaces the mapper at index j with a new mapper for the same shard after the shard moved.
+// The new mapper is opened and begun at the passed in time. A chunk size of 0 uses the chunk size
+// for raw queries.
+func (m *MapReduceJob) remap(j int, c *Call, startingTime int64, chunkSize int) error {
+	r, ok := m.Mappers[j].(Remapper)
+	if !ok {
+		return ErrShardMoved
+	}
+
+	m.remapMu.Lock()
+	if m.remapN >= MaxRemapN {
+		m.remapMu.Unlock()
+		return ErrShardMoved
+	}
+	m.remapN++
+	m.remapMu.Unlock()
+
+	mm, err := r.Remap()
+	if err != nil {
+		return err
+	}
+	m.Mappers[j].Close()
+	m.remapMu.Lock()
+	m.Mappers[j] = mm
+	m.remapMu.Unlock()
+
+	if err := m.openMapper(j); err != nil {
+		return err
+	}
+	if chunkSize == 0 {
+		chunkSize = m.mapperChunkSize(mm)
+	}
+	return mm.Begin(c, startingTime, chunkSize)
+}
+
+// canRetry returns true if a read of the mapper at index j that failed with err can be retried
+// after attempt earlier retries: the error must be transient, the mapper an IntervalSeeker and the
+// retry attempts of the job not used up.
+func (m *MapReduceJob) canRetry(j int, err error, attempt int) bool {
+	if attempt >= m.retryAttempts || !IsTransient(err) {
+		return false
+	}
+	m.remapMu.Lock()
+	_, ok := m.Mappers[j].(IntervalSeeker)
+	m.remapMu.Unlock()
+	return ok
+}
+
+// retry waits with exponential backoff before retry number attempt of a read of the mapper at
+// index j, then seeks the mapper to the passed in time. The wait ends early with ErrQueryKilled once
+// the executor of the job is killed, or with ErrSoftDeadline once a soft deadline that aborts the
+// query passes.
+func (m *MapReduceJob) retry(j int, attempt int, startingTime int64) error {
+	var deadline <-chan struct{}
+	if m.deadline != nil && m.deadline.abort {
+		deadline = m.deadline.C
+	}
+	timer := time.NewTimer(m.retryBackoff << uint(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-m.kill.stopped():
+		return ErrQueryKilled
+	case <-deadline:
+		return ErrSoftDeadline
+	}
+
+	m.remapMu.Lock()
+	s := m.Mappers[j].(IntervalSeeker)
+	m.remapMu.Unlock()
+	return s.SeekInterval(startingTime)
+}
+
+// mapperChunkSize returns the chunk size the mapper should use for a raw query. If adaptive
+// chunking is enabled and the mapper can estimate how many points it holds, the chunk size is
+// scaled accordingly. Otherwise the chunk size of the query is used. Either way it's capped at
+// the limit of the query, if any. Every mapper, local or remote, is begun with a chunk size from
+// here, so it's always positive: an uncapped query reading everything at once gets
+// unboundedChunkSize.
+func (m *MapReduceJob) mapperChunkSize(mm Mapper) int {
+	chunkSize := m.chunkSize
+	if e, ok := mm.(PointEstimator); ok && m.chunkSizeFunc != nil {
+		chunkSize = capChunkSize(m.chunkSizeFunc(m.chunkSize, e.EstimatedPointN()), m.maxChunkSize)
+	}
+
+	// the chunks of every mapper must fit in the points the series may buffer
+	if n := m.bufferedChunkSize(); n > 0 && chunkSize > n {
+		chunkSize = n
+	}
+
+	// a mapper never needs to read more points at once than the limit of the query
+	if chunkSize = capChunkSize(chunkSize, m.rawLimit()); chunkSize == 0 {
+		return unboundedChunkSize
+	}
+	return chunkSize
+}
+
+// unboundedChunkSize is the chunk size of mappers of raw queries that read everything at once.
+const unboundedChunkSize = math.MaxInt32
+
+// bufferedChunkSize returns the largest chunk size of the mappers of a raw query for which all the
+// chunks they hold at once, whether read ahead or waiting to be merged, fit in the points the job may
+// buffer. It's at least 1, or 0 if the buffered points aren't capped.
+func (m *MapReduceJob) bufferedChunkSize() int {
+	if m.maxBufferedPoints <= 0 || len(m.Mappers) == 0 {
+		return 0
+	}
+
+	// each mapper holds a chunk waiting to be merged, and while reading ahead, a chunk for each
+	// level of the prefetch depth plus the one being read
+	chunkN := 1
+	if m.prefetchDepth > 0 {
+		chunkN += m.prefetchDepth + 1
+	}
+	if n := m.maxBufferedPoints / (len(m.Mappers) * chunkN); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// rawLimit returns the number of points a raw query needs from each mapper to satisfy its limit
+// and offset, or 0 if it has no limit.
+func (m *MapReduceJob) rawLimit() int {
+	if m.stmt.Limit == 0 {
+		return 0
+	}
+	return m.stmt.Limit + m.stmt.Offset
+}
+
+// capChunkSize returns the chunk size capped at max. A chunk size of zero or less, which
+// returns everything at once, is capped too. If max is zero or less, the chunk size isn't capped,
+// and a negative chunk size is returned as zero, so mappers never see one.
+func capChunkSize(chunkSize, max int) int {
+	if max > 0 && (chunkSize <= 0 || chunkSize > max) {
+		return max
+	} else if chunkSize < 0 {
+		return 0
+	}
+	return chunkSize
+}
+
+// derivativeInterval returns the time interval for the one (and only) derivative func
+func (m *MapReduceJob) derivativeInterval() time.Duration {
+	if len(m.stmt.FunctionCalls()[0].Args) == 2 {
+		return m.stmt.FunctionCalls()[0].Args[1].(*DurationLiteral).Val
+	}
+	if m.stmt.groupByInterval > 0 {
+		return m.stmt.groupByInterval
+	}
+	return time.Second
+}
+
+func (m *MapReduceJob) isNonNegativeDerivative() bool {
+	return m.stmt.FunctionCalls()[0].Name == "non_negative_derivative"
+}
+
+func (m *MapReduceJob) processRawQueryDerivative(lastValueFromPreviousChunk *rawQueryMapOutput, valuesToReturn []*rawQueryMapOutput) []*rawQueryMapOutput {
+	// If we're called and do not have a derivative aggregate function, then return what was passed in
+	if !m.stmt.HasDerivative() {
+		return valuesToReturn
+	}
+
+	if len(valuesToReturn) == 0 {
+		return valuesToReturn
+	}
+
+	// If we only have 1 value, then the value did not change, so return
+	// a single row with 0.0
+	if len(valuesToReturn) == 1 {
+		return []*rawQueryMapOutput{
+			&rawQueryMapOutput{
+				Time:   valuesToReturn[0].Time,
+				Values: 0.0,
+			},
+		}
+	}
+
+	if lastValueFromPreviousChunk == nil {
+		lastValueFromPreviousChunk = valuesToReturn[0]
+	}
+
+	// Determines whether to drop negative differences
+	isNonNegative := m.isNonNegativeDerivative()
+
+	derivativeValues := []*rawQueryMapOutput{}
+	for i := 1; i < len(valuesToReturn); i++ {
+		v := valuesToReturn[i]
+
+		// Calculate the derivative of successive points by dividing the difference
+		// of each value by the elapsed time normalized to the interval
+		diff := i64tof64(v.Values) - i64tof64(lastValueFromPreviousChunk.Values)
+
+		elapsed := v.Time - lastValueFromPreviousChunk.Time
+
+		value := 0.0
+		if elapsed > 0 {
+			value = diff / (float64(elapsed) / float64(m.derivativeInterval()))
+		}
+
+		lastValueFromPreviousChunk = v
+
+		// Drop negative values for non-negative derivatives
+		if isNonNegative && diff < 0 {
+			continue
+		}
+
+		derivativeValues = append(derivativeValues, &rawQueryMapOutput{
+			Time:   v.Time,
+			Values: value,
+		})
+	}
+
+	return derivativeValues
+}
+
+// processDerivative returns the derivatives of the results
+func (m *MapReduceJob) processDerivative(results [][]interface{}) [][]interface{} {
+	// Return early if we're not supposed to process the derivatives
+	if !m.stmt.HasDerivative() {
+		return results
+	}
+
+	// Return early if we can't calculate derivatives
+	if len(results) == 0 {
+		return results
+	}
+
+	// If we only have 1 value, then the value did not change, so return
+	// a single row w/ 0.0
+	if len(results) == 1 {
+		return [][]interface{}{
+			[]interface{}{results[0][0], 0.0},
+		}
+	}
+
+	// Determines whether to drop negative differences
+	isNonNegative := m.isNonNegativeDerivative()
+
+	// Otherwise calculate the derivatives as the difference between consecutive
+	// points divided by the elapsed time.  Then normalize to the requested
+	// interval.
+	derivatives := [][]interface{}{}
+	for i := 1; i < len(results); i++ {
+		prev := results[i-1]
+		cur := results[i]
+
+		if cur[1] == nil || prev[1] == nil {
+			continue
+		}
+
+		elapsed := cur[0].(time.Time).Sub(prev[0].(time.Time))
+		diff := i64tof64(cur[1]) - i64tof64(prev[1])
+		value := 0.0
+		if elapsed > 0 {
+			value = float64(diff) / (float64(elapsed) / float64(m.derivativeInterval()))
+		}
+
+		// Drop negative values for non-negative derivatives
+		if isNonNegative && diff < 0 {
+			continue
+		}
+
+		val := []interface{}{
+			cur[0],
+			value,
+		}
+		derivatives = append(derivatives, val)
+	}
+
+	return derivatives
+}
+
+// processRawQueryDifference returns the difference of each raw point from the point before it. The
+// first point of the series doesn't have a difference, so it's dropped. prev is the last point of the
+// previous chunk, if any, and the last point of this chunk is returned for the next one.
+func (m *MapReduceJob) processRawQueryDifference(prev *rawQueryMapOutput, values []*rawQueryMapOutput) ([]*rawQueryMapOutput, *rawQueryMapOutput) {
+	if !m.stmt.HasDifference() {
+		return values, prev
+	}
+
+	differences := make([]*rawQueryMapOutput, 0, len(values))
+	for _, v := range values {
+		if prev != nil {
+			differences = append(differences, &rawQueryMapOutput{Time: v.Time, Values: difference(prev.Values, v.Values)})
+		}
+		prev = v
+	}
+	return differences, prev
+}
+
+// processDifference returns the difference of each interval from the interval before it. An
+// interval is only differenced if both it and the interval before it have a value, so intervals
+// filled with null don't return a difference, and neither does the first interval.
+func (m *MapReduceJob) processDifference(results [][]interface{}) [][]interface{} {
+	if !m.stmt.HasDifference() {
+		return results
+	}
+
+	differences := [][]interface{}{}
+	for i := 1; i < len(results); i++ {
+		prev, cur := results[i-1], results[i]
+		if cur[1] == nil || prev[1] == nil {
+			continue
+		}
+		differences = append(differences, []interface{}{cur[0], difference(prev[1], cur[1])})
+	}
+	return differences
+}
+
+// difference returns cur minus prev. The difference of integers is an integer.
+func difference(prev, cur interface{}) interface{} {
+	if p, ok := prev.(int64); ok {
+		if c, ok := cur.(int64); ok {
+			return c - p
+		}
+	}
+	return i64tof64(cur) - i64tof64(prev)
+}
+
+// holtWintersArgs returns the number of points to forecast and the season length of the
+// one (and only) holt_winters func
+func (m *MapReduceJob) holtWintersArgs() (n, season int) {
+	c := m.stmt.FunctionCalls()[0]
+	return int(c.Args[1].(*NumberLiteral).Val), int(c.Args[2].(*NumberLiteral).Val)
+}
+
+// processHoltWinters replaces the results with the values fitted by a Holt-Winters model,
+// followed by the forecasted values. Buckets without a value are skipped when fitting, so
+// the model is only accurate for evenly-spaced series.
+func (m *MapReduceJob) processHoltWinters(results [][]interface{}) ([][]interface{}, error) {
+	// Return early if we're not supposed to forecast
+	if !m.stmt.HasHoltWinters() || len(results) == 0 {
+		return results, nil
+	}
+
+	var times []time.Time
+	var values []float64
+	for _, vals := range results {
+		if vals[1] == nil {
+			continue
+		}
+		times = append(times, vals[0].(time.Time))
+		values = append(values, i64tof64(vals[1]))
+	}
+	if len(values) == 0 {
+		return results, nil
+	}
+
+	n, season := m.holtWintersArgs()
+	fitted, forecast, err := HoltWinters(values, n, season)
+	if err != nil {
+		return nil, err
+	}
+
+	forecasts := make([][]interface{}, 0, len(fitted)+len(forecast))
+	for i, v := range fitted {
+		forecasts = append(forecasts, []interface{}{times[i], v})
+	}
+
+	// forecasted points continue on from the last bucket
+	last := times[len(times)-1]
+	for i, v := range forecast {
+		t := last.Add(time.Duration(int64(i+1) * m.interval))
+		forecasts = append(forecasts, []interface{}{t, v})
+	}
+
+	return forecasts, nil
+}
+
+// processsResults will apply any math that was specified in the select statement against the passed in results
+func (m *MapReduceJob) processResults(results [][]interface{}) [][]interface{} {
+	hasMath := false
+	for _, f := range m.stmt.Fields {
+		if _, ok := f.Expr.(*BinaryExpr); ok {
+			hasMath = true
+		} else if _, ok := f.Expr.(*ParenExpr); ok {
+			hasMath = true
+		}
+	}
+
+	// the arithmetic of raw queries is computed for each point when their rows are created
+	if !hasMath || m.stmt.IsRawQuery {
+		return results
 	}
 
 	processors := make([]processor, len(m.stmt.Fields))
 	startIndex := 1
 	for i, f := range m.stmt.Fields {
-		processors[i], startIndex = getProcessor(f.Expr, startIndex)
+		processors[i], startIndex = getProcessor(f.Expr, startIndex)
+	}
+
+	mathResults := make([][]interface{}, len(results))
+	for i, _ := range mathResults {
+		mathResults[i] = make([]interface{}, len(m.stmt.Fields)+1)
+		// put the time in
+		mathResults[i][0] = results[i][0]
+		for j, p := range processors {
+			mathResults[i][j+1] = p(results[i])
+		}
+	}
+
+	return mathResults
+}
+
+// processFill will take the results and return new reaults (or the same if no fill modifications are needed) with whatever fill options the query has.
+func (m *MapReduceJob) processFill(results [][]interface{}) [][]interface{} {
+	// don't do anything if we're supposed to leave the nulls
+	if m.stmt.Fill == NullFill {
+		return results
+	}
+
+	if m.stmt.Fill == NoFill {
+		// remove any rows that have even one nil value. This one is tricky because they could have multiple
+		// aggregates, but this option means that any row that has even one nil gets purged.
+		newResults := make([][]interface{}, 0, len(results))
+		for _, vals := range results {
+			hasNil := false
+			// start at 1 because the first value is always time
+			for j := 1; j < len(vals); j++ {
+				if vals[j] == nil {
+					hasNil = true
+					break
+				}
+			}
+			if !hasNil {
+				newResults = append(newResults, vals)
+			}
+		}
+		return newResults
+	}
+
+	// they're either filling with previous values or a specific number
+	for i, vals := range results {
+		// start at 1 because the first value is always time
+		for j := 1; j < len(vals); j++ {
+			if vals[j] == nil {
+				switch m.stmt.Fill {
+				case PreviousFill:
+					if i != 0 {
+						vals[j] = results[i-1][j]
+					}
+				case NumberFill:
+					vals[j] = m.stmt.FillValue
+				}
+			}
+		}
+	}
+	return results
+}
+
+func getProcessor(expr Expr, startIndex int) (processor, int) {
+	switch expr := expr.(type) {
+	case *VarRef:
+		return newEchoProcessor(startIndex), startIndex + 1
+	case *Call:
+		return newEchoProcessor(startIndex), startIndex + 1
+	case *BinaryExpr:
+		return getBinaryProcessor(expr, startIndex)
+	case *ParenExpr:
+		return getProcessor(expr.Expr, startIndex)
+	case *NumberLiteral:
+		return newLiteralProcessor(expr.Val), startIndex
+	case *StringLiteral:
+		return newLiteralProcessor(expr.Val), startIndex
+	case *BooleanLiteral:
+		return newLiteralProcessor(expr.Val), startIndex
+	case *TimeLiteral:
+		return newLiteralProcessor(expr.Val), startIndex
+	case *DurationLiteral:
+		return newLiteralProcessor(expr.Val), startIndex
+	}
+	panic("unreachable")
+}
+
+type processor func(values []interface{}) interface{}
+
+func newEchoProcessor(index int) processor {
+	return func(values []interface{}) interface{} {
+		return values[index]
+	}
+}
+
+func newLiteralProcessor(val interface{}) processor {
+	return func(values []interface{}) interface{} {
+		return val
+	}
+}
+
+func getBinaryProcessor(expr *BinaryExpr, startIndex int) (processor, int) {
+	lhs, index := getProcessor(expr.LHS, startIndex)
+	rhs, index := getProcessor(expr.RHS, index)
+
+	return newBinaryExprEvaluator(expr.Op, lhs, rhs), index
+}
+
+func newBinaryExprEvaluator(op Token, lhs, rhs processor) processor {
+	switch op {
+	case ADD:
+		return func(values []interface{}) interface{} {
+			l := lhs(values)
+			r := rhs(values)
+			if lv, ok := l.(float64); ok {
+				if rv, ok := r.(float64); ok {
+					if rv != 0 {
+						return lv + rv
+					}
+				}
+			}
+			return nil
+		}
+	case SUB:
+		return func(values []interface{}) interface{} {
+			l := lhs(values)
+			r := rhs(values)
+			if lv, ok := l.(float64); ok {
+				if rv, ok := r.(float64); ok {
+					if rv != 0 {
+						return lv - rv
+					}
+				}
+			}
+			return nil
+		}
+	case MUL:
+		return func(values []interface{}) interface{} {
+			l := lhs(values)
+			r := rhs(values)
+			if lv, ok := l.(float64); ok {
+				if rv, ok := r.(float64); ok {
+					if rv != 0 {
+						return lv * rv
+					}
+				}
+			}
+			return nil
+		}
+	case DIV:
+		return func(values []interface{}) interface{} {
+			l := lhs(values)
+			r := rhs(values)
+			if lv, ok := l.(float64); ok {
+				if rv, ok := r.(float64); ok {
+					if rv != 0 {
+						return lv / rv
+					}
+				}
+			}
+			return nil
+		}
+	default:
+		// we shouldn't get here, but give them back nils if it goes this way
+		return func(values []interface{}) interface{} {
+			return nil
+		}
+	}
+}
+
+// resultsEmpty will return true if the all the result values are empty or contain only nulls
+func (m *MapReduceJob) resultsEmpty(resultValues [][]interface{}) bool {
+	for _, vals := range resultValues {
+		// start the loop at 1 because we want to skip over the time value
+		for i := 1; i < len(vals); i++ {
+			if vals[i] != nil {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// truncateTime truncates the timestamp to the precision of the query, if one was set.
+// Timestamps are always truncated down, and a GROUP BY interval is required to be a multiple of
+// the precision, so the start of an interval is never moved into another interval.
+func (m *MapReduceJob) truncateTime(t int64) int64 {
+	if m.precision <= 1 {
+		return t
+	}
+	r := t % m.precision
+	if r < 0 {
+		r += m.precision
+	}
+	return t - r
+}
+
+// IntervalTime is the time of a GROUP BY time interval that its values are sent at.
+type IntervalTime int
+
+const (
+	// IntervalStartTime sends the values of an interval at its start.
+	IntervalStartTime IntervalTime = iota
+
+	// IntervalEndTime sends the values of an interval at its end, which is the start of the next.
+	IntervalEndTime
+
+	// IntervalCenterTime sends the values of an interval halfway through it.
+	IntervalCenterTime
+)
+
+// intervalTimeShift returns how far after the start of each interval of the job its values are
+// sent. The window of a query grouped by window() ends with its interval, so it's centered on the
+// middle of the window. Queries with a single interval are sent at its start.
+func (m *MapReduceJob) intervalTimeShift() int64 {
+	if m.intervalTime == IntervalStartTime || m.TMin == 0 {
+		return 0
+	} else if d, _ := m.stmt.GroupByInterval(); d == 0 {
+		return 0
+	}
+
+	switch m.intervalTime {
+	case IntervalEndTime:
+		return m.interval
+	case IntervalCenterTime:
+		size := m.interval
+		if m.windowN > 1 {
+			size *= int64(m.windowN)
+		}
+		return m.interval - size/2
+	}
+	return 0
+}
+
+// emitTimes moves the timestamps in an aggregate row from the start of their intervals to the
+// time they're sent at, and truncates them to the precision of the query.
+func (m *MapReduceJob) emitTimes(row *Row) {
+	if shift := m.intervalTimeShift(); shift != 0 {
+		for _, vals := range row.Values {
+			if t, ok := vals[0].(time.Time); ok {
+				vals[0] = t.Add(time.Duration(shift))
+			}
+		}
+	}
+	m.truncateTimes(row)
+}
+
+// truncateTimes truncates the timestamps in an aggregate row to the precision of the query.
+func (m *MapReduceJob) truncateTimes(row *Row) {
+	if m.precision <= 1 {
+		return
+	}
+	for _, vals := range row.Values {
+		if t, ok := vals[0].(time.Time); ok {
+			vals[0] = time.Unix(0, m.truncateTime(t.UnixNano())).UTC()
+		}
+	}
+}
+
+// processRawResults will handle converting the reduce results from a raw query into a Row
+func (m *MapReduceJob) processRawResults(values []*rawQueryMapOutput) *Row {
+	if m.stmt.HasTransforms() {
+		return m.processTransformResults(values)
+	}
+
+	// the alias of each name is the alias of the field it's selected by, so a field selected
+	// several times has a column under each of its aliases
+	var selectNames, aliases []string
+	for _, f := range m.stmt.Fields {
+		for _, n := range walkNames(f.Expr) {
+			selectNames = append(selectNames, n)
+			aliases = append(aliases, f.Alias)
+		}
+	}
+
+	// ensure that time is in the select names and in the first position
+	hasTime := false
+	for i, n := range selectNames {
+		if n == "time" {
+			// Swap time to the first argument for names
+			if i != 0 {
+				selectNames[0], selectNames[i] = selectNames[i], selectNames[0]
+				aliases[0], aliases[i] = aliases[i], aliases[0]
+			}
+			hasTime = true
+			break
+		}
+	}
+
+	// time should always be in the list of names they get back
+	if !hasTime {
+		selectNames = append([]string{"time"}, selectNames...)
+		aliases = append([]string{""}, aliases...)
+	}
+
+	// since selectNames can contain tags, we need to strip them out
+	selectFields := make([]string, 0, len(selectNames))
+	fieldAliases := make([]string, 0, len(selectNames))
+
+	for i, n := range selectNames {
+		if _, found := m.TagSet.Tags[n]; !found {
+			selectFields = append(selectFields, n)
+			fieldAliases = append(fieldAliases, aliases[i])
+		}
+	}
+
+	row := &Row{
+		Name:    m.MeasurementName,
+		Tags:    m.TagSet.Tags,
+		Columns: rawColumnNames(selectFields, fieldAliases),
+	}
+
+	// return an empty row if there are no results
+	if len(values) == 0 {
+		return row
+	}
+
+	// if they've selected only a single value we have to handle things a little differently
+	singleValue := len(selectFields) == SelectColumnCountWithOneValue
+
+	// the results will have all of the raw mapper results, convert into the row
+	for _, v := range values {
+		vals := make([]interface{}, len(selectFields))
+
+		if singleValue {
+			vals[0] = time.Unix(0, m.truncateTime(v.Time)).UTC()
+			vals[1] = v.Values.(interface{})
+		} else if fields, ok := v.Values.(map[string]interface{}); ok {
+			// time is always the first value
+			vals[0] = time.Unix(0, m.truncateTime(v.Time)).UTC()
+
+			// populate the other values
+			for i := 1; i < len(selectFields); i++ {
+				vals[i] = fields[selectFields[i]]
+			}
+		} else {
+			// a mapper reading a single field selected several times, e.g. under different
+			// aliases, may return its values rather than a map
+			vals[0] = time.Unix(0, m.truncateTime(v.Time)).UTC()
+			for i := 1; i < len(selectFields); i++ {
+				vals[i] = v.Values
+			}
+		}
+
+		row.Values = append(row.Values, vals)
+	}
+
+	return row
+}
+
+// rawShardIDs returns the IDs of the shards the raw mapper outputs were read from, if the
+// job records them.
+func (m *MapReduceJob) rawShardIDs(values []*rawQueryMapOutput) []uint64 {
+	if !m.recordShardIDs || len(values) == 0 {
+		return nil
+	}
+	set := make(map[uint64]bool)
+	for _, v := range values {
+		set[v.shardID] = true
+	}
+	return sortedShardIDs(set)
+}
+
+// sortedShardIDs returns a set of shard IDs in ascending order, or nil if the set is empty.
+func sortedShardIDs(set map[uint64]bool) []uint64 {
+	if len(set) == 0 {
+		return nil
+	}
+	ids := make([]uint64, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Sort(uint64Slice(ids))
+	return ids
+}
+
+// uint64Slice sorts IDs, such as shard IDs, in ascending order.
+type uint64Slice []uint64
+
+func (a uint64Slice) Len() int           { return len(a) }
+func (a uint64Slice) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64Slice) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// rawColumnNames returns the column names of a raw query that selects the given fields, each with
+// the alias at the same position. A field is returned under its alias, if it has one. Time is always
+// the first column and keeps its name.
+func rawColumnNames(selectFields, aliases []string) []string {
+	columns := make([]string, len(selectFields))
+	for i, n := range selectFields {
+		if i > 0 && aliases[i] != "" {
+			columns[i] = aliases[i]
+		} else {
+			columns[i] = n
+		}
+	}
+	return columns
+}
+
+// processTransformResults converts the raw mapper results into a row for a query that computes its
+// fields with scalar functions or arithmetic. There's a column for each field, which holds the value
+// computed from each point, or the field's value if it's selected as it is.
+func (m *MapReduceJob) processTransformResults(values []*rawQueryMapOutput) *Row {
+	row := &Row{
+		Name:    m.MeasurementName,
+		Tags:    m.TagSet.Tags,
+		Columns: []string{"time"},
+	}
+
+	// time is always the first column and tags aren't returned as columns
+	var fields []*Field
+	for _, f := range m.stmt.Fields {
+		if ref, ok := f.Expr.(*VarRef); ok {
+			if _, found := m.TagSet.Tags[ref.Val]; found || ref.Val == "time" {
+				continue
+			}
+		}
+		row.Columns = append(row.Columns, transformColumnName(f))
+		fields = append(fields, f)
+	}
+
+	for _, v := range values {
+		vals := make([]interface{}, 1, len(row.Columns))
+		vals[0] = time.Unix(0, m.truncateTime(v.Time)).UTC()
+
+		for _, f := range fields {
+			vals = append(vals, evalTransform(f.Expr, v))
+		}
+
+		row.Values = append(row.Values, vals)
+	}
+
+	return row
+}
+
+// transformColumnName returns the column name of a field of a query with transforms. Arithmetic
+// without an alias is named after the fields it's computed from, e.g. value_a_value_b.
+func transformColumnName(f *Field) string {
+	if name := f.Name(); name != "" {
+		return name
+	}
+	return strings.Join(walkNames(f.Expr), "_")
+}
+
+// rawFieldValue returns the value of the named field from a raw mapper result. Mappers return
+// the value itself if only one field was selected.
+func rawFieldValue(v *rawQueryMapOutput, name string) interface{} {
+	if fields, ok := v.Values.(map[string]interface{}); ok {
+		return fields[name]
+	}
+	return v.Values
+}
+
+// InitializeMapFunc returns the map function of an aggregate call of the job, or of a raw query if
+// the call is nil. The aggregate is looked up in the aggregates of the planner, so mappers should
+// use it rather than the package function to support user-defined aggregates.
+func (m *MapReduceJob) InitializeMapFunc(c *Call) (MapFunc, error) {
+	fn, err := m.initializeMapFunc(c)
+	if err != nil {
+		return fn, err
+	}
+
+	// pass the points read by the map function to the planner's OnPoint hook
+	if m.onPoint != nil {
+		hook, field, mapFn := m.onPoint, m.pointFieldName(c), fn
+		fn = func(itr Iterator) interface{} {
+			return mapFn(&hookIterator{itr: itr, hook: hook, field: field})
+		}
+	}
+
+	// check the points of aggregates are in the interval being reduced, if the planner's option is set
+	if m.strictIntervals && c != nil {
+		mapFn := fn
+		fn = func(itr Iterator) interface{} {
+			return mapFn(&intervalCheckIterator{itr: itr, job: m})
+		}
+	}
+	return fn, nil
+}
+
+// RollupMapFunc returns a function that computes the output of the map function of c from the
+// rollups of the blocks of points in an interval, so mappers of shards that keep rollups don't have
+// to read the points. It returns nil if the map function must read the points: only the builtin
+// count(), sum(), mean(), min() and max() of a field can be computed from rollups, and not if the
+// points are passed to the OnPoint hook, checked against their intervals, grouped by value_bucket(),
+// skipped if they're non-finite or coerced to another type, or if the statement has the no_rollups
+// hint.
+func (m *MapReduceJob) RollupMapFunc(c *Call) func(rollups []Rollup) interface{} {
+	if c == nil || m.onPoint != nil || m.bucketWidth > 0 || m.SkipNonFinite || m.strictIntervals {
+		return nil
+	} else if m.stmt != nil && m.stmt.Hints.NoRollups {
+		return nil
+	}
+
+	a, call, err := m.lookupAggregate(c)
+	if err != nil || call == nil {
+		return nil
+	} else if _, ok := a.(builtinAggregate); !ok || len(call.Args) != 1 {
+		return nil
+	}
+	ref, ok := call.Args[0].(*VarRef)
+	if !ok {
+		return nil
+	} else if _, ok := m.FieldTypes[ref.Val]; ok {
+		return nil
+	}
+	return rollupMapFuncs[call.Name]
+}
+
+func (m *MapReduceJob) initializeMapFunc(c *Call) (MapFunc, error) {
+	if c == nil {
+		return InitializeMapFunc(c)
+	} else if m.bucketWidth > 0 {
+		return MapValueBuckets(m.bucketWidth), nil
+	}
+
+	a, call, err := m.lookupAggregate(c)
+	if err != nil {
+		return nil, err
+	} else if call == nil {
+		// derivatives and differences of raw values
+		return InitializeMapFunc(c)
+	}
+	return a.MapFunc(call)
+}
+
+// pointFieldName returns the name of the field whose values the mappers of a call return on their
+// own rather than in a map of field values: the field of an aggregate, or the first field selected
+// by a raw query.
+func (m *MapReduceJob) pointFieldName(c *Call) string {
+	if c == nil {
+		for _, n := range m.stmt.NamesInSelect() {
+			if _, ok := m.TagSet.Tags[n]; !ok && n != "time" {
+				return n
+			}
+		}
+		return ""
+	}
+
+	// the field of nested calls like derivative(mean(value), 1d)
+	if len(c.Args) > 0 {
+		if fn, ok := c.Args[0].(*Call); ok {
+			c = fn
+		}
+	}
+	if len(c.Args) > 0 {
+		switch arg := c.Args[0].(type) {
+		case *VarRef:
+			return arg.Val
+		case *Distinct:
+			return arg.Val
+		}
+	}
+	return ""
+}
+
+// pointHook calls the planner's OnPoint hook. It's shared by the jobs of a query, so its calls
+// are serialized even if several mappers are read at once.
+type pointHook struct {
+	mu sync.Mutex
+	fn func(series string, t time.Time, fields map[string]interface{})
+}
+
+// hookIterator wraps an iterator and passes every point it returns to a pointHook.
+type hookIterator struct {
+	itr   Iterator
+	hook  *pointHook
+	field string // the name of the values that aren't a map of field values
+}
+
+func (itr *hookIterator) Next() (seriesKey string, t int64, value interface{}) {
+	seriesKey, t, value = itr.itr.Next()
+	if t == 0 {
+		return
+	}
+
+	fields, ok := value.(map[string]interface{})
+	if !ok {
+		fields = map[string]interface{}{itr.field: value}
+	}
+	itr.hook.mu.Lock()
+	itr.hook.fn(seriesKey, time.Unix(0, t).UTC(), fields)
+	itr.hook.mu.Unlock()
+	return
+}
+
+// intervalCheck is the interval of an aggregate being reduced by a job with the planner's
+// StrictIntervals option, which the points read by its map functions must be in.
+type intervalCheck struct {
+	whole      bool  // true if the aggregates are reduced over the whole time range of the job
+	tmin, tmax int64 // the inclusive bounds of the interval being reduced
+	err        error // the first point read outside the interval being reduced, if any
+}
+
+// ErrMisalignedPoint is returned by queries planned with the StrictIntervals option when a mapper
+// returns a point of a series in the interval of an aggregate that doesn't contain its time.
+func ErrMisalignedPoint(seriesKey string, t, tmin, tmax int64) error {
+	format := func(t int64) string { return time.Unix(0, t).UTC().Format(time.RFC3339Nano) }
+	return fmt.Errorf("point of series %q at %s read in interval %s to %s", seriesKey, format(t), format(tmin), format(tmax))
+}
+
+// begin starts checking the interval that starts at t, which the job reads next.
+func (ic *intervalCheck) begin(m *MapReduceJob, t int64) {
+	if ic.whole {
+		ic.tmin, ic.tmax = m.TMin, m.TMax
+	} else {
+		ic.tmin, ic.tmax = t, t+m.interval-1
+	}
+}
+
+// intervalCheckIterator wraps an iterator and records the first point it returns that isn't in
+// the interval being reduced by its job.
+type intervalCheckIterator struct {
+	itr Iterator
+	job *MapReduceJob
+}
+
+func (itr *intervalCheckIterator) Next() (seriesKey string, t int64, value interface{}) {
+	seriesKey, t, value = itr.itr.Next()
+	if ic := itr.job.intervals; ic != nil && t != 0 && ic.err == nil && (t < ic.tmin || t > ic.tmax) {
+		ic.err = ErrMisalignedPoint(seriesKey, t, ic.tmin, ic.tmax)
+	}
+	return
+}
+
+// initializeReducer returns a function creating the reducers of an aggregate call, one for each
+// interval. Partial aggregates only support the built-in aggregates.
+func (m *MapReduceJob) initializeReducer(c *Call) (func() (Reducer, error), error) {
+	if m.bucketWidth > 0 {
+		return func() (Reducer, error) { return &valueBucketReducer{}, nil }, nil
+	} else if m.partial {
+		fn, err := InitializePartialReduceFunc(c)
+		if err != nil {
+			return nil, err
+		}
+		return func() (Reducer, error) { return &funcReducer{fn: fn}, nil }, nil
+	}
+
+	a, call, err := m.lookupAggregate(c)
+	if err != nil {
+		return nil, err
+	} else if call == nil {
+		return nil, fmt.Errorf("expected function argument to %s", c.Name)
+	}
+	return func() (Reducer, error) { return a.NewReducer(call) }, nil
+}
+
+// lookupAggregate returns the aggregate called by c in the aggregates of the job. concat() is
+// limited to the maximum length of the job, if it's set.
+func (m *MapReduceJob) lookupAggregate(c *Call) (Aggregate, *Call, error) {
+	aggregates := m.aggregates
+	if aggregates == nil {
+		aggregates = builtinAggregates
+	}
+	a, call, err := aggregates.lookup(c)
+	if ca, ok := a.(concatAggregate); ok && m.maxConcatBytes > 0 {
+		ca.maxBytes = m.maxConcatBytes
+		a = ca
+	}
+	return a, call, err
+}
+
+func (m *MapReduceJob) processAggregate(c *Call, newReducer func() (Reducer, error), resultValues [][]interface{}) error {
+	// the intervals are reduced unless the job is in another stage
+	defer m.timer.enter(m.timer.enter(stageReduce))
+
+	if m.windowN > 1 {
+		return m.processWindowAggregate(c, newReducer, resultValues)
+	}
+
+	// intialize the mappers
+	prev := m.timer.enter(stageRead)
+	for _, mm := range m.Mappers {
+		// for aggregate queries, we use the chunk size to determine how many times NextInterval should be called.
+		// This is the number of buckets that we need to fill.
+		if err := mm.Begin(c, m.TMin, len(resultValues)); err != nil {
+			return err
+		}
+	}
+	m.timer.enter(prev)
+	m.beginSortedIntervals()
+
+	// populate the result values for each interval of time
+	for i, _ := range resultValues {
+		r, err := newReducer()
+		if err != nil {
+			return err
+		}
+
+		if err := m.reduceInterval(c, r, i, len(resultValues), resultValues[i][0].(time.Time).UnixNano(), m.contributors); err != nil {
+			return err
+		}
+		v, err := finalize(r)
+		if err != nil {
+			return err
+		}
+		resultValues[i] = append(resultValues[i], v)
+	}
+
+	return nil
+}
+
+// beginSortedIntervals clears the outputs read ahead by the mappers of the previous aggregate, if
+// the job sorts them.
+func (m *MapReduceJob) beginSortedIntervals() {
+	if m.outOfOrder == OutOfOrderSort {
+		m.sortedIntervals = make([]intervalReadahead, len(m.Mappers))
+	}
+}
+
+// finalize returns the value of the aggregate of an interval reduced by r, or the error of a
+// reducer that failed.
+func finalize(r Reducer) (interface{}, error) {
+	v := r.Finalize()
+	if r, ok := r.(FallibleReducer); ok && r.Err() != nil {
+		return nil, r.Err()
+	}
+	return v, nil
+}
+
+// processWindowAggregate populates the values of an aggregate of a query grouped by window() with
+// the aggregate of the window ending with each interval. The mappers begin at the start of the
+// window of the first interval, so each interval is read once, and the outputs of the mappers for
+// the last windowN intervals are kept in a ring. The outputs of an interval are then combined into
+// the window of each of the windowN intervals ending with it.
+func (m *MapReduceJob) processWindowAggregate(c *Call, newReducer func() (Reducer, error), resultValues [][]interface{}) error {
+	if len(resultValues) == 0 {
+		return nil
+	}
+
+	// the intervals from the start of the first window to the last interval
+	first := resultValues[0][0].(time.Time).UnixNano()
+	last := resultValues[len(resultValues)-1][0].(time.Time).UnixNano()
+	start := first - int64(m.windowN-1)*m.interval
+	n := int((last-start)/m.interval) + 1
+
+	prev := m.timer.enter(stageRead)
+	for _, mm := range m.Mappers {
+		if err := mm.Begin(c, start, n); err != nil {
+			return err
+		}
+	}
+	m.timer.enter(prev)
+	m.beginSortedIntervals()
+
+	ring := make([]intervalOutputs, m.windowN)
+	for i, k := 0, 0; i < n && k < len(resultValues); i++ {
+		t := start + int64(i)*m.interval
+		outputs := &ring[i%m.windowN]
+		outputs.values = outputs.values[:0]
+		if err := m.reduceInterval(c, outputs, i, n, t, m.contributors); err != nil {
+			return err
+		}
+
+		if t != resultValues[k][0].(time.Time).UnixNano() {
+			continue
+		}
+		r, err := newReducer()
+		if err != nil {
+			return err
+		}
+		for _, o := range ring {
+			for _, v := range o.values {
+				r.Combine(v)
+			}
+		}
+		v, err := finalize(r)
+		if err != nil {
+			return err
+		}
+		resultValues[k] = append(resultValues[k], v)
+		k++
+	}
+	return nil
+}
+
+// intervalOutputs is a reducer that keeps the outputs of the mappers for an interval, so they can
+// be combined into the windows of several intervals.
+type intervalOutputs struct {
+	values []interface{}
+}
+
+func (o *intervalOutputs) Combine(partial interface{}) { o.values = append(o.values, partial) }
+func (o *intervalOutputs) Finalize() interface{}       { return o.values }
+
+// reduceInterval combines the outputs of every mapper for the interval at index i of n, which
+// starts at time t, with r. The shards whose mappers return data are added to contributors, if set.
+// It returns ErrQueryKilled once the executor of the job is killed.
+func (m *MapReduceJob) reduceInterval(c *Call, r Reducer, i, n int, t int64, contributors map[uint64]bool) error {
+	if m.kill.killed() {
+		return ErrQueryKilled
+	}
+	if m.intervals != nil {
+		m.intervals.begin(m, t)
+	}
+	for j := range m.Mappers {
+		res, err := m.nextAggregateInterval(c, j, i, n, t)
+		if err != nil {
+			return err
+		} else if m.intervals != nil && m.intervals.err != nil {
+			return m.intervals.err
+		}
+		if res != nil && contributors != nil {
+			contributors[m.Mappers[j].ShardID()] = true
+		}
+		r.Combine(res)
+	}
+	m.progress.advance(1, 0)
+	return nil
+}
+
+// nextAggregateInterval returns the output of the mapper at index j for the interval at index i of
+// n, which starts at t. The outputs of mappers that report their interval with IntervalTimer must
+// be for the interval at t, or the interval fails with ErrIntervalOutOfOrder, unless the job sorts
+// the outputs of its mappers, in which case the outputs read ahead of t are kept until their
+// interval is reduced.
+func (m *MapReduceJob) nextAggregateInterval(c *Call, j, i, n int, t int64) (interface{}, error) {
+	if _, ok := m.Mappers[j].(IntervalTimer); !ok || n == 1 {
+		return m.readAggregateInterval(c, j, i, n, t)
+	}
+
+	want := IntervalStart(t, m.interval, m.offset)
+	if m.outOfOrder != OutOfOrderSort {
+		res, err := m.readAggregateInterval(c, j, i, n, t)
+		if err != nil || res == nil {
+			return res, err
+		} else if got, ok := m.mapperIntervalTime(j); ok && got != want {
+			return nil, ErrIntervalOutOfOrder(m.Mappers[j].ShardID(), got, want)
+		}
+		return res, nil
+	}
+
+	b := &m.sortedIntervals[j]
+	if res, ok := b.outputs[want]; ok {
+		delete(b.outputs, want)
+		return res, nil
+	}
+	for b.read < n {
+		res, err := m.readAggregateInterval(c, j, i, n, t)
+		if err != nil {
+			return nil, err
+		}
+		b.read++
+		if res == nil {
+			continue
+		}
+
+		got, ok := m.mapperIntervalTime(j)
+		if !ok || got == want {
+			return res, nil
+		} else if _, ok := b.outputs[got]; ok || got < want {
+			// the interval was read before, or was already reduced without it
+			return nil, ErrIntervalOutOfOrder(m.Mappers[j].ShardID(), got, want)
+		}
+		if b.outputs == nil {
+			b.outputs = make(map[int64]interface{})
+		}
+		b.outputs[got] = res
+	}
+	return nil, nil
+}
+
+// mapperIntervalTime returns the start of the interval of the output the mapper at index j last
+// returned, or false if the mapper doesn't report it.
+func (m *MapReduceJob) mapperIntervalTime(j int) (int64, bool) {
+	it, ok := m.Mappers[j].(IntervalTimer)
+	if !ok {
+		return 0, false
+	}
+	t, ok := it.IntervalTime()
+	if !ok {
+		return 0, false
+	}
+	return IntervalStart(t, m.interval, m.offset), true
+}
+
+// readAggregateInterval reads the output of the mapper at index j for the interval at index i of n,
+// which starts at t, remapping or retrying the mapper if needed.
+func (m *MapReduceJob) readAggregateInterval(c *Call, j, i, n int, t int64) (interface{}, error) {
+	defer m.timer.enter(m.timer.enter(stageRead))
+
+	res, err := m.Mappers[j].NextInterval()
+	for attempt := 0; err == ErrShardMoved || (err != nil && m.canRetry(j, err, attempt)); {
+		// resume the new mapper, or read the mapper again, at the start of this interval. The
+		// first interval of a window query starts before the time range of the query.
+		startingTime := m.TMin
+		if i > 0 || m.windowN > 1 {
+			startingTime = t
+		}
+		if err == ErrShardMoved {
+			err = m.remap(j, c, startingTime, n-i)
+		} else {
+			err = m.retry(j, attempt, startingTime)
+			attempt++
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the intervals read ahead are read again
+		if m.sortedIntervals != nil {
+			m.sortedIntervals[j] = intervalReadahead{read: i}
+		}
+		res, err = m.Mappers[j].NextInterval()
+	}
+	return res, err
+}
+
+// intervalReadahead holds the outputs of a mapper of an aggregate whose job sorts them, which
+// were read ahead of the interval being reduced.
+type intervalReadahead struct {
+	outputs map[int64]interface{} // the outputs that haven't been reduced yet, by the start of their interval
+	read    int                   // the number of intervals read since the mapper was begun
+}
+
+// ErrIntervalOutOfOrder is returned when a mapper of an aggregate returns the interval starting at
+// t while the one starting at want is reduced, and the interval can't be reduced in time order.
+func ErrIntervalOutOfOrder(shardID uint64, t, want int64) error {
+	return fmt.Errorf("mapper of shard %d returned the interval at %s while reading the one at %s, out of time order",
+		shardID, time.Unix(0, t).UTC().Format(time.RFC3339Nano), time.Unix(0, want).UTC().Format(time.RFC3339Nano))
+}
+
+// intervalBudget returns the most intervals of a series an aggregate query reduces at once, unless
+// they're streamed.
+func (m *MapReduceJob) intervalBudget() int {
+	if m.maxIntervals > 0 {
+		return m.maxIntervals
+	}
+	return MaxGroupByPoints
+}
+
+// progressIntervals returns the number of intervals the job reduces, one for each aggregate in
+// each interval of its time range, for the progress of its query. Raw queries don't have any.
+func (m *MapReduceJob) progressIntervals() int {
+	if m.stmt.IsRawQuery || m.stmt.IsSimpleDerivative() || m.stmt.IsSimpleDifference() {
+		return 0
+	}
+
+	n := 1
+	if m.TMin != 0 && m.interval > 0 {
+		n = int((IntervalStart(m.TMax, m.interval, m.offset) + m.interval - IntervalStart(m.TMin, m.interval, m.offset)) / m.interval)
+		if n < 1 {
+			n = 1
+		} else if budget := m.intervalBudget(); n > budget {
+			n = budget
+		}
+	}
+
+	// window queries also read the intervals before their time range that their first windows start with
+	if m.windowN > 1 {
+		n += m.windowN - 1
+	}
+	return n * len(m.stmt.FunctionCalls())
+}
+
+// trimPartialIntervals narrows the time range of the job to the GROUP BY time intervals it covers
+// completely, so the intervals at its edges that are cut by the time range aren't reduced. The range
+// is empty if it doesn't cover any interval completely.
+func (m *MapReduceJob) trimPartialIntervals() {
+	if start := IntervalStart(m.TMin, m.interval, m.offset); start < m.TMin {
+		m.TMin = start + m.interval
+	}
+
+	// The upper bound is inclusive, so a range ending a nanosecond before the end of an interval
+	// completes it.
+	if end := IntervalStart(m.TMax+1, m.interval, m.offset); end <= m.TMax {
+		m.TMax = end - 1
+	}
+}
+
+// canStreamAggregates returns true if the intervals of the aggregate query can be sent as they're
+// completed. The mappers run a single aggregate at a time, so only queries with one aggregate are
+// streamed. Derivatives, differences and forecasts depend on the intervals around them, so those
+// queries are reduced in full first, as are queries sorted by descending time.
+func (m *MapReduceJob) canStreamAggregates(aggregates []*Call) bool {
+	return m.streamAggregates && m.chunkSize > 0 && m.interval > 0 && m.TMin != 0 && m.bucketWidth == 0 && m.windowN <= 1 &&
+		len(aggregates) == 1 && !m.partial && m.stmt.Offset == 0 && m.stmt.TimeAscending() &&
+		!m.stmt.HasDerivative() && !m.stmt.HasDifference() && !m.stmt.HasHoltWinters()
+}
+
+// streamAggregate reduces the intervals of an aggregate query grouped by time one at a time, and
+// sends them in rows of up to the chunk size of the job as soon as they're complete, rather than
+// once every interval is reduced. The mappers return their intervals in time order, so an interval
+// is complete once every mapper has returned it. Only the intervals of the row being filled are
+// held in memory, so such queries aren't limited to MaxGroupByPoints intervals.
+func (m *MapReduceJob) streamAggregate(out chan *Row, c *Call, newReducer func() (Reducer, error), filterEmptyResults bool) {
+	start := IntervalStart(m.TMin, m.interval, m.offset)
+	n := int((IntervalStart(m.TMax, m.interval, m.offset) + m.interval - start) / m.interval)
+	if m.stmt.Limit > 0 && m.stmt.Limit < n {
+		n = m.stmt.Limit
+	}
+
+	columnNames := make([]string, len(m.stmt.Fields)+1)
+	columnNames[0] = "time"
+	for i, f := range m.stmt.Fields {
+		columnNames[i+1] = f.Name()
+	}
+
+	// the intervals are reduced unless the job is in another stage
+	defer m.timer.enter(m.timer.enter(stageReduce))
+
+	was := m.timer.enter(stageRead)
+	for _, mm := range m.Mappers {
+		if err := mm.Begin(c, m.TMin, n); err != nil {
+			out <- &Row{Err: err}
+			return
+		}
+	}
+	m.timer.enter(was)
+	if m.recordShardIDs {
+		m.contributors = make(map[uint64]bool)
+	}
+
+	// the last row sent, which intervals are filled from with fill(previous)
+	var prev []interface{}
+	send := func(values [][]interface{}, partial bool) {
+		defer m.timer.enter(m.timer.enter(stageTransform))
+
+		if len(values) > 0 {
+			values = m.processResults(values)
+			if m.stmt.Fill == PreviousFill && prev != nil {
+				values = m.processFill(append([][]interface{}{prev}, values...))[1:]
+			} else {
+				values = m.processFill(values)
+			}
+		}
+		if len(values) == 0 && !partial {
+			return
+		} else if len(values) > 0 {
+			prev = values[len(values)-1]
+		}
+
+		row := &Row{
+			Name:     m.MeasurementName,
+			Tags:     m.TagSet.Tags,
+			Columns:  columnNames,
+			Values:   values,
+			ShardIDs: sortedShardIDs(m.contributors),
+			Partial:  partial,
+		}
+		m.emitTimes(row)
+		m.send(out, row)
+
+		if m.contributors != nil {
+			m.contributors = make(map[uint64]bool)
+		}
+	}
+
+	// the intervals every mapper has passed, which are complete
+	var watermark int
+	// the complete intervals that haven't been sent, starting at the interval at index sent
+	var values [][]interface{}
+	var sent int
+	// if empty series are filtered, the intervals are held back until one has a value
+	held := filterEmptyResults
+	// the soft deadline is only handled by the series being reduced when it passes
+	deadline := m.deadline
+	if deadline != nil && deadline.passed() {
+		deadline = nil
+	}
+	for i := 0; i < n; i++ {
+		t := start + int64(i)*m.interval
+		if t > m.TMax {
+			break
+		}
+
+		r, err := newReducer()
+		if err != nil {
+			out <- &Row{Name: m.MeasurementName, Tags: m.TagSet.Tags, Err: err}
+			return
+		}
+
+		// the shards that contribute to the interval, added to those of the row once it's complete
+		var ids map[uint64]bool
+		if m.contributors != nil {
+			ids = make(map[uint64]bool)
+		}
+		if deadline == nil {
+			err = m.reduceInterval(c, r, i, n, t, ids)
+		} else {
+			// reduce the interval in the background, so the complete intervals are sent at the
+			// deadline even if a mapper is slow to return this one
+			done := make(chan error, 1)
+			go func() {
+				var err error
+				defer func() { done <- err }()
+				defer m.recoverPanic(&err)
+				err = m.reduceInterval(c, r, i, n, t, ids)
+			}()
+			select {
+			case err = <-done:
+			case <-deadline.C:
+				send(values, true)
+				if !held {
+					sent, values = watermark, nil
+				}
+
+				// the mappers can't be closed until the interval is reduced
+				err = <-done
+				if deadline.abort {
+					return
+				}
+				deadline = nil
+			}
+		}
+		if err == ErrQueryKilled {
+			return
+		} else if err != nil {
+			out <- &Row{Name: m.MeasurementName, Tags: m.TagSet.Tags, Err: err}
+			return
+		}
+		for id := range ids {
+			m.contributors[id] = true
+		}
+		watermark = i + 1
+
+		v, err := finalize(r)
+		if err != nil {
+			out <- &Row{Name: m.MeasurementName, Tags: m.TagSet.Tags, Err: err}
+			return
+		}
+		if held {
+			if v == nil {
+				continue
+			}
+
+			// send the empty intervals held back before this one
+			held = false
+			for ; sent < i; sent += len(values) {
+				values = nil
+				for k := sent; k < i && len(values) < m.chunkSize; k++ {
+					values = append(values, []interface{}{time.Unix(0, start+int64(k)*m.interval).UTC(), nil})
+				}
+				send(values, false)
+			}
+			values = nil
+		}
+
+		values = append(values, []interface{}{time.Unix(0, t).UTC(), v})
+		if watermark-sent >= m.chunkSize {
+			send(values, false)
+			sent, values = watermark, nil
+		}
+	}
+
+	if len(values) > 0 {
+		send(values, false)
+	}
+}
+
+// softDeadline is the soft deadline of a query. C is closed once it passes.
+type softDeadline struct {
+	C     chan struct{}
+	abort bool // if true, the series being reduced when it passes is cut off, and those after it aren't executed
+	timer *time.Timer
+}
+
+// newSoftDeadline returns a deadline that passes after d.
+func newSoftDeadline(d time.Duration, abort bool) *softDeadline {
+	dl := &softDeadline{C: make(chan struct{}), abort: abort}
+	dl.timer = time.AfterFunc(d, func() { close(dl.C) })
+	return dl
+}
+
+// passed returns true if the deadline has passed.
+func (d *softDeadline) passed() bool {
+	select {
+	case <-d.C:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops the timer of the deadline.
+func (d *softDeadline) stop() { d.timer.Stop() }
+
+// ErrQueryKilled is sent once the jobs of a killed executor have stopped.
+var ErrQueryKilled = errors.New("query killed")
+
+// ErrSoftDeadline is returned by a read that was waiting to be retried when a soft deadline that
+// aborts the query passed.
+var ErrSoftDeadline = errors.New("soft deadline passed")
+
+// killSwitch stops the jobs of an executor when it's killed. It's only killed while the executor
+// runs, so every kill is reported with ErrQueryKilled. The executor can also stop its own jobs once
+// it has sent every row it will, which isn't reported.
+type killSwitch struct {
+	mu       sync.Mutex
+	started  bool          // true once the executor has started running
+	done     bool          // true once the executor has finished running
+	isKilled int32         // killRunning, killKilled or killStopped, set atomically, as it's checked by jobs reading in the background
+	c        chan struct{} // if set, closed once the jobs must stop
+}
+
+// The states of a killSwitch.
+const (
+	killRunning int32 = iota
+	killKilled
+	killStopped
+)
+
+// kill kills the executor if it's running and wasn't killed yet, and returns true if it was.
+func (k *killSwitch) kill() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.started || k.done || k.killed() {
+		return false
+	}
+	atomic.StoreInt32(&k.isKilled, killKilled)
+	if k.c != nil {
+		close(k.c)
+	}
+	return true
+}
+
+// stop stops the jobs like kill, but without reporting ErrQueryKilled, e.g. once the response of
+// the executor is cut off. An executor that's stopped can't be killed anymore.
+func (k *killSwitch) stop() {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if atomic.CompareAndSwapInt32(&k.isKilled, killRunning, killStopped) && k.c != nil {
+		close(k.c)
+	}
+}
+
+// killed returns true if the jobs of the executor must stop, because it was killed or stopped.
+func (k *killSwitch) killed() bool {
+	return k != nil && atomic.LoadInt32(&k.isKilled) != killRunning
+}
+
+// stopped returns a channel that's closed once the jobs of the executor must stop, like killed.
+// A nil kill switch returns a nil channel, which is never closed.
+func (k *killSwitch) stopped() <-chan struct{} {
+	if k == nil {
+		return nil
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.c == nil {
+		k.c = make(chan struct{})
+		if k.killed() {
+			close(k.c)
+		}
+	}
+	return k.c
+}
+
+// start marks the executor as running.
+func (k *killSwitch) start() {
+	if k != nil {
+		k.mu.Lock()
+		k.started = true
+		k.mu.Unlock()
+	}
+}
+
+// finish marks the executor as finished, so it can't be killed anymore, and returns true if it
+// was killed.
+func (k *killSwitch) finish() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.done = true
+	return atomic.LoadInt32(&k.isKilled) == killKilled
+}
+
+// QueryRegistry tracks the executors that are running, so they can be killed together, e.g. to
+// relieve an overloaded node. Executors planned by a planner with a registry are registered while
+// they run. It's safe for concurrent use.
+type QueryRegistry struct {
+	mu        sync.Mutex
+	executors map[*Executor]struct{}
+}
+
+// NewQueryRegistry returns an empty registry.
+func NewQueryRegistry() *QueryRegistry {
+	return &QueryRegistry{executors: make(map[*Executor]struct{})}
+}
+
+// add registers an executor that's starting to run.
+func (r *QueryRegistry) add(e *Executor) {
+	e.kill.start()
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.executors[e] = struct{}{}
+	r.mu.Unlock()
+}
+
+// remove removes an executor once it has finished running.
+func (r *QueryRegistry) remove(e *Executor) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.executors, e)
+	r.mu.Unlock()
+}
+
+// Len returns the number of executors running. A nil registry has none.
+func (r *QueryRegistry) Len() int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.executors)
+}
+
+// KillAll kills every executor that's running and returns the number killed. Executors that
+// finish or are killed by another call while it runs aren't counted, and those that start while
+// it runs may or may not be killed.
+func (r *QueryRegistry) KillAll() int {
+	r.mu.Lock()
+	executors := make([]*Executor, 0, len(r.executors))
+	for e := range r.executors {
+		executors = append(executors, e)
+	}
+	r.mu.Unlock()
+
+	var n int
+	for _, e := range executors {
+		if e.Kill() {
+			n++
+		}
+	}
+	return n
+}
+
+type MapReduceJobs []*MapReduceJob
+
+func (a MapReduceJobs) Len() int           { return len(a) }
+func (a MapReduceJobs) Less(i, j int) bool { return bytes.Compare(a[i].Key(), a[j].Key()) == -1 }
+func (a MapReduceJobs) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// ErrTagSetOrder is returned by queries planned with the StrictTagSetOrder option when the tag set
+// of a job comes before the one of the job preceding it.
+func ErrTagSetOrder(key, prev []byte) error {
+	return fmt.Errorf("tag set out of order: %q after %q", key, prev)
+}
+
+// checkTagSetOrder returns ErrTagSetOrder if the jobs aren't in ascending order of their keys.
+func checkTagSetOrder(jobs []*MapReduceJob) error {
+	for i := 1; i < len(jobs); i++ {
+		if bytes.Compare(jobs[i].Key(), jobs[i-1].Key()) == -1 {
+			return ErrTagSetOrder(jobs[i].Key(), jobs[i-1].Key())
+		}
+	}
+	return nil
+}
+
+// Mapper will run through a map function. A single mapper will be created
+// for each shard for each tagset that must be hit to satisfy a query.
+// Mappers can either point to a local shard or could point to a remote server.
+// The mappers of a query are grouped into jobs by tag set, in ascending order
+// of their keys (see Tx), and the rows of each tag set are sent in that order.
+type Mapper interface {
+	// Open will open the necessary resources to being the map job. Could be connections to remote servers or
+	// hitting the local bolt store
+	Open() error
+
+	// Close will close the mapper (either the bolt transaction or the request)
+	Close()
+
+	// Begin will set up the mapper to run the map function for a given aggregate call starting at the passed in time.
+	// For raw data queries it will yield to the mapper no more than limit number of points.
+	Begin(aggregate *Call, startingTime int64, limit int) error
+
+	// NextInterval will get the time ordered next interval of the given interval size from the mapper. This is a
+	// forward only operation from the start time passed into Begin. Will return nil when there is no more data to be read.
+	// Interval periods can be different based on time boundaries (months, daylight savings, etc) of the query.
+	NextInterval() (interface{}, error)
+
+	// ShardID returns the ID of the shard the mapper reads from, whether it's local or remote.
+	ShardID() uint64
+}
+
+// Mappers represents a list of mappers that can be sorted by shard ID.
+type Mappers []Mapper
+
+func (a Mappers) Len() int           { return len(a) }
+func (a Mappers) Less(i, j int) bool { return a[i].ShardID() < a[j].ShardID() }
+func (a Mappers) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// NonFiniteCounter is implemented by mappers that skip NaN and infinite float values when the
+// SkipNonFinite option of their job is set.
+type NonFiniteCounter interface {
+	// SkippedN returns the number of values skipped.
+	SkippedN() int
+}
+
+// Canceler is implemented by mappers whose reads can be cancelled while they're in progress, e.g.
+// mappers that fetch their points from a remote node. Cancel may be called while NextInterval is
+// running in another goroutine, which should then return promptly. The mapper is closed afterwards.
+type Canceler interface {
+	Cancel()
+}
+
+// ErrShardMoved is returned by a mapper when the shard it reads from has moved to another node.
+var ErrShardMoved = errors.New("shard moved")
+
+// ErrShardNotFound is returned by a mapper when its shard no longer exists, e.g. because it was
+// dropped after the meta store returned it to the query.
+var ErrShardNotFound = errors.New("shard not found")
+
+// ErrQueryPanic is returned when the execution of a series panics, e.g. because of a bug in a mapper.
+// The mappers of the series are closed and the series fails with the error, rather than the panic
+// crashing the process.
+func ErrQueryPanic(v interface{}) error {
+	return fmt.Errorf("panic executing query: %v", v)
+}
+
+// ErrShardBusy is returned when a mapper isn't opened within the open timeout of its query.
+func ErrShardBusy(shardID uint64, timeout time.Duration) error {
+	return fmt.Errorf("shard busy: shard %d wasn't opened within %s", shardID, timeout)
+}
+
+// MaxRemapN is the maximum number of mappers that are re-created per job after their shard moved.
+const MaxRemapN = 3
+
+// Remapper is implemented by mappers whose shard can move to another node while a query is
+// running, such as mappers reading from a remote shard. When NextInterval returns ErrShardMoved,
+// Remap is called to resolve the new owner of the shard and return a new mapper for it.
+//
+// The new mapper is opened and then begun at a checkpoint. For raw queries the checkpoint is the
+// time of the last point read from the old mapper, and points at that time which were already
+// read are skipped. For aggregate queries it's the start of the interval that failed. Mappers
+// must therefore support beginning at any time within the query's time range, and must return
+// points with the same timestamp in the same order every time they're read.
+type Remapper interface {
+	Remap() (Mapper, error)
+}
+
+// IntervalTimer is implemented by mappers of aggregates that report which interval they returned,
+// such as mappers reading from a remote node, so the job can check it reduces them in time order.
+//
+// Mappers that wrap another mapper forward the interval times of the mapper, or return false if it
+// doesn't report them. A PartialMapper reports the times of the partials returned by its node.
+type IntervalTimer interface {
+	// IntervalTime returns the time of the interval of the non-nil output NextInterval last
+	// returned, which may be any time in the interval, or false if it isn't known.
+	IntervalTime() (int64, bool)
+}
+
+// IntervalSeeker is implemented by mappers that can be read again from an earlier time, such as
+// mappers reading from a remote node, so a read that failed with a transient error can be retried.
+// SeekInterval positions the mapper as if it had been begun at the passed in time: the next call to
+// NextInterval returns the points of a raw query from that time, or the interval of an aggregate
+// starting at it. Like remapped mappers, they must return points with the same timestamp in the
+// same order every time they're read.
+type IntervalSeeker interface {
+	SeekInterval(startingTime int64) error
+}
+
+// IsTransient returns true if err is a transient error after which a read may succeed if it's
+// retried, such as a network timeout or a connection reset by the other node. Errors can also be
+// marked as transient by implementing a Transient method that returns true.
+func IsTransient(err error) bool {
+	switch err := err.(type) {
+	case interface {
+		Transient() bool
+	}:
+		return err.Transient()
+	case *net.OpError:
+		if err.Timeout() || err.Temporary() {
+			return true
+		}
+		if se, ok := err.Err.(*os.SyscallError); ok {
+			return se.Err == syscall.ECONNRESET
+		}
+		return err.Err == syscall.ECONNRESET
+	case net.Error:
+		return err.Timeout()
+	}
+	return false
+}
+
+// PointEstimator is implemented by mappers that can cheaply estimate the number of points they
+// will read, e.g. from the metadata of the underlying store.
+type PointEstimator interface {
+	// EstimatedPointN returns the approximate number of points held by the mapper.
+	EstimatedPointN() int
+}
+
+// ChunkSizeFunc returns the chunk size a mapper should use for a raw query, given the chunk
+// size requested for the query and the estimated number of points held by the mapper.
+type ChunkSizeFunc func(chunkSize, pointN int) int
+
+const (
+	// AdaptiveChunkTarget is the number of chunks AdaptiveChunkSize aims to split a mapper's points into.
+	AdaptiveChunkTarget = 100
+
+	// AdaptiveChunkScale is the factor by which AdaptiveChunkSize may shrink or grow the requested chunk size.
+	AdaptiveChunkScale = 4
+)
+
+// AdaptiveChunkSize is the default ChunkSizeFunc. It aims to read AdaptiveChunkTarget chunks
+// from each mapper, without moving more than AdaptiveChunkScale times away from the requested
+// chunk size. Small mappers never get a chunk size larger than the number of points they hold.
+func AdaptiveChunkSize(chunkSize, pointN int) int {
+	n := pointN / AdaptiveChunkTarget
+	if min := chunkSize / AdaptiveChunkScale; n < min {
+		n = min
+	}
+	if max := chunkSize * AdaptiveChunkScale; n > max {
+		n = max
+	}
+	if pointN > 0 && n > pointN {
+		n = pointN
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+type TagSet struct {
+	Tags       map[string]string
+	Filters    []Expr
+	SeriesKeys []string
+	Key        []byte
+}
+
+func (t *TagSet) AddFilter(key string, filter Expr) {
+	t.SeriesKeys = append(t.SeriesKeys, key)
+	t.Filters = append(t.Filters, filter)
+}
+
+// EncodeTagSet returns the canonical encoding of a tag set. It's used for the keys of tag sets
+// everywhere, so the same tags always produce the same key whatever the order of the map. The
+// sorted keys are followed by their values, all separated by '|', and any '|' or '\' in a key or
+// value is escaped with a backslash. For example, {"region": "us|west", "host": "a"} is encoded
+// as `host|region|a|us\|west`.
+func EncodeTagSet(tags map[string]string) string {
+	return string(AppendTagSet(nil, tags))
+}
+
+// AppendTagSet appends the canonical encoding of a tag set to dst and returns the extended buffer.
+func AppendTagSet(dst []byte, tags map[string]string) []byte {
+	if len(tags) == 0 {
+		return dst
+	}
+
+	// Sort the keys and determine the unescaped size.
+	sz := (len(tags) * 2) - 1 // separators
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		keys = append(keys, k)
+		sz += len(k) + len(v)
+	}
+	sort.Strings(keys)
+
+	if cap(dst)-len(dst) < sz {
+		b := make([]byte, len(dst), len(dst)+sz)
+		copy(b, dst)
+		dst = b
+	}
+	for i, k := range keys {
+		if i > 0 {
+			dst = append(dst, '|')
+		}
+		dst = appendTagSetEscaped(dst, k)
+	}
+	for _, k := range keys {
+		dst = append(dst, '|')
+		dst = appendTagSetEscaped(dst, tags[k])
+	}
+	return dst
+}
+
+// appendTagSetEscaped appends s to dst, escaping the separators of a tag set key.
+func appendTagSetEscaped(dst []byte, s string) []byte {
+	if strings.IndexAny(s, `|\`) == -1 {
+		return append(dst, s...)
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '|' || c == '\\' {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, s[i])
+	}
+	return dst
+}
+
+// ValidateAggregateFields returns an error if stmt selects a field outside a function call
+// alongside an aggregate. Aggregates return a single value per interval, so there's no raw value to
+// go alongside them, but tags can be selected with them. isField returns true if a name is a field
+// rather than a tag of the measurement being read. Transactions call it when they create the jobs
+// of each measurement, before any mappers are opened.
+func ValidateAggregateFields(stmt *SelectStatement, isField func(name string) bool) error {
+	calls := stmt.FunctionCalls()
+	if len(calls) == 0 {
+		return nil
+	}
+
+	for _, n := range stmt.NamesOutsideFunctionCalls() {
+		if isField(n) {
+			return fmt.Errorf("cannot select field %q alongside aggregate function %q; mixing raw fields and aggregates is not supported", n, calls[0].Name)
+		}
+	}
+	return nil
+}
+
+// validatePartialAggregates returns an error if a field of stmt can't return a partial state.
+func validatePartialAggregates(stmt *SelectStatement) error {
+	for _, f := range stmt.Fields {
+		c, ok := f.Expr.(*Call)
+		if !ok {
+			return fmt.Errorf("partial aggregates aren't supported for %s", f.Expr)
+		} else if _, err := InitializePartialReduceFunc(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alignGroupByOffset returns a copy of stmt whose GROUP BY offset has the offset of origin from the
+// Unix epoch added to it. The statement is returned as is if it isn't grouped by time, and is never
+// modified, so planning it again aligns it once.
+func alignGroupByOffset(stmt *SelectStatement, origin time.Time) (*SelectStatement, error) {
+	interval, err := stmt.GroupByInterval()
+	if err != nil || interval == 0 {
+		return stmt, err
+	}
+	offset, err := stmt.GroupByOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	offset = (time.Duration(origin.UnixNano()%int64(interval)) + offset) % interval
+	if offset < 0 {
+		offset += interval
+	}
+	other := stmt.Clone()
+	other.SetGroupByOffset(offset)
+	return other, nil
+}
+
+// IntervalStart returns the start of the GROUP BY interval that contains t. Intervals start on
+// the offset plus a multiple of the interval.
+func IntervalStart(t, interval, offset int64) int64 {
+	start := (t-offset)/interval*interval + offset
+	if start > t {
+		// division truncates towards zero, so times before the offset round up
+		start -= interval
+	}
+	return start
+}
+
+// ErrSeriesKeysNotSupported is returned when a job is restricted to a set of series keys but one
+// of its mappers can't read individual series.
+var ErrSeriesKeysNotSupported = errors.New("mapper doesn't support reading series by key")
+
+// SeriesKeyMapper is implemented by mappers that can read a subset of their series, e.g. to fetch
+// the raw data of series selected by an earlier query. SetSeriesKeys is called after Open and
+// before Begin. Begin then only seeks the given series, so NextInterval only returns their points.
+// Keys that aren't read by the mapper are ignored, and the keys apply to every subsequent call
+// to Begin.
+type SeriesKeyMapper interface {
+	Mapper
+	SetSeriesKeys(keys []string) error
+}
+
+// ErrExecuted is returned when an executor is executed again without being reset.
+var ErrExecuted = errors.New("executor has already been executed")
+
+// ErrResetNotSupported is returned by Executor.Reset when the transaction or one of the mappers
+// of the plan can't be reused for a different time range.
+var ErrResetNotSupported = errors.New("executor can't be reset, the query must be planned again")
+
+// ErrShardSetChanged is returned by Executor.Reset when the new time range reads from shards that
+// the plan doesn't have mappers for, e.g. because a new shard group was created.
+var ErrShardSetChanged = errors.New("shard set changed, the query must be planned again")
+
+// ResetTx is implemented by transactions whose jobs can be reused for a different time range.
+type ResetTx interface {
+	Tx
+
+	// ShardSetChanged returns true if the statement reads from shards that the jobs created by
+	// the transaction don't have mappers for.
+	ShardSetChanged(stmt *SelectStatement) (bool, error)
+}
+
+// WarmTx is implemented by transactions that can preload the indexes of the shards of a retention
+// policy. See Planner.Warm.
+type WarmTx interface {
+	Tx
+
+	// Warm opens the shards of the retention policy that the transaction reads and loads their
+	// indexes, but not their points. It stops with ErrWarmCanceled once closing is closed.
+	Warm(database, retentionPolicy string, closing <-chan struct{}) error
+}
+
+// ErrWarmNotSupported is returned by Planner.Warm when the transaction can't preload shard indexes.
+var ErrWarmNotSupported = errors.New("shard indexes can't be preloaded")
+
+// ErrWarmCanceled is returned by Planner.Warm when it's canceled before every shard is warmed.
+var ErrWarmCanceled = errors.New("warm canceled")
+
+// ErrMeasurementNotFound returns an error for a query against a measurement that doesn't exist.
+func ErrMeasurementNotFound(name string) error { return fmt.Errorf("measurement not found: %s", name) }
+
+// ErrMeasurementLookupNotSupported is returned by the planner when it must reject queries against
+// measurements that don't exist but the transaction can't look measurements up.
+var ErrMeasurementLookupNotSupported = errors.New("transaction doesn't support looking up measurements")
+
+// MeasurementTx is implemented by transactions that can look up measurements in the index.
+type MeasurementTx interface {
+	Tx
+
+	// MeasurementExists returns true if the measurement exists in its database.
+	MeasurementExists(m *Measurement) (bool, error)
+}
+
+// Downsample is a measurement that a continuous query downsamples a raw measurement into, such as
+// cpu_1h for SELECT max(value) AS value INTO cpu_1h FROM cpu GROUP BY time(1h), *. The downsample
+// must store the value of each field under the field's raw name, and keep the tags of the series.
+//
+// A query is only read from the downsample if the result of each of its aggregates over the
+// downsampled points is the same as over the raw points: every aggregate must be the one the
+// continuous query computes, and be min, max, sum, first or last. The query must be grouped by a
+// multiple of the interval of the downsample, with an offset that's also a multiple of it.
+type Downsample struct {
+	Measurement *Measurement  // the downsampled measurement
+	Interval    time.Duration // the GROUP BY time interval of the continuous query
+	Aggregate   string        // the aggregate the continuous query computes, e.g. "max"
+
+	// The recent part of the range of a query that's read from the raw measurement. Intervals
+	// that end before now minus the window are read from the downsample. It should be longer
+	// than the delay of the continuous query, and shorter than the retention of the raw data.
+	RawWindow time.Duration
+}
+
+// downsampleSplit returns the downsample of the measurement a statement selects from and the start
+// of the first interval read from the raw measurement, if the query is read from a downsample. A
+// nil downsample is returned if the statement can't be, or doesn't have any interval to read from it.
+func (p *Planner) downsampleSplit(stmt *SelectStatement, interval, offset time.Duration) (int64, *Downsample) {
+	if p.Downsamples == nil || stmt.IsRawQuery || stmt.Join != NoJoin || len(stmt.Sources) != 1 {
+		return 0, nil
+	}
+	m, ok := stmt.Sources[0].(*Measurement)
+	if !ok || m.Regex != nil {
+		return 0, nil
+	}
+	ds := p.Downsamples[m.Name]
+	if ds == nil || ds.Interval <= 0 || interval <= 0 || interval%ds.Interval != 0 || offset%ds.Interval != 0 {
+		return 0, nil
+	}
+
+	calls := stmt.FunctionCalls()
+	if len(calls) == 0 {
+		return 0, nil
+	}
+	for _, c := range calls {
+		switch c.Name {
+		case "min", "max", "sum", "first", "last":
+			if c.Name == ds.Aggregate {
+				continue
+			}
+		}
+		return 0, nil
+	}
+
+	// Only split a range that starts before the raw window.
+	tmin, _ := TimeRange(stmt.Condition)
+	split := IntervalStart(p.Now().Add(-ds.RawWindow).UnixNano(), int64(interval), int64(offset))
+	if tmin.IsZero() || tmin.UnixNano() >= split {
+		return 0, nil
+	}
+	return split, ds
+}
+
+// splitDownsampledJobs moves the mappers of the jobs of a downsample into the jobs of the same
+// series, so each job reads the intervals before the split time from the downsample and the
+// others from its raw mappers. Series of the downsample that the raw measurement doesn't have
+// aren't read.
+func splitDownsampledJobs(jobs, dsJobs []*MapReduceJob, split int64) {
+	byKey := make(map[string]*MapReduceJob, len(dsJobs))
+	for _, j := range dsJobs {
+		byKey[string(j.TagSet.Key)] = j
+	}
+
+	for _, j := range jobs {
+		for i, mm := range j.Mappers {
+			j.Mappers[i] = &splitMapper{Mapper: mm, split: split, recent: true, interval: j.interval, offset: j.offset}
+		}
+
+		dsj := byKey[string(j.TagSet.Key)]
+		if dsj == nil {
+			continue
+		}
+		for _, mm := range dsj.Mappers {
+			j.Mappers = append(j.Mappers, &splitMapper{Mapper: mm, split: split, interval: j.interval, offset: j.offset})
+		}
+		dsj.Mappers = nil
+	}
+
+	// The mappers of series only the downsample has aren't read.
+	for _, j := range dsJobs {
+		for _, mm := range j.Mappers {
+			mm.Close()
+		}
+	}
+}
+
+// splitMapper restricts a mapper of a query that's split between a downsample and its raw
+// measurement to the intervals it's read for: those from the split time for raw mappers, and
+// those before it for the mappers of the downsample. It returns nil for the other intervals,
+// without reading them. The other optional interfaces of the mapper aren't implemented, so its
+// shard isn't remapped if it moves.
+type splitMapper struct {
+	Mapper
+	split    int64 // the start of the first interval read from the raw measurement
+	recent   bool  // if true, the mapper reads the intervals from the split time, otherwise those before it
+	interval int64 // the group by interval of the query
+	offset   int64 // the offset of the group by interval boundaries
+	tmin     int64 // the start of the next interval
+}
+
+// Begin begins the mapper at the split time if it only reads the intervals from it.
+func (m *splitMapper) Begin(c *Call, startingTime int64, chunkSize int) error {
+	m.tmin = startingTime
+	if m.recent && startingTime < m.split {
+		startingTime = m.split
+	}
+	return m.Mapper.Begin(c, startingTime, chunkSize)
+}
+
+// IntervalTime returns the interval time of the wrapped mapper, if it reports it. The intervals
+// that aren't read are nil, which don't have one.
+func (m *splitMapper) IntervalTime() (int64, bool) {
+	if it, ok := m.Mapper.(IntervalTimer); ok {
+		return it.IntervalTime()
+	}
+	return 0, false
+}
+
+// NextInterval returns the next interval of the mapper if it reads it, and nil otherwise.
+func (m *splitMapper) NextInterval() (interface{}, error) {
+	t := m.tmin
+	m.tmin = IntervalStart(t, m.interval, m.offset) + m.interval
+	if m.recent != (t >= m.split) {
+		return nil, nil
+	}
+	return m.Mapper.NextInterval()
+}
+
+// Scope restricts the data a query can read, e.g. to the series of a tenant in a multi-tenant
+// deployment. See Planner.PlanContext.
+type Scope struct {
+	Database     string            // if set, the only database sources can name; otherwise they can't name one
+	Measurements []string          // if set, the only measurements that can be selected from
+	Tags         map[string]string // if set, the tags every series read must have, e.g. tenant=acme
+}
+
+// ErrMeasurementNotInScope is returned for a query selecting from a measurement outside its scope.
+func ErrMeasurementNotInScope(name string) error {
+	return fmt.Errorf("measurement %s isn't in the scope of the query", name)
+}
+
+// ErrDatabaseNotInScope is returned for a query selecting from a database outside its scope.
+func ErrDatabaseNotInScope(name string) error {
+	return fmt.Errorf("database %s isn't in the scope of the query", name)
+}
+
+// ErrSeriesNotInScope is returned by a mapper asked to read a series outside the scope of its query.
+func ErrSeriesNotInScope(key string) error {
+	return fmt.Errorf("series %s isn't in the scope of the query", key)
+}
+
+// Validate returns an error if the statement selects from a database or measurement outside the
+// scope. Sources that don't name a database read the default database of the query, which the
+// caller scopes. Regexes can't be checked against it, so they're rejected if the scope restricts
+// the measurements.
+func (s *Scope) Validate(stmt *SelectStatement) error {
+	for _, src := range stmt.Sources {
+		m, ok := src.(*Measurement)
+		if !ok {
+			return ErrMeasurementNotInScope(src.String())
+		} else if m.Database != "" && m.Database != s.Database {
+			return ErrDatabaseNotInScope(m.Database)
+		} else if m.Regex != nil && s.Measurements != nil {
+			return ErrMeasurementNotInScope(m.String())
+		} else if m.Regex == nil && !s.AllowsMeasurement(m.Name) {
+			return ErrMeasurementNotInScope(m.Name)
+		}
+	}
+	return nil
+}
+
+// AllowsMeasurement returns true if the scope allows the measurement to be read.
+func (s *Scope) AllowsMeasurement(name string) bool {
+	if s.Measurements == nil {
+		return true
+	}
+	for _, m := range s.Measurements {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsSeries returns true if a series with the given tags has every tag of the scope.
+func (s *Scope) AllowsSeries(tags map[string]string) bool {
+	for k, v := range s.Tags {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// condition returns the tag filters of the scope as an expression, or nil if it doesn't have any.
+// The tags are in order of key, so the condition is the same every time.
+func (s *Scope) condition() Expr {
+	keys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var cond Expr
+	for _, k := range keys {
+		var expr Expr = &BinaryExpr{Op: EQ, LHS: &VarRef{Val: k}, RHS: &StringLiteral{Val: s.Tags[k]}}
+		if cond != nil {
+			expr = &BinaryExpr{Op: AND, LHS: cond, RHS: expr}
+		}
+		cond = expr
+	}
+	return cond
+}
+
+// withTimeRangeStart returns a copy of the statement whose time range starts at start. The upper
+// bound of its time range and the rest of its condition are kept.
+func withTimeRangeStart(stmt *SelectStatement, start time.Time) *SelectStatement {
+	_, tmax := TimeRange(stmt.Condition)
+	var cond Expr = &BinaryExpr{Op: GTE, LHS: &VarRef{Val: "time"}, RHS: &TimeLiteral{Val: start.UTC()}}
+	if !tmax.IsZero() {
+		cond = &BinaryExpr{
+			Op:  AND,
+			LHS: cond,
+			RHS: &BinaryExpr{Op: LTE, LHS: &VarRef{Val: "time"}, RHS: &TimeLiteral{Val: tmax.UTC()}},
+		}
+	}
+
+	other := stmt.Clone()
+	if other.Condition != nil {
+		// Replace the old time conditions with true so they fold out below.
+		rest := RewriteFunc(other.Condition, func(n Node) Node {
+			switch n := n.(type) {
+			case *BinaryExpr:
+				if n.LHS.String() == "time" {
+					return &BooleanLiteral{Val: true}
+				}
+			case *Call:
+				return &BooleanLiteral{Val: true}
+			}
+			return n
+		}).(Expr)
+		cond = &BinaryExpr{Op: AND, LHS: rest, RHS: cond}
+	}
+	other.Condition = Reduce(cond, nil)
+	return other
+}
+
+// hasMultipleMeasurements returns true if the sources can select from more than one measurement.
+func hasMultipleMeasurements(sources Sources) bool {
+	if len(sources) > 1 {
+		return true
+	}
+	for _, src := range sources {
+		if m, ok := src.(*Measurement); ok && m.Regex != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMeasurementsExist returns an error if a measurement the statement selects from doesn't exist.
+// Measurements matched by a regex aren't checked, since a regex may match no measurement.
+func checkMeasurementsExist(tx Tx, stmt *SelectStatement) error {
+	mtx, ok := tx.(MeasurementTx)
+	if !ok {
+		return ErrMeasurementLookupNotSupported
+	}
+
+	for _, src := range stmt.Sources {
+		m, ok := src.(*Measurement)
+		if !ok || m.Regex != nil {
+			continue
+		}
+		if ok, err := mtx.MeasurementExists(m); err != nil {
+			return err
+		} else if !ok {
+			return ErrMeasurementNotFound(m.String())
+		}
+	}
+	return nil
+}
+
+// ErrSnapshotNotSupported is returned by Planner.PlanSnapshot when the transaction can't be
+// restricted to a set of shard groups.
+var ErrSnapshotNotSupported = errors.New("transaction doesn't support reading a snapshot of shard groups")
+
+// ErrSnapshotShardGroupsRequired is returned by Planner.PlanSnapshot when no shard groups are given.
+var ErrSnapshotShardGroupsRequired = errors.New("snapshot requires at least one shard group")
+
+// SnapshotTx is implemented by transactions that can read a fixed set of shard groups rather than
+// the shard groups that overlap the time range of a statement.
+type SnapshotTx interface {
+	Tx
+
+	// SetShardGroupIDs restricts the jobs created by the transaction to the shard groups with the
+	// given IDs. CreateMapReduceJobs returns an error if any of the groups no longer exists.
+	SetShardGroupIDs(ids []uint64)
+}
+
+// ResumeTokenVersion is the version of the format of encoded resume tokens.
+const ResumeTokenVersion = 1
+
+// ErrInvalidResumeToken is returned by ParseResumeToken when a token can't be decoded.
+var ErrInvalidResumeToken = errors.New("invalid resume token")
+
+// ErrResumeNotSupported is returned by Planner.PlanResume for statements whose rows depend on the
+// points before the position they're resumed from.
+var ErrResumeNotSupported = errors.New("only raw queries without LIMIT, OFFSET, joins, derivatives or differences can be resumed")
+
+// ResumeToken records how far the rows of a raw query have been read, so an interrupted query such
+// as a long export can be planned again with Planner.PlanResume and continued without reading the
+// points already returned again. For each series it holds the time of the last point read and the
+// number of points read at that time, as several points of a series can share a timestamp.
+//
+// The consumer of the rows records each row with Record once it's been handled, and persists the
+// encoded token from String as often as it likes. The encoding is the URL-safe base64 of a JSON
+// object with the version of the format and the position of each series, sorted by name and tags:
+//
+//	{"version":1,"series":[{"name":"cpu","tags":{"host":"a"},"time":1445000000000000000,"n":1}]}
+//
+// Times are in nanoseconds since the epoch, at the precision of the timestamps of the rows.
+type ResumeToken struct {
+	series map[string]*resumePosition
+}
+
+// resumePosition is the position of a series in a resume token.
+type resumePosition struct {
+	Name string            `json:"name"`
+	Tags map[string]string `json:"tags,omitempty"`
+	Time int64             `json:"time"`
+	N    int               `json:"n"`
+}
+
+// resumeTokenJSON is the encoded form of a resume token.
+type resumeTokenJSON struct {
+	Version int               `json:"version"`
+	Series  []*resumePosition `json:"series"`
+}
+
+// ParseResumeToken decodes a token encoded by ResumeToken.String.
+func ParseResumeToken(s string) (*ResumeToken, error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidResumeToken
+	}
+	var enc resumeTokenJSON
+	if err := json.Unmarshal(b, &enc); err != nil || enc.Version != ResumeTokenVersion {
+		return nil, ErrInvalidResumeToken
+	}
+
+	t := &ResumeToken{series: make(map[string]*resumePosition, len(enc.Series))}
+	for _, pos := range enc.Series {
+		if pos == nil || pos.N <= 0 {
+			return nil, ErrInvalidResumeToken
+		}
+		t.series[resumeKey(pos.Name, pos.Tags)] = pos
+	}
+	return t, nil
+}
+
+// Record moves the positions of the series of a row of a raw query past its points. Rows without
+// points, such as error rows, are ignored.
+func (t *ResumeToken) Record(row *Row) {
+	if row.Err != nil || len(row.Values) == 0 {
+		return
+	}
+	if t.series == nil {
+		t.series = make(map[string]*resumePosition)
+	}
+
+	key := resumeKey(row.Name, row.Tags)
+	pos := t.series[key]
+	if pos == nil {
+		pos = &resumePosition{Name: row.Name, Tags: row.Tags}
+		t.series[key] = pos
+	}
+	for _, v := range row.Values {
+		ts, ok := v[0].(time.Time)
+		if !ok {
+			continue
+		}
+		if n := ts.UnixNano(); pos.N > 0 && n == pos.Time {
+			pos.N++
+		} else {
+			pos.Time, pos.N = n, 1
+		}
+	}
+}
+
+// String returns the encoded token.
+func (t *ResumeToken) String() string {
+	keys := make([]string, 0, len(t.series))
+	for k := range t.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	enc := resumeTokenJSON{Version: ResumeTokenVersion, Series: make([]*resumePosition, 0, len(keys))}
+	for _, k := range keys {
+		enc.Series = append(enc.Series, t.series[k])
+	}
+	b, _ := json.Marshal(enc)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// position returns a copy of the position of a series, or nil if the token doesn't have one.
+func (t *ResumeToken) position(name string, tags map[string]string) *resumePosition {
+	if pos := t.series[resumeKey(name, tags)]; pos != nil {
+		other := *pos
+		return &other
+	}
+	return nil
+}
+
+// resumeKey returns the key of a series in a resume token. It also identifies the series counted
+// in the stats of a query.
+func resumeKey(name string, tags map[string]string) string {
+	return name + "\x00" + EncodeTagSet(tags)
+}
+
+// ReadConsistency is the consistency level of the reads of a query from a shard with several owners.
+type ReadConsistency int
+
+const (
+	// ReadConsistencyAny reads each shard from any one of its owners, usually the closest.
+	ReadConsistencyAny ReadConsistency = iota
+
+	// ReadConsistencyOne reads each shard from its primary owner, the first of its owners.
+	ReadConsistencyOne
+
+	// ReadConsistencyQuorum reads each shard from a majority of its owners and reconciles the
+	// points they disagree on.
+	ReadConsistencyQuorum
+)
+
+// ParseReadConsistency returns the read consistency level with the given name.
+func ParseReadConsistency(s string) (ReadConsistency, error) {
+	switch strings.ToLower(s) {
+	case "any":
+		return ReadConsistencyAny, nil
+	case "one":
+		return ReadConsistencyOne, nil
+	case "quorum":
+		return ReadConsistencyQuorum, nil
+	}
+	return 0, fmt.Errorf("invalid read consistency level: %s", s)
+}
+
+// String returns the name of the read consistency level.
+func (c ReadConsistency) String() string {
+	switch c {
+	case ReadConsistencyAny:
+		return "any"
+	case ReadConsistencyOne:
+		return "one"
+	case ReadConsistencyQuorum:
+		return "quorum"
+	}
+	return fmt.Sprintf("ReadConsistency(%d)", int(c))
+}
+
+// ErrReadConsistencyNotSupported is returned when a transaction can't read shards at a consistency level.
+func ErrReadConsistencyNotSupported(c ReadConsistency) error {
+	return fmt.Errorf("read consistency level not supported: %s", c)
+}
+
+// ConsistencyTx is implemented by transactions that can select among the owners of the shards
+// they read by consistency level.
+type ConsistencyTx interface {
+	Tx
+
+	// SetReadConsistency sets the consistency level of the mappers created by the transaction.
+	// It returns ErrReadConsistencyNotSupported if the transaction can't read at the level.
+	SetReadConsistency(c ReadConsistency) error
+}
+
+// ErrSLimitSingleSeries is returned by the planner for queries with SLIMIT or SOFFSET that can only
+// return a single series: those that aren't grouped by any tags and select from a single measurement.
+var ErrSLimitSingleSeries = errors.New("SLIMIT and SOFFSET require GROUP BY tags or more than one measurement")
+
+// ErrUnifyColumnsNotSupported is returned by the planner when columns are unified but the transaction
+// can't create jobs for measurements without every selected field.
+var ErrUnifyColumnsNotSupported = errors.New("transaction doesn't support unifying the columns of measurements")
+
+// ErrUnifyColumnsAggregate is returned by the planner when columns are unified for an aggregate query.
+var ErrUnifyColumnsAggregate = errors.New("columns can only be unified for raw queries")
+
+// UnifiedColumnsTx is implemented by transactions that can create jobs for measurements that don't
+// have every field selected by a statement, so a query selecting from several measurements with
+// different fields, e.g. SELECT * FROM /cpu.*/, returns the same columns for all of them.
+type UnifiedColumnsTx interface {
+	Tx
+
+	// SetUnifyColumns makes the mappers created by the transaction return null for the selected fields
+	// their measurement doesn't have, rather than CreateMapReduceJobs returning an error. Measurements
+	// without any of the selected fields have no jobs. A field that no measurement has is still an error.
+	SetUnifyColumns()
+}
+
+// ErrMultiMapperNotSupported is returned by MultiMapperTx.NewMultiMapper when a node can't read
+// several shards with a single mapper. The planner then keeps a mapper for each shard.
+var ErrMultiMapperNotSupported = errors.New("multi-shard mappers not supported")
+
+// NodeMapper is implemented by mappers that read a shard owned by another node.
+type NodeMapper interface {
+	Mapper
+
+	// NodeID returns the ID of the node that owns the shard.
+	NodeID() uint64
+}
+
+// MultiMapperTx is implemented by transactions that can read several shards owned by the same
+// node with a single mapper. The mapper must return the merged output of the shards for the job:
+// time ordered points for raw queries, and the combined map output of each interval for aggregates.
+type MultiMapperTx interface {
+	Tx
+
+	// NewMultiMapper returns an unopened mapper that reads the shards from the node for the job.
+	NewMultiMapper(job *MapReduceJob, nodeID uint64, shardIDs []uint64) (Mapper, error)
+}
+
+// coalesceNodeMappers replaces the mappers of the job that read from the same node with a single
+// mapper for the node. Mappers of nodes that don't support it are kept.
+func (m *MapReduceJob) coalesceNodeMappers(tx MultiMapperTx) error {
+	// group the shards of each node in the order the nodes are first seen
+	var nodeIDs []uint64
+	shardIDs := make(map[uint64][]uint64)
+	for _, mm := range m.Mappers {
+		if nm, ok := mm.(NodeMapper); ok {
+			if _, ok := shardIDs[nm.NodeID()]; !ok {
+				nodeIDs = append(nodeIDs, nm.NodeID())
+			}
+			shardIDs[nm.NodeID()] = append(shardIDs[nm.NodeID()], nm.ShardID())
+		}
+	}
+
+	coalesced := make(map[uint64]bool)
+	var mappers []Mapper
+	for _, nodeID := range nodeIDs {
+		if len(shardIDs[nodeID]) < 2 {
+			continue
+		}
+		mm, err := tx.NewMultiMapper(m, nodeID, shardIDs[nodeID])
+		if err == ErrMultiMapperNotSupported {
+			continue
+		} else if err != nil {
+			return err
+		}
+		coalesced[nodeID] = true
+		mappers = append(mappers, mm)
+	}
+	if len(mappers) == 0 {
+		return nil
+	}
+
+	for _, mm := range m.Mappers {
+		if nm, ok := mm.(NodeMapper); ok && coalesced[nm.NodeID()] {
+			continue
+		}
+		mappers = append(mappers, mm)
+	}
+	m.Mappers = mappers
+	sort.Sort(Mappers(m.Mappers))
+	return nil
+}
+
+// ErrPartialMapperRaw is returned when a partial mapper is begun for a raw query.
+var ErrPartialMapperRaw = errors.New("partial mappers only read aggregates")
+
+// PartialMapper pushes the aggregates of a series down to the node that owns its shards. The node
+// maps and combines the points of its shards, executing the query for the series with
+// Planner.PartialAggregates set, and returns one partial state per interval, e.g. the count and
+// mean of each interval of a mean, rather than the points. The coordinator then only combines the
+// partials of each interval with the outputs of its other mappers; a partial has the type of a map
+// output, so the usual reducer of the aggregate combines and finalizes it.
+//
+// The node must group the query by the intervals of the job, without window(), which the
+// coordinator applies to the combined partials.
+type PartialMapper struct {
+	job     *MapReduceJob
+	nodeID  uint64
+	shardID uint64
+	fetch   func() (*Row, error)
+
+	row    *Row  // the partial row of the series, nil if the node has no data for it
+	column int   // the column of the aggregate being read
+	index  int   // the index of the next value of the row
+	t      int64 // the start of the next interval
+	last   int64 // the time of the partial returned last
+}
+
+// NewPartialMapper returns an unopened mapper for the job that reads the partial row of its series
+// from a node with fetch, e.g. by sending the query to the node and decoding the row it returns
+// with UnmarshalPartialRow. fetch returns nil if the node has no data for the series. shardID is
+// the lowest ID of the shards the node reads.
+func NewPartialMapper(job *MapReduceJob, nodeID, shardID uint64, fetch func() (*Row, error)) *PartialMapper {
+	return &PartialMapper{job: job, nodeID: nodeID, shardID: shardID, fetch: fetch}
+}
+
+// Open reads the partial row of the series from the node.
+func (m *PartialMapper) Open() (err error) {
+	m.row, err = m.fetch()
+	return err
+}
+
+// Close closes the mapper.
+func (m *PartialMapper) Close() {}
+
+// ShardID returns the lowest ID of the shards read by the node.
+func (m *PartialMapper) ShardID() uint64 { return m.shardID }
+
+// NodeID returns the ID of the node that computes the partials.
+func (m *PartialMapper) NodeID() uint64 { return m.nodeID }
+
+// Begin sets the mapper up to return the partials of the aggregate c from the interval starting at
+// startingTime. The limit is ignored, as there's a partial per interval.
+func (m *PartialMapper) Begin(c *Call, startingTime int64, limit int) error {
+	if c == nil {
+		return ErrPartialMapperRaw
+	}
+
+	m.column = -1
+	for i, f := range m.job.stmt.Fields {
+		if f.Expr.String() == c.String() {
+			m.column = i + 1
+			break
+		}
+	}
+	if m.column < 0 {
+		return fmt.Errorf("no partial aggregate for %s", c)
+	}
+	m.index, m.t = 0, startingTime
+	return nil
+}
+
+// NextInterval returns the partial of the next interval, or nil if the node has none for it.
+// The times of the partials may be truncated to the precision of the node, so a partial is
+// returned by the first interval that ends after its time.
+func (m *PartialMapper) NextInterval() (interface{}, error) {
+	end := m.t + m.job.interval
+	m.t = end
+	if m.row == nil || m.index >= len(m.row.Values) {
+		return nil, nil
+	}
+
+	values := m.row.Values[m.index]
+	if t, ok := values[0].(time.Time); !ok {
+		return nil, fmt.Errorf("unexpected partial time: %v", values[0])
+	} else if t.UnixNano() >= end {
+		return nil, nil
+	} else if m.column >= len(values) {
+		return nil, fmt.Errorf("partial row has %d columns, expected at least %d", len(values), m.column+1)
 	}
+	m.index++
+	m.last = values[0].(time.Time).UnixNano()
+	return values[m.column], nil
+}
 
-	mathResults := make([][]interface{}, len(results))
-	for i, _ := range mathResults {
-		mathResults[i] = make([]interface{}, len(m.stmt.Fields)+1)
-		// put the time in
-		mathResults[i][0] = results[i][0]
-		for j, p := range processors {
-			mathResults[i][j+1] = p(results[i])
+// IntervalTime returns the time of the partial returned last. A time truncated to the precision of
+// the job to before the interval it was returned in is moved to the start of the interval.
+func (m *PartialMapper) IntervalTime() (int64, bool) {
+	start := m.t - m.job.interval
+	if m.last < start && start-m.last < m.job.precision {
+		return start, true
+	}
+	return m.last, true
+}
+
+// UnmarshalPartialRow decodes a row of partial aggregates encoded as JSON by a node executing stmt
+// with Planner.PartialAggregates set. The partials of each aggregate are decoded into the map
+// outputs of the aggregate by its unmarshaller, and empty intervals are nil.
+func UnmarshalPartialRow(stmt *SelectStatement, b []byte) (*Row, error) {
+	var o struct {
+		Name     string              `json:"name,omitempty"`
+		Tags     map[string]string   `json:"tags,omitempty"`
+		Columns  []string            `json:"columns,omitempty"`
+		Values   [][]json.RawMessage `json:"values,omitempty"`
+		ShardIDs []uint64            `json:"shardIDs,omitempty"`
+	}
+	if err := json.Unmarshal(b, &o); err != nil {
+		return nil, err
+	}
+
+	unmarshalFuncs := make([]UnmarshalFunc, len(stmt.Fields))
+	for i, f := range stmt.Fields {
+		c, ok := f.Expr.(*Call)
+		if !ok {
+			return nil, fmt.Errorf("partial aggregates aren't supported for %s", f.Expr)
+		}
+		fn, err := InitializeUnmarshaller(c)
+		if err != nil {
+			return nil, err
+		}
+		unmarshalFuncs[i] = fn
+	}
+
+	row := &Row{Name: o.Name, Tags: o.Tags, Columns: o.Columns, ShardIDs: o.ShardIDs, Values: make([][]interface{}, len(o.Values))}
+	for i, raw := range o.Values {
+		if len(raw) != len(unmarshalFuncs)+1 {
+			return nil, fmt.Errorf("partial row has %d columns, expected %d", len(raw), len(unmarshalFuncs)+1)
+		}
+
+		var t time.Time
+		if err := json.Unmarshal(raw[0], &t); err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, len(raw))
+		values[0] = t
+		for j, fn := range unmarshalFuncs {
+			if string(raw[j+1]) == "null" {
+				continue
+			}
+			v, err := fn(raw[j+1])
+			if err != nil {
+				return nil, err
+			}
+			values[j+1] = v
+		}
+		row.Values[i] = values
+	}
+	return row, nil
+}
+
+// TimeRangeMapper is implemented by mappers that know the time range of the shard they read, which
+// adjacent shards are coalesced by (see Planner.MapperCoalesceThreshold).
+type TimeRangeMapper interface {
+	// ShardTimeRange returns the start and the exclusive end of the time range of the shard.
+	ShardTimeRange() (start, end int64)
+}
+
+// coalesceAdjacentMappers replaces runs of up to factor mappers of a raw query whose shards follow
+// each other in time with a sequentialMapper, if the job has more than threshold mappers. If factor
+// is zero, the runs are as short as they can be for the job to have at most threshold mappers.
+// Aggregates read their mappers one after another an interval at a time already, so their mappers
+// are kept. So are the mappers of jobs that don't all implement TimeRangeMapper.
+func (m *MapReduceJob) coalesceAdjacentMappers(threshold, factor int) {
+	if len(m.Mappers) <= threshold || !(m.stmt.IsRawQuery || m.stmt.IsSimpleDerivative() || m.stmt.IsSimpleDifference()) {
+		return
+	}
+	if factor <= 0 {
+		factor = (len(m.Mappers) + threshold - 1) / threshold
+	}
+	if factor < 2 {
+		return
+	}
+
+	// order the mappers by the time range of their shards
+	ranges := make(mapperRanges, len(m.Mappers))
+	for i, mm := range m.Mappers {
+		r, ok := mm.(TimeRangeMapper)
+		if !ok {
+			return
+		}
+		ranges[i].mapper = mm
+		ranges[i].start, ranges[i].end = r.ShardTimeRange()
+	}
+	sort.Stable(ranges)
+
+	// a run ends once it's long enough, or at a shard that overlaps the one before it
+	var mappers []Mapper
+	var run []Mapper
+	var end int64
+	flush := func() {
+		if len(run) == 1 {
+			mappers = append(mappers, run[0])
+		} else if len(run) > 1 {
+			mappers = append(mappers, &sequentialMapper{mappers: run, job: m, shardID: run[0].ShardID()})
+		}
+		run = nil
+	}
+	for _, r := range ranges {
+		if len(run) == factor || (len(run) > 0 && r.start < end) {
+			flush()
+		}
+		run = append(run, r.mapper)
+		end = r.end
+	}
+	flush()
+
+	m.Mappers = mappers
+	sort.Sort(Mappers(m.Mappers))
+}
+
+// mapperRanges is a list of mappers with the time ranges of their shards, which can be sorted by
+// the start of the time ranges.
+type mapperRanges []struct {
+	mapper     Mapper
+	start, end int64
+}
+
+func (a mapperRanges) Len() int           { return len(a) }
+func (a mapperRanges) Less(i, j int) bool { return a[i].start < a[j].start }
+func (a mapperRanges) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// ErrCoalescedAggregate is returned when a coalesced mapper is asked to run an aggregate.
+var ErrCoalescedAggregate = errors.New("coalesced mappers don't run aggregates")
+
+// sequentialMapper reads the shards of several mappers of a raw query, whose time ranges follow each
+// other, one after another, so the job reads them with a single mapper rather than one per shard.
+// Only one of the mappers is open at a time: each is opened once the one before it is drained, and
+// closed once it's drained itself. Each chunk is read from a single mapper, which ShardID returns
+// until the next chunk is read.
+type sequentialMapper struct {
+	mappers    []Mapper      // the mappers in the time order of their shards
+	job        *MapReduceJob // the job of the mappers
+	shardID    uint64        // the ID of the shard of the mapper read last
+	cur        int           // the index of the mapper being read
+	desc       bool          // if true, the mappers are read backward from the last one
+	open       bool          // true if the mapper being read is open
+	seriesKeys []string      // if set, the series keys each mapper is restricted to once it's opened
+
+	begun        bool  // true once Begin is called, so each mapper is begun once it's opened
+	startingTime int64 // the starting time passed to Begin
+	chunkSize    int   // the chunk size passed to Begin
+}
+
+// Open opens the first mapper to be read. Mappers whose shard isn't found are skipped if the job
+// tolerates missing shards. ErrShardNotFound is only returned if every shard is missing.
+func (s *sequentialMapper) Open() error {
+	s.desc = !s.job.stmt.TimeAscending()
+	if s.cur = 0; s.desc {
+		s.cur = len(s.mappers) - 1
+	}
+	s.begun = false
+	if err := s.openCurrent(); err != nil {
+		return err
+	} else if !s.open {
+		return ErrShardNotFound
+	}
+	return nil
+}
+
+// openCurrent opens the mapper being read, moving past those whose shard isn't found if the job
+// tolerates missing shards. The mapper is restricted to the series keys, and begun if Begin has
+// been called. No mapper is opened once every mapper has been read.
+func (s *sequentialMapper) openCurrent() error {
+	for ; s.cur >= 0 && s.cur < len(s.mappers); s.advance() {
+		mm := s.mappers[s.cur]
+		err := mm.Open()
+		if err == ErrShardNotFound && s.job.tolerateMissingShards {
+			mm.Close()
+			if s.job.logger != nil {
+				s.job.logger.Printf("skipping shard %d of %s: %s", mm.ShardID(), s.job.MeasurementName, ErrShardNotFound)
+			}
+			continue
+		} else if err != nil {
+			mm.Close()
+			return err
+		}
+
+		s.open = true
+		s.shardID = mm.ShardID()
+		if s.seriesKeys != nil {
+			if err := mm.(SeriesKeyMapper).SetSeriesKeys(s.seriesKeys); err != nil {
+				return err
+			}
+		}
+		if s.begun {
+			return mm.Begin(nil, s.startingTime, s.chunkSize)
+		}
+		return nil
+	}
+	return nil
+}
+
+// advance moves to the next mapper to be read.
+func (s *sequentialMapper) advance() {
+	if s.desc {
+		s.cur--
+	} else {
+		s.cur++
+	}
+}
+
+// Close closes the mapper being read, if it's open. The mappers before it were closed once they
+// were drained, and those after it haven't been opened.
+func (s *sequentialMapper) Close() {
+	if s.open {
+		s.mappers[s.cur].Close()
+		s.open = false
+	}
+}
+
+// ShardID returns the ID of the shard of the mapper the last chunk was read from.
+func (s *sequentialMapper) ShardID() uint64 { return s.shardID }
+
+// Begin begins the mapper being read at the starting time, and each mapper after it once it's
+// opened. Only raw queries are read sequentially.
+func (s *sequentialMapper) Begin(c *Call, startingTime int64, chunkSize int) error {
+	if c != nil {
+		return ErrCoalescedAggregate
+	}
+	s.begun, s.startingTime, s.chunkSize = true, startingTime, chunkSize
+	if s.open {
+		return s.mappers[s.cur].Begin(nil, startingTime, chunkSize)
+	}
+	return nil
+}
+
+// NextInterval returns the next chunk of points of the mapper being read. Once it returns an empty
+// chunk it's closed, and the next mapper is opened. It returns nil once every mapper has been read.
+func (s *sequentialMapper) NextInterval() (interface{}, error) {
+	for s.open {
+		mm := s.mappers[s.cur]
+		res, err := mm.NextInterval()
+		if err != nil {
+			return nil, err
+		}
+		if values, _ := res.([]*rawQueryMapOutput); len(values) > 0 {
+			s.shardID = mm.ShardID()
+			return res, nil
+		}
+
+		mm.Close()
+		s.open = false
+		s.advance()
+		if err := s.openCurrent(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// SetSeriesKeys restricts the mapper being read to the series keys, and each mapper after it once
+// it's opened. Every mapper must implement SeriesKeyMapper.
+func (s *sequentialMapper) SetSeriesKeys(keys []string) error {
+	for _, mm := range s.mappers {
+		if _, ok := mm.(SeriesKeyMapper); !ok {
+			return ErrSeriesKeysNotSupported
+		}
+	}
+	s.seriesKeys = keys
+	if s.open {
+		return s.mappers[s.cur].(SeriesKeyMapper).SetSeriesKeys(keys)
+	}
+	return nil
+}
+
+// IntervalTime returns the interval time of the mapper read last, if it reports it.
+func (s *sequentialMapper) IntervalTime() (int64, bool) {
+	if !s.open {
+		return 0, false
+	} else if it, ok := s.mappers[s.cur].(IntervalTimer); ok {
+		return it.IntervalTime()
+	}
+	return 0, false
+}
+
+// SkippedN returns the number of NaN and infinite values skipped by the mappers.
+func (s *sequentialMapper) SkippedN() int {
+	var n int
+	for _, mm := range s.mappers {
+		if c, ok := mm.(NonFiniteCounter); ok {
+			n += c.SkippedN()
+		}
+	}
+	return n
+}
+
+// Cancel cancels the reads of the mappers that can be cancelled.
+func (s *sequentialMapper) Cancel() {
+	for _, mm := range s.mappers {
+		if c, ok := mm.(Canceler); ok {
+			c.Cancel()
+		}
+	}
+}
+
+// Resetter is implemented by mappers that can be reused for a different time range. Reset is
+// called while the mapper is closed, and the next call to Begin seeks within the new range.
+type Resetter interface {
+	Reset(tmin, tmax int64) error
+}
+
+// ErrTimeBoundRequired is returned by the planner when a query has no lower time bound and
+// the planner requires one.
+var ErrTimeBoundRequired = errors.New("query must include a lower time bound, e.g. WHERE time > now() - 1h")
+
+// ErrAutoIntervalTimeBound is returned by the planner when a query is grouped by time(auto) but
+// has no lower time bound to choose the interval from.
+var ErrAutoIntervalTimeBound = errors.New("GROUP BY time(auto) requires a lower time bound, e.g. WHERE time > now() - 1h")
+
+// ErrWindowTimeBound is returned by the planner when a query is grouped by window() but has no lower
+// time bound for its windows to start from.
+var ErrWindowTimeBound = errors.New("GROUP BY window() requires a lower time bound, e.g. WHERE time > now() - 1h")
+
+// ErrInvalidChunkSize is returned by the planner when a query is planned with a negative chunk
+// size other than UseDefaultChunkSize, or with UseDefaultChunkSize if its default is negative.
+func ErrInvalidChunkSize(chunkSize int) error {
+	return fmt.Errorf("invalid chunk size: %d, must be 0 or more", chunkSize)
+}
+
+// DefaultChunkSize is the default chunk size of raw queries planned with UseDefaultChunkSize.
+const DefaultChunkSize = 10000
+
+// DefaultMaxChunkSize is the default maximum chunk size of raw queries. It keeps a query that asks
+// for everything at once from buffering every point of a series in memory.
+const DefaultMaxChunkSize = 10000
+
+// DefaultPrefetchDepth is the default number of chunks each mapper of a raw query reads ahead.
+const DefaultPrefetchDepth = 1
+
+// DefaultRetryBackoff is the default time waited before the first retry of a mapper's read.
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// DefaultAutoIntervalPoints is the number of intervals targeted by time(auto) by default.
+const DefaultAutoIntervalPoints = 100
+
+// autoIntervals are the intervals time(auto) chooses from, in increasing order. Larger
+// intervals are whole multiples of the last one.
+var autoIntervals = []time.Duration{
+	time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 5 * time.Second, 10 * time.Second, 15 * time.Second, 30 * time.Second,
+	time.Minute, 5 * time.Minute, 10 * time.Minute, 15 * time.Minute, 30 * time.Minute,
+	time.Hour, 2 * time.Hour, 3 * time.Hour, 6 * time.Hour, 12 * time.Hour,
+	24 * time.Hour, 7 * 24 * time.Hour,
+}
+
+// AutoInterval returns the interval for about n intervals over the time range [tmin, tmax]. It's
+// the smallest of a set of round durations, e.g. 1m or 6h, that doesn't return more than n intervals.
+// If precision is set, the interval is rounded up to a multiple of it.
+func AutoInterval(tmin, tmax time.Time, n int, precision time.Duration) time.Duration {
+	if n <= 0 {
+		n = DefaultAutoIntervalPoints
+	}
+	target := tmax.Sub(tmin) / time.Duration(n)
+
+	interval := autoIntervals[len(autoIntervals)-1]
+	if target > interval {
+		interval *= (target + interval - 1) / interval
+	} else {
+		for _, d := range autoIntervals {
+			if d >= target {
+				interval = d
+				break
+			}
+		}
+	}
+
+	if precision > 0 && interval%precision != 0 {
+		interval += precision - interval%precision
+	}
+	return interval
+}
+
+// Planner represents an object for creating execution plans.
+type Planner struct {
+	DB DB
+
+	// Returns the current time. Defaults to time.Now().
+	Now func() time.Time
+
+	// The resolution of the timestamps in emitted rows, e.g. time.Second. Timestamps are
+	// truncated to this precision. Defaults to 0, which leaves timestamps unchanged.
+	Precision time.Duration
+
+	// If true, queries without a lower time bound are rejected to prevent accidental scans
+	// of the entire history of a measurement. Defaults to false.
+	RequireTimeBound bool
+
+	// If set, the lower time bound of queries without one is the current time minus this
+	// window. It's ignored if RequireTimeBound is set. Defaults to 0, which queries from the
+	// start of the epoch.
+	DefaultQueryWindow time.Duration
+
+	// If set, the lower time bound of a query without one is the current time minus this, as if
+	// the statement had a "time >= now() - Since" condition. It lets a caller limit how far back
+	// a single query looks without rewriting its WHERE clause, and satisfies RequireTimeBound.
+	// The lower bound of a query is, in order of precedence, the one in its WHERE clause, Since,
+	// DefaultQueryWindow, or the start of the epoch. Defaults to 0, which doesn't set a bound.
+	Since time.Duration
+
+	// If set, queries that would return more series than this are rejected before any data
+	// is read. Defaults to 0, which doesn't limit the number of series.
+	MaxSeriesPerQuery int
+
+	// If set, GROUP BY time intervals are aligned to this time instead of the Unix epoch, e.g. so
+	// time(1d) intervals start at midnight in another time zone. The GROUP BY offset of a query
+	// is relative to it. Defaults to the zero time, which aligns intervals to the epoch.
+	TimeOrigin time.Time
+
+	// The number of intervals targeted by queries grouped by time(auto). The interval is chosen
+	// from the time range of the query using AutoInterval. Defaults to 0, which targets
+	// DefaultAutoIntervalPoints intervals.
+	AutoIntervalPoints int
+
+	// If true, the points of every series are merged into a single sequence in time order rather
+	// than returned series by series, e.g. for a time ordered export. Each row holds consecutive
+	// points of one series, so its name and tags identify the series of its points, and at most
+	// the chunk size of points, if set. The series are read concurrently, and as each returns its
+	// points in time order only a chunk of each is held at once. Defaults to false.
+	MergeSeries bool
+
+	// If true, the executor checks that the jobs of a query are in ascending order of their
+	// measurements and tag sets, as the Tx must create them, before it runs them. The rows of tag
+	// sets are sent and merged in the order of their jobs, so a query whose jobs are out of order
+	// fails with ErrTagSetOrder rather than returning its series in an inconsistent order. It's
+	// meant for testing implementations of Tx. Defaults to false.
+	StrictTagSetOrder bool
+
+	// If true, the executor checks that every point the map functions of an aggregate read for an
+	// interval, e.g. by a shard computing its GROUP BY time intervals wrongly, is in the interval
+	// the executor is reducing, so points that would be counted in the wrong interval fail the
+	// series with ErrMisalignedPoint rather than silently skewing its results. The points of
+	// mappers that don't map with the functions of their job, such as remote mappers, aren't
+	// checked, and shards don't aggregate from rollups. It's meant for debugging wrong aggregates.
+	// Defaults to false.
+	StrictIntervals bool
+
+	// If true, the GROUP BY time intervals at the edges of the time range of a query that it
+	// doesn't cover completely aren't returned, e.g. the current interval of a query without an
+	// upper time bound, so every interval aggregates the same span of time. Defaults to false,
+	// which returns them with the points that fall in the time range.
+	DropPartialIntervals bool
+
+	// The time of each GROUP BY time interval that its values are sent at: the start of the
+	// interval, its end or its center. Only the times of the rows change, not the intervals the
+	// points fall in. Partial aggregates are always sent at the start of their intervals, so the
+	// node that finalizes them can merge them. Defaults to IntervalStartTime.
+	IntervalTime IntervalTime
+
+	// If true, the executor sends a final row with Done set and the stats of the query
+	// before closing its channel. Defaults to false.
+	EmitDone bool
+
+	// If true, the executor records the time spent by each series in each stage of execution:
+	// reading the mappers, merging raw points, reducing aggregates, transforming the results and
+	// waiting for the consumer to encode the rows. It's reported in the Profile of the stats sent
+	// with EmitDone, to tell whether a slow query is bound by its reads or by computing its results,
+	// so the stages are only timed if EmitDone is also set. Defaults to false, which doesn't read
+	// the clock.
+	Profile bool
+
+	// If true, NaN and infinite float values are skipped by the mappers, so they're neither
+	// returned by raw queries nor aggregated, and they're counted in the stats of the executor.
+	// Defaults to false, which aggregates them like any other value: NaN makes the sum and mean
+	// of an interval NaN, and its min and max NaN unless the interval also has an infinite value.
+	SkipNonFinite bool
+
+	// If true, aggregate queries return the partial state of each aggregate instead of its final
+	// value, e.g. the count and mean of a mean, so a coordinating node can combine the partials
+	// of several sources and finalize them. See InitializePartialReduceFunc for the encoding.
+	// Fill options aren't applied to partials, and queries with aggregates that can't be combined,
+	// such as derivative(), or with math on aggregates are rejected. Defaults to false.
+	PartialAggregates bool
+
+	// If set, the downsamples of raw measurements, by the name of the raw measurement. Aggregate
+	// queries grouped by time over a raw measurement with a downsample read the intervals that end
+	// before the raw window of the downsample from the downsampled measurement, and the recent ones
+	// from the raw measurement, so wide time ranges read far fewer points. See Downsample for the
+	// queries that are redirected. Defaults to nil, which always reads the raw measurement.
+	Downsamples map[string]*Downsample
+
+	// The maximum number of points read from a mapper, or sent in a single row, at once by raw
+	// queries, whatever chunk size is requested. Larger results are split into several rows for
+	// the same series. Defaults to DefaultMaxChunkSize. Zero or less doesn't cap the chunk size.
+	MaxChunkSize int
+
+	// The chunk size of raw queries planned with UseDefaultChunkSize, which is capped at
+	// MaxChunkSize like a requested one. Defaults to DefaultChunkSize.
+	DefaultChunkSize int
+
+	// The approximate maximum number of points of a series a raw query holds at once. The chunks read
+	// from the mappers of the series are made small enough for all of them to fit, and a row is sent
+	// as soon as this many points are waiting, whatever chunk size is requested, so even a single
+	// enormous series that's read from many shards is read with bounded memory. The rows of a series
+	// are still sent in time order. Defaults to 0, which doesn't cap the points held.
+	MaxSeriesBufferedPoints int
+
+	// The most GROUP BY time intervals of a series an aggregate query holds in memory. Every interval
+	// of a series is held until they've all been reduced, unless its aggregates are streamed (see
+	// StreamAggregates), so a series with more intervals fails with an error. Defaults to 0, which
+	// holds up to MaxGroupByPoints intervals.
+	MaxSeriesIntervals int
+
+	// If true, a series with more intervals than MaxSeriesIntervals doesn't fail. Its earliest
+	// intervals that fit are reduced and sent in rows marked as Partial, and the series after it
+	// aren't executed, so the query returns the series completed before the budget is exceeded
+	// and the intervals of the series that exceeds it, rather than nothing. Forecasts with
+	// holt_winters() still fail, as they would extrapolate from the middle of the series. Defaults
+	// to false.
+	PartialOverBudget bool
+
+	// The maximum total length in bytes of the strings concat() joins in an interval. The strings are
+	// buffered until the interval is reduced, so an interval that exceeds it fails its series with
+	// ErrConcatTooLarge rather than growing without bound. Defaults to DefaultMaxConcatBytes. Zero or
+	// less uses DefaultMaxConcatBytes.
+	MaxConcatBytes int
+
+	// The number of chunks each mapper of a raw query reads ahead in the background while the
+	// current chunks are processed, so reads from disk or the network overlap with processing.
+	// Defaults to DefaultPrefetchDepth. Zero or less reads each chunk only when it's needed.
+	PrefetchDepth int
+
+	// If true, Plan returns an error for queries against a measurement that doesn't exist, rather
+	// than planning a query that returns no series. Measurements are looked up before any mappers
+	// are created, so the transaction must implement MeasurementTx. Defaults to false.
+	ErrorOnMissingMeasurement bool
+
+	// The approximate maximum number of bytes of rows sent by a query, estimated from the size of
+	// their encoded names, tags, columns and values. The row that reaches it is cut to the values
+	// that fit and marked Truncated, and no more rows are sent. This bounds the size of responses
+	// with wide rows, unlike LIMIT. Defaults to 0, which doesn't limit the response size.
+	MaxResponseBytes int
+
+	// If true, the mappers of a job that read shards owned by the same node are replaced with a
+	// single mapper for the node, if the transaction implements MultiMapperTx. Defaults to false.
+	CoalesceNodeMappers bool
+
+	// If set, the jobs of raw queries with more mappers than this, e.g. over a time range spanning
+	// hundreds of shard groups, read the shards of adjacent shard groups with one mapper, which
+	// reads them one after another. This trades the parallelism of reading every shard at once for
+	// fewer goroutines and open shards. Only mappers that implement TimeRangeMapper are coalesced,
+	// and coalesced plans can't be reset. The results are the same either way. Defaults to 0, which
+	// keeps a mapper for each shard.
+	MapperCoalesceThreshold int
+
+	// The number of adjacent mappers read by each coalesced mapper. Defaults to 0, which coalesces
+	// as few as needed for each job to have at most MapperCoalesceThreshold mappers.
+	MapperCoalesceFactor int
+
+	// If true, each row records the IDs of the shards whose mappers contributed points to it in
+	// ShardIDs, to help track down the shard a wrong series was read from. Defaults to false.
+	RecordShardIDs bool
+
+	// The aggregate functions queries can call, by name. Queries calling any other function are
+	// rejected. Defaults to DefaultAggregates(), which can be extended with user-defined
+	// aggregates. If nil, the built-in aggregates are used.
+	Aggregates Aggregates
+
+	// If true, aggregate queries grouped by time send their intervals in rows of up to the chunk
+	// size as soon as every mapper has passed them, rather than in a single row per series once
+	// every interval is reduced. This bounds the memory used, and the time to the first row, of
+	// queries over many intervals, which aren't limited to MaxGroupByPoints intervals. Queries with
+	// several aggregates, derivatives, differences, forecasts or an OFFSET are still sent in full.
+	// Defaults to false.
+	StreamAggregates bool
+
+	// The consistency level of the reads from shards with several owners. Levels other than
+	// ReadConsistencyAny require the transaction to implement ConsistencyTx. Defaults to
+	// ReadConsistencyAny.
+	Consistency ReadConsistency
+
+	// If set, the longest a query waits for each mapper to open, e.g. while its shard is locked by a
+	// compaction. A mapper that isn't opened in time fails its series with ErrShardBusy, which is
+	// sent as an error row and marks the query as partial. Defaults to zero, which waits indefinitely.
+	OpenTimeout time.Duration
+
+	// If set, the longest the executor waits for the consumer of Execute to receive a row, e.g. from
+	// a slow or dead HTTP client. A consumer that stalls for longer kills the query: its mappers are
+	// closed once the jobs stop, and a row with ErrIdleTimeout is sent, waiting up to the timeout
+	// again for the consumer to receive it. The time spent producing rows doesn't count. Defaults
+	// to zero, which waits indefinitely.
+	IdleTimeout time.Duration
+
+	// If set, the number of times a read of a mapper that fails with a transient error (see
+	// IsTransient) is retried before the series fails with the error. Only mappers that implement
+	// IntervalSeeker are retried: the mapper is sought back to the checkpoint it would be remapped
+	// at, so the read resumes after the last interval received from it. Permanent errors aren't
+	// retried. Defaults to zero, which fails the series with the first error.
+	RetryAttempts int
+
+	// The time waited before the first retry of a read, which doubles for each further attempt.
+	// Defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+
+	// How raw queries resolve points of the same series at the same nanosecond read from different
+	// shards, a rare corruption that's otherwise returned as several points at one time. The number
+	// of conflicting points is counted in ExecutorStats.ConflictN, so a query run with
+	// ConflictKeepAll diagnoses corrupt data without changing its results. Defaults to
+	// ConflictIgnore, which doesn't look for conflicts.
+	RawConflicts ConflictResolution
+
+	// How queries handle a mapper that returns a point before one it already returned, or an
+	// interval of an aggregate other than the one being reduced, which would otherwise be merged out
+	// of order. Defaults to OutOfOrderError, which fails the series.
+	OutOfOrder OutOfOrderHandling
+
+	// The retention policy ConflictPreferRetentionPolicy prefers the points of. Only the mappers
+	// that implement RetentionPolicyMapper are known to read it.
+	PreferredRetentionPolicy string
+
+	// If true, the rows of a raw query selecting from several measurements with different fields all
+	// have the columns of every selected field, which are null for the points of the measurements
+	// that don't have them, so tabular clients can read every row the same way. The transaction must
+	// implement UnifiedColumnsTx. Defaults to false, which fails queries selecting a field that one
+	// of their measurements doesn't have.
+	UnifyColumns bool
+
+	// If true, mappers that return ErrShardNotFound when they're opened are skipped, so a query
+	// reading a shard that was dropped after the meta store returned it reads the other shards
+	// rather than failing. Defaults to false, which fails the series with ErrShardNotFound.
+	TolerateMissingShards bool
+
+	// If set, the shards skipped because of TolerateMissingShards are logged to it.
+	Logger *log.Logger
+
+	// If set, the soft deadline of queries whose aggregates are streamed (see StreamAggregates),
+	// measured from the start of execution. Unlike a timeout, it returns the data that's ready rather
+	// than an error: once it passes, the complete intervals of the series being reduced that haven't
+	// been sent are sent straight away in a row marked as Partial, even if a mapper is still reading
+	// the next interval. Defaults to zero, which doesn't set a deadline.
+	SoftDeadline time.Duration
+
+	// If true, the series being reduced when the soft deadline passes ends with its partial row, and
+	// the series after it aren't executed. Defaults to false, which continues reading the series
+	// and sends its remaining intervals, and those of the series after it, as usual.
+	AbortAtDeadline bool
+
+	// If set, called with every point read by the map functions of a query, before it's aggregated or
+	// transformed, e.g. to sample or log anomalous values. series is the key of the point's series,
+	// and fields has the values the query reads from the point, which must not be modified. It's
+	// called by the goroutine reading the mappers, so a slow hook slows the query down rather than
+	// points being buffered for it, and the calls for a query are never concurrent. Mappers that
+	// don't map points with the functions of their job, such as remote mappers, don't call it.
+	// Defaults to nil.
+	OnPoint func(series string, t time.Time, fields map[string]interface{})
+
+	// If set, called with the progress of each execution of a query, e.g. to show a progress bar
+	// for a long export. It's called when the fraction of the query processed advances by at least
+	// a percent, and with the complete progress exactly once, when every series has been executed.
+	// Calls for a query are never concurrent, and should return quickly as they hold up execution.
+	// Defaults to nil, which doesn't track progress.
+	OnProgress func(Progress)
+
+	// If set, the types the values of fields are coerced to when mappers decode them, by field name.
+	// It's a recovery tool for fields whose type is inconsistent across shards because of a
+	// historical write bug, which would otherwise fail or skew the aggregates of the merged values,
+	// e.g. treating a field as a float everywhere. See CoerceFieldValue for the coercion rules; a
+	// value that can't be coerced fails the query. Defaults to nil, which reads values as written.
+	FieldTypes map[string]DataType
+
+	// If set, enables adaptive chunking for raw queries. The chunk size of each mapper
+	// that implements PointEstimator is scaled by this function. Defaults to nil, which
+	// uses the requested chunk size for every mapper.
+	ChunkSizeFunc ChunkSizeFunc
+
+	// The registry the executors planned are registered in while they run, so KillAllQueries can
+	// kill them. Planners can share a registry to kill the queries of all of them together.
+	// Defaults to a new registry; if nil, executors aren't registered.
+	Registry *QueryRegistry
+}
+
+// NewPlanner returns a new instance of Planner.
+func NewPlanner(db DB) *Planner {
+	return &Planner{
+		DB:               db,
+		Now:              time.Now,
+		MaxChunkSize:     DefaultMaxChunkSize,
+		DefaultChunkSize: DefaultChunkSize,
+		PrefetchDepth:    DefaultPrefetchDepth,
+		MaxConcatBytes:   DefaultMaxConcatBytes,
+		Aggregates:       DefaultAggregates(),
+		RetryBackoff:     DefaultRetryBackoff,
+		Registry:         NewQueryRegistry(),
+	}
+}
+
+// Plan creates an execution plan for the given SelectStatement and returns an Executor.
+func (p *Planner) Plan(stmt *SelectStatement, chunkSize int) (*Executor, error) {
+	return p.plan(stmt, chunkSize, nil, nil, nil)
+}
+
+// PlanContext creates an execution plan restricted to a scope, such as the series of the tenant
+// running the query. The statement is rejected if it selects from a measurement outside the
+// scope, and the tag filters of the scope are ANDed with the WHERE clause of a copy of it, so it
+// only reads the series that have them. Each job carries the scope to its mappers, which must check it again
+// before reading, so mappers on other nodes don't have to trust the node that planned the query.
+func (p *Planner) PlanContext(stmt *SelectStatement, chunkSize int, scope *Scope) (*Executor, error) {
+	if scope == nil {
+		return p.plan(stmt, chunkSize, nil, nil, nil)
+	}
+	if err := scope.Validate(stmt); err != nil {
+		return nil, err
+	}
+	if cond := scope.condition(); cond != nil {
+		stmt = stmt.Clone()
+		if stmt.Condition != nil {
+			cond = &BinaryExpr{Op: AND, LHS: cond, RHS: &ParenExpr{Expr: stmt.Condition}}
+		}
+		stmt.Condition = cond
+	}
+	return p.plan(stmt, chunkSize, nil, nil, scope)
+}
+
+// normalizeChunkSize returns the chunk size of the jobs of a query planned with chunkSize: the
+// default chunk size for UseDefaultChunkSize, capped at MaxChunkSize. Zero returns everything at
+// once, up to the cap. Other negative chunk sizes are rejected with ErrInvalidChunkSize.
+func (p *Planner) normalizeChunkSize(chunkSize int) (int, error) {
+	if chunkSize == UseDefaultChunkSize {
+		chunkSize = p.DefaultChunkSize
+	}
+	if chunkSize < 0 {
+		return 0, ErrInvalidChunkSize(chunkSize)
+	}
+	return capChunkSize(chunkSize, p.MaxChunkSize), nil
+}
+
+// KillAllQueries kills every executor running in the registry of the planner, e.g. to relieve an
+// overloaded node, and returns the number killed. Each killed executor sends ErrQueryKilled once
+// its jobs have stopped. It's safe to call while queries start and finish.
+func (p *Planner) KillAllQueries() int {
+	if p.Registry == nil {
+		return 0
+	}
+	return p.Registry.KillAll()
+}
+
+// Warm preloads the indexes of the shards of a retention policy of a database, so the first
+// queries reading them, e.g. after startup or before a known heavy dashboard load, don't wait for
+// them to be read from disk. Warming touches the index of each shard, not its points. It stops
+// with ErrWarmCanceled once closing is closed, which may be nil if it can't be canceled.
+func (p *Planner) Warm(database, retentionPolicy string, closing <-chan struct{}) error {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return err
+	}
+	wtx, ok := tx.(WarmTx)
+	if !ok {
+		return ErrWarmNotSupported
+	}
+	return wtx.Warm(database, retentionPolicy, closing)
+}
+
+// PlanSnapshot creates an execution plan that only reads from the shard groups with the given IDs,
+// rather than the shard groups that overlap the time range of the statement. Planning a query with
+// the same shard groups again returns the same results, even as new shard groups are created. The
+// transaction must implement SnapshotTx, and an error is returned if any of the groups was dropped.
+func (p *Planner) PlanSnapshot(stmt *SelectStatement, chunkSize int, shardGroupIDs []uint64) (*Executor, error) {
+	if len(shardGroupIDs) == 0 {
+		return nil, ErrSnapshotShardGroupsRequired
+	}
+	return p.plan(stmt, chunkSize, shardGroupIDs, nil, nil)
+}
+
+// PlanResume creates an execution plan that continues a raw query from a resume token recorded
+// from the rows of an earlier execution of the same statement. The mappers of each series in the
+// token start reading at its position and the points up to and including it are skipped, so the
+// rows return exactly the points that weren't recorded, as long as no points were written at or
+// before the position since. Series that aren't in the token are read from the start.
+//
+// Points with the same time are skipped by their count, so mappers must return them in the same
+// order every time they're read, as they must to be remapped.
+func (p *Planner) PlanResume(stmt *SelectStatement, chunkSize int, token *ResumeToken) (*Executor, error) {
+	if !stmt.IsRawQuery || stmt.Limit > 0 || stmt.Offset > 0 || stmt.Join == InnerJoin || stmt.HasDerivative() || stmt.HasDifference() {
+		return nil, ErrResumeNotSupported
+	}
+	return p.plan(stmt, chunkSize, nil, token, nil)
+}
+
+// plan creates an execution plan for the statement. If shardGroupIDs is set, only those shard groups are read.
+// If resume is set, the series in it are read from their positions. If scope is set, it's passed to the mappers.
+func (p *Planner) plan(stmt *SelectStatement, chunkSize int, shardGroupIDs []uint64, resume *ResumeToken, scope *Scope) (*Executor, error) {
+	chunkSize, err := p.normalizeChunkSize(chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	now := p.Now().UTC()
+
+	// Replace instances of "now()" with the current time.
+	stmt.Condition = Reduce(stmt.Condition, &NowValuer{Now: now})
+
+	// Guard against queries that would scan from the start of the epoch. A lower bound in the
+	// statement takes precedence over Since, which takes precedence over the defaults.
+	var window time.Duration
+	if tmin, _ := TimeRange(stmt.Condition); tmin.IsZero() {
+		window = p.Since
+		if window <= 0 && p.RequireTimeBound {
+			return nil, ErrTimeBoundRequired
+		} else if window <= 0 {
+			window = p.DefaultQueryWindow
+		}
+	}
+
+	// The lower time bound and the interval of time(auto) queries are set on a copy of the
+	// statement, which is planned instead, so the statement gets them from its own time range if
+	// it's planned again.
+	if window > 0 || stmt.IsAutoInterval() {
+		stmt = stmt.Clone()
+	}
+	if window > 0 {
+		cond := &BinaryExpr{Op: GTE, LHS: &VarRef{Val: "time"}, RHS: &TimeLiteral{Val: now.Add(-window)}}
+		if stmt.Condition != nil {
+			cond = &BinaryExpr{Op: AND, LHS: &ParenExpr{Expr: stmt.Condition}, RHS: cond}
+		}
+		stmt.Condition = cond
+	}
+
+	// Choose the interval of time(auto) queries from their time range, so the rest of the plan uses
+	// it like any other.
+	if stmt.IsAutoInterval() {
+		tmin, tmax := TimeRange(stmt.Condition)
+		if tmin.IsZero() {
+			return nil, ErrAutoIntervalTimeBound
+		} else if tmax.IsZero() {
+			tmax = now
+		}
+		stmt.SetGroupByInterval(AutoInterval(tmin, tmax, p.AutoIntervalPoints, p.Precision))
+	}
+
+	// Align the intervals to the time origin by adding it to the offset. A copy of the statement
+	// is planned with the combined offset, so the mappers and the executor use the same intervals.
+	if !p.TimeOrigin.IsZero() {
+		if stmt, err = alignGroupByOffset(stmt, p.TimeOrigin); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.PartialAggregates && !stmt.IsRawQuery {
+		if err := validatePartialAggregates(stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	// Reject calls to functions that aren't aggregates before any data is read.
+	aggregates := p.Aggregates
+	if aggregates == nil {
+		aggregates = builtinAggregates
+	}
+	for _, c := range stmt.FunctionCalls() {
+		if _, _, err := aggregates.lookup(c); err != nil {
+			return nil, err
+		}
+	}
+
+	// Begin an unopened transaction.
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	// Restrict the transaction to the shard groups of a snapshot.
+	if shardGroupIDs != nil {
+		stx, ok := tx.(SnapshotTx)
+		if !ok {
+			return nil, ErrSnapshotNotSupported
+		}
+		stx.SetShardGroupIDs(shardGroupIDs)
+	}
+
+	// Select among the owners of each shard at the consistency level of the planner.
+	if p.Consistency != ReadConsistencyAny {
+		ctx, ok := tx.(ConsistencyTx)
+		if !ok {
+			return nil, ErrReadConsistencyNotSupported(p.Consistency)
+		}
+		if err := ctx.SetReadConsistency(p.Consistency); err != nil {
+			return nil, err
+		}
+	}
+
+	// Return null for the fields a measurement doesn't have, so every row has the same columns.
+	if p.UnifyColumns {
+		utx, ok := tx.(UnifiedColumnsTx)
+		if !ok {
+			return nil, ErrUnifyColumnsNotSupported
+		} else if !stmt.IsRawQuery {
+			return nil, ErrUnifyColumnsAggregate
+		}
+		utx.SetUnifyColumns()
+	}
+
+	// Determine group by tag keys.
+	interval, tags, err := stmt.Dimensions.Normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := stmt.GroupByOffset()
+	if err != nil {
+		return nil, err
+	}
+
+	// SLIMIT and SOFFSET page through the series of a query, so the query must be able to return
+	// more than one.
+	if (stmt.SLimit > 0 || stmt.SOffset > 0) && len(tags) == 0 && !hasMultipleMeasurements(stmt.Sources) {
+		return nil, ErrSLimitSingleSeries
+	}
+
+	// Intervals must start on a multiple of the precision, so truncating their start time doesn't
+	// move points into a different interval.
+	if p.Precision < 0 {
+		return nil, fmt.Errorf("invalid precision: %s", p.Precision)
+	} else if p.Precision > 0 && interval%p.Precision != 0 {
+		return nil, fmt.Errorf("GROUP BY time interval %s must be a multiple of the precision %s", FormatDuration(interval), FormatDuration(p.Precision))
+	} else if p.Precision > 0 && offset%p.Precision != 0 {
+		return nil, fmt.Errorf("GROUP BY time offset %s must be a multiple of the precision %s", FormatDuration(offset), FormatDuration(p.Precision))
+	}
+
+	if p.ErrorOnMissingMeasurement {
+		if err := checkMeasurementsExist(tx, stmt); err != nil {
+			return nil, err
+		}
+	}
+
+	// Queries grouped by window() aggregate the window ending with each interval, so their jobs also
+	// read the intervals before their time range that the windows of their first intervals start
+	// with. The windows of time(auto) queries must be made of whole intervals of the chosen interval.
+	windowSize, err := stmt.WindowSize()
+	if err != nil {
+		return nil, err
+	}
+	jobStmt := stmt
+	var windowMin time.Time
+	if windowSize > 0 {
+		if err := stmt.validateWindow(); err != nil {
+			return nil, err
+		} else if p.PartialAggregates {
+			return nil, errors.New("window() doesn't support partial aggregates")
+		}
+		if windowMin, _ = TimeRange(stmt.Condition); windowMin.IsZero() {
+			return nil, ErrWindowTimeBound
+		}
+		start := IntervalStart(windowMin.UnixNano(), interval.Nanoseconds(), offset.Nanoseconds()) - int64(windowSize-interval)
+		jobStmt = withTimeRangeStart(stmt, time.Unix(0, start))
+	}
+
+	// TODO: hanldle queries that select from multiple measurements. This assumes that we're only selecting from a single one
+	jobs, err := tx.CreateMapReduceJobs(jobStmt, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	// LIMIT and OFFSET the unique series. Without an SLIMIT, every series after the SOFFSET is returned.
+	if stmt.SLimit > 0 || stmt.SOffset > 0 {
+		if stmt.SOffset > len(jobs) {
+			jobs = nil
+		} else {
+			end := len(jobs)
+			if stmt.SLimit > 0 && stmt.SOffset+stmt.SLimit < end {
+				end = stmt.SOffset + stmt.SLimit
+			}
+			jobs = jobs[stmt.SOffset:end]
 		}
 	}
 
-	return mathResults
-}
+	// Each job returns a series. The tag sets of the jobs come from the index, so this is checked
+	// before any mappers are opened.
+	if p.MaxSeriesPerQuery > 0 && len(jobs) > p.MaxSeriesPerQuery {
+		return nil, fmt.Errorf("query would return %d series, which exceeds the maximum of %d; add tag filters to the WHERE clause or use SLIMIT", len(jobs), p.MaxSeriesPerQuery)
+	}
 
-// processFill will take the results and return new reaults (or the same if no fill modifications are needed) with whatever fill options the query has.
-func (m *MapReduceJob) processFill(results [][]interface{}) [][]interface{} {
-	// don't do anything if we're supposed to leave the nulls
-	if m.stmt.Fill == NullFill {
-		return results
+	// Count the points of each bin of values of queries grouped by value_bucket().
+	bucketWidth, err := stmt.ValueBucketWidth()
+	if err != nil {
+		return nil, err
+	} else if bucketWidth > 0 && p.PartialAggregates {
+		return nil, errors.New("value_bucket() doesn't support partial aggregates")
 	}
 
-	if m.stmt.Fill == NoFill {
-		// remove any rows that have even one nil value. This one is tricky because they could have multiple
-		// aggregates, but this option means that any row that has even one nil gets purged.
-		newResults := make([][]interface{}, 0, len(results))
-		for _, vals := range results {
-			hasNil := false
-			// start at 1 because the first value is always time
-			for j := 1; j < len(vals); j++ {
-				if vals[j] == nil {
-					hasNil = true
-					break
-				}
-			}
-			if !hasNil {
-				newResults = append(newResults, vals)
-			}
+	// The jobs stop once the executor is killed
+	kill := &killSwitch{}
+
+	// The jobs add the time of their stages to the profile of the query, if it's profiled. The
+	// profile is only reported in the final row, so there's nothing to time without one.
+	var profile *stageProfile
+	if p.Profile && p.EmitDone {
+		profile = &stageProfile{}
+	}
+
+	// The jobs share the hook, so its calls are serialized across them
+	var onPoint *pointHook
+	if p.OnPoint != nil {
+		onPoint = &pointHook{fn: p.OnPoint}
+	}
+
+	// Read the older intervals of queries over a downsampled measurement from the downsample. The
+	// jobs of the downsample are set up like those of the query, and their mappers are then moved
+	// into the jobs of the same series.
+	split, ds := p.downsampleSplit(stmt, interval, offset)
+	if ds != nil && ((scope != nil && !scope.AllowsMeasurement(ds.Measurement.Name)) || windowSize > 0 || stmt.Hints.NoDownsample) {
+		ds = nil
+	}
+	var dsJobs []*MapReduceJob
+	if ds != nil {
+		dsStmt := stmt.Clone()
+		dsStmt.Sources = Sources{ds.Measurement}
+		if dsJobs, err = tx.CreateMapReduceJobs(dsStmt, tags); err != nil {
+			return nil, err
 		}
-		return newResults
 	}
 
-	// they're either filling with previous values or a specific number
-	for i, vals := range results {
-		// start at 1 because the first value is always time
-		for j := 1; j < len(vals); j++ {
-			if vals[j] == nil {
-				switch m.stmt.Fill {
-				case PreviousFill:
-					if i != 0 {
-						vals[j] = results[i-1][j]
-					}
-				case NumberFill:
-					vals[j] = m.stmt.FillValue
-				}
+	for _, j := range append(append([]*MapReduceJob{}, jobs...), dsJobs...) {
+		// Order the mappers by shard, however they were created, so each job reads its shards in
+		// the same order every time.
+		sort.Sort(Mappers(j.Mappers))
+
+		j.interval = interval.Nanoseconds()
+		j.offset = offset.Nanoseconds()
+		j.stmt = stmt
+		j.chunkSize = chunkSize
+		j.chunkSizeFunc = p.ChunkSizeFunc
+		j.maxChunkSize = p.MaxChunkSize
+		j.prefetchDepth = p.PrefetchDepth
+		if stmt.Hints.NoPrefetch {
+			j.prefetchDepth = 0
+		}
+		j.precision = p.Precision.Nanoseconds()
+		j.SkipNonFinite = p.SkipNonFinite
+		j.FieldTypes = p.FieldTypes
+		j.Scope = scope
+		j.partial = p.PartialAggregates
+		j.recordShardIDs = p.RecordShardIDs
+		j.aggregates = aggregates
+		j.streamAggregates = p.StreamAggregates && !stmt.Hints.NoStreamAggregates
+		j.openTimeout = p.OpenTimeout
+		j.retryAttempts = p.RetryAttempts
+		j.retryBackoff = p.RetryBackoff
+		j.conflictRes = p.RawConflicts
+		j.preferredRP = p.PreferredRetentionPolicy
+		j.outOfOrder = p.OutOfOrder
+		j.tolerateMissingShards = p.TolerateMissingShards
+		j.logger = p.Logger
+		j.dropPartialIntervals = p.DropPartialIntervals
+		j.intervalTime = p.IntervalTime
+		j.kill = kill
+		j.profile = profile
+		j.maxBufferedPoints = p.MaxSeriesBufferedPoints
+		j.maxIntervals = p.MaxSeriesIntervals
+		j.maxConcatBytes = p.MaxConcatBytes
+		j.partialOverBudget = p.PartialOverBudget
+		j.strictIntervals = p.StrictIntervals
+		j.onPoint = onPoint
+		j.bucketWidth = bucketWidth
+		if windowSize > 0 {
+			j.TMin = windowMin.UnixNano()
+			j.windowN = int(windowSize / interval)
+		}
+		if resume != nil {
+			j.resume = resume.position(j.MeasurementName, j.TagSet.Tags)
+		}
+
+		// Read the shards each node owns with one mapper, so the query makes a single request
+		// to each node rather than one per shard.
+		if mtx, ok := tx.(MultiMapperTx); ok && p.CoalesceNodeMappers && !stmt.Hints.NoCoalesce {
+			if err := j.coalesceNodeMappers(mtx); err != nil {
+				return nil, err
 			}
 		}
+		if p.MapperCoalesceThreshold > 0 && !stmt.Hints.NoCoalesce {
+			j.coalesceAdjacentMappers(p.MapperCoalesceThreshold, p.MapperCoalesceFactor)
+		}
 	}
-	return results
+	if ds != nil {
+		splitDownsampledJobs(jobs, dsJobs, split)
+	}
+
+	return &Executor{tx: tx, stmt: stmt, jobs: jobs, interval: interval.Nanoseconds(), emitDone: p.EmitDone, maxResponseBytes: p.MaxResponseBytes, mergeSeries: p.MergeSeries, strictTagSetOrder: p.StrictTagSetOrder, softDeadline: p.SoftDeadline, abortAtDeadline: p.AbortAtDeadline, onProgress: p.OnProgress, idleTimeout: p.IdleTimeout, kill: kill, profile: profile, registry: p.Registry}, nil
 }
 
-func getProcessor(expr Expr, startIndex int) (processor, int) {
-	switch expr := expr.(type) {
-	case *VarRef:
-		return newEchoProcessor(startIndex), startIndex + 1
-	case *Call:
-		return newEchoProcessor(startIndex), startIndex + 1
-	case *BinaryExpr:
-		return getBinaryProcessor(expr, startIndex)
-	case *ParenExpr:
-		return getProcessor(expr.Expr, startIndex)
-	case *NumberLiteral:
-		return newLiteralProcessor(expr.Val), startIndex
-	case *StringLiteral:
-		return newLiteralProcessor(expr.Val), startIndex
-	case *BooleanLiteral:
-		return newLiteralProcessor(expr.Val), startIndex
-	case *TimeLiteral:
-		return newLiteralProcessor(expr.Val), startIndex
-	case *DurationLiteral:
-		return newLiteralProcessor(expr.Val), startIndex
+// Executor represents the implementation of Executor.
+// It executes all reducers and combines their result into a row.
+type Executor struct {
+	tx       Tx               // transaction
+	stmt     *SelectStatement // original statement
+	jobs     []*MapReduceJob  // one job per unique tag set that will return in the query
+	interval int64            // the group by interval of the query in nanoseconds
+	emitDone bool             // if true, a final row with the stats of the query is sent
+	executed bool             // true once execution has started, until the executor is reset
+
+	maxResponseBytes int  // if set, rows are cut off once their estimated size reaches this
+	mergeSeries      bool // if true, the points of every series are merged into a single time ordered sequence
+
+	strictTagSetOrder bool // if true, the jobs are checked to be in ascending order of their keys before they're run
+
+	softDeadline    time.Duration // if set, streamed aggregates send their complete intervals once this has passed
+	abortAtDeadline bool          // if true, execution stops at the soft deadline
+
+	onProgress func(Progress) // if set, called with the progress of execution
+
+	idleTimeout time.Duration // if set, the query is killed once a row isn't received within this
+
+	kill     *killSwitch    // stops the jobs when the executor is killed
+	profile  *stageProfile  // if set, the time the jobs spend in each stage of execution
+	registry *QueryRegistry // if set, the executor is registered in it while it's executed
+	done     chan struct{}  // closed once the current execution has finished
+}
+
+// ExecutorStats summarizes the execution of a query.
+type ExecutorStats struct {
+	RowN      int           // the number of rows sent, excluding the final row
+	PointN    int           // the number of values sent
+	SeriesN   int           // the number of distinct series sent, by name and tags, which chunked series span several rows of
+	ColumnN   int           // the number of distinct columns of the rows sent, including time
+	Partial   bool          // true if execution stopped early because of an error, or rows were sent at the soft deadline
+	Interval  time.Duration // the GROUP BY time interval, including one chosen for time(auto)
+	SkippedN  int           // the number of NaN and infinite values skipped by the mappers
+	ConflictN int           // the number of raw points of a series at the same time as one read from another shard
+	Duration  time.Duration // the time taken to execute the query
+
+	Truncated bool // true if rows were cut off at the maximum response size
+
+	Profile *Profile // if the planner's Profile option is set, the time spent in each stage of execution
+}
+
+// Profile is the time the series of a query spent in each stage of execution, summed over the
+// series. The series are executed one at a time, so the stages add up to about the duration of
+// the query, unless its series are merged or joined, which executes them concurrently.
+type Profile struct {
+	Read      time.Duration // opening and reading the mappers, including waiting for prefetched chunks
+	Merge     time.Duration // merging the points of raw queries, and applying their offsets and limits
+	Reduce    time.Duration // combining the outputs of the mappers for each interval of aggregates
+	Transform time.Duration // math, fill, derivatives, differences and forecasts, and building the rows
+	Encode    time.Duration // waiting for the consumer to receive rows, while it encodes and writes the rows before
+}
+
+// Total returns the time spent in every stage.
+func (p *Profile) Total() time.Duration {
+	return p.Read + p.Merge + p.Reduce + p.Transform + p.Encode
+}
+
+// stage is a stage of execution timed by a profile.
+type stage int
+
+const (
+	stageRead stage = iota
+	stageMerge
+	stageReduce
+	stageTransform
+	stageEncode
+	stageN
+)
+
+// stageProfile accumulates the time the jobs of a query spend in each stage. Jobs that are executed
+// concurrently add to it at the same time.
+type stageProfile struct {
+	d [stageN]int64 // the nanoseconds spent in each stage, added to atomically
+}
+
+// reset clears the profile before an execution.
+func (p *stageProfile) reset() {
+	if p == nil {
+		return
+	}
+	for i := range p.d {
+		atomic.StoreInt64(&p.d[i], 0)
 	}
-	panic("unreachable")
 }
 
-type processor func(values []interface{}) interface{}
+// profile returns the time spent in each stage, or nil if the query isn't profiled.
+func (p *stageProfile) profile() *Profile {
+	if p == nil {
+		return nil
+	}
+	d := func(s stage) time.Duration { return time.Duration(atomic.LoadInt64(&p.d[s])) }
+	return &Profile{
+		Read:      d(stageRead),
+		Merge:     d(stageMerge),
+		Reduce:    d(stageReduce),
+		Transform: d(stageTransform),
+		Encode:    d(stageEncode),
+	}
+}
 
-func newEchoProcessor(index int) processor {
-	return func(values []interface{}) interface{} {
-		return values[index]
+// start returns a timer for an execution of a job that's in stage s, or nil if the query isn't
+// profiled.
+func (p *stageProfile) start(s stage) *stageTimer {
+	if p == nil {
+		return nil
 	}
+	return &stageTimer{p: p, stage: s, since: time.Now()}
 }
 
-func newLiteralProcessor(val interface{}) processor {
-	return func(values []interface{}) interface{} {
-		return val
+// stageTimer times the stages of an execution of a job, adding the time spent in each to the
+// profile of the query. A nil or stopped timer does nothing, so the stages of jobs that aren't
+// profiled cost a nil check.
+type stageTimer struct {
+	mu    sync.Mutex // protects the timer from intervals of streamed aggregates reduced in the background
+	p     *stageProfile
+	stage stage
+	since time.Time
+}
+
+// enter adds the time since the timer last changed stage to the current stage, and moves to stage
+// s. It returns the stage the timer was in, so a function can time itself with
+// defer t.enter(t.enter(s)).
+func (t *stageTimer) enter(s stage) stage {
+	if t == nil {
+		return s
 	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.p == nil {
+		return s
+	}
+
+	now := time.Now()
+	atomic.AddInt64(&t.p.d[t.stage], int64(now.Sub(t.since)))
+	prev := t.stage
+	t.stage, t.since = s, now
+	return prev
 }
 
-func getBinaryProcessor(expr *BinaryExpr, startIndex int) (processor, int) {
-	lhs, index := getProcessor(expr.LHS, startIndex)
-	rhs, index := getProcessor(expr.RHS, index)
+// stop adds the time of the current stage, and stops the timer.
+func (t *stageTimer) stop() {
+	if t == nil {
+		return
+	}
+	t.enter(t.stage)
 
-	return newBinaryExprEvaluator(expr.Op, lhs, rhs), index
+	t.mu.Lock()
+	t.p = nil
+	t.mu.Unlock()
 }
 
-func newBinaryExprEvaluator(op Token, lhs, rhs processor) processor {
-	switch op {
-	case ADD:
-		return func(values []interface{}) interface{} {
-			l := lhs(values)
-			r := rhs(values)
-			if lv, ok := l.(float64); ok {
-				if rv, ok := r.(float64); ok {
-					if rv != 0 {
-						return lv + rv
-					}
-				}
-			}
-			return nil
-		}
-	case SUB:
-		return func(values []interface{}) interface{} {
-			l := lhs(values)
-			r := rhs(values)
-			if lv, ok := l.(float64); ok {
-				if rv, ok := r.(float64); ok {
-					if rv != 0 {
-						return lv - rv
-					}
-				}
-			}
-			return nil
-		}
-	case MUL:
-		return func(values []interface{}) interface{} {
-			l := lhs(values)
-			r := rhs(values)
-			if lv, ok := l.(float64); ok {
-				if rv, ok := r.(float64); ok {
-					if rv != 0 {
-						return lv * rv
-					}
+// Progress is the progress of the execution of a query, which is passed to the planner's OnProgress
+// hook. The mappers of a series that ends early, e.g. because of an error or a limit, count as
+// drained, and the intervals it didn't reduce as completed.
+type Progress struct {
+	CompletedIntervals int // the intervals of aggregates reduced, one per aggregate in each interval of each series
+	TotalIntervals     int // the intervals of aggregates the query reduces, zero for raw queries
+	DrainedMappers     int // the mappers that have returned all their data
+	TotalMappers       int // the mappers of every series of the query
+}
+
+// Fraction returns the fraction of the query processed, from 0 to 1. It's the fraction of intervals
+// completed for aggregate queries and of mappers drained for raw queries. A query without any
+// mappers is complete.
+func (p Progress) Fraction() float64 {
+	if p.TotalIntervals > 0 {
+		return float64(p.CompletedIntervals) / float64(p.TotalIntervals)
+	} else if p.TotalMappers > 0 {
+		return float64(p.DrainedMappers) / float64(p.TotalMappers)
+	}
+	return 1
+}
+
+// progressTracker reports the progress of an execution to the planner's OnProgress hook. It's
+// shared by the jobs of the query, so its calls are serialized even if several mappers are read
+// at once.
+type progressTracker struct {
+	mu      sync.Mutex
+	fn      func(Progress)
+	p       Progress
+	percent int // the percentage of the query processed when progress was last reported
+}
+
+// startProgress starts tracking the progress of an execution, with a share of it for each job.
+// It returns nil if the planner's hook isn't set.
+func (e *Executor) startProgress() *progressTracker {
+	if e.onProgress == nil {
+		return nil
+	}
+
+	t := &progressTracker{fn: e.onProgress}
+	for _, j := range e.jobs {
+		j.progress = &progressShare{tracker: t, intervals: j.progressIntervals(), mappers: len(j.Mappers)}
+		t.p.TotalIntervals += j.progress.intervals
+		t.p.TotalMappers += j.progress.mappers
+	}
+	return t
+}
+
+// finish reports the complete progress of the execution.
+func (t *progressTracker) finish() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.CompletedIntervals, t.p.DrainedMappers = t.p.TotalIntervals, t.p.TotalMappers
+	t.fn(t.p)
+}
+
+// progressShare is the part of the progress of an execution a job hasn't completed yet. Its
+// methods do nothing if it's nil, so jobs can call them whether progress is tracked or not.
+type progressShare struct {
+	tracker   *progressTracker
+	intervals int // the intervals the job hasn't reduced
+	mappers   int // the mappers of the job that haven't been drained
+}
+
+// advance adds intervals and drained mappers of the job to the progress, reporting it if it has
+// advanced by at least a percent. Complete progress is only reported once execution finishes.
+func (s *progressShare) advance(intervals, mappers int) {
+	if s == nil {
+		return
+	}
+
+	t := s.tracker
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.add(intervals, mappers)
+	if percent := int(t.p.Fraction() * 100); percent > t.percent && percent < 100 {
+		t.percent = percent
+		t.fn(t.p)
+	}
+}
+
+// complete adds everything the job hasn't completed to the progress.
+func (s *progressShare) complete() {
+	if s == nil {
+		return
+	}
+
+	s.tracker.mu.Lock()
+	n, m := s.intervals, s.mappers
+	s.tracker.mu.Unlock()
+	s.advance(n, m)
+}
+
+// add moves up to intervals and mappers of the job to the progress. The tracker's lock must be held.
+func (s *progressShare) add(intervals, mappers int) {
+	if intervals > s.intervals {
+		intervals = s.intervals
+	}
+	if mappers > s.mappers {
+		mappers = s.mappers
+	}
+	s.intervals -= intervals
+	s.mappers -= mappers
+	s.tracker.p.CompletedIntervals += intervals
+	s.tracker.p.DrainedMappers += mappers
+}
+
+// Interval returns the GROUP BY time interval of the query, or zero if it isn't grouped by time.
+// For a query grouped by time(auto), it's the interval chosen by the planner.
+func (e *Executor) Interval() time.Duration { return time.Duration(e.interval) }
+
+// Execute begins execution of the query and returns a channel to receive rows.
+func (e *Executor) Execute() <-chan *Row {
+	// Create output channel and stream data in a separate goroutine.
+	out := make(chan *Row, 0)
+	if e.executed {
+		go func() {
+			out <- &Row{Err: ErrExecuted}
+			close(out)
+		}()
+		return out
+	}
+	e.executed = true
+	e.done = make(chan struct{})
+	if e.idleTimeout > 0 {
+		ch, done := make(chan *Row, 0), make(chan struct{})
+		go func() {
+			e.execute(ch)
+			close(done)
+		}()
+		go e.forwardIdle(ch, out, done)
+		return out
+	}
+	go e.execute(out)
+
+	return out
+}
+
+// ErrIdleTimeout is sent when the consumer of a query doesn't receive a row within the idle
+// timeout of the planner, which kills the query.
+var ErrIdleTimeout = errors.New("query killed: rows not received within the idle timeout")
+
+// forwardIdle sends the rows of in to out, and closes out once in is closed. If a row isn't
+// received from out within the idle timeout, the query is killed, and the rest of its rows are
+// dropped so the jobs can stop. Once execution is done and the mappers are closed, ErrIdleTimeout
+// is sent, waiting up to the timeout again for the consumer to receive it.
+func (e *Executor) forwardIdle(in <-chan *Row, out chan<- *Row, done <-chan struct{}) {
+	defer close(out)
+
+	// the timer only runs while a row is waiting to be received
+	timer := time.NewTimer(e.idleTimeout)
+	timer.Stop()
+	for row := range in {
+		timer.Reset(e.idleTimeout)
+		select {
+		case out <- row:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
 				}
 			}
-			return nil
+			continue
+		case <-timer.C:
 		}
-	case DIV:
-		return func(values []interface{}) interface{} {
-			l := lhs(values)
-			r := rhs(values)
-			if lv, ok := l.(float64); ok {
-				if rv, ok := r.(float64); ok {
-					if rv != 0 {
-						return lv / rv
-					}
-				}
-			}
-			return nil
+
+		e.kill.kill()
+		for range in {
 		}
-	default:
-		// we shouldn't get here, but give them back nils if it goes this way
-		return func(values []interface{}) interface{} {
-			return nil
+		<-done
+		timer.Reset(e.idleTimeout)
+		select {
+		case out <- &Row{Err: ErrIdleTimeout}:
+			timer.Stop()
+		case <-timer.C:
 		}
+		return
 	}
 }
 
-// resultsEmpty will return true if the all the result values are empty or contain only nulls
-func (m *MapReduceJob) resultsEmpty(resultValues [][]interface{}) bool {
-	for _, vals := range resultValues {
-		// start the loop at 1 because we want to skip over the time value
-		for i := 1; i < len(vals); i++ {
-			if vals[i] != nil {
-				return false
+// Iterator returns an iterator that returns the rows of the query as they're requested. It's an
+// alternative to Execute for consumers that pull rows on demand, such as a paging API. Execution
+// starts on the first call to Next, and the mappers are only ever one row ahead of the consumer.
+func (e *Executor) Iterator() (*RowIterator, error) {
+	if e.executed {
+		return nil, ErrExecuted
+	}
+	e.executed = true
+	return &RowIterator{e: e}, nil
+}
+
+// RowIterator returns the rows of an executor on demand. Errors are returned as rows, as they are
+// by Execute. Close must be called if the iterator isn't read to the end.
+type RowIterator struct {
+	e      *Executor
+	ch     chan *Row
+	closed bool
+}
+
+// Next returns the next row, or false once every row has been returned or the iterator is closed.
+func (itr *RowIterator) Next() (*Row, bool) {
+	if itr.closed {
+		return nil, false
+	} else if itr.ch == nil {
+		// The channel is unbuffered, so each row is only produced once the previous one is read.
+		itr.ch = make(chan *Row, 0)
+		itr.e.done = make(chan struct{})
+		go itr.e.execute(itr.ch)
+	}
+
+	row, ok := <-itr.ch
+	return row, ok
+}
+
+// Close discards the rows that haven't been returned. If execution has started, the remaining
+// rows are drained in the background so the jobs can finish and close their mappers.
+func (itr *RowIterator) Close() {
+	if itr.closed {
+		return
+	}
+	itr.closed = true
+	if itr.ch != nil {
+		go func(ch chan *Row) {
+			for _ = range ch {
 			}
-		}
+		}(itr.ch)
 	}
-	return true
 }
 
-// processRawResults will handle converting the reduce results from a raw query into a Row
-func (m *MapReduceJob) processRawResults(values []*rawQueryMapOutput) *Row {
-	selectNames := m.stmt.NamesInSelect()
+// Reset sets the time range of the query to [start, end) so it can be executed again without
+// being planned again. The jobs and their mappers are reused, and the mappers seek to the new
+// time range when they're next opened.
+//
+// Reuse is safe for repeated queries over a stable set of shards and series, such as a
+// downsampling task that moves its time range forward every interval. The tag sets of the jobs
+// are those found when the query was planned, so series created since aren't read. If the new
+// time range reads from shards the plan doesn't have mappers for, ErrShardSetChanged is returned
+// and the query must be planned again. Reset must not be called while the rows of a previous
+// execution are still being read. It waits for the previous execution to finish closing its
+// mappers, so the rows must have been read to the end, or the iterator closed, first.
+func (e *Executor) Reset(start, end time.Time) error {
+	if e.done != nil {
+		<-e.done
+	}
 
-	// ensure that time is in the select names and in the first position
-	hasTime := false
-	for i, n := range selectNames {
-		if n == "time" {
-			// Swap time to the first argument for names
-			if i != 0 {
-				selectNames[0], selectNames[i] = selectNames[i], selectNames[0]
+	tx, ok := e.tx.(ResetTx)
+	if !ok {
+		return ErrResetNotSupported
+	}
+	for _, j := range e.jobs {
+		for _, mm := range j.Mappers {
+			if _, ok := mm.(Resetter); !ok {
+				return ErrResetNotSupported
 			}
-			hasTime = true
-			break
 		}
 	}
 
-	// time should always be in the list of names they get back
-	if !hasTime {
-		selectNames = append([]string{"time"}, selectNames...)
+	stmt := e.stmt.Clone()
+	if err := stmt.SetTimeRange(start, end); err != nil {
+		return err
+	}
+	if changed, err := tx.ShardSetChanged(stmt); err != nil {
+		return err
+	} else if changed {
+		return ErrShardSetChanged
 	}
 
-	// since selectNames can contain tags, we need to strip them out
-	selectFields := make([]string, 0, len(selectNames))
+	offset, err := stmt.GroupByOffset()
+	if err != nil {
+		return err
+	}
 
-	for _, n := range selectNames {
-		if _, found := m.TagSet.Tags[n]; !found {
-			selectFields = append(selectFields, n)
+	// Restore the state of the jobs that changes while they're executed.
+	tmin, tmax := TimeRange(stmt.Condition)
+	e.kill = &killSwitch{}
+	for _, j := range e.jobs {
+		j.kill = e.kill
+		j.TMin = tmin.UnixNano()
+		j.TMax = tmax.UnixNano()
+		j.interval = e.interval
+		j.offset = offset.Nanoseconds()
+		j.stmt = stmt
+		j.remapN = 0
+		for _, mm := range j.Mappers {
+			if err := mm.(Resetter).Reset(j.TMin, j.TMax); err != nil {
+				return err
+			}
 		}
 	}
+	e.stmt = stmt
+	e.executed = false
 
-	row := &Row{
-		Name:    m.MeasurementName,
-		Tags:    m.TagSet.Tags,
-		Columns: selectFields,
-	}
+	return nil
+}
 
-	// return an empty row if there are no results
-	if len(values) == 0 {
-		return row
+func (e *Executor) close() {
+	for _, j := range e.jobs {
+		j.Close()
 	}
+}
 
-	// if they've selected only a single value we have to handle things a little differently
-	singleValue := len(selectFields) == SelectColumnCountWithOneValue
+// finish ends an execution once its jobs have run: the MRJobs are closed, the executor is
+// unregistered and its complete progress is reported.
+func (e *Executor) finish(progress *progressTracker) {
+	e.close()
+	e.registry.remove(e)
+	progress.finish()
+}
 
-	// the results will have all of the raw mapper results, convert into the row
-	for _, v := range values {
-		vals := make([]interface{}, len(selectFields))
+// execute runs in a separate separate goroutine and streams data from processors. The execution
+// is finished before out is closed, so a consumer that has read every row can reset the executor
+// and execute it again.
+func (e *Executor) execute(out chan *Row) {
+	defer close(e.done)
 
-		if singleValue {
-			vals[0] = time.Unix(0, v.Time).UTC()
-			vals[1] = v.Values.(interface{})
-		} else {
-			fields := v.Values.(map[string]interface{})
+	// Register the executor so it can be killed while it's executed.
+	e.registry.add(e)
 
-			// time is always the first value
-			vals[0] = time.Unix(0, v.Time).UTC()
+	// Track the progress of execution, if the planner's hook is set
+	progress := e.startProgress()
 
-			// populate the other values
-			for i := 1; i < len(selectFields); i++ {
-				vals[i] = fields[selectFields[i]]
+	if !e.emitDone {
+		e.runKillable(out)
+		e.finish(progress)
+		close(out)
+		return
+	}
+
+	// Keep track of the rows sent so they can be summarized in the final row.
+	e.profile.reset()
+	start := time.Now()
+	stats := &ExecutorStats{Interval: e.Interval()}
+	ch := make(chan *Row, 0)
+	go func() {
+		e.runKillable(ch)
+		close(ch)
+	}()
+	series := make(map[string]bool)
+	columns := make(map[string]bool)
+	for row := range ch {
+		if row.Err != nil {
+			stats.Partial = true
+		} else {
+			stats.RowN++
+			stats.PointN += len(row.Values)
+			series[resumeKey(row.Name, row.Tags)] = true
+			for _, c := range row.Columns {
+				columns[c] = true
 			}
+			stats.Truncated = stats.Truncated || row.Truncated
+			stats.Partial = stats.Partial || row.Partial
+		}
+		out <- row
+	}
+	e.finish(progress)
+	stats.Duration = time.Since(start)
+	stats.SeriesN, stats.ColumnN = len(series), len(columns)
+	stats.Profile = e.profile.profile()
+	for _, j := range e.jobs {
+		for _, mm := range j.Mappers {
+			if c, ok := mm.(NonFiniteCounter); ok {
+				stats.SkippedN += c.SkippedN()
+			}
+		}
+		if j.conflicts != nil {
+			stats.ConflictN += j.conflicts.n
 		}
-
-		row.Values = append(row.Values, vals)
 	}
 
-	return row
+	// Mark the end of the output channel.
+	out <- &Row{Done: true, Stats: stats}
+	close(out)
 }
 
-func (m *MapReduceJob) processAggregate(c *Call, reduceFunc ReduceFunc, resultValues [][]interface{}) error {
-	mapperOutputs := make([]interface{}, len(m.Mappers))
-
-	// intialize the mappers
-	for _, mm := range m.Mappers {
-		// for aggregate queries, we use the chunk size to determine how many times NextInterval should be called.
-		// This is the number of buckets that we need to fill.
-		if err := mm.Begin(c, m.TMin, len(resultValues)); err != nil {
-			return err
-		}
+// runKillable runs the jobs, and sends ErrQueryKilled once they've stopped if the executor was
+// killed before they were done.
+func (e *Executor) runKillable(out chan *Row) {
+	e.run(out)
+	if e.kill.finish() {
+		out <- &Row{Err: ErrQueryKilled}
 	}
+}
 
-	// populate the result values for each interval of time
-	for i, _ := range resultValues {
-		// collect the results from each mapper
-		for j, mm := range m.Mappers {
-			res, err := mm.NextInterval()
-			if err != nil {
-				return err
-			}
-			mapperOutputs[j] = res
-		}
-		resultValues[i] = append(resultValues[i], reduceFunc(mapperOutputs))
+// Kill stops the execution of the query. Each job stops before it reads its next interval, so a
+// read in progress completes first, and a row with ErrQueryKilled is sent once the jobs have
+// stopped. It returns false if the executor isn't being executed or was already killed.
+func (e *Executor) Kill() bool { return e.kill.kill() }
+
+// run executes every MRJob and sends their rows to out. If the size of the response is limited,
+// the rows are cut off and the jobs are stopped once the limit is reached.
+func (e *Executor) run(out chan *Row) {
+	if e.maxResponseBytes <= 0 {
+		e.runJobs(out)
+		return
 	}
 
-	return nil
+	ch := make(chan *Row, 0)
+	go func() {
+		e.runJobs(ch)
+		close(ch)
+	}()
+	truncateRows(ch, out, e.maxResponseBytes, e.kill.stop)
 }
 
-type MapReduceJobs []*MapReduceJob
+// runJobs executes every MRJob and sends their rows to out.
+func (e *Executor) runJobs(out chan *Row) {
+	// The rows of tag sets are sent and merged in the order of their jobs
+	if e.strictTagSetOrder {
+		if err := checkTagSetOrder(e.jobs); err != nil {
+			out <- &Row{Err: err}
+			return
+		}
+	}
 
-func (a MapReduceJobs) Len() int           { return len(a) }
-func (a MapReduceJobs) Less(i, j int) bool { return bytes.Compare(a[i].Key(), a[j].Key()) == -1 }
-func (a MapReduceJobs) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+	// Joined sources are combined after every job has run
+	if e.stmt.Join == InnerJoin {
+		e.executeJoin(out)
+		return
+	}
 
-// Mapper will run through a map function. A single mapper will be created
-// for each shard for each tagset that must be hit to satisfy a query.
-// Mappers can either point to a local shard or could point to a remote server.
-type Mapper interface {
-	// Open will open the necessary resources to being the map job. Could be connections to remote servers or
-	// hitting the local bolt store
-	Open() error
+	// Series are interleaved by the time of their points
+	if e.mergeSeries && len(e.jobs) > 1 {
+		e.executeMerge(out)
+		return
+	}
 
-	// Close will close the mapper (either the bolt transaction or the request)
-	Close()
+	// If we have multiple tag sets we'll want to filter out the empty ones
+	filterEmptyResults := len(e.jobs) > 1
 
-	// Begin will set up the mapper to run the map function for a given aggregate call starting at the passed in time.
-	// For raw data queries it will yield to the mapper no more than limit number of points.
-	Begin(aggregate *Call, startingTime int64, limit int) error
+	// Start the soft deadline, which is shared by the jobs
+	var deadline *softDeadline
+	if e.softDeadline > 0 {
+		deadline = newSoftDeadline(e.softDeadline, e.abortAtDeadline)
+		defer deadline.stop()
+	}
 
-	// NextInterval will get the time ordered next interval of the given interval size from the mapper. This is a
-	// forward only operation from the start time passed into Begin. Will return nil when there is no more data to be read.
-	// Interval periods can be different based on time boundaries (months, daylight savings, etc) of the query.
-	NextInterval() (interface{}, error)
-}
+	// Execute each MRJob serially
+	for _, j := range e.jobs {
+		if deadline != nil && deadline.abort && deadline.passed() {
+			break
+		} else if e.kill.killed() {
+			break
+		}
+		j.deadline = deadline
+		j.Execute(out, filterEmptyResults)
 
-type TagSet struct {
-	Tags       map[string]string
-	Filters    []Expr
-	SeriesKeys []string
-	Key        []byte
+		// the series after one that exceeded its budget aren't executed
+		if j.overBudget {
+			break
+		}
+	}
 }
 
-func (t *TagSet) AddFilter(key string, filter Expr) {
-	t.SeriesKeys = append(t.SeriesKeys, key)
-	t.Filters = append(t.Filters, filter)
-}
+// truncateRows sends the rows from in to out until their estimated size reaches max bytes. The row
+// that reaches it is cut to the values that fit and marked as truncated, and stop is called so the
+// jobs sending the rows stop before their next read. The rows they send until then are discarded.
+// Errors are always sent.
+func truncateRows(in <-chan *Row, out chan<- *Row, max int, stop func()) {
+	var n int
+	var truncated bool
+	for row := range in {
+		// keep reading after the limit until the jobs have stopped
+		if row.Err != nil {
+			out <- row
+			continue
+		} else if truncated {
+			continue
+		}
 
-// Planner represents an object for creating execution plans.
-type Planner struct {
-	DB DB
+		n += rowHeaderSize(row)
+		for i, v := range row.Values {
+			if n += valuesSize(v); n > max {
+				row.Values = row.Values[:i]
+				truncated = true
+				break
+			}
+		}
+		if truncated || n >= max {
+			row.Truncated, truncated = true, true
+			stop()
+		}
+		out <- row
+	}
+}
 
-	// Returns the current time. Defaults to time.Now().
-	Now func() time.Time
+// rowHeaderSize returns the approximate number of bytes taken by the name, tags and columns of a
+// row when it's encoded, excluding its values.
+func rowHeaderSize(row *Row) int {
+	n := len(row.Name)
+	for k, v := range row.Tags {
+		n += len(k) + len(v) + 6
+	}
+	for _, c := range row.Columns {
+		n += len(c) + 3
+	}
+	return n + 9*len(row.ShardIDs)
 }
 
-// NewPlanner returns a new instance of Planner.
-func NewPlanner(db DB) *Planner {
-	return &Planner{
-		DB:  db,
-		Now: time.Now,
+// valuesSize returns the approximate number of bytes taken by the values of a point of a row when
+// it's encoded.
+func valuesSize(values []interface{}) int {
+	n := 2
+	for _, v := range values {
+		switch v := v.(type) {
+		case string:
+			n += len(v) + 3
+		case time.Time:
+			n += 33 // a quoted RFC3339Nano time
+		case bool:
+			n += 6
+		case nil:
+			n += 5
+		default:
+			n += 9
+		}
 	}
+	return n
 }
 
-// Plan creates an execution plan for the given SelectStatement and returns an Executor.
-func (p *Planner) Plan(stmt *SelectStatement, chunkSize int) (*Executor, error) {
-	now := p.Now().UTC()
+// executeJoin runs every MRJob and joins their rows by tag set and time. A row is emitted for
+// each tag set present in every measurement, with a value for each time present in every
+// measurement's row. For aggregate queries the times are the start of each GROUP BY interval,
+// so the rows are joined on their intervals. Columns are prefixed with their measurement name.
+func (e *Executor) executeJoin(out chan *Row) {
+	// collect the rows of every job
+	var rows []*Row
+	ch := make(chan *Row, 0)
+	go func() {
+		for _, j := range e.jobs {
+			j.Execute(ch, true)
+			if j.overBudget {
+				break
+			}
+		}
+		close(ch)
+	}()
+	for row := range ch {
+		rows = append(rows, row)
+	}
 
-	// Replace instances of "now()" with the current time.
-	stmt.Condition = Reduce(stmt.Condition, &NowValuer{Now: now})
+	// group the rows by tag set, keeping track of the order measurements and tag sets were seen in.
+	// The chunks of a series are combined into a single row.
+	var names, keys []string
+	seen := make(map[string]bool)
+	rowsByTags := make(map[string]map[string]*Row)
+	for _, row := range rows {
+		if row.Err != nil {
+			out <- row
+			return
+		}
 
-	// Begin an unopened transaction.
-	tx, err := p.DB.Begin()
-	if err != nil {
-		return nil, err
+		if !seen[row.Name] {
+			seen[row.Name] = true
+			names = append(names, row.Name)
+		}
+		key := row.tagsKey()
+		if rowsByTags[key] == nil {
+			rowsByTags[key] = make(map[string]*Row)
+			keys = append(keys, key)
+		}
+		if prev := rowsByTags[key][row.Name]; prev != nil {
+			prev.Values = append(prev.Values, row.Values...)
+			prev.ShardIDs = append(prev.ShardIDs, row.ShardIDs...)
+			prev.Partial = prev.Partial || row.Partial
+			continue
+		}
+		rowsByTags[key][row.Name] = row
 	}
 
-	// Determine group by tag keys.
-	interval, tags, err := stmt.Dimensions.Normalize()
-	if err != nil {
-		return nil, err
-	}
+	for _, key := range keys {
+		// an inner join drops tag sets that aren't present in every measurement
+		byName := rowsByTags[key]
+		if len(byName) != len(names) {
+			continue
+		}
 
-	// TODO: hanldle queries that select from multiple measurements. This assumes that we're only selecting from a single one
-	jobs, err := tx.CreateMapReduceJobs(stmt, tags)
-	if err != nil {
-		return nil, err
-	}
+		joined := &Row{
+			Name:    strings.Join(names, ","),
+			Tags:    byName[names[0]].Tags,
+			Columns: []string{"time"},
+		}
 
-	// LIMIT and OFFSET the unique series
-	if stmt.SLimit > 0 || stmt.SOffset > 0 {
-		if stmt.SOffset > len(jobs) {
-			jobs = nil
-		} else {
-			if stmt.SOffset+stmt.SLimit > len(jobs) {
-				stmt.SLimit = len(jobs) - stmt.SOffset
+		// index the values of each measurement by time
+		valuesByTime := make([]map[int64][]interface{}, len(names))
+		for i, name := range names {
+			row := byName[name]
+			for _, c := range row.Columns[1:] {
+				joined.Columns = append(joined.Columns, name+"."+c)
+			}
+			joined.Partial = joined.Partial || row.Partial
+
+			valuesByTime[i] = make(map[int64][]interface{}, len(row.Values))
+			for _, v := range row.Values {
+				valuesByTime[i][v[0].(time.Time).UnixNano()] = v[1:]
+			}
+		}
+
+		// an inner join drops times that aren't present in every measurement
+	VALUES:
+		for _, v := range byName[names[0]].Values {
+			t := v[0].(time.Time)
+			vals := []interface{}{t}
+			for i := range names {
+				other, ok := valuesByTime[i][t.UnixNano()]
+				if !ok {
+					continue VALUES
+				}
+				vals = append(vals, other...)
 			}
+			joined.Values = append(joined.Values, vals)
+		}
 
-			jobs = jobs[stmt.SOffset : stmt.SOffset+stmt.SLimit]
+		if len(joined.Values) > 0 {
+			set := make(map[uint64]bool)
+			for _, name := range names {
+				for _, id := range byName[name].ShardIDs {
+					set[id] = true
+				}
+			}
+			joined.ShardIDs = sortedShardIDs(set)
+			out <- joined
 		}
 	}
+}
 
-	for _, j := range jobs {
-		j.interval = interval.Nanoseconds()
-		j.stmt = stmt
-		j.chunkSize = chunkSize
+// executeMerge executes every MRJob concurrently and merges the points of their rows into a single
+// time ordered sequence of rows. Points at the same time are sent in the order of the jobs. An error
+// row is sent as soon as it's received, and the rest of the job's rows are discarded.
+func (e *Executor) executeMerge(out chan *Row) {
+	// the jobs of series that fail are drained in the background, and must finish before the
+	// executor closes them
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	h := &seriesStreamHeap{ascending: e.stmt.TimeAscending()}
+	for i, j := range e.jobs {
+		ch := make(chan *Row, 0)
+		wg.Add(1)
+		go func(j *MapReduceJob) {
+			defer wg.Done()
+			j.Execute(ch, true)
+			close(ch)
+		}(j)
+
+		s := &seriesStream{ch: ch, index: i}
+		if s.advance(out) {
+			h.streams = append(h.streams, s)
+		}
+	}
+	heap.Init(h)
+
+	// the row of the series whose points are being collected, and the shards they were read from
+	var row *Row
+	var rowStream *seriesStream
+	var shardIDs map[uint64]bool
+	flush := func() {
+		if row != nil {
+			row.ShardIDs = sortedShardIDs(shardIDs)
+			out <- row
+			row = nil
+		}
 	}
 
-	return &Executor{tx: tx, stmt: stmt, jobs: jobs, interval: interval.Nanoseconds()}, nil
-}
+	chunkSize := e.jobs[0].chunkSize
+	for h.Len() > 0 {
+		s := h.streams[0]
+		if row == nil || s != rowStream || (chunkSize > 0 && len(row.Values) >= chunkSize) {
+			flush()
+			row = &Row{Name: s.row.Name, Tags: s.row.Tags, Columns: s.row.Columns}
+			rowStream = s
+			shardIDs = make(map[uint64]bool)
+		}
+		row.Values = append(row.Values, s.row.Values[s.pos])
+		for _, id := range s.row.ShardIDs {
+			shardIDs[id] = true
+		}
 
-// Executor represents the implementation of Executor.
-// It executes all reducers and combines their result into a row.
-type Executor struct {
-	tx       Tx               // transaction
-	stmt     *SelectStatement // original statement
-	jobs     []*MapReduceJob  // one job per unique tag set that will return in the query
-	interval int64            // the group by interval of the query in nanoseconds
+		if s.advance(out) {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	flush()
 }
 
-// Execute begins execution of the query and returns a channel to receive rows.
-func (e *Executor) Execute() <-chan *Row {
-	// Create output channel and stream data in a separate goroutine.
-	out := make(chan *Row, 0)
-	go e.execute(out)
-
-	return out
+// seriesStream reads the points of the rows of a job one at a time.
+type seriesStream struct {
+	ch    <-chan *Row
+	index int  // the index of the job, which orders points sent at the same time
+	row   *Row // the row of the current point
+	pos   int  // the index of the current point in the row
 }
 
-func (e *Executor) close() {
-	for _, j := range e.jobs {
-		j.Close()
+// advance moves to the next point, reading the next row once every point of the current one has
+// been read. It returns false once there are no more points. If an error row is read it's sent to
+// out, and the remaining rows are drained so the job can finish.
+func (s *seriesStream) advance(out chan *Row) bool {
+	s.pos++
+	for s.row == nil || s.pos >= len(s.row.Values) {
+		row, ok := <-s.ch
+		if !ok {
+			return false
+		} else if row.Err != nil {
+			out <- row
+			go func() {
+				for _ = range s.ch {
+				}
+			}()
+			return false
+		}
+		s.row, s.pos = row, 0
 	}
+	return true
 }
 
-// execute runs in a separate separate goroutine and streams data from processors.
-func (e *Executor) execute(out chan *Row) {
-	// Ensure the the MRJobs close after execution.
-	defer e.close()
+// time returns the time of the current point.
+func (s *seriesStream) time() int64 { return s.row.Values[s.pos][0].(time.Time).UnixNano() }
 
-	// If we have multiple tag sets we'll want to filter out the empty ones
-	filterEmptyResults := len(e.jobs) > 1
+// seriesStreamHeap is a heap of series streams ordered by the time of their current point, and then
+// by the order of their jobs.
+type seriesStreamHeap struct {
+	streams   []*seriesStream
+	ascending bool
+}
 
-	// Execute each MRJob serially
-	for _, j := range e.jobs {
-		j.Execute(out, filterEmptyResults)
+func (h *seriesStreamHeap) Len() int { return len(h.streams) }
+func (h *seriesStreamHeap) Less(i, j int) bool {
+	if ti, tj := h.streams[i].time(), h.streams[j].time(); ti != tj {
+		return rawBefore(ti, tj, h.ascending)
 	}
+	return h.streams[i].index < h.streams[j].index
+}
+func (h *seriesStreamHeap) Swap(i, j int) { h.streams[i], h.streams[j] = h.streams[j], h.streams[i] }
 
-	// Mark the end of the output channel.
-	close(out)
+func (h *seriesStreamHeap) Push(x interface{}) { h.streams = append(h.streams, x.(*seriesStream)) }
+
+func (h *seriesStreamHeap) Pop() interface{} {
+	old := h.streams
+	n := len(old)
+	x := old[n-1]
+	h.streams = old[:n-1]
+	return x
 }
 
 func i64tof64(v interface{}) float64 {
@@ -949,27 +6048,34 @@ type Row struct {
 	Columns []string          `json:"columns,omitempty"`
 	Values  [][]interface{}   `json:"values,omitempty"`
 	Err     error             `json:"err,omitempty"`
+
+	// Set on the last row sent if the response was cut off at the planner's MaxResponseBytes.
+	Truncated bool `json:"truncated,omitempty"`
+
+	// The IDs of the shards that contributed points to the row, if the planner's RecordShardIDs
+	// option is set.
+	ShardIDs []uint64 `json:"shardIDs,omitempty"`
+
+	// Set on the row sent when the planner's SoftDeadline passes while its series is being reduced.
+	// It has the complete intervals of the series that hadn't been sent, and may have none.
+	Partial bool `json:"partial,omitempty"`
+
+	// Set on the final row of a query if the planner's EmitDone option is set.
+	Done  bool           `json:"done,omitempty"`
+	Stats *ExecutorStats `json:"-"`
 }
 
-// tagsHash returns a hash of tag key/value pairs.
+// tagsHash returns a hash of tag key/value pairs. It hashes the encoded tag set, so the keys
+// and values of different tag sets can't run together into the same bytes.
 func (r *Row) tagsHash() uint64 {
 	h := fnv.New64a()
-	keys := r.tagsKeys()
-	for _, k := range keys {
-		h.Write([]byte(k))
-		h.Write([]byte(r.Tags[k]))
-	}
+	h.Write(AppendTagSet(nil, r.Tags))
 	return h.Sum64()
 }
 
-// tagKeys returns a sorted list of tag keys.
-func (r *Row) tagsKeys() []string {
-	a := make([]string, len(r.Tags))
-	for k := range r.Tags {
-		a = append(a, k)
-	}
-	sort.Strings(a)
-	return a
+// tagsKey returns a string that is unique to the row's tag key/value pairs.
+func (r *Row) tagsKey() string {
+	return EncodeTagSet(r.Tags)
 }
 
 // Rows represents a list of rows that can be sorted consistently by name/tag.
@@ -1,8 +1,22 @@
 package influxql
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -452,3 +466,4637 @@ func TestProcessRawQueryDerivative(t *testing.T) {
 		}
 	}
 }
+
+// Ensure the planner scales the chunk size of each mapper when adaptive chunking is enabled.
+func TestPlanner_Plan_ChunkSizeFunc(t *testing.T) {
+	small := &testEstimatingMapper{testMapper{points: testPoints(0, 10)}, 10}
+	large := &testEstimatingMapper{testMapper{points: testPoints(0, 10)}, 1000000}
+	other := &testMapper{points: testPoints(0, 10)}
+
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(small, large, other)}})
+	p.ChunkSizeFunc = AdaptiveChunkSize
+	rows := testExecute(t, p, `SELECT value FROM cpu`, 1000)
+
+	if small.chunkSize != 10 {
+		t.Fatalf("unexpected small chunk size: %d", small.chunkSize)
+	} else if large.chunkSize != 4000 {
+		t.Fatalf("unexpected large chunk size: %d", large.chunkSize)
+	} else if other.chunkSize != 1000 {
+		t.Fatalf("unexpected chunk size for mapper without estimate: %d", other.chunkSize)
+	} else if len(rows) != 1 || len(rows[0].Values) != 30 {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+}
+
+// Ensure chunk sizes are capped, and oversized results are split into several rows for the series.
+func TestPlanner_Plan_MaxChunkSize(t *testing.T) {
+	for i, tt := range []struct {
+		chunkSize int
+		funcSize  bool // if true, chunk sizes are scaled by AdaptiveChunkSize
+		exp       []int
+	}{
+		{chunkSize: 0, exp: []int{10, 10, 5}},
+		{chunkSize: 1000, exp: []int{10, 10, 5}},
+		{chunkSize: 8, exp: []int{8, 8, 8, 1}},
+		{chunkSize: 8, funcSize: true, exp: []int{10, 10, 5}},
+	} {
+		m := &testEstimatingMapper{testMapper{points: testPoints(0, 25)}, 1000000}
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+		p.MaxChunkSize = 10
+		if tt.funcSize {
+			p.ChunkSizeFunc = AdaptiveChunkSize
+		}
+
+		rows := testExecute(t, p, `SELECT value FROM cpu`, tt.chunkSize)
+		var sizes []int
+		for _, row := range rows {
+			sizes = append(sizes, len(row.Values))
+		}
+		if !reflect.DeepEqual(sizes, tt.exp) {
+			t.Errorf("%d. unexpected row sizes: %v", i, sizes)
+		} else if m.chunkSize > 10 {
+			t.Errorf("%d. unexpected mapper chunk size: %d", i, m.chunkSize)
+		}
+	}
+}
+
+// Ensure the planner rejects negative chunk sizes, and uses its default chunk size when asked to.
+func TestPlanner_Plan_ChunkSize(t *testing.T) {
+	for i, tt := range []struct {
+		chunkSize        int
+		maxChunkSize     int
+		defaultChunkSize int
+		exp              int
+		err              string
+	}{
+		{chunkSize: 5, maxChunkSize: 10, exp: 5},
+		{chunkSize: 20, maxChunkSize: 10, exp: 10},
+		{chunkSize: 0, maxChunkSize: 10, exp: 10},
+		{chunkSize: 0, exp: unboundedChunkSize},
+		{chunkSize: UseDefaultChunkSize, maxChunkSize: 10, defaultChunkSize: 4, exp: 4},
+		{chunkSize: UseDefaultChunkSize, maxChunkSize: 10, defaultChunkSize: 40, exp: 10},
+		{chunkSize: UseDefaultChunkSize, defaultChunkSize: 0, exp: unboundedChunkSize},
+		{chunkSize: -2, maxChunkSize: 10, err: `invalid chunk size: -2, must be 0 or more`},
+		{chunkSize: UseDefaultChunkSize, defaultChunkSize: -5, err: `invalid chunk size: -5, must be 0 or more`},
+	} {
+		m := &testMapper{points: testPoints(0, 25)}
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+		p.MaxChunkSize, p.DefaultChunkSize = tt.maxChunkSize, tt.defaultChunkSize
+		e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), tt.chunkSize)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%d. unexpected error: %v", i, err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+
+		for row := range e.Execute() {
+			if row.Err != nil {
+				t.Errorf("%d. unexpected row error: %s", i, row.Err)
+			}
+		}
+		if m.chunkSize != tt.exp {
+			t.Errorf("%d. unexpected mapper chunk size: %d", i, m.chunkSize)
+		}
+	}
+
+	if n := NewPlanner(&testDB{}).DefaultChunkSize; n != DefaultChunkSize {
+		t.Fatalf("unexpected default chunk size: %d", n)
+	}
+}
+
+// Ensure a chunk size function returning a negative chunk size doesn't pass it to the mappers, which
+// read everything at once instead.
+func TestPlanner_Plan_ChunkSizeFunc_Negative(t *testing.T) {
+	m := &testEstimatingMapper{testMapper{points: testPoints(0, 10)}, 1000000}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+	p.MaxChunkSize = 0
+	p.ChunkSizeFunc = func(chunkSize, pointN int) int { return -1 }
+	if rows := testExecute(t, p, `SELECT value FROM cpu`, 100); len(rows) != 1 || len(rows[0].Values) != 10 {
+		t.Fatalf("unexpected rows: %v", rows)
+	} else if m.chunkSize != unboundedChunkSize {
+		t.Fatalf("unexpected mapper chunk size: %d", m.chunkSize)
+	}
+}
+
+// Ensure the requested chunk size is used for every mapper by default.
+func TestPlanner_Plan_ChunkSizeFunc_Default(t *testing.T) {
+	m := &testEstimatingMapper{testMapper{points: testPoints(0, 10)}, 1000000}
+	testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}}), `SELECT value FROM cpu`, 1000)
+	if m.chunkSize != 1000 {
+		t.Fatalf("unexpected chunk size: %d", m.chunkSize)
+	}
+}
+
+func TestAdaptiveChunkSize(t *testing.T) {
+	for i, tt := range []struct {
+		chunkSize, pointN, exp int
+	}{
+		{chunkSize: 1000, pointN: 0, exp: 250},
+		{chunkSize: 1000, pointN: 10, exp: 10},
+		{chunkSize: 1000, pointN: 50000, exp: 500},
+		{chunkSize: 1000, pointN: 200000, exp: 2000},
+		{chunkSize: 1000, pointN: 10000000, exp: 4000},
+		{chunkSize: 1, pointN: 0, exp: 1},
+	} {
+		if got := AdaptiveChunkSize(tt.chunkSize, tt.pointN); got != tt.exp {
+			t.Errorf("%d. AdaptiveChunkSize(%d, %d) = %d, exp %d", i, tt.chunkSize, tt.pointN, got, tt.exp)
+		}
+	}
+}
+
+// Ensure holt_winters emits the fitted points followed by the forecasted points.
+func TestMapReduceJob_Execute_HoltWinters(t *testing.T) {
+	m := &testMapper{points: testPoints(0, 10), interval: int64(time.Second)}
+	j := testJob(m)
+	j.TMin, j.TMax = int64(time.Second), int64(10*time.Second)
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{j}}),
+		`SELECT holt_winters(mean(value), 2, 0) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(1s)`, 0)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if values := rows[0].Values; len(values) != 12 {
+		t.Fatalf("unexpected value count: %d", len(values))
+	} else if tm := values[11][0].(time.Time); !tm.Equal(time.Unix(12, 0)) {
+		t.Fatalf("unexpected forecast time: %s", tm)
+	} else if v := values[11][1].(float64); math.Abs(v-12) > 1e-9 {
+		t.Fatalf("unexpected forecast value: %v", v)
+	}
+}
+
+// Ensure a raw query resumes from the last point read when a mapper's shard moves mid-stream.
+func TestMapReduceJob_Execute_ShardMoved_Raw(t *testing.T) {
+	// two points share the time of the last point in the first chunk
+	points := testPoints(0, 10)
+	points = append(points[:3], append([]*rawQueryMapOutput{{Time: points[2].Time, Values: 100.0}}, points[3:]...)...)
+
+	m := &testMovingMapper{testMapper: testMapper{points: points}, failAfter: 1}
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}}), `SELECT value FROM cpu`, 3)
+
+	var got []interface{}
+	for _, row := range rows {
+		for _, v := range row.Values {
+			got = append(got, v[1])
+		}
+	}
+	if exp := []interface{}{1.0, 2.0, 3.0, 100.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values:\n\nexp=%v\n\ngot=%v", exp, got)
+	} else if !m.closed || m.remapped == nil || !m.remapped.opened {
+		t.Fatal("expected mapper to be closed and replaced")
+	}
+}
+
+// Ensure an aggregate query resumes from the failed interval when a mapper's shard moves mid-stream.
+func TestMapReduceJob_Execute_ShardMoved_Aggregate(t *testing.T) {
+	m := &testMovingMapper{testMapper: testMapper{points: testPoints(0, 10), interval: int64(2 * time.Second)}, failAfter: 2}
+	j := testJob(m)
+	j.TMin, j.TMax = int64(time.Second), int64(10*time.Second)
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{j}}),
+		`SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(2s)`, 0)
+
+	var got []interface{}
+	for _, v := range rows[0].Values {
+		got = append(got, v[1])
+	}
+	if exp := []interface{}{1.0, 2.0, 2.0, 2.0, 2.0, 1.0}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values:\n\nexp=%v\n\ngot=%v", exp, got)
+	} else if m.remapped == nil {
+		t.Fatal("expected mapper to be replaced")
+	}
+}
+
+// Ensure a moved shard returns an error if the mapper can't be re-created.
+func TestMapReduceJob_Execute_ShardMoved_NotRemappable(t *testing.T) {
+	m := &testMovingMapper{testMapper: testMapper{points: testPoints(0, 10)}, failAfter: 1, maxRemapN: -1}
+	q, _ := ParseQuery(`SELECT value FROM cpu`)
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}}).Plan(q.Statements[0].(*SelectStatement), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rowErr error
+	for row := range e.Execute() {
+		if row.Err != nil {
+			rowErr = row.Err
+		}
+	}
+	if rowErr != ErrShardMoved {
+		t.Fatalf("unexpected error: %v", rowErr)
+	}
+}
+
+// Ensure a raw query resumes from the last point read when a mapper's read fails with a transient
+// error and is retried.
+func TestMapReduceJob_Execute_Retry_Raw(t *testing.T) {
+	m := &testFlakyMapper{testMapper: testMapper{points: testPoints(0, 10)}, failAfter: 1, failN: 2, err: testTransientError{}}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+	p.RetryAttempts, p.RetryBackoff = 3, time.Millisecond
+	rows := testExecute(t, p, `SELECT value FROM cpu`, 3)
+
+	var got []interface{}
+	for _, row := range rows {
+		for _, v := range row.Values {
+			got = append(got, v[1])
+		}
+	}
+	if exp := []interface{}{1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values:\n\nexp=%v\n\ngot=%v", exp, got)
+	} else if exp := []int64{int64(3 * time.Second), int64(3 * time.Second)}; !reflect.DeepEqual(m.seeks, exp) {
+		t.Fatalf("unexpected seeks: %v", m.seeks)
+	}
+}
+
+// Ensure an aggregate query resumes from the failed interval when a mapper's read fails with a
+// transient error and is retried.
+func TestMapReduceJob_Execute_Retry_Aggregate(t *testing.T) {
+	m := &testFlakyMapper{testMapper: testMapper{points: testPoints(0, 10), interval: int64(2 * time.Second)}, failAfter: 2, failN: 1, err: testTransientError{}}
+	j := testJob(m)
+	j.TMin, j.TMax = int64(time.Second), int64(10*time.Second)
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+	p.RetryAttempts, p.RetryBackoff = 1, time.Millisecond
+
+	rows := testExecute(t, p,
+		`SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(2s)`, 0)
+
+	var got []interface{}
+	for _, v := range rows[0].Values {
+		got = append(got, v[1])
+	}
+	if exp := []interface{}{1.0, 2.0, 2.0, 2.0, 2.0, 1.0}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values:\n\nexp=%v\n\ngot=%v", exp, got)
+	} else if exp := []int64{int64(4 * time.Second)}; !reflect.DeepEqual(m.seeks, exp) {
+		t.Fatalf("unexpected seeks: %v", m.seeks)
+	}
+}
+
+// Ensure reads are retried at most the configured number of times, and permanent errors aren't.
+func TestMapReduceJob_Execute_Retry_Error(t *testing.T) {
+	errPermanent := errors.New("permanent")
+	for i, tt := range []struct {
+		err      error
+		attempts int
+		seekN    int
+	}{
+		{err: testTransientError{}, attempts: 2, seekN: 2},
+		{err: testTransientError{}, attempts: 0, seekN: 0},
+		{err: errPermanent, attempts: 2, seekN: 0},
+	} {
+		m := &testFlakyMapper{testMapper: testMapper{points: testPoints(0, 10)}, failAfter: 1, failN: 5, err: tt.err}
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+		p.RetryAttempts, p.RetryBackoff = tt.attempts, time.Millisecond
+		e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var rowErr error
+		for row := range e.Execute() {
+			if row.Err != nil {
+				rowErr = row.Err
+			}
+		}
+		if rowErr != tt.err {
+			t.Errorf("%d. unexpected error: %v", i, rowErr)
+		} else if len(m.seeks) != tt.seekN {
+			t.Errorf("%d. unexpected seek count: %d", i, len(m.seeks))
+		}
+	}
+}
+
+// Ensure the wait before a retry ends when the executor is killed, or when a soft deadline that
+// aborts the query passes.
+func TestMapReduceJob_Execute_Retry_Stop(t *testing.T) {
+	// collect returns the error of the rows of the executor, failing if they aren't all sent soon.
+	collect := func(ch <-chan *Row) (rowErr error) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case row, ok := <-ch:
+				if !ok {
+					return rowErr
+				} else if row.Err != nil {
+					rowErr = row.Err
+				}
+			case <-timeout:
+				t.Fatal("timed out waiting for the retry to stop")
+			}
+		}
+	}
+
+	m := &testFlakyMapper{testMapper: testMapper{points: testPoints(0, 10)}, failAfter: 1, failN: 1, err: testTransientError{}}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+	p.RetryAttempts, p.RetryBackoff = 1, time.Hour
+	e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := e.Execute()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		e.Kill()
+	}()
+	if err := collect(ch); err != ErrQueryKilled {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(m.seeks) != 0 {
+		t.Fatalf("unexpected seeks: %v", m.seeks)
+	}
+
+	m = &testFlakyMapper{testMapper: testMapper{points: testPoints(0, 10), interval: int64(2 * time.Second)}, failAfter: 2, failN: 1, err: testTransientError{}}
+	j := testJob(m)
+	j.TMin, j.TMax = int64(time.Second), int64(10*time.Second)
+	p = NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+	p.RetryAttempts, p.RetryBackoff = 1, time.Hour
+	p.StreamAggregates, p.SoftDeadline, p.AbortAtDeadline = true, 10*time.Millisecond, true
+	e, err = p.Plan(MustParseStatement(`SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(2s)`).(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := collect(e.Execute()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(m.seeks) != 0 {
+		t.Fatalf("unexpected seeks: %v", m.seeks)
+	}
+}
+
+// Ensure network timeouts and reset connections are transient errors.
+func TestIsTransient(t *testing.T) {
+	for i, tt := range []struct {
+		err error
+		exp bool
+	}{
+		{err: &net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}, exp: true},
+		{err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}, exp: true},
+		{err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, exp: false},
+		{err: testTransientError{}, exp: true},
+		{err: io.EOF, exp: false},
+		{err: ErrShardMoved, exp: false},
+	} {
+		if got := IsTransient(tt.err); got != tt.exp {
+			t.Errorf("%d. %v: exp %v, got %v", i, tt.err, tt.exp, got)
+		}
+	}
+}
+
+// Ensure raw timestamps are truncated to the precision of the planner.
+func TestMapReduceJob_Execute_Precision_Raw(t *testing.T) {
+	m := &testMapper{points: []*rawQueryMapOutput{
+		{Time: int64(1500 * time.Millisecond), Values: float64(1)},
+		{Time: int64(2999 * time.Millisecond), Values: float64(2)},
+	}}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+	p.Precision = time.Second
+
+	rows := testExecute(t, p, `SELECT value FROM cpu`, 10)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := [][]interface{}{
+		{time.Unix(1, 0).UTC(), float64(1)},
+		{time.Unix(2, 0).UTC(), float64(2)},
+	}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+}
+
+// Ensure truncating aggregate timestamps doesn't move points between intervals.
+func TestMapReduceJob_Execute_Precision_Aggregate(t *testing.T) {
+	m := &testMapper{points: testPoints(0, 4), interval: int64(2 * time.Second)}
+	j := testJob(m)
+	j.TMin, j.TMax = int64(time.Second), int64(4*time.Second)
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+	p.Precision = time.Second
+
+	rows := testExecute(t, p, `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:04Z' GROUP BY time(2s)`, 0)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := [][]interface{}{
+		{time.Unix(0, 0).UTC(), float64(1)},
+		{time.Unix(2, 0).UTC(), float64(2)},
+		{time.Unix(4, 0).UTC(), float64(1)},
+	}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+}
+
+// Ensure the planner rejects a GROUP BY interval that isn't a multiple of the precision.
+func TestPlanner_Plan_Precision_InvalidInterval(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+	p.Precision = time.Minute
+
+	q, err := ParseQuery(`SELECT count(value) FROM cpu WHERE time > now() - 1h GROUP BY time(90s)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Plan(q.Statements[0].(*SelectStatement), 0); err == nil || err.Error() != "GROUP BY time interval 90s must be a multiple of the precision 1m" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure joined measurements only return the tag sets and times present in every measurement.
+func TestMapReduceJob_Execute_Join_Raw(t *testing.T) {
+	cpuA, cpuB := testJob(&testMapper{points: testPoints(0, 4)}), testJob(&testMapper{points: testPoints(0, 4)})
+	cpuA.TagSet.Tags, cpuB.TagSet.Tags = map[string]string{"host": "a"}, map[string]string{"host": "b"}
+	memA := testJob(&testMapper{points: testPoints(2, 4)})
+	memA.MeasurementName, memA.TagSet.Tags = "mem", map[string]string{"host": "a"}
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{cpuA, cpuB, memA}}), `SELECT value FROM cpu JOIN mem GROUP BY host`, 10)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := (Row{
+		Name:    "cpu,mem",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []string{"time", "cpu.value", "mem.value"},
+		Values: [][]interface{}{
+			{time.Unix(3, 0).UTC(), float64(3), float64(3)},
+			{time.Unix(4, 0).UTC(), float64(4), float64(4)},
+		},
+	}); !reflect.DeepEqual(*rows[0], exp) {
+		t.Fatalf("unexpected row: %+v", *rows[0])
+	}
+}
+
+// Ensure joined measurements combine every chunk of their series.
+func TestMapReduceJob_Execute_Join_Chunked(t *testing.T) {
+	cpu, mem := testJob(&testMapper{points: testPoints(0, 10)}), testJob(&testMapper{points: testPoints(2, 10)})
+	mem.MeasurementName = "mem"
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{cpu, mem}}), `SELECT value FROM cpu JOIN mem`, 3)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	}
+	var exp [][]interface{}
+	for sec := 3; sec <= 10; sec++ {
+		exp = append(exp, []interface{}{time.Unix(int64(sec), 0).UTC(), float64(sec), float64(sec)})
+	}
+	if !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+}
+
+// Ensure joined aggregates are combined by GROUP BY interval.
+func TestMapReduceJob_Execute_Join_Aggregate(t *testing.T) {
+	cpu := testJob(&testMapper{points: testPoints(0, 4), interval: int64(2 * time.Second)})
+	mem := testJob(&testMapper{points: testPoints(2, 4), interval: int64(2 * time.Second)})
+	mem.MeasurementName = "mem"
+	for _, j := range []*MapReduceJob{cpu, mem} {
+		j.TMin, j.TMax = int64(2*time.Second), int64(5*time.Second)
+	}
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{cpu, mem}}),
+		`SELECT mean(value) FROM cpu JOIN mem WHERE time >= '1970-01-01T00:00:02Z' AND time <= '1970-01-01T00:00:05Z' GROUP BY time(2s)`, 0)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := [][]interface{}{
+		{time.Unix(2, 0).UTC(), float64(2.5), float64(3)},
+		{time.Unix(4, 0).UTC(), float64(4), float64(4.5)},
+	}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+}
+
+// Ensure the planner rejects queries without a lower time bound if one is required.
+func TestPlanner_Plan_RequireTimeBound(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+	p.RequireTimeBound = true
+
+	for _, s := range []string{`SELECT value FROM cpu`, `SELECT value FROM cpu WHERE time < now()`} {
+		q, err := ParseQuery(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.Plan(q.Statements[0].(*SelectStatement), 0); err != ErrTimeBoundRequired {
+			t.Fatalf("%s: unexpected error: %v", s, err)
+		}
+	}
+	testExecute(t, p, `SELECT value FROM cpu WHERE time > now() - 1h`, 10)
+}
+
+// Ensure the planner limits queries without a lower time bound to the default window.
+func TestPlanner_Plan_DefaultQueryWindow(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+	p.Now = func() time.Time { return time.Unix(7200, 0) }
+	p.DefaultQueryWindow = time.Hour
+
+	for _, tt := range []struct {
+		s    string
+		tmin time.Time
+	}{
+		{s: `SELECT value FROM cpu`, tmin: time.Unix(3600, 0)},
+		{s: `SELECT value FROM cpu WHERE host = 'a'`, tmin: time.Unix(3600, 0)},
+		{s: `SELECT value FROM cpu WHERE time > now() - 10m`, tmin: time.Unix(6600, 1)},
+	} {
+		q, err := ParseQuery(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stmt := q.Statements[0].(*SelectStatement)
+		if e, err := p.Plan(stmt, 0); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.s, err)
+		} else if tmin, _ := TimeRange(e.stmt.Condition); !tmin.Equal(tt.tmin) {
+			t.Fatalf("%s: unexpected lower time bound: %s", tt.s, tmin)
+		}
+	}
+
+	// the window slides when the statement is planned again, and isn't added to the statement
+	stmt := MustParseStatement(`SELECT value FROM cpu WHERE host = 'a'`).(*SelectStatement)
+	for _, now := range []int64{7200, 10800} {
+		p.Now = func() time.Time { return time.Unix(now, 0) }
+		if e, err := p.Plan(stmt, 0); err != nil {
+			t.Fatal(err)
+		} else if tmin, _ := TimeRange(e.stmt.Condition); !tmin.Equal(time.Unix(now-3600, 0)) {
+			t.Fatalf("%d: unexpected lower time bound: %s", now, tmin)
+		} else if s := stmt.String(); s != `SELECT value FROM cpu WHERE host = 'a'` {
+			t.Fatalf("%d: statement rewritten: %s", now, s)
+		}
+	}
+}
+
+// Ensure Since sets the lower time bound of queries without one, ahead of the default window,
+// and doesn't override the bound of those that have one.
+func TestPlanner_Plan_Since(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+	p.Now = func() time.Time { return time.Unix(7200, 0) }
+	p.RequireTimeBound = true
+	p.DefaultQueryWindow = time.Hour
+	p.Since = 30 * time.Minute
+
+	for _, tt := range []struct {
+		s    string
+		tmin time.Time
+	}{
+		{s: `SELECT value FROM cpu`, tmin: time.Unix(5400, 0)},
+		{s: `SELECT value FROM cpu WHERE host = 'a'`, tmin: time.Unix(5400, 0)},
+		{s: `SELECT value FROM cpu WHERE time > now() - 2h`, tmin: time.Unix(0, 1)},
+		{s: `SELECT value FROM cpu WHERE time >= '1970-01-01T01:50:00Z'`, tmin: time.Unix(6600, 0)},
+	} {
+		stmt := MustParseStatement(tt.s).(*SelectStatement)
+		if e, err := p.Plan(stmt, 0); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.s, err)
+		} else if tmin, _ := TimeRange(e.stmt.Condition); !tmin.Equal(tt.tmin) {
+			t.Fatalf("%s: unexpected lower time bound: %s", tt.s, tmin)
+		}
+	}
+}
+
+// Ensure the executor sends a final row with the stats of the query if requested.
+func TestExecutor_Execute_EmitDone(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{points: testPoints(0, 4)})}})
+	p.EmitDone = true
+
+	rows := testExecute(t, p, `SELECT value FROM cpu`, 10)
+	if len(rows) != 2 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if rows[0].Done {
+		t.Fatal("expected first row not to be done")
+	} else if row := rows[1]; !row.Done || row.Stats == nil {
+		t.Fatalf("expected final row to be done: %+v", row)
+	} else if row.Stats.RowN != 1 || row.Stats.PointN != 4 || row.Stats.Partial {
+		t.Fatalf("unexpected stats: %+v", row.Stats)
+	}
+}
+
+// Ensure the stats of the final row count the series, columns and values of the rows sent.
+func TestExecutor_Execute_EmitDone_Shape(t *testing.T) {
+	newJob := func(host string, points []*rawQueryMapOutput) *MapReduceJob {
+		job := testJob(&testMapper{points: points})
+		job.TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+		return job
+	}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{
+		newJob("a", testPoints(0, 5)),
+		newJob("b", testPoints(0, 3)),
+		newJob("c", testPoints(0, 1)),
+	}})
+	p.EmitDone = true
+
+	// the series are chunked, so there are more rows than series
+	rows := testExecute(t, p, `SELECT value FROM cpu GROUP BY host`, 2)
+	stats := rows[len(rows)-1].Stats
+	series := make(map[string]bool)
+	columns := make(map[string]bool)
+	var pointN int
+	for _, row := range rows[:len(rows)-1] {
+		series[row.Tags["host"]] = true
+		for _, c := range row.Columns {
+			columns[c] = true
+		}
+		pointN += len(row.Values)
+	}
+	if stats.RowN != len(rows)-1 || stats.RowN <= 3 {
+		t.Fatalf("unexpected row count: %d", stats.RowN)
+	} else if stats.SeriesN != len(series) || stats.SeriesN != 3 {
+		t.Fatalf("unexpected series count: %d", stats.SeriesN)
+	} else if stats.ColumnN != len(columns) || stats.ColumnN != 2 {
+		t.Fatalf("unexpected column count: %d", stats.ColumnN)
+	} else if stats.PointN != pointN || stats.PointN != 9 {
+		t.Fatalf("unexpected point count: %d", stats.PointN)
+	}
+}
+
+// Ensure a profiled query reports the time spent in each stage, which sums to about its duration.
+func TestExecutor_Execute_Profile(t *testing.T) {
+	const delay = 5 * time.Millisecond
+	for _, tt := range []struct {
+		s      string
+		stage  func(*Profile) time.Duration // the stage that reduces or merges the points, besides reading them
+		encode time.Duration                // the least time the consumer is waited for
+	}{
+		// the rows of the raw query are sent as they're read, so the slow consumer is waited for
+		{s: `SELECT value FROM cpu`, stage: func(p *Profile) time.Duration { return p.Merge }, encode: 10 * delay},
+		{s: `SELECT mean(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:00:50Z' GROUP BY time(10s)`, stage: func(p *Profile) time.Duration { return p.Reduce }},
+	} {
+		m := &testSlowMapper{testMapper: testMapper{points: testPoints(0, 40), interval: int64(10 * time.Second)}, delay: delay}
+		job := testJob(m)
+		if tmin, tmax := TimeRange(MustParseStatement(tt.s).(*SelectStatement).Condition); !tmin.IsZero() {
+			job.TMin, job.TMax = tmin.UnixNano(), tmax.UnixNano()
+		}
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+		p.EmitDone = true
+		p.Profile = true
+
+		q, err := ParseQuery(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e, err := p.Plan(q.Statements[0].(*SelectStatement), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the consumer is twice as slow to receive each row as the mapper is to read its points
+		var stats *ExecutorStats
+		for row := range e.Execute() {
+			if row.Err != nil {
+				t.Fatalf("%s: unexpected error: %s", tt.s, row.Err)
+			} else if row.Done {
+				stats = row.Stats
+				continue
+			}
+			time.Sleep(2 * delay)
+		}
+
+		prof := stats.Profile
+		if prof == nil {
+			t.Fatalf("%s: expected a profile", tt.s)
+		} else if prof.Read < 4*delay {
+			t.Fatalf("%s: unexpected read time: %s", tt.s, prof.Read)
+		} else if prof.Encode < tt.encode {
+			t.Fatalf("%s: unexpected encode time: %s", tt.s, prof.Encode)
+		} else if tt.stage(prof) <= 0 || prof.Transform <= 0 {
+			t.Fatalf("%s: expected time in every stage: %+v", tt.s, prof)
+		} else if total := prof.Total(); total > stats.Duration || total < stats.Duration*8/10 {
+			t.Fatalf("%s: stages sum to %s, query took %s: %+v", tt.s, total, stats.Duration, prof)
+		}
+	}
+}
+
+// Ensure queries that aren't profiled don't report a profile.
+func TestExecutor_Execute_Profile_Disabled(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{points: testPoints(0, 4)})}})
+	p.EmitDone = true
+
+	rows := testExecute(t, p, `SELECT value FROM cpu`, 10)
+	if stats := rows[len(rows)-1].Stats; stats.Profile != nil {
+		t.Fatalf("unexpected profile: %+v", stats.Profile)
+	}
+
+	// the stages of a profiled query aren't timed if the profile isn't reported
+	p.EmitDone, p.Profile = false, true
+	e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 10)
+	if err != nil {
+		t.Fatal(err)
+	} else if e.profile != nil || e.jobs[0].profile != nil {
+		t.Fatal("unexpected profile without EmitDone")
+	}
+}
+
+// Ensure progress is reported as the intervals of aggregates and the mappers of raw queries are
+// completed, and reaches 100% exactly once, at the end of execution.
+func TestExecutor_Execute_OnProgress(t *testing.T) {
+	newJob := func(host string, interval time.Duration) *MapReduceJob {
+		job := testJob(&testMapper{points: testPoints(0, 10), interval: int64(interval)})
+		job.TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+		job.TMin, job.TMax = int64(time.Second), int64(10*time.Second)
+		return job
+	}
+
+	for _, tt := range []struct {
+		q        string
+		interval time.Duration
+		exp      []Progress
+	}{
+		{
+			q:        `SELECT value FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY host`,
+			interval: 0,
+			exp: []Progress{
+				{DrainedMappers: 1, TotalMappers: 2},
+				{DrainedMappers: 2, TotalMappers: 2},
+			},
+		},
+		{
+			// 6 intervals for each of the 2 series
+			q:        `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(2s), host`,
+			interval: 2 * time.Second,
+		},
+	} {
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob("a", tt.interval), newJob("b", tt.interval)}})
+		var got []Progress
+		p.OnProgress = func(progress Progress) { got = append(got, progress) }
+		testExecute(t, p, tt.q, 4)
+
+		// the mappers of an aggregate are drained once its series is complete
+		exp := tt.exp
+		if exp == nil {
+			for i := 1; i <= 12; i++ {
+				drained := (i - 1) / 6
+				if i == 12 {
+					drained = 2
+				}
+				exp = append(exp, Progress{CompletedIntervals: i, TotalIntervals: 12, DrainedMappers: drained, TotalMappers: 2})
+			}
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%s:\n\nexp=%+v\n\ngot=%+v", tt.q, exp, got)
+		}
+		for i, progress := range got {
+			if f := progress.Fraction(); (f == 1) != (i == len(got)-1) {
+				t.Fatalf("%s: unexpected fraction of progress %d: %v", tt.q, i, f)
+			}
+		}
+	}
+}
+
+// Ensure NaN and infinite values are skipped by the mappers and counted in the stats.
+func TestExecutor_Execute_SkipNonFinite(t *testing.T) {
+	m := &testMapper{points: []*rawQueryMapOutput{
+		{Time: int64(1 * time.Second), Values: 1.0},
+		{Time: int64(2 * time.Second), Values: math.NaN()},
+		{Time: int64(3 * time.Second), Values: 3.0},
+		{Time: int64(4 * time.Second), Values: math.Inf(-1)},
+	}}
+	j := testJob(m)
+	m.job = j
+
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+	p.EmitDone = true
+	p.SkipNonFinite = true
+
+	rows := testExecute(t, p, `SELECT mean(value) FROM cpu`, 0)
+	if len(rows) != 2 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := [][]interface{}{{time.Unix(0, 0).UTC(), float64(2)}}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	} else if rows[1].Stats.SkippedN != 2 {
+		t.Fatalf("unexpected stats: %+v", rows[1].Stats)
+	}
+}
+
+// Ensure raw queries resolve the points of a series read at the same time from several shards with
+// each resolution, and count the conflicts in the stats.
+func TestExecutor_Execute_RawConflicts(t *testing.T) {
+	point := func(sec int, key string, v float64) *rawQueryMapOutput {
+		return &rawQueryMapOutput{Time: int64(sec) * int64(time.Second), Values: v, seriesKey: key}
+	}
+	for _, tt := range []struct {
+		resolution ConflictResolution
+		values     []float64
+		conflictN  int
+	}{
+		{resolution: ConflictIgnore, values: []float64{1, 2, 20, 200, 3, 30}},
+		{resolution: ConflictKeepAll, values: []float64{1, 2, 20, 200, 3, 30}, conflictN: 2},
+		{resolution: ConflictPreferHighestShard, values: []float64{1, 20, 200, 30}, conflictN: 2},
+		{resolution: ConflictPreferRetentionPolicy, values: []float64{1, 2, 200, 3}, conflictN: 2},
+	} {
+		for _, chunkSize := range []int{0, 1} {
+			// host=b only has a point at the second second, in the second shard, so it doesn't conflict
+			j := testJob(
+				&testRPMapper{testMapper: &testMapper{shardID: 1, points: []*rawQueryMapOutput{
+					point(1, "cpu,host=a", 1), point(2, "cpu,host=a", 2), point(3, "cpu,host=a", 3),
+				}}, rp: "default"},
+				&testRPMapper{testMapper: &testMapper{shardID: 2, points: []*rawQueryMapOutput{
+					point(2, "cpu,host=a", 20), point(2, "cpu,host=b", 200), point(3, "cpu,host=a", 30),
+				}}, rp: "restored"},
+			)
+
+			p := NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+			p.EmitDone = true
+			p.RawConflicts = tt.resolution
+			p.PreferredRetentionPolicy = "default"
+
+			rows := testExecute(t, p, `SELECT value FROM cpu`, chunkSize)
+			var values []float64
+			for _, row := range rows[:len(rows)-1] {
+				for _, v := range row.Values {
+					values = append(values, v[1].(float64))
+				}
+			}
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("%d/%d: unexpected values: %v", tt.resolution, chunkSize, values)
+			} else if n := rows[len(rows)-1].Stats.ConflictN; n != tt.conflictN {
+				t.Errorf("%d/%d: unexpected conflict count: %d", tt.resolution, chunkSize, n)
+			}
+		}
+	}
+}
+
+// Ensure the planner warms the shards of a retention policy through transactions that support it.
+func TestPlanner_Warm(t *testing.T) {
+	if err := NewPlanner(&testDB{}).Warm("db0", "rp0", nil); err != ErrWarmNotSupported {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	db := &testWarmDB{}
+	if err := NewPlanner(db).Warm("db0", "rp0", nil); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(db.warmed, []string{"db0.rp0"}) {
+		t.Fatalf("unexpected warmed retention policies: %v", db.warmed)
+	}
+
+	closing := make(chan struct{})
+	close(closing)
+	if err := NewPlanner(db).Warm("db0", "rp1", closing); err != ErrWarmCanceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure killing all queries stops every running executor, which each end their rows with
+// ErrQueryKilled, and doesn't count executors that have finished.
+func TestPlanner_KillAllQueries(t *testing.T) {
+	const n = 3
+	gate := make(chan struct{})
+	registry := NewQueryRegistry()
+	var chs []<-chan *Row
+	for i := 0; i < n; i++ {
+		m := &testGateMapper{testMapper: testMapper{points: testPoints(0, 20)}, gateN: 1, gate: gate}
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+		p.Registry = registry
+		e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chs = append(chs, e.Execute())
+	}
+
+	// wait for the executors to block on their mappers
+	for start := time.Now(); registry.Len() < n; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("unexpected running executors: %d", registry.Len())
+		}
+	}
+	p := &Planner{Registry: registry}
+	if killed := p.KillAllQueries(); killed != n {
+		t.Fatalf("unexpected killed count: %d", killed)
+	} else if killed := p.KillAllQueries(); killed != 0 {
+		t.Fatalf("unexpected killed count on second kill: %d", killed)
+	}
+	close(gate)
+
+	for i, ch := range chs {
+		var rows []*Row
+		for row := range ch {
+			rows = append(rows, row)
+		}
+		if len(rows) == 0 || rows[len(rows)-1].Err != ErrQueryKilled {
+			t.Fatalf("executor %d: unexpected rows: %v", i, rows)
+		}
+		for _, row := range rows[:len(rows)-1] {
+			if row.Err != nil || len(row.Values) == 20 {
+				t.Fatalf("executor %d: unexpected row before kill: %v", i, row)
+			}
+		}
+	}
+	if registry.Len() != 0 {
+		t.Fatalf("unexpected running executors after kill: %d", registry.Len())
+	} else if killed := p.KillAllQueries(); killed != 0 {
+		t.Fatalf("unexpected killed count after queries finished: %d", killed)
+	}
+	if killed := (&Planner{}).KillAllQueries(); killed != 0 {
+		t.Fatalf("unexpected killed count without registry: %d", killed)
+	} else if n := (&Planner{}).Registry.Len(); n != 0 {
+		t.Fatalf("unexpected running executors without registry: %d", n)
+	}
+}
+
+// Ensure killing all queries while queries start and finish doesn't deadlock, and that the count
+// of executors killed matches the executors that report ErrQueryKilled.
+func TestPlanner_KillAllQueries_Concurrent(t *testing.T) {
+	registry := NewQueryRegistry()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reported int
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{points: testPoints(0, 20)})}})
+				p.Registry = registry
+				p.EmitDone = j%2 == 0
+				e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 1)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for row := range e.Execute() {
+					if row.Err == ErrQueryKilled {
+						mu.Lock()
+						reported++
+						mu.Unlock()
+					} else if row.Err != nil {
+						t.Errorf("unexpected row error: %s", row.Err)
+					}
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	killed := make(chan int)
+	go func() {
+		var n int
+		for {
+			select {
+			case <-done:
+				killed <- n
+				return
+			default:
+				n += registry.KillAll()
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+
+	if n := <-killed; n != reported {
+		t.Fatalf("unexpected killed count: %d, reported %d", n, reported)
+	}
+}
+
+// Ensure a query whose consumer stops receiving rows is killed once the idle timeout passes, and
+// that its mappers are closed before the error is sent.
+func TestExecutor_Execute_IdleTimeout(t *testing.T) {
+	gate := make(chan struct{})
+	close(gate)
+	m := &testBlockingMapper{testMapper: testMapper{points: testPoints(0, 100)}, gate: gate, closing: make(chan struct{})}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+	p.IdleTimeout = 20 * time.Millisecond
+	e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ch := e.Execute()
+	if row := <-ch; row.Err != nil || len(row.Values) != 1 {
+		t.Fatalf("unexpected first row: %v", row)
+	}
+
+	// the consumer stalls until the query is killed, so the row being sent is dropped
+	<-m.closing
+	var rows []*Row
+	for row := range ch {
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 || rows[0].Err != ErrIdleTimeout {
+		t.Fatalf("unexpected rows after stalling: %v", rows)
+	} else if !m.closed {
+		t.Fatal("expected mapper to be closed")
+	}
+}
+
+// Ensure the idle timeout doesn't count the time spent producing rows.
+func TestExecutor_Execute_IdleTimeout_SlowMapper(t *testing.T) {
+	gate := make(chan struct{})
+	m := &testGateMapper{testMapper: testMapper{points: testPoints(0, 20)}, gateN: 1, gate: gate}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+	p.IdleTimeout = 20 * time.Millisecond
+	time.AfterFunc(100*time.Millisecond, func() { close(gate) })
+
+	var n int
+	for _, row := range testExecute(t, p, `SELECT value FROM cpu`, 5) {
+		n += len(row.Values)
+	}
+	if n != 20 {
+		t.Fatalf("unexpected point count: %d", n)
+	}
+}
+
+// Ensure a mapper of a raw query that returns a point before one it already returned fails the
+// series by default, and has its points sorted when the planner sorts them.
+func TestExecutor_Execute_OutOfOrder(t *testing.T) {
+	points := func(secs ...int) []*rawQueryMapOutput {
+		var a []*rawQueryMapOutput
+		for _, sec := range secs {
+			a = append(a, &rawQueryMapOutput{Time: int64(sec) * int64(time.Second), Values: float64(sec)})
+		}
+		return a
+	}
+	newJob := func() *MapReduceJob {
+		return testJob(
+			&testMapper{shardID: 1, points: points(1, 5, 3, 4)},
+			&testMapper{shardID: 2, points: points(2, 6)},
+		)
+	}
+	for _, chunkSize := range []int{0, 1} {
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob()}})
+		e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rowErr error
+		for row := range e.Execute() {
+			if row.Err != nil {
+				rowErr = row.Err
+			}
+		}
+		if exp := ErrOutOfOrder(1, 3*int64(time.Second), 5*int64(time.Second)); rowErr == nil || rowErr.Error() != exp.Error() {
+			t.Errorf("%d: unexpected error: %v", chunkSize, rowErr)
+		}
+
+		p = NewPlanner(&testDB{jobs: []*MapReduceJob{newJob()}})
+		p.OutOfOrder = OutOfOrderSort
+		var times []int64
+		for _, row := range testExecute(t, p, `SELECT value FROM cpu`, chunkSize) {
+			for _, v := range row.Values {
+				times = append(times, v[0].(time.Time).Unix())
+			}
+		}
+		if exp := []int64{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(times, exp) {
+			t.Errorf("%d: unexpected times: %v", chunkSize, times)
+		}
+	}
+}
+
+// Ensure a mapper of an aggregate that returns an interval other than the one being reduced fails
+// the series by default, and has its intervals reduced in time order when the planner sorts them.
+func TestExecutor_Execute_IntervalOutOfOrder(t *testing.T) {
+	// the mappers are also read wrapped by the mappers of a query split between a downsample and
+	// its raw measurement, which forward the intervals of the mappers they wrap
+	newJob := func(split bool) *MapReduceJob {
+		mappers := []Mapper{
+			&testIntervalMapper{testMapper: testMapper{shardID: 1}, times: []int64{5, 3, 4}},
+			&testIntervalMapper{testMapper: testMapper{shardID: 2}, times: []int64{3, 4, 5}},
+		}
+		if split {
+			for i, mm := range mappers {
+				mappers[i] = &splitMapper{Mapper: mm, recent: true, interval: int64(time.Second)}
+			}
+		}
+		j := testJob(mappers...)
+		j.TMin, j.TMax = int64(3*time.Second), int64(6*time.Second)-1
+		return j
+	}
+	q := `SELECT sum(value) FROM cpu WHERE time >= '1970-01-01T00:00:03Z' AND time < '1970-01-01T00:00:06Z' GROUP BY time(1s)`
+
+	for _, split := range []bool{false, true} {
+		e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob(split)}}).Plan(MustParseStatement(q).(*SelectStatement), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rowErr error
+		for row := range e.Execute() {
+			if row.Err != nil {
+				rowErr = row.Err
+			}
+		}
+		if exp := ErrIntervalOutOfOrder(1, 5*int64(time.Second), 3*int64(time.Second)); rowErr == nil || rowErr.Error() != exp.Error() {
+			t.Errorf("split=%v: unexpected error: %v", split, rowErr)
+		}
+
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob(split)}})
+		p.OutOfOrder = OutOfOrderSort
+		rows := testExecute(t, p, q, 0)
+		if len(rows) != 1 {
+			t.Fatalf("split=%v: unexpected row count: %d", split, len(rows))
+		} else if exp := [][]interface{}{
+			{time.Unix(3, 0).UTC(), float64(6)},
+			{time.Unix(4, 0).UTC(), float64(8)},
+			{time.Unix(5, 0).UTC(), float64(10)},
+		}; !reflect.DeepEqual(rows[0].Values, exp) {
+			t.Errorf("split=%v: unexpected values: %v", split, rows[0].Values)
+		}
+	}
+}
+
+// Ensure the mappers of adjacent shards of raw queries are coalesced past the threshold, and the
+// results are the same as reading every shard with its own mapper.
+func TestPlanner_Plan_CoalesceAdjacentMappers(t *testing.T) {
+	// six shard groups of 10s with a point every 2s, and a shard overlapping the third group,
+	// which can't be read in sequence with it
+	newJob := func() *MapReduceJob {
+		j := testJob()
+		for i := 0; i < 6; i++ {
+			j.Mappers = append(j.Mappers, testRangeShard(uint64(i+1), i*10, 10, 5, j))
+		}
+		j.Mappers = append(j.Mappers, testRangeShard(7, 20, 10, 3, j))
+		return j
+	}
+
+	for _, tt := range []struct {
+		threshold, factor int
+		mapperN           int
+	}{
+		{threshold: 2, mapperN: 2},            // 1-3, and 7 followed by 4-6
+		{threshold: 2, factor: 2, mapperN: 4}, // 1-2, 3, 7 and 4, and 5-6
+		{threshold: 10, mapperN: 7},
+	} {
+		for _, q := range []string{`SELECT value FROM cpu`, `SELECT value FROM cpu ORDER BY time DESC`, `SELECT derivative(value, 1s) FROM cpu`} {
+			for _, chunkSize := range []int{0, 2} {
+				exp := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{newJob()}}), q, chunkSize)
+
+				j := newJob()
+				p := NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+				p.MapperCoalesceThreshold, p.MapperCoalesceFactor = tt.threshold, tt.factor
+				rows := testExecute(t, p, q, chunkSize)
+				if len(j.Mappers) != tt.mapperN {
+					t.Errorf("%d/%d: %s: unexpected mapper count: %d", tt.threshold, tt.factor, q, len(j.Mappers))
+				} else if !reflect.DeepEqual(rowValues(rows), rowValues(exp)) {
+					t.Errorf("%d/%d: %s: chunk size %d: unexpected values:\n%v\nexp: %v", tt.threshold, tt.factor, q, chunkSize, rowValues(rows), rowValues(exp))
+				}
+			}
+		}
+	}
+
+	// aggregates aren't coalesced
+	j := newJob()
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+	p.MapperCoalesceThreshold = 2
+	testExecute(t, p, `SELECT count(value) FROM cpu`, 0)
+	if len(j.Mappers) != 7 {
+		t.Fatalf("unexpected mapper count: %d", len(j.Mappers))
+	}
+
+	// nor are the mappers of queries with the no_coalesce hint
+	j = newJob()
+	p = NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+	p.MapperCoalesceThreshold = 2
+	p.PrefetchDepth = 2
+	rows := testExecute(t, p, `SELECT /*+ no_coalesce no_prefetch */ value FROM cpu`, 0)
+	exp := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{newJob()}}), `SELECT value FROM cpu`, 0)
+	if len(j.Mappers) != 7 || j.prefetchDepth != 0 {
+		t.Fatalf("unexpected mapper count and prefetch depth: %d, %d", len(j.Mappers), j.prefetchDepth)
+	} else if !reflect.DeepEqual(rowValues(rows), rowValues(exp)) {
+		t.Fatalf("unexpected values:\n%v\nexp: %v", rowValues(rows), rowValues(exp))
+	}
+}
+
+// Ensure a coalesced mapper only opens each shard once the one before it is drained, and closes
+// the shards it has drained.
+func TestPlanner_Plan_CoalesceAdjacentMappers_OpenLazily(t *testing.T) {
+	j := testJob()
+	c := &testOpenCounter{}
+	for i := 0; i < 3; i++ {
+		j.Mappers = append(j.Mappers, &testCountedRangeMapper{testRangeMapper: testRangeShard(uint64(i+1), i*10, 10, 2, j), counter: c})
+	}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+	p.MapperCoalesceThreshold = 1
+	rows := testExecute(t, p, `SELECT value FROM cpu`, 2)
+	if len(j.Mappers) != 1 {
+		t.Fatalf("unexpected mapper count: %d", len(j.Mappers))
+	} else if n := len(rowValues(rows)); n != 6 {
+		t.Fatalf("unexpected value count: %d", n)
+	} else if c.peak != 1 || c.open != 0 {
+		t.Fatalf("unexpected open shards: peak %d, %d left open", c.peak, c.open)
+	}
+}
+
+// testOpenCounter counts the mappers that are open at once.
+type testOpenCounter struct {
+	mu         sync.Mutex
+	open, peak int
+}
+
+// testCountedRangeMapper is a test mapper that reads a shard with a time range, and counts itself
+// as open from when it's opened until it's closed.
+type testCountedRangeMapper struct {
+	*testRangeMapper
+	counter *testOpenCounter
+}
+
+func (m *testCountedRangeMapper) Open() error {
+	m.counter.mu.Lock()
+	defer m.counter.mu.Unlock()
+	if m.counter.open++; m.counter.open > m.counter.peak {
+		m.counter.peak = m.counter.open
+	}
+	return m.testRangeMapper.Open()
+}
+
+func (m *testCountedRangeMapper) Close() {
+	m.counter.mu.Lock()
+	defer m.counter.mu.Unlock()
+	m.counter.open--
+	m.testRangeMapper.Close()
+}
+
+// testRangeShard returns a mapper of a shard covering n seconds from start, with pointN points
+// spread evenly through it.
+func testRangeShard(shardID uint64, start, n, pointN int, job *MapReduceJob) *testRangeMapper {
+	m := &testRangeMapper{
+		testMapper: &testMapper{shardID: shardID, job: job},
+		start:      int64(start) * int64(time.Second),
+		end:        int64(start+n) * int64(time.Second),
+	}
+	for i := 0; i < pointN; i++ {
+		sec := start + i*n/pointN
+		m.points = append(m.points, &rawQueryMapOutput{Time: int64(sec)*int64(time.Second) + int64(shardID), Values: float64(shardID*100) + float64(i)})
+	}
+	return m
+}
+
+// testRangeMapper is a test mapper that reads a shard with a time range.
+type testRangeMapper struct {
+	*testMapper
+	start, end int64
+}
+
+func (m *testRangeMapper) ShardTimeRange() (start, end int64) { return m.start, m.end }
+
+// rowValues returns the values of every row.
+func rowValues(rows []*Row) [][]interface{} {
+	var values [][]interface{}
+	for _, row := range rows {
+		values = append(values, row.Values...)
+	}
+	return values
+}
+
+// testRPMapper is a test mapper that reads a shard of a retention policy.
+type testRPMapper struct {
+	*testMapper
+	rp string
+}
+
+func (m *testRPMapper) RetentionPolicy() string { return m.rp }
+
+// Ensure a job's series keys are passed to its mappers before they begin.
+func TestMapReduceJob_Execute_SeriesKeys(t *testing.T) {
+	m := &testSeriesKeyMapper{testMapper: testMapper{points: testPoints(0, 4)}}
+	j := testJob(m)
+	j.SeriesKeys = []string{"cpu,host=a"}
+
+	testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{j}}), `SELECT value FROM cpu`, 10)
+	if !reflect.DeepEqual(m.keys, j.SeriesKeys) {
+		t.Fatalf("unexpected series keys: %v", m.keys)
+	}
+}
+
+// Ensure a job with series keys returns an error if a mapper can't read series by key.
+func TestMapReduceJob_Execute_SeriesKeys_NotSupported(t *testing.T) {
+	j := testJob(&testMapper{points: testPoints(0, 4)})
+	j.SeriesKeys = []string{"cpu,host=a"}
+
+	q, err := ParseQuery(`SELECT value FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{j}}).Plan(q.Statements[0].(*SelectStatement), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := <-e.Execute(); row == nil || row.Err != ErrSeriesKeysNotSupported {
+		t.Fatalf("unexpected row: %+v", row)
+	}
+}
+
+// Ensure points near an offset interval boundary are grouped into the correct interval.
+func TestMapReduceJob_Execute_GroupByOffset(t *testing.T) {
+	m := &testMapper{points: testPoints(13, 4), interval: int64(10 * time.Second), offset: int64(5 * time.Second)}
+	j := testJob(m)
+	j.TMin, j.TMax = int64(10*time.Second), int64(20*time.Second)
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{j}}),
+		`SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time <= '1970-01-01T00:00:20Z' GROUP BY time(10s, 5s)`, 0)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := [][]interface{}{
+		{time.Unix(5, 0).UTC(), float64(1)},
+		{time.Unix(15, 0).UTC(), float64(3)},
+	}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+}
+
+// Ensure the intervals of a query are aligned to the time origin of the planner.
+func TestMapReduceJob_Execute_TimeOrigin(t *testing.T) {
+	m := &testMapper{points: testPoints(13, 4), interval: int64(10 * time.Second), offset: int64(5 * time.Second)}
+	j := testJob(m)
+	j.TMin, j.TMax = int64(10*time.Second), int64(20*time.Second)
+
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{j}})
+	p.TimeOrigin = time.Unix(-25, 0)
+	rows := testExecute(t, p, `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time <= '1970-01-01T00:00:20Z' GROUP BY time(10s)`, 0)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := [][]interface{}{
+		{time.Unix(5, 0).UTC(), float64(1)},
+		{time.Unix(15, 0).UTC(), float64(3)},
+	}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+}
+
+// Ensure a statement planned again with a time origin is aligned to it once.
+func TestPlanner_Plan_TimeOrigin_Replan(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+	p.TimeOrigin = time.Unix(3, 0)
+	stmt := MustParseStatement(`SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time <= '1970-01-01T00:00:20Z' GROUP BY time(10s, 4s)`).(*SelectStatement)
+	for i := 0; i < 2; i++ {
+		e, err := p.Plan(stmt, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if offset, err := e.stmt.GroupByOffset(); err != nil || offset != 7*time.Second {
+			t.Fatalf("%d. unexpected offset: %s (%v)", i, offset, err)
+		} else if offset, err := stmt.GroupByOffset(); err != nil || offset != 4*time.Second {
+			t.Fatalf("%d. statement modified: offset %s (%v)", i, offset, err)
+		}
+	}
+}
+
+// Ensure the time origin is added to the GROUP BY offset of a statement.
+func TestAlignGroupByOffset(t *testing.T) {
+	for i, tt := range []struct {
+		s      string
+		origin time.Time
+		exp    string
+	}{
+		{s: `SELECT count(value) FROM cpu WHERE time < now() GROUP BY time(10s)`, origin: time.Unix(3, 0), exp: `SELECT count(value) FROM cpu WHERE time < now() GROUP BY time(10s, 3s)`},
+		{s: `SELECT count(value) FROM cpu WHERE time < now() GROUP BY time(10s, 4s)`, origin: time.Unix(3, 0), exp: `SELECT count(value) FROM cpu WHERE time < now() GROUP BY time(10s, 7s)`},
+		{s: `SELECT count(value) FROM cpu WHERE time < now() GROUP BY time(10s, 8s)`, origin: time.Unix(-3, 0), exp: `SELECT count(value) FROM cpu WHERE time < now() GROUP BY time(10s, 5s)`},
+		{s: `SELECT count(value) FROM cpu WHERE time < now() GROUP BY time(1h), host`, origin: time.Date(2000, 1, 1, 0, 15, 0, 0, time.UTC), exp: `SELECT count(value) FROM cpu WHERE time < now() GROUP BY time(1h, 15m), host`},
+		{s: `SELECT value FROM cpu`, origin: time.Unix(3, 0), exp: `SELECT value FROM cpu`},
+	} {
+		q, err := ParseQuery(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		stmt := q.Statements[0].(*SelectStatement)
+		if other, err := alignGroupByOffset(stmt, tt.origin); err != nil {
+			t.Fatalf("%d. %s", i, err)
+		} else if s := other.String(); s != tt.exp {
+			t.Errorf("%d. unexpected statement: %s", i, s)
+		} else if s := stmt.String(); s != tt.s {
+			t.Errorf("%d. statement modified: %s", i, s)
+		}
+	}
+}
+
+func TestIntervalStart(t *testing.T) {
+	for i, tt := range []struct {
+		t, interval, offset int64
+		exp                 int64
+	}{
+		{t: 0, interval: 10, offset: 0, exp: 0},
+		{t: 19, interval: 10, offset: 0, exp: 10},
+		{t: 14, interval: 10, offset: 5, exp: 5},
+		{t: 15, interval: 10, offset: 5, exp: 15},
+		{t: 4, interval: 10, offset: 5, exp: -5},
+	} {
+		if start := IntervalStart(tt.t, tt.interval, tt.offset); start != tt.exp {
+			t.Errorf("%d. unexpected start: exp=%d, got=%d", i, tt.exp, start)
+		}
+	}
+}
+
+// Ensure scalar functions are applied to each raw value.
+func TestMapReduceJob_Execute_Transforms(t *testing.T) {
+	m := &testMapper{points: []*rawQueryMapOutput{
+		{Time: int64(time.Second), Values: float64(-1.5)},
+		{Time: int64(2 * time.Second), Values: float64(2.4)},
+	}}
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}}),
+		`SELECT value, abs(value), ceil(value), floor(value), round(value) AS r FROM cpu`, 10)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := []string{"time", "value", "abs", "ceil", "floor", "r"}; !reflect.DeepEqual(rows[0].Columns, exp) {
+		t.Fatalf("unexpected columns: %v", rows[0].Columns)
+	} else if exp := [][]interface{}{
+		{time.Unix(1, 0).UTC(), float64(-1.5), float64(1.5), float64(-1), float64(-2), float64(-2)},
+		{time.Unix(2, 0).UTC(), float64(2.4), float64(2.4), float64(3), float64(2), float64(2)},
+	}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+}
+
+// Ensure arithmetic and scalar functions combine the fields of each point, and can be nested.
+func TestMapReduceJob_Execute_Arithmetic(t *testing.T) {
+	m := &testMapper{points: []*rawQueryMapOutput{
+		{Time: int64(time.Second), Values: map[string]interface{}{"a": float64(3), "b": float64(4), "n": int64(6)}},
+		{Time: int64(2 * time.Second), Values: map[string]interface{}{"a": float64(1), "b": float64(0), "n": int64(-2)}},
+		{Time: int64(3 * time.Second), Values: map[string]interface{}{"a": float64(2), "n": int64(1)}},
+	}}
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}}),
+		`SELECT a / b, sqrt(pow(a, 2) + pow(b, 2)) AS hyp, (a + 1) * n, n - n AS zero, atan2(b, a) FROM cpu`, 10)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := []string{"time", "a_b", "hyp", "a_n", "zero", "atan2"}; !reflect.DeepEqual(rows[0].Columns, exp) {
+		t.Fatalf("unexpected columns: %v", rows[0].Columns)
+	} else if exp := [][]interface{}{
+		{time.Unix(1, 0).UTC(), float64(0.75), float64(5), float64(24), int64(0), math.Atan2(4, 3)},
+		{time.Unix(2, 0).UTC(), nil, float64(1), float64(-4), int64(0), float64(0)},
+		{time.Unix(3, 0).UTC(), nil, nil, float64(3), int64(0), nil},
+	}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+}
+
+// Ensure the planner rejects queries that would return too many series.
+func TestPlanner_Plan_MaxSeriesPerQuery(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{}), testJob(&testMapper{}), testJob(&testMapper{})}})
+	p.MaxSeriesPerQuery = 2
+
+	q, err := ParseQuery(`SELECT value FROM cpu GROUP BY host`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Plan(q.Statements[0].(*SelectStatement), 0); err == nil || err.Error() != "query would return 3 series, which exceeds the maximum of 2; add tag filters to the WHERE clause or use SLIMIT" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Series limits are applied first.
+	testExecute(t, p, `SELECT value FROM cpu GROUP BY host SLIMIT 2`, 10)
+}
+
+// Ensure SLIMIT and SOFFSET page through the series of queries that can return several, and are
+// rejected for queries that can only return one.
+func TestPlanner_Plan_SLimit(t *testing.T) {
+	for _, tt := range []struct {
+		q     string
+		hosts []string
+		err   error
+	}{
+		{q: `SELECT value FROM cpu SLIMIT 2`, err: ErrSLimitSingleSeries},
+		{q: `SELECT value FROM cpu SOFFSET 1`, err: ErrSLimitSingleSeries},
+		{q: `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' GROUP BY time(1s) SLIMIT 1`, err: ErrSLimitSingleSeries},
+		{q: `SELECT value FROM cpu GROUP BY host`, hosts: []string{"a", "b", "c"}},
+		{q: `SELECT value FROM cpu GROUP BY host SLIMIT 2`, hosts: []string{"a", "b"}},
+		{q: `SELECT value FROM cpu GROUP BY host SLIMIT 2 SOFFSET 2`, hosts: []string{"c"}},
+		{q: `SELECT value FROM cpu GROUP BY host SOFFSET 1`, hosts: []string{"b", "c"}},
+		{q: `SELECT value FROM cpu GROUP BY host SOFFSET 5`},
+		{q: `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' GROUP BY time(1s), host SLIMIT 1`, hosts: []string{"a"}},
+		{q: `SELECT value FROM cpu, mem SLIMIT 1`, hosts: []string{"a"}},
+		{q: `SELECT value FROM /c.*/ SLIMIT 1 SOFFSET 1`, hosts: []string{"b"}},
+	} {
+		var jobs []*MapReduceJob
+		for _, host := range []string{"a", "b", "c"} {
+			j := testJob(&testMapper{points: testPoints(0, 1)})
+			j.TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+			jobs = append(jobs, j)
+		}
+
+		e, err := NewPlanner(&testDB{jobs: jobs}).Plan(MustParseStatement(tt.q).(*SelectStatement), 0)
+		if err != tt.err {
+			t.Errorf("%s: unexpected error: %v", tt.q, err)
+			continue
+		} else if err != nil {
+			continue
+		}
+
+		var hosts []string
+		for row := range e.Execute() {
+			if row.Err != nil {
+				t.Fatalf("%s: %s", tt.q, row.Err)
+			}
+			hosts = append(hosts, row.Tags["host"])
+		}
+		if !reflect.DeepEqual(hosts, tt.hosts) {
+			t.Errorf("%s: exp hosts %v, got %v", tt.q, tt.hosts, hosts)
+		}
+	}
+}
+
+// Ensure aggregates over a downsampled measurement read the intervals before the raw window from
+// the downsample and the others from the raw measurement, and that only queries whose results
+// are the same over the downsample are split.
+func TestPlanner_Plan_Downsample(t *testing.T) {
+	// the downsample has the max of each 10s interval, plus 1000 so it can be told apart
+	var downsampled []*rawQueryMapOutput
+	for sec := 10; sec < 100; sec += 10 {
+		downsampled = append(downsampled, &rawQueryMapOutput{Time: int64(sec) * int64(time.Second), Values: float64(sec + 1009)})
+	}
+
+	for _, tt := range []struct {
+		q      string
+		split  bool
+		values []interface{}
+	}{
+		{
+			q:      `SELECT max(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:01:40Z' GROUP BY time(10s)`,
+			split:  true,
+			values: []interface{}{1019.0, 1029.0, 1039.0, 1049.0, 1059.0, 69.0, 79.0, 89.0, 99.0},
+		},
+		{
+			q:      `SELECT max(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:01:40Z' GROUP BY time(30s)`,
+			split:  true,
+			values: []interface{}{1029.0, 1059.0, 89.0, 99.0},
+		},
+		{
+			// the range is within the raw window
+			q:      `SELECT max(value) FROM cpu WHERE time >= '1970-01-01T00:01:00Z' AND time < '1970-01-01T00:01:40Z' GROUP BY time(10s)`,
+			values: []interface{}{69.0, 79.0, 89.0, 99.0},
+		},
+		{
+			// the interval isn't a multiple of the interval of the downsample
+			q:      `SELECT max(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:01:40Z' GROUP BY time(15s)`,
+			values: []interface{}{14.0, 29.0, 44.0, 59.0, 74.0, 89.0, 99.0},
+		},
+		{
+			// the max of the downsample isn't the mean of the raw points
+			q:      `SELECT mean(value) FROM cpu WHERE time >= '1970-01-01T00:00:50Z' AND time < '1970-01-01T00:01:10Z' GROUP BY time(10s)`,
+			values: []interface{}{54.5, 64.5},
+		},
+		{
+			q:      `SELECT value FROM cpu WHERE time >= '1970-01-01T00:01:38Z' AND time < '1970-01-01T00:01:40Z'`,
+			values: []interface{}{98.0, 99.0},
+		},
+	} {
+		stmt := MustParseStatement(tt.q).(*SelectStatement)
+		interval, _ := stmt.GroupByInterval()
+		tmin, tmax := TimeRange(stmt.Condition)
+		newJob := func(m *testMapper) *MapReduceJob {
+			m.interval = int64(interval)
+			j := testJob(m)
+			j.TMin, j.TMax = tmin.UnixNano(), tmax.UnixNano()
+			return j
+		}
+		raw := &testMapper{points: testPoints(0, 99)}
+		ds := &testMapper{points: downsampled}
+
+		p := NewPlanner(&testSourceJobsDB{jobs: map[string][]*MapReduceJob{
+			"cpu":     {newJob(raw)},
+			"cpu_10s": {newJob(ds)},
+		}})
+		p.Now = func() time.Time { return time.Unix(100, 0) }
+		p.Downsamples = map[string]*Downsample{
+			"cpu": {Measurement: &Measurement{Name: "cpu_10s"}, Interval: 10 * time.Second, Aggregate: "max", RawWindow: 40 * time.Second},
+		}
+
+		rows := testExecute(t, p, tt.q, 10)
+		var got []interface{}
+		var rawN int
+		for _, row := range rows {
+			for _, v := range row.Values {
+				got = append(got, v[1])
+				if v[1].(float64) < 1000 {
+					rawN++
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.values) {
+			t.Errorf("%s:\n\nexp=%v\n\ngot=%v", tt.q, tt.values, got)
+		} else if ds.opened != tt.split {
+			t.Errorf("%s: unexpected read of the downsample: %v", tt.q, ds.opened)
+		} else if tt.split && raw.intervalN != rawN {
+			// the raw mapper only reads the intervals it returns
+			t.Errorf("%s: raw mapper read %d intervals, exp %d", tt.q, raw.intervalN, rawN)
+		}
+	}
+}
+
+// Ensure scoped plans reject measurements outside the scope, AND the tag filters of the scope with
+// the WHERE clause of a copy of the statement and pass the scope to the jobs.
+func TestPlanner_PlanContext(t *testing.T) {
+	scope := &Scope{Database: "acme", Measurements: []string{"cpu"}, Tags: map[string]string{"tenant": "acme", "region": "west"}}
+	for _, tt := range []struct {
+		q    string
+		cond string
+		err  string
+	}{
+		{q: `SELECT value FROM cpu`, cond: `region = 'west' AND tenant = 'acme'`},
+		{q: `SELECT value FROM cpu WHERE host = 'a' OR tenant = 'other'`, cond: `region = 'west' AND tenant = 'acme' AND (host = 'a' OR tenant = 'other')`},
+		{q: `SELECT value FROM mem`, err: `measurement mem isn't in the scope of the query`},
+		{q: `SELECT value FROM cpu, mem`, err: `measurement mem isn't in the scope of the query`},
+		{q: `SELECT value FROM /c.*/`, err: `measurement /c.*/ isn't in the scope of the query`},
+		{q: `SELECT value FROM "acme".."cpu"`, cond: `region = 'west' AND tenant = 'acme'`},
+		{q: `SELECT value FROM "db2".."cpu"`, err: `database db2 isn't in the scope of the query`},
+		{q: `SELECT value FROM cpu, "db2".."cpu"`, err: `database db2 isn't in the scope of the query`},
+	} {
+		job := testJob(&testMapper{})
+		stmt := MustParseStatement(tt.q).(*SelectStatement)
+		e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{job}}).PlanContext(stmt, 0, scope)
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Errorf("%s: unexpected error: %v", tt.q, err)
+		} else if err != nil {
+			continue
+		} else if cond := e.stmt.Condition.String(); cond != tt.cond {
+			t.Errorf("%s: unexpected condition: %s", tt.q, cond)
+		} else if s := stmt.String(); s != MustParseStatement(tt.q).String() {
+			t.Errorf("%s: statement modified: %s", tt.q, s)
+		} else if job.Scope != scope {
+			t.Errorf("%s: scope not passed to the job", tt.q)
+		}
+	}
+}
+
+// Ensure an executor can be executed again over a new time range after it's reset.
+func TestExecutor_Reset(t *testing.T) {
+	m := &testResettingMapper{testMapper: testMapper{points: testPoints(0, 20), interval: int64(5 * time.Second)}}
+	q, err := ParseQuery(`SELECT count(value) FROM cpu WHERE time >= 5s AND time < 10s GROUP BY time(5s)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := testJob(m)
+	j.TMin, j.TMax = int64(5*time.Second), int64(10*time.Second-1)
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{j}}).Plan(q.Statements[0].(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if values := testResetRows(t, e); !reflect.DeepEqual(values, [][]interface{}{{time.Unix(5, 0).UTC(), float64(5)}}) {
+		t.Fatalf("unexpected values: %v", values)
+	} else if m.closeN != 1 {
+		t.Fatalf("unexpected close count: %d", m.closeN)
+	}
+
+	if err := e.Reset(time.Unix(10, 0), time.Unix(20, 0)); err != nil {
+		t.Fatal(err)
+	} else if m.resetTMin != int64(10*time.Second) || m.resetTMax != int64(20*time.Second-1) {
+		t.Fatalf("unexpected mapper bounds: %d, %d", m.resetTMin, m.resetTMax)
+	}
+	if values := testResetRows(t, e); !reflect.DeepEqual(values, [][]interface{}{
+		{time.Unix(10, 0).UTC(), float64(5)},
+		{time.Unix(15, 0).UTC(), float64(5)},
+	}) {
+		t.Fatalf("unexpected values: %v", values)
+	} else if m.closeN != 2 {
+		t.Fatalf("unexpected close count: %d", m.closeN)
+	}
+}
+
+// Ensure an executor isn't reset when the new time range reads from other shards.
+func TestExecutor_Reset_ShardSetChanged(t *testing.T) {
+	q, err := ParseQuery(`SELECT count(value) FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testResettingMapper{})}, shardSetChanged: true}).Plan(q.Statements[0].(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reset(time.Unix(10, 0), time.Unix(20, 0)); err != ErrShardSetChanged {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure an executor isn't reset when one of its mappers can't be reused.
+func TestExecutor_Reset_NotSupported(t *testing.T) {
+	q, err := ParseQuery(`SELECT count(value) FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testResettingMapper{}, &testMapper{})}}).Plan(q.Statements[0].(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reset(time.Unix(10, 0), time.Unix(20, 0)); err != ErrResetNotSupported {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// testResetRows executes e and returns the values of its single row.
+func testResetRows(t *testing.T, e *Executor) [][]interface{} {
+	var rows []*Row
+	for row := range e.Execute() {
+		if row.Err != nil {
+			t.Fatalf("unexpected row error: %s", row.Err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	}
+	return rows[0].Values
+}
+
+// Ensure an iterator returns the same rows as Execute and only starts the query when it's read.
+func TestExecutor_Iterator(t *testing.T) {
+	exp := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{points: testPoints(0, 20)})}}), `SELECT value FROM cpu`, 5)
+
+	q, err := ParseQuery(`SELECT value FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &testMapper{points: testPoints(0, 20)}
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}}).Plan(q.Statements[0].(*SelectStatement), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr, err := e.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	} else if m.opened {
+		t.Fatal("mapper opened before the first row was requested")
+	}
+
+	var rows []*Row
+	for row, ok := itr.Next(); ok; row, ok = itr.Next() {
+		if row.Err != nil {
+			t.Fatal(row.Err)
+		}
+		rows = append(rows, row)
+	}
+	if !reflect.DeepEqual(rows, exp) {
+		t.Fatalf("unexpected rows: %v", rows)
+	} else if !m.closed {
+		t.Fatal("mapper not closed")
+	}
+	if _, ok := itr.Next(); ok {
+		t.Fatal("expected no more rows")
+	}
+}
+
+// Ensure a closed iterator doesn't return any more rows.
+func TestExecutor_Iterator_Close(t *testing.T) {
+	q, err := ParseQuery(`SELECT value FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{points: testPoints(0, 20)})}}).Plan(q.Statements[0].(*SelectStatement), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr, err := e.Iterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row, ok := itr.Next(); !ok || row.Err != nil {
+		t.Fatalf("unexpected row: %v, %v", row, ok)
+	}
+	itr.Close()
+	if _, ok := itr.Next(); ok {
+		t.Fatal("expected no more rows")
+	}
+}
+
+// Ensure an executor can't be executed twice without being reset.
+func TestExecutor_ErrExecuted(t *testing.T) {
+	q, err := ParseQuery(`SELECT count(value) FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}}).Plan(q.Statements[0].(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _ = range e.Execute() {
+	}
+
+	if _, err := e.Iterator(); err != ErrExecuted {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if row := <-e.Execute(); row == nil || row.Err != ErrExecuted {
+		t.Fatalf("unexpected row: %v", row)
+	}
+}
+
+// Ensure the planner chooses the interval of time(auto) queries from their time range.
+func TestPlanner_Plan_AutoInterval(t *testing.T) {
+	for i, tt := range []struct {
+		s         string
+		points    int
+		precision time.Duration
+		interval  time.Duration
+		err       error
+	}{
+		{s: `SELECT count(value) FROM cpu WHERE time >= '2000-01-01T00:00:00Z' AND time < '2000-01-01T01:00:00Z' GROUP BY time(auto)`, interval: time.Minute},
+		{s: `SELECT count(value) FROM cpu WHERE time >= '2000-01-01T00:00:00Z' AND time < '2000-01-01T01:00:00Z' GROUP BY time(auto)`, points: 10, interval: 10 * time.Minute},
+		{s: `SELECT count(value) FROM cpu WHERE time >= '2000-01-01T00:00:00Z' AND time < '2000-01-01T00:00:01Z' GROUP BY time(auto)`, precision: time.Second, interval: time.Second},
+		{s: `SELECT count(value) FROM cpu WHERE time >= '1999-12-31T00:00:00Z' GROUP BY time(auto)`, interval: 15 * time.Minute},
+		{s: `SELECT count(value) FROM cpu WHERE time < '2000-01-01T00:00:00Z' GROUP BY time(auto)`, err: ErrAutoIntervalTimeBound},
+		{s: `SELECT count(value) FROM cpu WHERE time >= '1999-12-31T00:00:00Z' GROUP BY time(1h)`, interval: time.Hour},
+	} {
+		q, err := ParseQuery(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+		p.Now = func() time.Time { return time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC) }
+		p.AutoIntervalPoints, p.Precision = tt.points, tt.precision
+		e, err := p.Plan(q.Statements[0].(*SelectStatement), 0)
+		if err != tt.err {
+			t.Errorf("%d. unexpected error: %v", i, err)
+		} else if err == nil && e.Interval() != tt.interval {
+			t.Errorf("%d. unexpected interval: %s", i, e.Interval())
+		}
+	}
+}
+
+// Ensure planning a time(auto) query doesn't change its statement, so planning it again over a
+// different time range chooses the interval of that range.
+func TestPlanner_Plan_AutoInterval_Replan(t *testing.T) {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	stmt := MustParseStatement(`SELECT count(value) FROM cpu WHERE time >= '2000-01-01T00:00:00Z' GROUP BY time(auto)`).(*SelectStatement)
+
+	var intervals []time.Duration
+	for _, d := range []time.Duration{time.Hour, 10 * time.Hour} {
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+		p.Now = func() time.Time { return start.Add(d) }
+		e, err := p.Plan(stmt, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if !stmt.IsAutoInterval() {
+			t.Fatalf("statement rewritten: %s", stmt)
+		}
+		intervals = append(intervals, e.Interval())
+	}
+	if exp := []time.Duration{time.Minute, 10 * time.Minute}; !reflect.DeepEqual(intervals, exp) {
+		t.Fatalf("unexpected intervals: %v", intervals)
+	}
+}
+
+// Ensure the interval chosen for time(auto) is a round duration.
+func TestAutoInterval(t *testing.T) {
+	tmin := time.Unix(0, 0)
+	for i, tt := range []struct {
+		d         time.Duration
+		n         int
+		precision time.Duration
+		exp       time.Duration
+	}{
+		{d: 0, exp: time.Millisecond},
+		{d: 50 * time.Second, exp: 500 * time.Millisecond},
+		{d: 100 * time.Second, exp: time.Second},
+		{d: 101 * time.Second, exp: 5 * time.Second},
+		{d: 7 * 24 * time.Hour, exp: 2 * time.Hour},
+		{d: 7 * 24 * time.Hour, n: 7, exp: 24 * time.Hour},
+		{d: 365 * 24 * time.Hour, exp: 7 * 24 * time.Hour},
+		{d: 365 * 24 * time.Hour, n: 10, exp: 6 * 7 * 24 * time.Hour},
+		{d: 45 * time.Second, precision: time.Second, exp: time.Second},
+		{d: 10 * time.Minute, precision: 7 * time.Second, exp: 14 * time.Second},
+	} {
+		if d := AutoInterval(tmin, tmin.Add(tt.d), tt.n, tt.precision); d != tt.exp {
+			t.Errorf("%d. unexpected interval: exp=%s, got=%s", i, tt.exp, d)
+		}
+	}
+}
+
+// Ensure an executor returns the partial state of aggregates when asked to.
+func TestExecutor_Execute_PartialAggregates(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{points: testPoints(0, 2)}, &testMapper{points: testPoints(2, 2)})}})
+	p.PartialAggregates = true
+	rows := testExecute(t, p, `SELECT mean(value), max(value) FROM cpu`, 0)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := []interface{}{time.Unix(0, 0).UTC(), &meanMapOutput{Count: 4, Mean: 2.5}, &minMaxMapOut{Val: 4}}; !reflect.DeepEqual(rows[0].Values[0], exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values[0])
+	}
+}
+
+// Ensure string fields can be counted, deduplicated, and joined in time order within each interval.
+func TestExecutor_Execute_StringAggregates(t *testing.T) {
+	messages := func(secs ...int) []*rawQueryMapOutput {
+		var a []*rawQueryMapOutput
+		for _, sec := range secs {
+			a = append(a, &rawQueryMapOutput{Time: int64(sec) * int64(time.Second), Values: fmt.Sprintf("m%d", sec)})
+		}
+		return a
+	}
+	newPlanner := func(points ...[]*rawQueryMapOutput) *Planner {
+		job := testJob()
+		job.TMin, job.TMax = int64(10*time.Second), int64(30*time.Second)-1
+		for i, a := range points {
+			job.Mappers = append(job.Mappers, &testMapper{points: a, interval: int64(10 * time.Second), shardID: uint64(i + 1), job: job})
+		}
+		return NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+	}
+	const where = ` FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:00:30Z' GROUP BY time(10s)`
+
+	rows := testExecute(t, newPlanner(messages(11, 14, 21), messages(12, 13, 25)), `SELECT concat(value, ' | '), count(value), first(value), last(value)`+where, 0)
+	if exp := [][]interface{}{
+		{time.Unix(10, 0).UTC(), "m11 | m12 | m13 | m14", float64(4), "m11", "m14"},
+		{time.Unix(20, 0).UTC(), "m21 | m25", float64(2), "m21", "m25"},
+	}; len(rows) != 1 || !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+
+	rows = testExecute(t, newPlanner(messages(11, 21), messages(11, 22)), `SELECT distinct(value)`+where, 0)
+	if exp := [][]interface{}{
+		{time.Unix(10, 0).UTC(), distinctValues{"m11"}},
+		{time.Unix(20, 0).UTC(), distinctValues{"m21", "m22"}},
+	}; len(rows) != 1 || !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected distinct rows: %v", rows)
+	}
+
+	// an interval joining too many bytes fails the series
+	big := []*rawQueryMapOutput{{Time: int64(11 * time.Second), Values: strings.Repeat("x", DefaultMaxConcatBytes)}}
+	if err := testConcatErr(t, newPlanner(big, messages(12)), where); err == nil || err.Error() != ErrConcatTooLarge(DefaultMaxConcatBytes).Error() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the limit is set by the planner
+	p := newPlanner(messages(11, 12), messages(13))
+	p.MaxConcatBytes = 8
+	if err := testConcatErr(t, p, where); err == nil || err.Error() != ErrConcatTooLarge(8).Error() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p.MaxConcatBytes = 12
+	if err := testConcatErr(t, p, where); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// testConcatErr executes a concat() of the value of points with a planner, and returns the error
+// of the rows, if any.
+func testConcatErr(t *testing.T, p *Planner, where string) error {
+	e, err := p.Plan(MustParseStatement(`SELECT concat(value)`+where).(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rowErr error
+	for row := range e.Execute() {
+		if row.Err != nil {
+			rowErr = row.Err
+		}
+	}
+	return rowErr
+}
+
+// Ensure a coordinator combining the partial aggregates a node computes for its shards returns the
+// same aggregates as reading the shards itself.
+func TestPartialMapper(t *testing.T) {
+	const s = `SELECT mean(value), count(value), max(value), first(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:00:50Z' GROUP BY time(10s)`
+	newJob := func(points ...[]*rawQueryMapOutput) *MapReduceJob {
+		job := testJob()
+		job.TMin, job.TMax = int64(10*time.Second), int64(50*time.Second)-1
+		for i, a := range points {
+			job.Mappers = append(job.Mappers, &testMapper{points: a, interval: int64(10 * time.Second), shardID: uint64(i + 1), job: job})
+		}
+		return job
+	}
+	local, remote := testPoints(10, 15), [][]*rawQueryMapOutput{testPoints(20, 5), testPoints(35, 10)}
+
+	// the node returns the partials of its shards encoded as JSON
+	fetch := func() (*Row, error) {
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob(remote...)}})
+		p.PartialAggregates = true
+		b, err := json.Marshal(testExecute(t, p, s, 0)[0])
+		if err != nil {
+			return nil, err
+		}
+		return UnmarshalPartialRow(MustParseStatement(s).(*SelectStatement), b)
+	}
+	noData := func() (*Row, error) { return nil, nil }
+
+	for _, tt := range []struct {
+		fetch  func() (*Row, error)
+		points [][]*rawQueryMapOutput
+	}{
+		{fetch: fetch, points: append([][]*rawQueryMapOutput{local}, remote...)},
+		{fetch: noData, points: [][]*rawQueryMapOutput{local}},
+	} {
+		exp := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{newJob(tt.points...)}}), s, 0)
+
+		job := newJob(local)
+		job.Mappers = append(job.Mappers, NewPartialMapper(job, 1, 2, tt.fetch))
+		if rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{job}}), s, 0); !reflect.DeepEqual(rows, exp) {
+			t.Errorf("unexpected rows: %v, expected %v", rows[0].Values, exp[0].Values)
+		}
+	}
+
+	if err := NewPartialMapper(testJob(), 1, 2, noData).Begin(nil, 0, 0); err != ErrPartialMapperRaw {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a node returning its partials out of time order fails the series
+	job := newJob()
+	job.Mappers = []Mapper{NewPartialMapper(job, 1, 2, func() (*Row, error) {
+		return &Row{Values: [][]interface{}{{time.Unix(30, 0).UTC(), float64(1)}, {time.Unix(10, 0).UTC(), float64(1)}}}, nil
+	})}
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{job}}).Plan(MustParseStatement(`SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:00:50Z' GROUP BY time(10s)`).(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rowErr error
+	for row := range e.Execute() {
+		if row.Err != nil {
+			rowErr = row.Err
+		}
+	}
+	if exp := ErrIntervalOutOfOrder(2, 10*int64(time.Second), 40*int64(time.Second)); rowErr == nil || rowErr.Error() != exp.Error() {
+		t.Fatalf("unexpected error: %v", rowErr)
+	}
+}
+
+// Ensure queries whose aggregates can't be combined are rejected when partial states are requested.
+func TestPlanner_Plan_PartialAggregates_NotSupported(t *testing.T) {
+	for i, tt := range []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT mean(value) * 2 FROM cpu`, err: `partial aggregates aren't supported for mean(value) * 2.000`},
+		{s: `SELECT derivative(mean(value), 1s) FROM cpu WHERE time > now() - 1h GROUP BY time(1m)`, err: `partial aggregates aren't supported for derivative()`},
+	} {
+		q, err := ParseQuery(tt.s)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+		p.PartialAggregates = true
+		if _, err := p.Plan(q.Statements[0].(*SelectStatement), 0); err == nil || err.Error() != tt.err {
+			t.Errorf("%d. unexpected error: %v", i, err)
+		}
+	}
+}
+
+// Ensure the planner rejects read consistency levels the transaction can't read at.
+func TestPlanner_Plan_Consistency_NotSupported(t *testing.T) {
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+	p.Consistency = ReadConsistencyOne
+	_, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 0)
+	if err == nil || err.Error() != "read consistency level not supported: one" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the rows of measurements with different fields have the same columns when columns are
+// unified, with null for the fields a measurement doesn't have.
+func TestPlanner_Plan_UnifyColumns(t *testing.T) {
+	cpu := testJob(&testMapper{points: []*rawQueryMapOutput{{Time: int64(time.Second), Values: map[string]interface{}{"idle": 1.0, "value": 2.0}}}})
+	mem := testJob(&testMapper{points: []*rawQueryMapOutput{{Time: int64(time.Second), Values: map[string]interface{}{"free": 3.0, "value": 4.0}}}})
+	mem.MeasurementName = "mem"
+	db := &testUnifiedColumnsDB{testDB: testDB{jobs: []*MapReduceJob{cpu, mem}}}
+
+	p := NewPlanner(db)
+	p.UnifyColumns = true
+	rows := testExecute(t, p, `SELECT free, idle, value FROM cpu, mem`, 0)
+	if !db.unified {
+		t.Fatal("columns not unified by the transaction")
+	}
+
+	var got []string
+	for _, row := range rows {
+		got = append(got, fmt.Sprintf("%s:%v:%v", row.Name, row.Columns, row.Values[0][1:]))
+	}
+	if exp := []string{"cpu:[time free idle value]:[<nil> 1 2]", "mem:[time free idle value]:[3 <nil> 4]"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+
+	// Aggregates aren't unified, and the transaction must support unifying columns.
+	if _, err := p.Plan(MustParseStatement(`SELECT mean(value) FROM cpu, mem`).(*SelectStatement), 0); err != ErrUnifyColumnsAggregate {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	p = NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{})}})
+	p.UnifyColumns = true
+	if _, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 0); err != ErrUnifyColumnsNotSupported {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure read consistency levels are parsed by name.
+func TestParseReadConsistency(t *testing.T) {
+	for _, tt := range []struct {
+		s   string
+		c   ReadConsistency
+		err string
+	}{
+		{s: "any", c: ReadConsistencyAny},
+		{s: "ONE", c: ReadConsistencyOne},
+		{s: "quorum", c: ReadConsistencyQuorum},
+		{s: "all", err: "invalid read consistency level: all"},
+	} {
+		c, err := ParseReadConsistency(tt.s)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: unexpected error: %v", tt.s, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %s", tt.s, err)
+		} else if c != tt.c {
+			t.Errorf("%s: exp %s, got %s", tt.s, tt.c, c)
+		}
+	}
+}
+
+// Ensure the mappers of a job that read from the same node are coalesced into one mapper per node.
+func TestPlanner_Plan_CoalesceNodeMappers(t *testing.T) {
+	local := &testMapper{shardID: 1}
+	j := testJob(
+		&testNodeMapper{testMapper{shardID: 4}, 2},
+		&testNodeMapper{testMapper{shardID: 2}, 1},
+		local,
+		&testNodeMapper{testMapper{shardID: 3}, 1},
+		&testNodeMapper{testMapper{shardID: 5}, 3},
+		&testNodeMapper{testMapper{shardID: 6}, 2},
+	)
+
+	var requests [][]uint64
+	db := &testMultiMapperDB{testDB: testDB{jobs: []*MapReduceJob{j}}}
+	db.newMultiMapper = func(job *MapReduceJob, nodeID uint64, shardIDs []uint64) (Mapper, error) {
+		if job != j {
+			t.Fatalf("unexpected job: %v", job)
+		} else if nodeID == 2 {
+			return nil, ErrMultiMapperNotSupported
+		}
+		requests = append(requests, append([]uint64{nodeID}, shardIDs...))
+		return &testMapper{shardID: shardIDs[0]}, nil
+	}
+
+	q, err := ParseQuery(`SELECT count(value) FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlanner(db)
+	p.CoalesceNodeMappers = true
+	if _, err := p.Plan(q.Statements[0].(*SelectStatement), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Node 1 is coalesced, node 2 doesn't support it, and node 3 only owns one shard.
+	if exp := [][]uint64{{1, 2, 3}}; !reflect.DeepEqual(requests, exp) {
+		t.Fatalf("unexpected requests: %v", requests)
+	}
+	var ids []uint64
+	for _, mm := range j.Mappers {
+		ids = append(ids, mm.ShardID())
+	}
+	if !reflect.DeepEqual(ids, []uint64{1, 2, 4, 5, 6}) {
+		t.Fatalf("unexpected mappers: %v", ids)
+	} else if j.Mappers[0] != local {
+		t.Fatal("expected the local mapper to be kept")
+	}
+}
+
+// Ensure raw fields and aggregates are returned under their aliases.
+func TestMapReduceJob_Execute_Alias(t *testing.T) {
+	for i, tt := range []struct {
+		s       string
+		columns []string
+	}{
+		{s: `SELECT value FROM cpu`, columns: []string{"time", "value"}},
+		{s: `SELECT value AS v FROM cpu`, columns: []string{"time", "v"}},
+		{s: `SELECT value AS a, value AS b FROM cpu`, columns: []string{"time", "a", "b"}},
+		{s: `SELECT value, value AS b FROM cpu`, columns: []string{"time", "value", "b"}},
+		{s: `SELECT value * 2 AS doubled FROM cpu`, columns: []string{"time", "doubled"}},
+		{s: `SELECT mean(value) AS avg_cpu FROM cpu`, columns: []string{"time", "avg_cpu"}},
+		{s: `SELECT mean(value) AS avg_cpu, max(value) FROM cpu`, columns: []string{"time", "avg_cpu", "max"}},
+	} {
+		m := &testMapper{points: testPoints(0, 4)}
+		j := testJob(m)
+		m.job = j
+
+		rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{j}}), tt.s, 10)
+		if len(rows) != 1 {
+			t.Fatalf("%d. unexpected row count: %d", i, len(rows))
+		} else if !reflect.DeepEqual(rows[0].Columns, tt.columns) {
+			t.Fatalf("%d. unexpected columns: %v", i, rows[0].Columns)
+		} else if len(rows[0].Values) == 0 {
+			t.Fatalf("%d. expected values", i)
+		}
+	}
+
+	// a field selected several times has its value in each of its columns
+	m := &testMapper{points: testPoints(0, 4)}
+	j := testJob(m)
+	m.job = j
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{j}}), `SELECT value AS a, value AS b FROM cpu`, 10)
+	for _, vals := range rows[0].Values {
+		if len(vals) != 3 || vals[1] == nil || vals[1] != vals[2] {
+			t.Fatalf("unexpected values: %v", vals)
+		}
+	}
+}
+
+// Ensure raw queries return the same results whether or not the mappers are read ahead.
+func TestMapReduceJob_Execute_Prefetch(t *testing.T) {
+	var exp []*Row
+	for _, depth := range []int{0, 1, 3} {
+		m0 := &testMapper{points: testPoints(0, 20), shardID: 1}
+		m1 := &testMapper{points: testPoints(10, 20), shardID: 2}
+
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m0, m1)}})
+		p.PrefetchDepth = depth
+		rows := testExecute(t, p, `SELECT value FROM cpu`, 3)
+
+		if exp == nil {
+			exp = rows
+		} else if !reflect.DeepEqual(rows, exp) {
+			t.Fatalf("depth %d: unexpected rows:\n\ngot=%v\n\nexp=%v", depth, rows, exp)
+		}
+	}
+}
+
+// Ensure mappers aren't read after they're closed when a raw query ends before they're empty.
+func TestMapReduceJob_Execute_Prefetch_EarlyTermination(t *testing.T) {
+	m := &testCloseCheckMapper{testMapper: testMapper{points: testPoints(0, 100)}}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+	p.PrefetchDepth = 2
+
+	rows := testExecute(t, p, `SELECT value FROM cpu LIMIT 15`, 10)
+	if len(rows) != 2 || len(rows[0].Values) != 10 || len(rows[1].Values) != 5 {
+		t.Fatalf("unexpected rows: %v", rows)
+	} else if !m.closed {
+		t.Fatal("expected mapper to be closed")
+	} else if m.readAfterClose {
+		t.Fatal("mapper read after close")
+	}
+}
+
+// Ensure a raw query reads each mapper once if its limit is satisfied by the first chunk of each.
+func TestMapReduceJob_Execute_Limit_EarlyTermination(t *testing.T) {
+	m0 := &testMapper{points: testPoints(0, 100), shardID: 1}
+	m1 := &testMapper{points: testPoints(1, 100), shardID: 2}
+	m2 := &testMapper{points: testPoints(2, 100), shardID: 3}
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m0, m1, m2)}}), `SELECT value FROM cpu LIMIT 1`, 100)
+	if exp := [][]interface{}{{time.Unix(1, 0).UTC(), 1.0}}; len(rows) != 1 || !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+	for _, m := range []*testMapper{m0, m1, m2} {
+		if m.intervalN != 1 {
+			t.Fatalf("shard %d: unexpected reads: %d", m.shardID, m.intervalN)
+		} else if m.chunkSize != 1 {
+			t.Fatalf("shard %d: unexpected chunk size: %d", m.shardID, m.chunkSize)
+		} else if !m.closed {
+			t.Fatalf("shard %d: expected mapper to be closed", m.shardID)
+		}
+	}
+}
+
+// Ensure reads that are in progress when a raw query reaches its limit are cancelled.
+func TestMapReduceJob_Execute_Limit_Cancel(t *testing.T) {
+	m := &testCancelMapper{testMapper: testMapper{points: testPoints(0, 20)}, cancel: make(chan struct{})}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+
+	// the mapper is read ahead, so a read is blocked once the limit is reached
+	done := make(chan []*Row)
+	go func() { done <- testExecute(t, p, `SELECT value FROM cpu LIMIT 15`, 10) }()
+
+	select {
+	case rows := <-done:
+		if len(rows) != 2 || len(rows[1].Values) != 5 {
+			t.Fatalf("unexpected rows: %v", rows)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the query to end")
+	}
+}
+
+// Ensure the planner can reject queries against measurements that don't exist.
+func TestPlanner_Plan_ErrorOnMissingMeasurement(t *testing.T) {
+	db := &testMeasurementDB{measurements: map[string]bool{"cpu": true}}
+	for i, tt := range []struct {
+		s   string
+		on  bool
+		err string
+	}{
+		{s: `SELECT value FROM does_not_exist`},
+		{s: `SELECT value FROM does_not_exist`, on: true, err: `measurement not found: does_not_exist`},
+		{s: `SELECT value FROM cpu, does_not_exist`, on: true, err: `measurement not found: does_not_exist`},
+		{s: `SELECT value FROM cpu`, on: true},
+		{s: `SELECT value FROM /does_not_exist/`, on: true},
+	} {
+		q, err := ParseQuery(tt.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		p := NewPlanner(db)
+		p.ErrorOnMissingMeasurement = tt.on
+		_, err = p.Plan(q.Statements[0].(*SelectStatement), 0)
+		if (err == nil && tt.err != "") || (err != nil && err.Error() != tt.err) {
+			t.Fatalf("%d. unexpected error: %v", i, err)
+		}
+	}
+
+	// The transaction must be able to look up measurements.
+	q, err := ParseQuery(`SELECT value FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewPlanner(&testDB{})
+	p.ErrorOnMissingMeasurement = true
+	if _, err := p.Plan(q.Statements[0].(*SelectStatement), 0); err != ErrMeasurementLookupNotSupported {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure a snapshot plan restricts the transaction to the given shard groups.
+func TestPlanner_PlanSnapshot(t *testing.T) {
+	m := &testMapper{points: testPoints(0, 3)}
+	db := &testSnapshotDB{testDB: testDB{jobs: []*MapReduceJob{testJob(m)}}}
+
+	q, err := ParseQuery(`SELECT value FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := q.Statements[0].(*SelectStatement)
+
+	e, err := NewPlanner(db).PlanSnapshot(stmt, 10, []uint64{3, 5})
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(db.shardGroupIDs, []uint64{3, 5}) {
+		t.Fatalf("unexpected shard groups: %v", db.shardGroupIDs)
+	}
+
+	var rows []*Row
+	for row := range e.Execute() {
+		rows = append(rows, row)
+	}
+	if len(rows) != 1 || len(rows[0].Values) != 3 {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+
+	// A snapshot needs shard groups and a transaction that can read them.
+	if _, err := NewPlanner(db).PlanSnapshot(stmt, 10, nil); err != ErrSnapshotShardGroupsRequired {
+		t.Fatalf("unexpected error: %v", err)
+	} else if _, err := NewPlanner(&testDB{}).PlanSnapshot(stmt, 10, []uint64{3}); err != ErrSnapshotNotSupported {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure rows are cut off once the response reaches its maximum size.
+func TestExecutor_MaxResponseBytes(t *testing.T) {
+	j0 := testJob(&testMapper{points: testPoints(0, 1000)})
+	j1 := testJob(&testMapper{points: testPoints(0, 1000)})
+	j1.TagSet = &TagSet{Tags: map[string]string{"host": "serverB"}, Key: []byte("serverB")}
+
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{j0, j1}})
+	p.EmitDone = true
+	p.MaxResponseBytes = 2000
+	rows := testExecute(t, p, `SELECT value FROM cpu`, 10)
+
+	// the last row is the stats of the query
+	last := rows[len(rows)-2]
+	if !last.Truncated {
+		t.Fatalf("expected last row to be truncated: %v", last)
+	} else if stats := rows[len(rows)-1].Stats; !stats.Truncated {
+		t.Fatalf("expected truncated stats: %+v", stats)
+	}
+
+	var n, pointN int
+	for i, row := range rows[:len(rows)-1] {
+		if len(row.Tags) > 0 {
+			t.Fatalf("unexpected row from the second series: %v", row)
+		} else if row.Truncated && i != len(rows)-2 {
+			t.Fatalf("unexpected truncated row %d", i)
+		}
+		n += rowHeaderSize(row)
+		for _, v := range row.Values {
+			n += valuesSize(v)
+		}
+		pointN += len(row.Values)
+	}
+	if n > p.MaxResponseBytes {
+		t.Fatalf("response too large: %d bytes", n)
+	} else if pointN == 0 || pointN >= 1000 {
+		t.Fatalf("unexpected point count: %d", pointN)
+	}
+
+	// the jobs are stopped once the limit is reached rather than read to the end
+	if m := j0.Mappers[0].(*testMapper); m.index >= 1000 {
+		t.Fatalf("unexpected points read after the limit: %d", m.index)
+	} else if m := j1.Mappers[0].(*testMapper); m.opened {
+		t.Fatal("unexpected read of the second series after the limit")
+	}
+
+	// without a limit every row is sent
+	p.MaxResponseBytes = 0
+	rows = testExecute(t, p, `SELECT value FROM cpu`, 10)
+	if stats := rows[len(rows)-1].Stats; stats.Truncated || stats.PointN != 2000 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+// Ensure difference() returns the differences of consecutive raw points, merged across mappers and chunks.
+func TestMapReduceJob_Execute_Difference(t *testing.T) {
+	point := func(sec int, v interface{}) *rawQueryMapOutput {
+		return &rawQueryMapOutput{Time: int64(sec) * int64(time.Second), Values: v}
+	}
+	m0 := &testMapper{points: []*rawQueryMapOutput{point(1, 1.0), point(3, 9.0), point(5, 25.0)}, shardID: 1}
+	m1 := &testMapper{points: []*rawQueryMapOutput{point(2, 4.0), point(4, 16.0)}, shardID: 2}
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m0, m1)}}), `SELECT difference(value) FROM cpu`, 2)
+
+	var got [][]interface{}
+	for _, row := range rows {
+		got = append(got, row.Values...)
+	}
+	if exp := [][]interface{}{
+		{time.Unix(2, 0).UTC(), 3.0},
+		{time.Unix(3, 0).UTC(), 5.0},
+		{time.Unix(4, 0).UTC(), 7.0},
+		{time.Unix(5, 0).UTC(), 9.0},
+	}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values:\n\nexp=%v\n\ngot=%v", exp, got)
+	}
+
+	// the difference of integers is an integer
+	m := &testMapper{points: []*rawQueryMapOutput{point(1, int64(10)), point(2, int64(7))}}
+	rows = testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}}), `SELECT difference(value) FROM cpu`, 10)
+	if exp := [][]interface{}{{time.Unix(2, 0).UTC(), int64(-3)}}; len(rows) != 1 || !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+}
+
+// Ensure difference() of an aggregate doesn't return differences for intervals filled with null.
+func TestMapReduceJob_Execute_Difference_Fill(t *testing.T) {
+	for _, tt := range []struct {
+		fill string
+		exp  [][]interface{}
+	}{
+		{
+			fill: "",
+			exp:  [][]interface{}{{time.Unix(2, 0).UTC(), 2.0}, {time.Unix(5, 0).UTC(), 4.0}},
+		},
+		{
+			fill: "fill(0)",
+			exp: [][]interface{}{
+				{time.Unix(2, 0).UTC(), 2.0},
+				{time.Unix(3, 0).UTC(), -4.0},
+				{time.Unix(4, 0).UTC(), 16.0},
+				{time.Unix(5, 0).UTC(), 4.0},
+			},
+		},
+		{
+			fill: "fill(previous)",
+			exp: [][]interface{}{
+				{time.Unix(2, 0).UTC(), 2.0},
+				{time.Unix(3, 0).UTC(), 0.0},
+				{time.Unix(4, 0).UTC(), 12.0},
+				{time.Unix(5, 0).UTC(), 4.0},
+			},
+		},
+		{
+			fill: "fill(none)",
+			exp:  [][]interface{}{{time.Unix(2, 0).UTC(), 2.0}, {time.Unix(4, 0).UTC(), 12.0}, {time.Unix(5, 0).UTC(), 4.0}},
+		},
+	} {
+		// there's no point at 3s
+		m := &testMapper{interval: int64(time.Second), points: []*rawQueryMapOutput{
+			{Time: int64(1 * time.Second), Values: 2.0},
+			{Time: int64(2 * time.Second), Values: 4.0},
+			{Time: int64(4 * time.Second), Values: 16.0},
+			{Time: int64(5 * time.Second), Values: 20.0},
+		}}
+		j := testJob(m)
+		j.TMin, j.TMax = int64(time.Second), int64(5*time.Second)
+
+		rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{j}}),
+			`SELECT difference(max(value)) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:05Z' GROUP BY time(1s) `+tt.fill, 0)
+		if len(rows) != 1 {
+			t.Fatalf("%s: unexpected row count: %d", tt.fill, len(rows))
+		} else if !reflect.DeepEqual(rows[0].Values, tt.exp) {
+			t.Fatalf("%s: unexpected values:\n\nexp=%v\n\ngot=%v", tt.fill, tt.exp, rows[0].Values)
+		}
+	}
+}
+
+// Ensure rows record the shards that contributed points to them if the planner's option is set.
+func TestExecutor_RecordShardIDs(t *testing.T) {
+	point := func(sec int, v interface{}) *rawQueryMapOutput {
+		return &rawQueryMapOutput{Time: int64(sec) * int64(time.Second), Values: v}
+	}
+	db := func() *testDB {
+		return &testDB{jobs: []*MapReduceJob{testJob(
+			&testMapper{points: []*rawQueryMapOutput{point(1, 1.0), point(2, 2.0), point(3, 3.0)}, shardID: 1},
+			&testMapper{points: []*rawQueryMapOutput{point(10, 10.0)}, shardID: 2},
+			&testMapper{shardID: 3},
+		)}}
+	}
+
+	// shard IDs aren't recorded by default
+	for _, row := range testExecute(t, NewPlanner(db()), `SELECT value FROM cpu`, 2) {
+		if row.ShardIDs != nil {
+			t.Fatalf("unexpected shard IDs: %v", row.ShardIDs)
+		}
+	}
+
+	p := NewPlanner(db())
+	p.RecordShardIDs = true
+	rows := testExecute(t, p, `SELECT value FROM cpu`, 2)
+	if len(rows) != 3 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := []uint64{1}; !reflect.DeepEqual(rows[0].ShardIDs, exp) {
+		t.Fatalf("unexpected shard IDs of the first chunk: exp=%v, got=%v", exp, rows[0].ShardIDs)
+	} else if exp := []uint64{1, 2}; !reflect.DeepEqual(rows[1].ShardIDs, exp) {
+		t.Fatalf("unexpected shard IDs of the second chunk: exp=%v, got=%v", exp, rows[1].ShardIDs)
+	} else if rows[2].ShardIDs != nil {
+		t.Fatalf("unexpected shard IDs of the empty row: %v", rows[2].ShardIDs)
+	}
+
+	// the empty shard didn't contribute to the aggregate
+	p = NewPlanner(db())
+	p.RecordShardIDs = true
+	rows = testExecute(t, p, `SELECT count(value) FROM cpu`, 0)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := []uint64{1, 2}; !reflect.DeepEqual(rows[0].ShardIDs, exp) {
+		t.Fatalf("unexpected shard IDs: exp=%v, got=%v", exp, rows[0].ShardIDs)
+	}
+}
+
+// Ensure queries can call user-defined aggregates registered with the planner.
+func TestPlanner_Aggregates(t *testing.T) {
+	job := testJob()
+	m0 := &testMapper{points: testPoints(0, 3), shardID: 1, job: job}
+	m1 := &testMapper{points: testPoints(3, 2), shardID: 2, job: job}
+	m2 := &testMapper{shardID: 3, job: job}
+	job.Mappers = []Mapper{m0, m1, m2}
+
+	agg := &testProductAggregate{}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+	p.Aggregates["product"] = agg
+
+	rows := testExecute(t, p, `SELECT product(value), sum(value) FROM cpu`, 0)
+	if exp := [][]interface{}{{time.Unix(0, 0).UTC(), 120.0, 15.0}}; len(rows) != 1 || !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected rows: %v", rows)
+	} else if agg.reducerN != 1 {
+		t.Fatalf("unexpected reducers: %d", agg.reducerN)
+	}
+
+	// functions that aren't registered are rejected by the planner
+	for _, s := range []string{`SELECT foo(value) FROM cpu`, `SELECT derivative(foo(value)) FROM cpu`} {
+		q, err := ParseQuery(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewPlanner(&testDB{}).Plan(q.Statements[0].(*SelectStatement), 0); err == nil || err.Error() != `function not found: "foo"` {
+			t.Fatalf("%s: unexpected error: %v", s, err)
+		}
+	}
+}
+
+// Ensure only the builtin aggregates whose map functions can be computed from rollups, of fields
+// whose points don't have to be read by the map function, are computed from rollups.
+func TestMapReduceJob_RollupMapFunc(t *testing.T) {
+	for _, tt := range []struct {
+		job    *MapReduceJob
+		expr   string
+		rollup bool
+	}{
+		{job: &MapReduceJob{}, expr: `count(value)`, rollup: true},
+		{job: &MapReduceJob{}, expr: `sum(value)`, rollup: true},
+		{job: &MapReduceJob{}, expr: `mean(value)`, rollup: true},
+		{job: &MapReduceJob{}, expr: `min(value)`, rollup: true},
+		{job: &MapReduceJob{}, expr: `max(value)`, rollup: true},
+		{job: &MapReduceJob{}, expr: `derivative(mean(value), 1s)`, rollup: true},
+		{job: &MapReduceJob{}, expr: `median(value)`},
+		{job: &MapReduceJob{}, expr: `last(value)`},
+		{job: &MapReduceJob{}, expr: `count(distinct(value))`},
+		{job: &MapReduceJob{}, expr: `derivative(value, 1s)`},
+		{job: &MapReduceJob{onPoint: &pointHook{}}, expr: `sum(value)`},
+		{job: &MapReduceJob{bucketWidth: 10}, expr: `count(value)`},
+		{job: &MapReduceJob{SkipNonFinite: true}, expr: `sum(value)`},
+		{job: &MapReduceJob{FieldTypes: map[string]DataType{"value": Integer}}, expr: `sum(value)`},
+		{job: &MapReduceJob{FieldTypes: map[string]DataType{"other": Integer}}, expr: `sum(value)`, rollup: true},
+		{job: &MapReduceJob{aggregates: Aggregates{"sum": &testProductAggregate{}}}, expr: `sum(value)`},
+		{job: &MapReduceJob{stmt: &SelectStatement{Hints: Hints{NoRollups: true}}}, expr: `sum(value)`},
+	} {
+		expr, err := ParseExpr(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fn := tt.job.RollupMapFunc(expr.(*Call)); (fn != nil) != tt.rollup {
+			t.Fatalf("%s: unexpected rollup map func: %v", tt.expr, fn != nil)
+		}
+	}
+}
+
+// Ensure aggregates grouped by time are sent as their intervals are completed when streaming is enabled.
+func TestMapReduceJob_Execute_StreamAggregates(t *testing.T) {
+	newJob := func() *MapReduceJob {
+		m0 := &testMapper{points: testPoints(0, 10), interval: int64(2 * time.Second), shardID: 1}
+		m1 := &testMapper{points: testPoints(10, 10), interval: int64(2 * time.Second), shardID: 2}
+		job := testJob(m0, m1)
+		job.TMin, job.TMax = int64(2*time.Second), int64(20*time.Second)
+		return job
+	}
+	const s = `SELECT sum(value) FROM cpu WHERE time >= '1970-01-01T00:00:02Z' AND time <= '1970-01-01T00:00:20Z' GROUP BY time(2s)`
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{newJob()}}), s, 4)
+	if len(rows) != 1 || len(rows[0].Values) != 10 {
+		t.Fatalf("unexpected buffered rows: %v", rows)
+	}
+
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob()}})
+	p.StreamAggregates = true
+	streamed := testExecute(t, p, s, 4)
+	if len(streamed) != 3 {
+		t.Fatalf("unexpected row count: %d", len(streamed))
+	}
+	var values [][]interface{}
+	for i, row := range streamed {
+		if exp := []int{4, 4, 2}[i]; len(row.Values) != exp {
+			t.Fatalf("%d. unexpected value count: %d", i, len(row.Values))
+		}
+		values = append(values, row.Values...)
+	}
+	if !reflect.DeepEqual(values, rows[0].Values) {
+		t.Fatalf("streamed values differ:\n%v\n%v", values, rows[0].Values)
+	}
+
+	// the first row is sent before the later intervals are read
+	m := &testGateMapper{testMapper: testMapper{points: testPoints(0, 20), interval: int64(2 * time.Second)}, gateN: 4, gate: make(chan struct{})}
+	job := testJob(m)
+	job.TMin, job.TMax = int64(2*time.Second), int64(20*time.Second)
+	p = NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+	p.StreamAggregates = true
+	e, err := p.Plan(MustParseStatement(s).(*SelectStatement), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := e.Execute()
+	if row := <-ch; row.Err != nil || len(row.Values) != 4 {
+		t.Fatalf("unexpected first row: %v", row)
+	}
+	close(m.gate)
+	for range ch {
+	}
+}
+
+// Ensure streamed aggregates are filled from the rows sent before them.
+func TestMapReduceJob_Execute_StreamAggregates_Fill(t *testing.T) {
+	points := append(testPoints(1, 1), testPoints(9, 1)...)
+	job := testJob(&testMapper{points: points, interval: int64(time.Second)})
+	job.TMin, job.TMax = int64(time.Second), int64(10*time.Second)
+
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+	p.StreamAggregates = true
+	rows := testExecute(t, p, `SELECT sum(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(1s) fill(previous)`, 4)
+
+	var values []interface{}
+	for _, row := range rows {
+		for _, v := range row.Values {
+			values = append(values, v[1])
+		}
+	}
+	if exp := []interface{}{nil, 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, 2.0, 10.0}; !reflect.DeepEqual(values, exp) {
+		t.Fatalf("unexpected values: %v", values)
+	}
+}
+
+// Ensure streamed aggregates aren't limited to MaxGroupByPoints intervals.
+func TestMapReduceJob_Execute_StreamAggregates_MaxGroupByPoints(t *testing.T) {
+	newJob := func() *MapReduceJob {
+		job := testJob(&testMapper{points: testPoints(0, 10), interval: int64(time.Second)})
+		job.TMin, job.TMax = int64(time.Second), int64(MaxGroupByPoints+1)*int64(time.Second)
+		return job
+	}
+	const s = `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-02T03:46:41Z' GROUP BY time(1s)`
+
+	e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob()}}).Plan(MustParseStatement(s).(*SelectStatement), 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row := <-e.Execute(); row.Err == nil {
+		t.Fatal("expected too many points error")
+	}
+
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob()}})
+	p.StreamAggregates = true
+	var n int
+	for _, row := range testExecute(t, p, s, 10000) {
+		n += len(row.Values)
+	}
+	if n != MaxGroupByPoints+1 {
+		t.Fatalf("unexpected value count: %d", n)
+	}
+}
+
+// Ensure a series with more intervals than it may hold fails the query, unless the planner's
+// option is set, which sends the series before it, and the intervals of the series that fit, in a
+// partial result.
+func TestExecutor_Execute_PartialOverBudget(t *testing.T) {
+	// the series end after 2, 5 and 2 intervals
+	newJobs := func() []*MapReduceJob {
+		var jobs []*MapReduceJob
+		for _, j := range []struct {
+			host string
+			end  int
+		}{{"a", 30}, {"b", 60}, {"c", 30}} {
+			job := testJob(&testMapper{points: testPoints(0, 60), interval: int64(10 * time.Second)})
+			job.TagSet = &TagSet{Tags: map[string]string{"host": j.host}, Key: []byte(j.host)}
+			job.TMin, job.TMax = int64(10*time.Second), int64(j.end)*int64(time.Second)-1
+			jobs = append(jobs, job)
+		}
+		return jobs
+	}
+	const s = `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:01:00Z' GROUP BY time(10s), host`
+
+	p := NewPlanner(&testDB{jobs: newJobs()})
+	p.MaxSeriesIntervals = 3
+	e, err := p.Plan(MustParseStatement(s).(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errs []error
+	for row := range e.Execute() {
+		if row.Err != nil {
+			errs = append(errs, row.Err)
+		}
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected too many points error: %v", errs)
+	}
+
+	p = NewPlanner(&testDB{jobs: newJobs()})
+	p.MaxSeriesIntervals = 3
+	p.PartialOverBudget = true
+	p.EmitDone = true
+	rows := testExecute(t, p, s, 0)
+
+	var got []string
+	for _, row := range rows[:len(rows)-1] {
+		var counts []interface{}
+		for _, v := range row.Values {
+			counts = append(counts, v[1])
+		}
+		got = append(got, fmt.Sprintf("%s=%v partial=%v", row.Tags["host"], counts, row.Partial))
+	}
+	if exp := []string{"a=[10 10] partial=false", "b=[10 10 10] partial=true"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected rows:\nexp: %v\ngot: %v", exp, got)
+	} else if stats := rows[len(rows)-1].Stats; !stats.Partial {
+		t.Fatalf("expected partial stats: %+v", stats)
+	}
+}
+
+// Ensure streamed series without any values are filtered out when there are several series.
+func TestMapReduceJob_Execute_StreamAggregates_FilterEmpty(t *testing.T) {
+	newJob := func(host string, points []*rawQueryMapOutput) *MapReduceJob {
+		job := testJob(&testMapper{points: points, interval: int64(time.Second)})
+		job.TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+		job.TMin, job.TMax = int64(time.Second), int64(10*time.Second)
+		return job
+	}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{
+		newJob("a", testPoints(6, 1)),
+		newJob("b", nil),
+	}})
+	p.StreamAggregates = true
+	rows := testExecute(t, p, `SELECT sum(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(1s), host`, 4)
+
+	var values []interface{}
+	for _, row := range rows {
+		if row.Tags["host"] != "a" {
+			t.Fatalf("unexpected row: %v", row)
+		}
+		for _, v := range row.Values {
+			values = append(values, v[1])
+		}
+	}
+	if exp := []interface{}{nil, nil, nil, nil, nil, nil, 7.0, nil, nil, nil}; !reflect.DeepEqual(values, exp) {
+		t.Fatalf("unexpected values: %v", values)
+	}
+}
+
+// Ensure statements selecting fields alongside aggregates are rejected, and tags are allowed.
+func TestValidateAggregateFields(t *testing.T) {
+	isField := func(name string) bool { return name != "host" }
+	for i, tt := range []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT value FROM cpu`},
+		{s: `SELECT value, abs(value) FROM cpu`},
+		{s: `SELECT mean(value), max(value) FROM cpu`},
+		{s: `SELECT mean(value) * 2 + sum(value) FROM cpu`},
+		{s: `SELECT mean(value) FROM cpu GROUP BY host`},
+		{s: `SELECT percentile(value, 90), count(value) FROM cpu`},
+		{s: `SELECT derivative(mean(value)) FROM cpu WHERE time > now() - 1h GROUP BY time(1m)`},
+		{s: `SELECT max(value), host FROM cpu GROUP BY host`},
+		{s: `SELECT max(value), host FROM cpu`},
+		{s: `SELECT value, mean(value) FROM cpu`, err: `cannot select field "value" alongside aggregate function "mean"; mixing raw fields and aggregates is not supported`},
+		{s: `SELECT sum(value) / value FROM cpu`, err: `cannot select field "value" alongside aggregate function "sum"; mixing raw fields and aggregates is not supported`},
+		{s: `SELECT count(value), (idle + 1) FROM cpu`, err: `cannot select field "idle" alongside aggregate function "count"; mixing raw fields and aggregates is not supported`},
+		{s: `SELECT max(value), host, idle FROM cpu`, err: `cannot select field "idle" alongside aggregate function "max"; mixing raw fields and aggregates is not supported`},
+	} {
+		q, err := ParseQuery(tt.s)
+		if err != nil {
+			t.Fatalf("%d. unable to parse %q: %s", i, tt.s, err)
+		}
+		if err := ValidateAggregateFields(q.Statements[0].(*SelectStatement), isField); tt.err == "" && err != nil {
+			t.Fatalf("%d. %s: unexpected error: %s", i, tt.s, err)
+		} else if tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Fatalf("%d. %s: unexpected error: %v", i, tt.s, err)
+		}
+	}
+}
+
+// Ensure raw queries sorted by descending time read their mappers backward and merge them in
+// descending time order.
+func TestMapReduceJob_Execute_OrderByDesc(t *testing.T) {
+	for _, tt := range []struct {
+		s   string
+		exp []interface{}
+	}{
+		{s: `SELECT value FROM cpu ORDER BY time DESC`, exp: []interface{}{10.0, 9.0, 8.0, 7.0, 6.0, 5.0, 4.0, 3.0, 2.0, 1.0}},
+		{s: `SELECT value FROM cpu ORDER BY DESC LIMIT 4 OFFSET 2`, exp: []interface{}{8.0, 7.0, 6.0, 5.0}},
+		{s: `SELECT value FROM cpu ORDER BY time ASC LIMIT 3`, exp: []interface{}{1.0, 2.0, 3.0}},
+	} {
+		// the mappers have every other point
+		job := testJob()
+		var m0, m1 testMapper
+		for i, p := range testPoints(0, 10) {
+			if i%2 == 0 {
+				m0.points = append(m0.points, p)
+			} else {
+				m1.points = append(m1.points, p)
+			}
+		}
+		m0.shardID, m0.job = 1, job
+		m1.shardID, m1.job = 2, job
+		job.Mappers = []Mapper{&m0, &m1}
+
+		var values []interface{}
+		for _, row := range testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{job}}), tt.s, 3) {
+			for _, v := range row.Values {
+				values = append(values, v[1])
+			}
+		}
+		if !reflect.DeepEqual(values, tt.exp) {
+			t.Fatalf("%s: unexpected values: %v", tt.s, values)
+		}
+	}
+}
+
+// Ensure the intervals of aggregates sorted by descending time are returned latest first.
+func TestMapReduceJob_Execute_OrderByDesc_Aggregate(t *testing.T) {
+	j := testJob(&testMapper{points: testPoints(0, 10), interval: int64(2 * time.Second)})
+	j.TMin, j.TMax = int64(time.Second), int64(10*time.Second)
+
+	rows := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{j}}),
+		`SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(2s) ORDER BY time DESC`, 0)
+
+	var times []int64
+	var got []interface{}
+	for _, v := range rows[0].Values {
+		times = append(times, v[0].(time.Time).Unix())
+		got = append(got, v[1])
+	}
+	if exp := []int64{10, 8, 6, 4, 2, 0}; !reflect.DeepEqual(times, exp) {
+		t.Fatalf("unexpected times: %v", times)
+	} else if exp := []interface{}{1.0, 2.0, 2.0, 2.0, 2.0, 1.0}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected values: %v", got)
+	}
+}
+
+// BenchmarkMapReduceJob_Execute_OrderByDesc reads a raw query sorted by descending time
+// backward from the end of the series, one chunk at a time.
+func BenchmarkMapReduceJob_Execute_OrderByDesc(b *testing.B) {
+	benchmarkExecuteRaw(b, `SELECT value FROM cpu ORDER BY time DESC`, nil)
+}
+
+// BenchmarkMapReduceJob_Execute_OrderByDescReversed reads the series forward and reverses it
+// in memory, as a baseline for reading it backward.
+func BenchmarkMapReduceJob_Execute_OrderByDescReversed(b *testing.B) {
+	benchmarkExecuteRaw(b, `SELECT value FROM cpu`, func(rows []*Row) {
+		var values [][]interface{}
+		for _, row := range rows {
+			values = append(values, row.Values...)
+		}
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	})
+}
+
+// benchmarkExecuteRaw executes a raw query over a series of 100K points in chunks of 1K points.
+// The rows are dropped as they're received, unless fn is set, which is called with all of them.
+func benchmarkExecuteRaw(b *testing.B, s string, fn func(rows []*Row)) {
+	points := testPoints(0, 100000)
+	stmt := MustParseStatement(s).(*SelectStatement)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		job := testJob()
+		job.TMax = points[len(points)-1].Time
+		job.Mappers = []Mapper{&testMapper{points: points, job: job}}
+		e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{job}}).Plan(stmt, 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		var rows []*Row
+		for row := range e.Execute() {
+			if fn != nil {
+				rows = append(rows, row)
+			}
+		}
+		if fn != nil {
+			fn(rows)
+		}
+	}
+}
+
+// BenchmarkExecutor_Execute_Raw_1Shard reads 100K points from a single shard.
+func BenchmarkExecutor_Execute_Raw_1Shard(b *testing.B) {
+	benchmarkExecuteShards(b, `SELECT value FROM cpu`, 1, 1, 100000, 100000)
+}
+
+// BenchmarkExecutor_Execute_Raw_8Shards merges 100K points whose times interleave across 8 shards.
+func BenchmarkExecutor_Execute_Raw_8Shards(b *testing.B) {
+	benchmarkExecuteShards(b, `SELECT value FROM cpu`, 1, 8, 100000, 100000)
+}
+
+// BenchmarkExecutor_Execute_Aggregate_8Shards reduces 100 intervals of 100K points whose times
+// interleave across 8 shards.
+func BenchmarkExecutor_Execute_Aggregate_8Shards(b *testing.B) {
+	benchmarkExecuteShards(b, `SELECT mean(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time < '1970-01-01T00:01:41Z' GROUP BY time(1s)`, 1, 8, 100000, 100)
+}
+
+// BenchmarkExecutor_Execute_GroupByTag_1000Series reduces 1000 series of 100 points across 2 shards.
+func BenchmarkExecutor_Execute_GroupByTag_1000Series(b *testing.B) {
+	benchmarkExecuteShards(b, `SELECT mean(value) FROM cpu GROUP BY host`, 1000, 2, 100, 1000)
+}
+
+// BenchmarkExecutor_Execute_Raw_256Shards reads 102400 points from 256 adjacent shards, each with
+// its own mapper.
+func BenchmarkExecutor_Execute_Raw_256Shards(b *testing.B) {
+	benchmarkExecuteAdjacentShards(b, 0)
+}
+
+// BenchmarkExecutor_Execute_Raw_256Shards_Coalesced reads the same points with 8 mappers, each
+// reading 32 of the shards one after another.
+func BenchmarkExecutor_Execute_Raw_256Shards_Coalesced(b *testing.B) {
+	benchmarkExecuteAdjacentShards(b, 8)
+}
+
+// BenchmarkExecutor_Execute_RemoteAggregate_RawPoints reduces 100 intervals of 100K points from 8
+// shards on a remote node, which ships the points of the shards to the coordinator.
+func BenchmarkExecutor_Execute_RemoteAggregate_RawPoints(b *testing.B) {
+	benchmarkExecuteRemoteAggregate(b, false)
+}
+
+// BenchmarkExecutor_Execute_RemoteAggregate_Partials reduces the same intervals with the aggregate
+// pushed down to the node, which ships a partial per interval.
+func BenchmarkExecutor_Execute_RemoteAggregate_Partials(b *testing.B) {
+	benchmarkExecuteRemoteAggregate(b, true)
+}
+
+// benchmarkExecuteRemoteAggregate executes a mean grouped by time over the points of 8 shards on a
+// remote node, which either returns the partials of the mean or the points, encoded as JSON. The
+// bytes the node returns are reported.
+func benchmarkExecuteRemoteAggregate(b *testing.B, partial bool) {
+	const shardN, pointN = 8, 100000
+	const where = ` FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time < '1970-01-01T00:01:41Z'`
+	stmt := MustParseStatement(`SELECT mean(value)` + where + ` GROUP BY time(1s)`).(*SelectStatement)
+	rawStmt := MustParseStatement(`SELECT value` + where).(*SelectStatement)
+
+	points := make([][]*rawQueryMapOutput, shardN)
+	for k := 0; k < pointN; k++ {
+		t := int64(time.Second) + int64(k)*int64(time.Millisecond)
+		points[k%shardN] = append(points[k%shardN], &rawQueryMapOutput{Time: t, Values: float64(k)})
+	}
+	newJob := func(points ...[]*rawQueryMapOutput) *MapReduceJob {
+		job := testJob()
+		job.TMin, job.TMax = int64(time.Second), int64(101*time.Second)-1
+		for j := range points {
+			job.Mappers = append(job.Mappers, &testMapper{points: points[j], interval: int64(time.Second), shardID: uint64(j + 1), job: job})
+		}
+		return job
+	}
+
+	// execute runs a statement on the node and returns its rows encoded as JSON
+	var wireBytes int
+	execute := func(p *Planner, stmt *SelectStatement) [][]byte {
+		e, err := p.Plan(stmt.Clone(), 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var encoded [][]byte
+		for row := range e.Execute() {
+			if row.Err != nil {
+				b.Fatal(row.Err)
+			}
+			buf, err := json.Marshal(row)
+			if err != nil {
+				b.Fatal(err)
+			}
+			wireBytes += len(buf)
+			encoded = append(encoded, buf)
+		}
+		return encoded
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		job := newJob()
+		if partial {
+			job.Mappers = []Mapper{NewPartialMapper(job, 1, 1, func() (*Row, error) {
+				p := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob(points...)}})
+				p.PartialAggregates = true
+				return UnmarshalPartialRow(stmt, execute(p, stmt)[0])
+			})}
+		} else {
+			// the coordinator maps the points the node returns
+			var remote []*rawQueryMapOutput
+			for _, buf := range execute(NewPlanner(&testDB{jobs: []*MapReduceJob{newJob(points...)}}), rawStmt) {
+				var row Row
+				if err := json.Unmarshal(buf, &row); err != nil {
+					b.Fatal(err)
+				}
+				for _, v := range row.Values {
+					t, err := time.Parse(time.RFC3339Nano, v[0].(string))
+					if err != nil {
+						b.Fatal(err)
+					}
+					remote = append(remote, &rawQueryMapOutput{Time: t.UnixNano(), Values: v[1]})
+				}
+			}
+			job.Mappers = []Mapper{&testMapper{points: remote, interval: int64(time.Second), shardID: 1, job: job}}
+		}
+
+		e, err := NewPlanner(&testDB{jobs: []*MapReduceJob{job}}).Plan(stmt.Clone(), 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var n int
+		for row := range e.Execute() {
+			if row.Err != nil {
+				b.Fatal(row.Err)
+			}
+			n += len(row.Values)
+		}
+		if n != 100 {
+			b.Fatalf("unexpected value count: %d", n)
+		}
+	}
+	b.ReportMetric(float64(wireBytes)/float64(b.N), "wire-bytes/op")
+}
+
+// benchmarkExecuteAdjacentShards executes a raw query over 256 adjacent shards of 400 points, with
+// the mappers coalesced past the threshold, if it's set. The peak number of goroutines while the
+// rows are received is reported.
+func benchmarkExecuteAdjacentShards(b *testing.B, threshold int) {
+	const shardN, pointN = 256, 400
+	stmt := MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement)
+	shards := make([]*testRangeMapper, shardN)
+	for i := range shards {
+		shards[i] = testRangeShard(uint64(i+1), i*pointN, pointN, pointN, nil)
+	}
+
+	var peak int
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		job := testJob()
+		job.TMax = int64(shardN*pointN) * int64(time.Second)
+		for _, s := range shards {
+			m := &testRangeMapper{testMapper: &testMapper{points: s.points, shardID: s.shardID, job: job}, start: s.start, end: s.end}
+			job.Mappers = append(job.Mappers, m)
+		}
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+		p.MapperCoalesceThreshold = threshold
+		e, err := p.Plan(stmt.Clone(), 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		var n int
+		for row := range e.Execute() {
+			if row.Err != nil {
+				b.Fatal(row.Err)
+			}
+			n += len(row.Values)
+			if g := runtime.NumGoroutine(); g > peak {
+				peak = g
+			}
+		}
+		if n != shardN*pointN {
+			b.Fatalf("unexpected value count: %d", n)
+		}
+	}
+	b.ReportMetric(float64(peak), "goroutines")
+}
+
+// benchmarkExecuteShards executes a query over seriesN series, each read from shardN shards whose
+// pointN points, one per millisecond from 1s, interleave. The number of values returned is checked
+// against valueN, so the benchmark can't pass without reading every point.
+func benchmarkExecuteShards(b *testing.B, s string, seriesN, shardN, pointN, valueN int) {
+	stmt := MustParseStatement(s).(*SelectStatement)
+
+	// the points of each shard, which are shared by the mappers of every series
+	points := make([][]*rawQueryMapOutput, shardN)
+	for k := 0; k < pointN; k++ {
+		t := int64(time.Second) + int64(k)*int64(time.Millisecond)
+		points[k%shardN] = append(points[k%shardN], &rawQueryMapOutput{Time: t, Values: float64(k)})
+	}
+	interval, _, err := stmt.Dimensions.Normalize()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	newJobs := func() []*MapReduceJob {
+		jobs := make([]*MapReduceJob, seriesN)
+		for i := range jobs {
+			host := fmt.Sprintf("server%04d", i)
+			jobs[i] = testJob()
+			jobs[i].TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+			jobs[i].TMin = int64(time.Second)
+			jobs[i].TMax = int64(time.Second) + int64(pointN)*int64(time.Millisecond) - 1
+			for j := range points {
+				m := &testMapper{points: points[j], interval: interval.Nanoseconds(), shardID: uint64(j + 1), job: jobs[i]}
+				jobs[i].Mappers = append(jobs[i].Mappers, m)
+			}
+		}
+		return jobs
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		e, err := NewPlanner(&testDB{jobs: newJobs()}).Plan(stmt.Clone(), 1000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		var n int
+		for row := range e.Execute() {
+			if row.Err != nil {
+				b.Fatal(row.Err)
+			}
+			n += len(row.Values)
+		}
+		if n != valueN {
+			b.Fatalf("unexpected value count: %d", n)
+		}
+	}
+}
+
+// Ensure a mapper that isn't opened within the open timeout fails the query with a shard busy
+// error, and is closed once its Open call returns.
+func TestMapReduceJob_Execute_OpenTimeout(t *testing.T) {
+	m := &testBlockingMapper{testMapper: testMapper{points: testPoints(0, 2), shardID: 2}, gate: make(chan struct{}), closing: make(chan struct{})}
+	p := NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(m)}})
+	p.OpenTimeout = 10 * time.Millisecond
+	e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu`).(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.emitDone = true
+
+	var rows []*Row
+	for row := range e.Execute() {
+		rows = append(rows, row)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("unexpected rows: %v", rows)
+	} else if err := rows[0].Err; err == nil || err.Error() != "shard busy: shard 2 wasn't opened within 10ms" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !rows[1].Stats.Partial {
+		t.Fatal("expected partial results")
+	}
+
+	// The mapper is only closed once it's opened.
+	select {
+	case <-m.closing:
+		t.Fatal("mapper closed while opening")
+	default:
+	}
+	close(m.gate)
+	select {
+	case <-m.closing:
+	case <-time.After(time.Second):
+		t.Fatal("mapper not closed")
+	}
+}
+
+// Ensure the mappers of shards that aren't found are skipped and logged if missing shards are
+// tolerated, and fail the query otherwise.
+func TestMapReduceJob_Execute_TolerateMissingShards(t *testing.T) {
+	s := `SELECT value FROM cpu`
+	newPlanner := func() (*Planner, *testMissingMapper) {
+		missing := &testMissingMapper{testMapper: testMapper{shardID: 2}}
+		return NewPlanner(&testDB{jobs: []*MapReduceJob{testJob(&testMapper{points: testPoints(0, 2), shardID: 1}, missing)}}), missing
+	}
+
+	p, _ := newPlanner()
+	e, err := p.Plan(MustParseStatement(s).(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if row := <-e.Execute(); row.Err != ErrShardNotFound {
+		t.Fatalf("unexpected row: %v", row)
+	}
+
+	var buf bytes.Buffer
+	p, missing := newPlanner()
+	p.TolerateMissingShards = true
+	p.Logger = log.New(&buf, "", 0)
+	if rows := testExecute(t, p, s, 0); len(rows) != 1 || rows[0].Err != nil || len(rows[0].Values) != 2 {
+		t.Fatalf("unexpected rows: %v", rows)
+	} else if !missing.closed {
+		t.Fatal("expected skipped mapper to be closed")
+	} else if exp := "skipping shard 2 of cpu: shard not found\n"; buf.String() != exp {
+		t.Fatalf("unexpected log: %q", buf.String())
+	}
+}
+
+// Ensure the points of every series are merged in time order when series are merged, with each
+// row holding the consecutive points of one series.
+func TestExecutor_Execute_MergeSeries(t *testing.T) {
+	newPlanner := func() *Planner {
+		var jobs []*MapReduceJob
+		for host, secs := range map[string][]int{"a": {1, 2, 6}, "b": {3, 6}, "c": {4, 5, 7}} {
+			var points []*rawQueryMapOutput
+			for _, sec := range secs {
+				points = append(points, &rawQueryMapOutput{Time: int64(sec) * int64(time.Second), Values: float64(sec)})
+			}
+			j := testJob(&testMapper{points: points})
+			j.TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+			jobs = append(jobs, j)
+		}
+		sort.Sort(MapReduceJobs(jobs))
+
+		p := NewPlanner(&testDB{jobs: jobs})
+		p.MergeSeries = true
+		return p
+	}
+
+	var got []string
+	for _, row := range testExecute(t, newPlanner(), `SELECT value FROM cpu GROUP BY host`, 10) {
+		var secs []string
+		for _, v := range row.Values {
+			secs = append(secs, fmt.Sprint(v[1]))
+		}
+		got = append(got, row.Tags["host"]+":"+strings.Join(secs, ","))
+	}
+	if exp := []string{"a:1,2", "b:3", "c:4,5", "a:6", "b:6", "c:7"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected rows: %v", got)
+	}
+
+	// Rows hold at most the chunk size of points.
+	if rows := testExecute(t, newPlanner(), `SELECT value FROM cpu GROUP BY host`, 1); len(rows) != 8 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	}
+}
+
+// Ensure queries planned with the strict tag set order option fail if the Tx returns jobs out of
+// order, whether their rows are sent job by job or merged, and run if they're in order.
+func TestExecutor_Execute_StrictTagSetOrder(t *testing.T) {
+	newPlanner := func(hosts ...string) *Planner {
+		var jobs []*MapReduceJob
+		for _, host := range hosts {
+			j := testJob(&testMapper{points: testPoints(0, 2)})
+			j.TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+			jobs = append(jobs, j)
+		}
+		p := NewPlanner(&testDB{jobs: jobs})
+		p.StrictTagSetOrder = true
+		return p
+	}
+
+	for _, merge := range []bool{false, true} {
+		p := newPlanner("a", "c", "b")
+		p.MergeSeries = merge
+		e, err := p.Plan(MustParseStatement(`SELECT value FROM cpu GROUP BY host`).(*SelectStatement), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows []*Row
+		for row := range e.Execute() {
+			rows = append(rows, row)
+		}
+		if len(rows) != 1 || rows[0].Err == nil || rows[0].Err.Error() != `tag set out of order: "cpub" after "cpuc"` {
+			t.Fatalf("merge=%v: unexpected rows: %v", merge, rows)
+		}
+
+		// jobs of the same tag set, e.g. from several sources, are in order
+		p = newPlanner("a", "b", "b", "c")
+		p.MergeSeries = merge
+		if rows := testExecute(t, p, `SELECT value FROM cpu GROUP BY host`, 0); len(rows) == 0 {
+			t.Fatalf("merge=%v: expected rows", merge)
+		}
+	}
+
+	// jobs out of order are run in the order they're in by default
+	p := newPlanner("b", "a")
+	p.StrictTagSetOrder = false
+	if rows := testExecute(t, p, `SELECT value FROM cpu GROUP BY host`, 0); len(rows) != 2 || rows[0].Tags["host"] != "b" {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+}
+
+// Ensure the points a mapper reads for each interval are checked to be in the interval if the
+// planner's option is set, so a mapper computing its intervals with the wrong offset fails.
+func TestExecutor_Execute_StrictIntervals(t *testing.T) {
+	newPlanner := func(offset time.Duration, strict bool) *Planner {
+		m := &testMapper{points: testPoints(0, 40), interval: int64(10 * time.Second), offset: int64(offset)}
+		job := testJob(m)
+		job.TMin, job.TMax = int64(10*time.Second), int64(40*time.Second)-1
+		m.job = job
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+		p.StrictIntervals = strict
+		return p
+	}
+	const s = `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:00:40Z' GROUP BY time(10s)`
+
+	counts := func(rows []*Row) []interface{} {
+		var a []interface{}
+		for _, row := range rows {
+			for _, v := range row.Values {
+				a = append(a, v[1])
+			}
+		}
+		return a
+	}
+
+	// the intervals of an aligned mapper pass
+	if got := counts(testExecute(t, newPlanner(0, true), s, 0)); !reflect.DeepEqual(got, []interface{}{10.0, 10.0, 10.0}) {
+		t.Fatalf("unexpected counts: %v", got)
+	}
+
+	// the intervals of a mapper that's off by 5s are wrong without the check
+	if got := counts(testExecute(t, newPlanner(5*time.Second, false), s, 0)); !reflect.DeepEqual(got, []interface{}{5.0, 10.0, 10.0}) {
+		t.Fatalf("unexpected counts: %v", got)
+	}
+
+	// and fail with it, at the first point outside its interval
+	e, err := newPlanner(5*time.Second, true).Plan(MustParseStatement(s).(*SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows []*Row
+	for row := range e.Execute() {
+		rows = append(rows, row)
+	}
+	exp := ErrMisalignedPoint("", int64(15*time.Second), int64(20*time.Second), int64(30*time.Second)-1)
+	if len(rows) != 1 || rows[0].Err == nil || rows[0].Err.Error() != exp.Error() {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+}
+
+// Ensure a query resumed from a token recorded from its rows returns the points that weren't
+// recorded, without any duplicates, wherever it was interrupted.
+func TestPlanner_PlanResume(t *testing.T) {
+	newPlanner := func() *Planner {
+		// The two shards of host a both have points at 6s to 8s.
+		a := testJob(&testMapper{points: testPoints(0, 8), shardID: 1}, &testMapper{points: testPoints(5, 5), shardID: 2})
+		a.TagSet = &TagSet{Tags: map[string]string{"host": "a"}, Key: []byte("a")}
+		b := testJob(&testMapper{points: testPoints(2, 4), shardID: 1})
+		b.TagSet = &TagSet{Tags: map[string]string{"host": "b"}, Key: []byte("b")}
+		for _, j := range []*MapReduceJob{a, b} {
+			for _, mm := range j.Mappers {
+				mm.(*testMapper).job = j
+			}
+		}
+		return NewPlanner(&testDB{jobs: []*MapReduceJob{a, b}})
+	}
+	points := func(rows []*Row) []string {
+		var a []string
+		for _, row := range rows {
+			for _, v := range row.Values {
+				a = append(a, fmt.Sprintf("%s:%v", row.Tags["host"], v[1]))
+			}
+		}
+		return a
+	}
+
+	for _, s := range []string{
+		`SELECT value FROM cpu GROUP BY host`,
+		`SELECT value FROM cpu GROUP BY host ORDER BY time DESC`,
+	} {
+		exp := points(testExecute(t, newPlanner(), s, 2))
+
+		for n := 0; n < len(exp); n++ {
+			// Read rows until n points have been read, recording each of them.
+			e, err := newPlanner().Plan(MustParseStatement(s).(*SelectStatement), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			itr, err := e.Iterator()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var token ResumeToken
+			var rows []*Row
+			for len(points(rows)) < n {
+				row, _ := itr.Next()
+				token.Record(row)
+				rows = append(rows, row)
+			}
+			itr.Close()
+
+			resumed, err := ParseResumeToken(token.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, err = newPlanner().PlanResume(MustParseStatement(s).(*SelectStatement), 2, resumed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for row := range e.Execute() {
+				if row.Err != nil {
+					t.Fatal(row.Err)
+				}
+				rows = append(rows, row)
+			}
+			if got := points(rows); !reflect.DeepEqual(got, exp) {
+				t.Fatalf("%s: resumed after %d points: unexpected points: %v", s, n, got)
+			}
+		}
+	}
+
+	// The mappers seek to the position the query is resumed from.
+	p := newPlanner()
+	var token ResumeToken
+	token.Record(&Row{Name: "cpu", Tags: map[string]string{"host": "a"}, Values: [][]interface{}{{time.Unix(7, 0).UTC(), 7.0}}})
+	testExecute(t, p, `SELECT value FROM cpu GROUP BY host`, 10)
+	e, err := p.PlanResume(MustParseStatement(`SELECT value FROM cpu GROUP BY host`).(*SelectStatement), 10, &token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _ = range e.Execute() {
+	}
+	if m := p.DB.(*testDB).jobs[0].Mappers[0].(*testMapper); m.tmin != int64(7*time.Second) {
+		t.Fatalf("unexpected starting time: %d", m.tmin)
+	}
+
+	// Queries whose rows depend on earlier points can't be resumed.
+	for _, s := range []string{
+		`SELECT value FROM cpu LIMIT 10`,
+		`SELECT value FROM cpu OFFSET 10`,
+		`SELECT derivative(value) FROM cpu`,
+		`SELECT count(value) FROM cpu`,
+	} {
+		if _, err := newPlanner().PlanResume(MustParseStatement(s).(*SelectStatement), 10, &token); err != ErrResumeNotSupported {
+			t.Fatalf("%s: unexpected error: %v", s, err)
+		}
+	}
+}
+
+// Ensure resume tokens are decoded as they're encoded.
+func TestParseResumeToken(t *testing.T) {
+	var token ResumeToken
+	token.Record(&Row{Name: "cpu", Tags: map[string]string{"host": "a"}, Values: [][]interface{}{
+		{time.Unix(1, 0).UTC(), 1.0},
+		{time.Unix(2, 0).UTC(), 2.0},
+		{time.Unix(2, 0).UTC(), 3.0},
+	}})
+	token.Record(&Row{Name: "mem", Values: [][]interface{}{{time.Unix(3, 0).UTC(), 1.0}}})
+	token.Record(&Row{Err: errors.New("marker")})
+
+	b, err := base64.URLEncoding.DecodeString(token.String())
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := `{"version":1,"series":[{"name":"cpu","tags":{"host":"a"},"time":2000000000,"n":2},{"name":"mem","time":3000000000,"n":1}]}`; string(b) != exp {
+		t.Fatalf("unexpected encoding: %s", b)
+	}
+
+	other, err := ParseResumeToken(token.String())
+	if err != nil {
+		t.Fatal(err)
+	} else if other.String() != token.String() {
+		t.Fatalf("unexpected token: %s", other)
+	}
+
+	for _, s := range []string{
+		"not base64!",
+		base64.URLEncoding.EncodeToString([]byte(`{"version":2,"series":[]}`)),
+		base64.URLEncoding.EncodeToString([]byte(`{"version":1,"series":[{"name":"cpu","time":0,"n":0}]}`)),
+	} {
+		if _, err := ParseResumeToken(s); err != ErrInvalidResumeToken {
+			t.Fatalf("%q: unexpected error: %v", s, err)
+		}
+	}
+}
+
+// Ensure the intervals at the edges of the time range are returned with the points in the range,
+// or dropped if they aren't covered completely and the planner's option is set.
+func TestMapReduceJob_Execute_DropPartialIntervals(t *testing.T) {
+	execute := func(s string, drop, stream bool) []interface{} {
+		tmin, tmax := TimeRange(MustParseStatement(s).(*SelectStatement).Condition)
+		job := testJob(&testMapper{points: testPoints(0, 8), interval: int64(4 * time.Second)})
+		job.TMin, job.TMax = tmin.UnixNano(), tmax.UnixNano()
+
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+		p.DropPartialIntervals = drop
+		p.StreamAggregates = stream
+
+		var a []interface{}
+		for _, row := range testExecute(t, p, s, 10) {
+			for _, v := range row.Values {
+				a = append(a, fmt.Sprintf("%d:%v", v[0].(time.Time).Unix(), v[1]))
+			}
+		}
+		return a
+	}
+
+	for i, tt := range []struct {
+		s    string
+		exp  []interface{} // the intervals returned by default
+		full []interface{} // the intervals returned when partial intervals are dropped
+	}{
+		{
+			s:    `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time < '1970-01-01T00:00:09Z' GROUP BY time(4s)`,
+			exp:  []interface{}{"0:3", "4:4", "8:1"},
+			full: []interface{}{"4:4"},
+		},
+		{
+			s:    `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time < '1970-01-01T00:00:08Z' GROUP BY time(4s)`,
+			exp:  []interface{}{"0:3", "4:4"},
+			full: []interface{}{"4:4"},
+		},
+		{
+			s:    `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:04Z' AND time <= '1970-01-01T00:00:08Z' GROUP BY time(4s)`,
+			exp:  []interface{}{"4:4", "8:1"},
+			full: []interface{}{"4:4"},
+		},
+		{
+			s:    `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:03Z' GROUP BY time(4s)`,
+			exp:  []interface{}{"0:3"},
+			full: nil,
+		},
+	} {
+		for _, stream := range []bool{false, true} {
+			if got := execute(tt.s, false, stream); !reflect.DeepEqual(got, tt.exp) {
+				t.Errorf("%d. stream=%v: unexpected intervals: %v", i, stream, got)
+			}
+			if got := execute(tt.s, true, stream); !reflect.DeepEqual(got, tt.full) {
+				t.Errorf("%d. stream=%v: unexpected complete intervals: %v", i, stream, got)
+			}
+		}
+	}
+}
+
+// Ensure a panic in a mapper fails its series with an error row, closes the mappers and ends the
+// query, rather than crashing the process or leaving the consumer waiting.
+func TestMapReduceJob_Execute_Panic(t *testing.T) {
+	for i, tt := range []struct {
+		s             string
+		prefetchDepth int
+		panicOpen     bool
+	}{
+		{s: `SELECT value FROM cpu`, prefetchDepth: DefaultPrefetchDepth},
+		{s: `SELECT value FROM cpu`},
+		{s: `SELECT sum(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY time(2s)`},
+		{s: `SELECT value FROM cpu`, panicOpen: true},
+	} {
+		m0 := newTestPanicMapper(testMapper{points: testPoints(0, 10), interval: int64(2 * time.Second), shardID: 1}, 0, false)
+		m1 := newTestPanicMapper(testMapper{points: testPoints(10, 10), interval: int64(2 * time.Second), shardID: 2}, 2, tt.panicOpen)
+		job := testJob(m0, m1)
+		job.TMin, job.TMax = int64(time.Second), int64(10*time.Second)
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+		p.PrefetchDepth = tt.prefetchDepth
+
+		e, err := p.Plan(MustParseStatement(tt.s).(*SelectStatement), 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows []*Row
+		ch := e.Execute()
+		timeout := time.After(5 * time.Second)
+	loop:
+		for {
+			select {
+			case row, ok := <-ch:
+				if !ok {
+					break loop
+				}
+				rows = append(rows, row)
+			case <-timeout:
+				t.Fatalf("%d. query didn't finish", i)
+			}
+		}
+
+		if len(rows) == 0 || rows[len(rows)-1].Err == nil {
+			t.Fatalf("%d. expected an error row: %v", i, rows)
+		} else if err := rows[len(rows)-1].Err; err.Error() != "panic executing query: decode error" {
+			t.Fatalf("%d. unexpected error: %s", i, err)
+		}
+		for _, m := range []*testPanicMapper{m0, m1} {
+			select {
+			case <-m.closing:
+			default:
+				t.Fatalf("%d. mapper of shard %d not closed", i, m.shardID)
+			}
+		}
+	}
+}
+
+// Ensure an aggregate query without a GROUP BY time interval reduces every point of each series
+// into a single value at the start of the time range.
+func TestMapReduceJob_Execute_NoGroupByTime(t *testing.T) {
+	for _, tt := range []struct {
+		s          string
+		tmin, tmax int64
+		exp        []string
+	}{
+		{
+			s:    `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:10Z' GROUP BY host`,
+			tmin: int64(time.Second), tmax: int64(10 * time.Second),
+			exp: []string{"a:1:10", "b:1:4", "c:1:7"},
+		},
+		{
+			s:    `SELECT count(value) FROM cpu GROUP BY host`,
+			tmax: int64(time.Hour),
+			exp:  []string{"a:0:10", "b:0:4", "c:0:7"},
+		},
+	} {
+		var jobs []*MapReduceJob
+		for _, host := range []string{"a", "b", "c"} {
+			n := map[string]int{"a": 10, "b": 4, "c": 7}[host]
+			j := testJob(&testMapper{points: testPoints(0, n), shardID: 1}, &testMapper{shardID: 2})
+			j.TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+			j.TMin, j.TMax = tt.tmin, tt.tmax
+			jobs = append(jobs, j)
+		}
+
+		var got []string
+		for _, row := range testExecute(t, NewPlanner(&testDB{jobs: jobs}), tt.s, 0) {
+			for _, v := range row.Values {
+				got = append(got, fmt.Sprintf("%s:%d:%v", row.Tags["host"], v[0].(time.Time).Unix(), v[1]))
+			}
+		}
+		if !reflect.DeepEqual(got, tt.exp) {
+			t.Fatalf("%s: unexpected values: %v", tt.s, got)
+		}
+	}
+}
+
+// Ensure the points of a raw query held at once are capped, and that the rows of a series sent
+// early are still in time order.
+func TestMapReduceJob_Execute_MaxSeriesBufferedPoints(t *testing.T) {
+	for _, prefetchDepth := range []int{0, 1} {
+		// the points of the series interleave across 4 shards
+		var mappers []*testMapper
+		for i := 0; i < 4; i++ {
+			var points []*rawQueryMapOutput
+			for k := i; k < 400; k += 4 {
+				points = append(points, &rawQueryMapOutput{Time: int64(k+1) * int64(time.Millisecond), Values: float64(k)})
+			}
+			mappers = append(mappers, &testMapper{points: points, shardID: uint64(i + 1)})
+		}
+		job := testJob(mappers[0], mappers[1], mappers[2], mappers[3])
+
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+		p.PrefetchDepth = prefetchDepth
+		p.MaxSeriesBufferedPoints = 40
+		rows := testExecute(t, p, `SELECT value FROM cpu`, 1000)
+
+		if exp := 40 / (4 * []int{1, 3}[prefetchDepth]); mappers[0].chunkSize != exp {
+			t.Fatalf("prefetch=%d: unexpected mapper chunk size: %d", prefetchDepth, mappers[0].chunkSize)
+		}
+		if len(rows) < 5 {
+			t.Fatalf("prefetch=%d: unexpected row count: %d", prefetchDepth, len(rows))
+		}
+		var n int
+		for _, row := range rows {
+			// a row can pass the cap by the points of the merge that reached it
+			if len(row.Values) > 80 {
+				t.Fatalf("prefetch=%d: unexpected row size: %d", prefetchDepth, len(row.Values))
+			}
+			for _, v := range row.Values {
+				if v[1] != float64(n) {
+					t.Fatalf("prefetch=%d: unexpected value at %d: %v", prefetchDepth, n, v[1])
+				}
+				n++
+			}
+		}
+		if n != 400 {
+			t.Fatalf("prefetch=%d: unexpected point count: %d", prefetchDepth, n)
+		}
+	}
+}
+
+// Ensure the complete intervals of streamed aggregates are sent at the soft deadline while a mapper
+// is slow to return the next, and that the query continues or stops after it per the planner.
+func TestMapReduceJob_Execute_SoftDeadline(t *testing.T) {
+	newJob := func(host string, gate chan struct{}) *MapReduceJob {
+		m := &testGateMapper{testMapper: testMapper{points: testPoints(0, 20), interval: int64(2 * time.Second)}, gateN: 3, gate: gate}
+		job := testJob(m)
+		job.TagSet = &TagSet{Tags: map[string]string{"host": host}, Key: []byte(host)}
+		job.TMin, job.TMax = int64(2*time.Second), int64(20*time.Second)
+		return job
+	}
+	const s = `SELECT sum(value) FROM cpu WHERE time >= '1970-01-01T00:00:02Z' AND time <= '1970-01-01T00:00:20Z' GROUP BY time(2s), host`
+
+	open := make(chan struct{})
+	close(open)
+	exp := testExecute(t, NewPlanner(&testDB{jobs: []*MapReduceJob{newJob("a", open)}}), s, 10)[0].Values
+
+	for _, abort := range []bool{false, true} {
+		gate := make(chan struct{})
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{newJob("a", gate), newJob("b", open)}})
+		p.StreamAggregates = true
+		p.SoftDeadline = 50 * time.Millisecond
+		p.AbortAtDeadline = abort
+		e, err := p.Plan(MustParseStatement(s).(*SelectStatement), 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the intervals before the one being read are sent at the deadline
+		ch := e.Execute()
+		row := <-ch
+		if row.Err != nil || !row.Partial || !reflect.DeepEqual(row.Values, exp[:3]) {
+			t.Fatalf("abort=%v: unexpected partial row: %v", abort, row)
+		}
+		close(gate)
+
+		values := row.Values
+		var hosts []string
+		for row := range ch {
+			if row.Err != nil || row.Partial {
+				t.Fatalf("abort=%v: unexpected row: %v", abort, row)
+			}
+			if row.Tags["host"] == "a" {
+				values = append(values, row.Values...)
+			} else {
+				hosts = append(hosts, row.Tags["host"])
+			}
+		}
+		if abort {
+			if len(values) != 3 || len(hosts) != 0 {
+				t.Fatalf("abort=%v: unexpected values: %v, hosts: %v", abort, values, hosts)
+			}
+		} else if !reflect.DeepEqual(values, exp) || len(hosts) == 0 {
+			t.Fatalf("abort=%v: unexpected values: %v, hosts: %v", abort, values, hosts)
+		}
+	}
+}
+
+// Ensure the planner's OnPoint hook is called with every point read by the map functions.
+func TestMapReduceJob_Execute_OnPoint(t *testing.T) {
+	const s = `SELECT sum(value) FROM cpu WHERE time >= '1970-01-01T00:00:02Z' AND time <= '1970-01-01T00:00:20Z' GROUP BY time(2s)`
+	for _, stream := range []bool{false, true} {
+		job := testJob()
+		job.TMin, job.TMax = int64(2*time.Second), int64(20*time.Second)
+		job.Mappers = []Mapper{
+			&testMapper{points: testPoints(1, 10), interval: int64(2 * time.Second), shardID: 1, job: job},
+			&testMapper{points: testPoints(11, 9), interval: int64(2 * time.Second), shardID: 2, job: job},
+		}
+
+		var times []time.Time
+		var mismatchN int
+		p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+		p.StreamAggregates = stream
+		p.OnPoint = func(series string, tm time.Time, fields map[string]interface{}) {
+			if exp := map[string]interface{}{"value": float64(tm.Unix())}; !reflect.DeepEqual(fields, exp) {
+				mismatchN++
+			}
+			times = append(times, tm)
+		}
+
+		var sum float64
+		for _, row := range testExecute(t, p, s, 4) {
+			for _, v := range row.Values {
+				if v[1] != nil {
+					sum += v[1].(float64)
+				}
+			}
+		}
+		if sum != 209 {
+			t.Fatalf("stream=%v: unexpected sum: %v", stream, sum)
+		}
+
+		// every point is passed to the hook once, with its value
+		if len(times) != 19 || mismatchN != 0 {
+			t.Fatalf("stream=%v: unexpected point count: %d, mismatched fields: %d", stream, len(times), mismatchN)
+		}
+		seen := make(map[int64]bool)
+		for _, tm := range times {
+			seen[tm.Unix()] = true
+		}
+		for sec := int64(2); sec <= 20; sec++ {
+			if !seen[sec] {
+				t.Fatalf("stream=%v: point at %ds wasn't passed to the hook", stream, sec)
+			}
+		}
+	}
+}
+
+// Ensure queries grouped by value_bucket() count the points of each bin of values across shards.
+func TestMapReduceJob_Execute_ValueBucket(t *testing.T) {
+	newPlanner := func(interval time.Duration) *Planner {
+		job := testJob()
+		job.TMin, job.TMax = int64(time.Second), int64(20*time.Second)
+		job.Mappers = []Mapper{
+			&testMapper{points: testPoints(0, 12), interval: int64(interval), shardID: 1, job: job},
+			&testMapper{points: testPoints(12, 8), interval: int64(interval), shardID: 2, job: job},
+		}
+		return NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+	}
+
+	// the values are 1 to 20, so the first bin has the 4 values below 5 and the last only 20
+	rows := testExecute(t, newPlanner(0), `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:20Z' GROUP BY value_bucket(5)`, 10)
+	var hist []string
+	for _, row := range rows {
+		if len(row.Values) != 1 {
+			t.Fatalf("unexpected row: %v", row)
+		}
+		hist = append(hist, fmt.Sprintf("%s=%v", row.Tags[ValueBucketTag], row.Values[0][1]))
+	}
+	if exp := []string{"0=4", "5=5", "10=5", "15=5", "20=1"}; !reflect.DeepEqual(hist, exp) {
+		t.Fatalf("unexpected histogram: %v", hist)
+	}
+
+	// bins are counted in each interval, and an interval without values in the bin is null
+	rows = testExecute(t, newPlanner(10*time.Second), `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:20Z' GROUP BY time(10s), value_bucket(10)`, 10)
+	hist = nil
+	for _, row := range rows {
+		var counts []interface{}
+		for _, v := range row.Values {
+			counts = append(counts, v[1])
+		}
+		hist = append(hist, fmt.Sprintf("%s=%v", row.Tags[ValueBucketTag], counts))
+	}
+	if exp := []string{"0=[9 <nil> <nil>]", "10=[<nil> 10 <nil>]", "20=[<nil> <nil> 1]"}; !reflect.DeepEqual(hist, exp) {
+		t.Fatalf("unexpected histogram: %v", hist)
+	}
+
+	for _, tt := range []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT mean(value) FROM cpu GROUP BY value_bucket(5)`, err: `value_bucket() requires a single count() of a field`},
+		{s: `SELECT count(value), sum(value) FROM cpu GROUP BY value_bucket(5)`, err: `value_bucket() requires a single count() of a field`},
+		{s: `SELECT count(value) FROM cpu GROUP BY value_bucket(0)`, err: `value_bucket dimension must have a positive number argument`},
+		{s: `SELECT count(value) FROM cpu GROUP BY value_bucket(5), value_bucket(10)`, err: `multiple value_bucket dimensions not allowed`},
+		{s: `SELECT count(value) FROM cpu GROUP BY bucket(5)`, err: `only time(), value_bucket() and window() calls allowed in dimensions`},
+	} {
+		stmt, err := NewParser(strings.NewReader(tt.s)).ParseStatement()
+		if err == nil {
+			_, err = newPlanner(0).Plan(stmt.(*SelectStatement), 10)
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Fatalf("%s: unexpected error: %v", tt.s, err)
+		}
+	}
+}
+
+// Ensure the values of the intervals of aggregates are sent at the time of each interval chosen by
+// the planner's IntervalTime option.
+func TestMapReduceJob_Execute_IntervalTime(t *testing.T) {
+	for _, tt := range []struct {
+		intervalTime IntervalTime
+		secs         []int64
+	}{
+		{intervalTime: IntervalStartTime, secs: []int64{10, 20, 30, 40}},
+		{intervalTime: IntervalEndTime, secs: []int64{20, 30, 40, 50}},
+		{intervalTime: IntervalCenterTime, secs: []int64{15, 25, 35, 45}},
+	} {
+		// the intervals are the same whether they're sent all at once or streamed
+		for _, stream := range []bool{false, true} {
+			job := testJob()
+			job.TMin, job.TMax = int64(10*time.Second), int64(50*time.Second)-1
+			job.Mappers = []Mapper{
+				&testMapper{points: testPoints(10, 9), interval: int64(10 * time.Second), shardID: 1, job: job},
+				&testMapper{points: testPoints(30, 5), interval: int64(10 * time.Second), shardID: 2, job: job},
+			}
+			p := NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+			p.IntervalTime = tt.intervalTime
+			p.StreamAggregates = stream
+
+			var values [][]interface{}
+			for _, row := range testExecute(t, p, `SELECT count(value) FROM cpu WHERE time >= '1970-01-01T00:00:10Z' AND time < '1970-01-01T00:00:50Z' GROUP BY time(10s) fill(0)`, 1) {
+				values = append(values, row.Values...)
+			}
+
+			var exp [][]interface{}
+			for i, n := range []float64{9, 0, 5, 0} {
+				exp = append(exp, []interface{}{time.Unix(tt.secs[i], 0).UTC(), n})
+			}
+			if !reflect.DeepEqual(values, exp) {
+				t.Errorf("%d/%v: unexpected values: %v", tt.intervalTime, stream, values)
+			}
+		}
+	}
+}
+
+// Ensure queries grouped by window() aggregate the overlapping windows ending with each interval,
+// including the points before the time range that the first windows start with.
+func TestMapReduceJob_Execute_Window(t *testing.T) {
+	newPlanner := func() *Planner {
+		job := testJob()
+		job.TMax = int64(40*time.Second) - int64(time.Microsecond)
+		job.Mappers = []Mapper{
+			&testMapper{points: testPoints(0, 30), interval: int64(5 * time.Second), shardID: 1, job: job},
+			&testMapper{points: testPoints(30, 30), interval: int64(5 * time.Second), shardID: 2, job: job},
+		}
+		return NewPlanner(&testDB{jobs: []*MapReduceJob{job}})
+	}
+
+	// the window of each interval covers the 15s ending with it, e.g. 10s to 24s for the interval
+	// at 20s, so each point is in three windows
+	rows := testExecute(t, newPlanner(), `SELECT sum(value), count(value), mean(value) FROM cpu WHERE time >= '1970-01-01T00:00:20Z' AND time < '1970-01-01T00:00:40Z' GROUP BY time(5s), window(15s)`, 0)
+	if len(rows) != 1 {
+		t.Fatalf("unexpected row count: %d", len(rows))
+	} else if exp := [][]interface{}{
+		{time.Unix(20, 0).UTC(), float64(255), float64(15)},
+		{time.Unix(25, 0).UTC(), float64(330), float64(15)},
+		{time.Unix(30, 0).UTC(), float64(405), float64(15)},
+		{time.Unix(35, 0).UTC(), float64(480), float64(15)},
+	}; len(rows[0].Values) != len(exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	} else {
+		for i, v := range rows[0].Values {
+			if !reflect.DeepEqual(v[:3], exp[i]) {
+				t.Fatalf("unexpected values: %v", v)
+			} else if mean := v[3].(float64); math.Abs(mean-exp[i][1].(float64)/15) > 1e-9 {
+				t.Fatalf("unexpected mean: %v", v)
+			}
+		}
+	}
+
+	// a window of a single interval is the interval
+	rows = testExecute(t, newPlanner(), `SELECT sum(value) FROM cpu WHERE time >= '1970-01-01T00:00:20Z' AND time < '1970-01-01T00:00:40Z' GROUP BY time(5s), window(5s)`, 0)
+	if exp := [][]interface{}{
+		{time.Unix(20, 0).UTC(), float64(110)},
+		{time.Unix(25, 0).UTC(), float64(135)},
+		{time.Unix(30, 0).UTC(), float64(160)},
+		{time.Unix(35, 0).UTC(), float64(185)},
+	}; !reflect.DeepEqual(rows[0].Values, exp) {
+		t.Fatalf("unexpected values: %v", rows[0].Values)
+	}
+
+	for _, tt := range []struct {
+		s   string
+		err string
+	}{
+		{s: `SELECT max(value) FROM cpu WHERE time > 0 GROUP BY time(5s), window(15s)`, err: `window() only supports mean(), sum() and count(), not max(value)`},
+		{s: `SELECT count(distinct(value)) FROM cpu WHERE time > 0 GROUP BY time(5s), window(15s)`, err: `window() only supports mean(), sum() and count(), not count(distinct(value))`},
+		{s: `SELECT mean(value) FROM cpu WHERE time > 0 GROUP BY time(10s), window(15s)`, err: `window size 15s must be a multiple of the GROUP BY time interval 10s`},
+		{s: `SELECT mean(value) FROM cpu WHERE time > 0 GROUP BY window(15s)`, err: `window() requires a GROUP BY time interval`},
+		{s: `SELECT mean(value) FROM cpu WHERE time > 0 GROUP BY time(5s), window(0s)`, err: `window dimension must have a positive duration argument`},
+		{s: `SELECT mean(value) FROM cpu WHERE time > 0 GROUP BY time(5s), window(15s), window(10s)`, err: `multiple window dimensions not allowed`},
+		{s: `SELECT mean(value) FROM cpu WHERE time < '1970-01-01T00:00:40Z' GROUP BY time(5s), window(15s)`, err: ErrWindowTimeBound.Error()},
+	} {
+		stmt, err := NewParser(strings.NewReader(tt.s)).ParseStatement()
+		if err == nil {
+			_, err = newPlanner().Plan(stmt.(*SelectStatement), 0)
+		}
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: unexpected error: %v", tt.s, err)
+		}
+	}
+}
+
+// Ensure withTimeRangeStart replaces the lower time bound and keeps the rest of the condition.
+func TestWithTimeRangeStart(t *testing.T) {
+	q, err := ParseQuery(`SELECT mean(value) FROM cpu WHERE host = 'a' AND time >= '1970-01-01T00:00:20Z' AND time < '1970-01-01T00:00:40Z' GROUP BY time(5s); SELECT value FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt := q.Statements[0].(*SelectStatement)
+	other := withTimeRangeStart(stmt, time.Unix(10, 0))
+	if s := other.Condition.String(); s != `host = 'a' AND time >= '1970-01-01 00:00:10' AND time <= '1970-01-01 00:00:39.999999'` {
+		t.Fatalf("unexpected condition: %s", s)
+	} else if tmin, tmax := TimeRange(other.Condition); !tmin.Equal(time.Unix(10, 0)) || !tmax.Equal(time.Unix(40, 0).Add(-time.Nanosecond)) {
+		t.Fatalf("unexpected time range: %s - %s", tmin, tmax)
+	}
+	if tmin, _ := TimeRange(stmt.Condition); !tmin.Equal(time.Unix(20, 0)) {
+		t.Fatalf("statement modified: %s", stmt.Condition)
+	}
+
+	// statements without a condition only get the time range
+	other = withTimeRangeStart(q.Statements[1].(*SelectStatement), time.Unix(10, 0))
+	if s := other.Condition.String(); s != `time >= '1970-01-01 00:00:10'` {
+		t.Fatalf("unexpected condition: %s", s)
+	}
+}
+
+// Ensure the planner orders the mappers of each job by shard ID.
+func TestPlanner_Plan_SortMappers(t *testing.T) {
+	j := testJob(&testMapper{shardID: 3}, &testMapper{shardID: 1}, &testMapper{shardID: 2})
+	q, err := ParseQuery(`SELECT value FROM cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPlanner(&testDB{jobs: []*MapReduceJob{j}}).Plan(q.Statements[0].(*SelectStatement), 10); err != nil {
+		t.Fatal(err)
+	}
+	for i, mm := range j.Mappers {
+		if id := mm.ShardID(); id != uint64(i+1) {
+			t.Fatalf("%d. unexpected shard id: %d", i, id)
+		}
+	}
+}
+
+// Ensure tag sets are encoded the same way whatever the order of their map.
+func TestEncodeTagSet(t *testing.T) {
+	a := map[string]string{}
+	a["host"] = "serverA"
+	a["region"] = "uswest"
+	a["dc"] = "a"
+	b := map[string]string{}
+	b["dc"] = "a"
+	b["region"] = "uswest"
+	b["host"] = "serverA"
+
+	if x, y := EncodeTagSet(a), EncodeTagSet(b); x != y {
+		t.Fatalf("keys differ: %q != %q", x, y)
+	} else if x != "dc|host|region|a|serverA|uswest" {
+		t.Fatalf("unexpected key: %q", x)
+	}
+
+	// Separators are escaped so different tag sets can't collide.
+	for _, tt := range []struct {
+		tags map[string]string
+		exp  string
+	}{
+		{tags: nil, exp: ""},
+		{tags: map[string]string{"a|b": "c"}, exp: `a\|b|c`},
+		{tags: map[string]string{"a": "b|c"}, exp: `a|b\|c`},
+		{tags: map[string]string{`a\`: "b"}, exp: `a\\|b`},
+	} {
+		if got := EncodeTagSet(tt.tags); got != tt.exp {
+			t.Errorf("EncodeTagSet(%v) = %q, exp %q", tt.tags, got, tt.exp)
+		}
+	}
+}
+
+// Ensure raw outputs from any number of mappers are merged in time order.
+func TestMergeRawOutputs(t *testing.T) {
+	for n := 0; n <= 4; n++ {
+		chunks := testChunks(n, 3)
+
+		values := mergeRawOutputs(chunks, true)
+		if len(values) != n*3 {
+			t.Fatalf("%d chunks: unexpected value count: %d", n, len(values))
+		}
+		for i := 1; i < len(values); i++ {
+			if values[i].Time < values[i-1].Time {
+				t.Fatalf("%d chunks: values out of order at %d: %v", n, i, values)
+			}
+		}
+	}
+}
+
+// Ensure raw outputs read in descending time order are merged in descending time order.
+func TestMergeRawOutputs_Descending(t *testing.T) {
+	for n := 0; n <= 4; n++ {
+		chunks := testChunks(n, 3)
+		for _, c := range chunks {
+			for i, j := 0, len(c)-1; i < j; i, j = i+1, j-1 {
+				c[i], c[j] = c[j], c[i]
+			}
+		}
+
+		values := mergeRawOutputs(chunks, false)
+		if len(values) != n*3 {
+			t.Fatalf("%d chunks: unexpected value count: %d", n, len(values))
+		}
+		for i := 1; i < len(values); i++ {
+			if values[i].Time > values[i-1].Time {
+				t.Fatalf("%d chunks: values out of order at %d: %v", n, i, values)
+			}
+		}
+	}
+}
+
+func BenchmarkMergeRawOutputs_1(b *testing.B) { benchmarkMergeRawOutputs(b, 1) }
+func BenchmarkMergeRawOutputs_2(b *testing.B) { benchmarkMergeRawOutputs(b, 2) }
+func BenchmarkMergeRawOutputs_8(b *testing.B) { benchmarkMergeRawOutputs(b, 8) }
+
+// BenchmarkMergeRawOutputsHeap_1 merges a single chunk with a heap, as a baseline for the
+// single shard case.
+func BenchmarkMergeRawOutputsHeap_1(b *testing.B) {
+	chunks := testChunks(1, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mergeRawOutputsHeap(chunks, true)
+	}
+}
+
+func benchmarkMergeRawOutputs(b *testing.B, n int) {
+	chunks := testChunks(n, 10000/n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		mergeRawOutputs(chunks, true)
+	}
+}
+
+// testChunks returns n time ordered chunks of size points whose times interleave.
+func testChunks(n, size int) [][]*rawQueryMapOutput {
+	chunks := make([][]*rawQueryMapOutput, n)
+	for i := range chunks {
+		for j := 0; j < size; j++ {
+			chunks[i] = append(chunks[i], &rawQueryMapOutput{Time: int64(j*n + (n - i)), Values: float64(j)})
+		}
+	}
+	return chunks
+}
+
+// testDB is a DB whose transactions return a fixed set of map reduce jobs.
+type testDB struct {
+	jobs            []*MapReduceJob
+	shardSetChanged bool // returned by ShardSetChanged
+}
+
+func (db *testDB) Begin() (Tx, error) { return db, nil }
+
+func (db *testDB) CreateMapReduceJobs(stmt *SelectStatement, tagKeys []string) ([]*MapReduceJob, error) {
+	return db.jobs, nil
+}
+
+func (db *testDB) ShardSetChanged(stmt *SelectStatement) (bool, error) {
+	return db.shardSetChanged, nil
+}
+
+// testWarmDB is a test DB whose transactions record the retention policies they warm.
+type testWarmDB struct {
+	testDB
+	warmed []string
+}
+
+func (db *testWarmDB) Begin() (Tx, error) { return db, nil }
+
+func (db *testWarmDB) Warm(database, retentionPolicy string, closing <-chan struct{}) error {
+	select {
+	case <-closing:
+		return ErrWarmCanceled
+	default:
+	}
+	db.warmed = append(db.warmed, database+"."+retentionPolicy)
+	return nil
+}
+
+// testSourceJobsDB is a test DB whose transactions return the jobs of the measurement selected from.
+type testSourceJobsDB struct {
+	jobs map[string][]*MapReduceJob
+}
+
+func (db *testSourceJobsDB) Begin() (Tx, error) { return db, nil }
+
+func (db *testSourceJobsDB) CreateMapReduceJobs(stmt *SelectStatement, tagKeys []string) ([]*MapReduceJob, error) {
+	return db.jobs[stmt.Sources[0].(*Measurement).Name], nil
+}
+
+// testUnifiedColumnsDB is a testDB whose transactions implement UnifiedColumnsTx.
+type testUnifiedColumnsDB struct {
+	testDB
+	unified bool // set by SetUnifyColumns
+}
+
+func (db *testUnifiedColumnsDB) Begin() (Tx, error) { return db, nil }
+
+func (db *testUnifiedColumnsDB) SetUnifyColumns() { db.unified = true }
+
+// testJob returns a job for the "cpu" measurement covering the first hour of the epoch.
+func testJob(mappers ...Mapper) *MapReduceJob {
+	return &MapReduceJob{
+		MeasurementName: "cpu",
+		TagSet:          &TagSet{Tags: map[string]string{}},
+		Mappers:         mappers,
+		TMin:            0,
+		TMax:            int64(time.Hour),
+	}
+}
+
+// testPoints returns n float points, one per second, starting at the given second.
+// Every point's value is its time in seconds.
+func testPoints(start, n int) []*rawQueryMapOutput {
+	a := make([]*rawQueryMapOutput, n)
+	for i := range a {
+		sec := start + i + 1
+		a[i] = &rawQueryMapOutput{Time: int64(sec) * int64(time.Second), Values: float64(sec)}
+	}
+	return a
+}
+
+// testExecute plans and executes a query. Any row errors fail the test.
+func testExecute(t *testing.T, p *Planner, s string, chunkSize int) []*Row {
+	q, err := ParseQuery(s)
+	if err != nil {
+		t.Fatalf("unable to parse query %q: %s", s, err)
+	}
+
+	e, err := p.Plan(q.Statements[0].(*SelectStatement), chunkSize)
+	if err != nil {
+		t.Fatalf("unable to plan query %q: %s", s, err)
+	}
+
+	var rows []*Row
+	for row := range e.Execute() {
+		if row.Err != nil {
+			t.Fatalf("unexpected row error: %s", row.Err)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// testMapper is an in-memory Mapper over a single series of points.
+// It is used to exercise the engine without a storage backend.
+type testMapper struct {
+	points   []*rawQueryMapOutput // points in time order
+	interval int64                // group by interval for aggregate queries
+	offset   int64                // group by offset for aggregate queries
+	shardID  uint64               // the ID returned by ShardID
+	job      *MapReduceJob        // if set, the job whose options are applied by Begin
+	skippedN int                  // the number of non-finite values skipped
+
+	chunkSize  int     // chunk size passed to Begin
+	mapFunc    MapFunc // map function for aggregate queries
+	isRaw      bool    // true if Begin was called for a raw query
+	desc       bool    // true if a raw query reads the points backward
+	tmin, tmax int64   // bounds of the current interval
+	index      int     // index of the next point to read
+
+	intervalN int // the number of calls to NextInterval
+
+	// Tests read opened and closed, and the bounds of the interval, once the output channel of the
+	// executor is closed, which is after the mappers are closed, so they aren't guarded.
+	opened, closed bool
+}
+
+func (m *testMapper) Open() error { m.opened = true; return nil }
+func (m *testMapper) Close()      { m.closed = true }
+
+func (m *testMapper) ShardID() uint64 { return m.shardID }
+
+func (m *testMapper) SkippedN() int { return m.skippedN }
+
+func (m *testMapper) Begin(c *Call, startingTime int64, chunkSize int) error {
+	initializeMapFunc := InitializeMapFunc
+	if m.job != nil {
+		initializeMapFunc = m.job.InitializeMapFunc
+	}
+	mapFunc, err := initializeMapFunc(c)
+	if err != nil {
+		return err
+	}
+	m.mapFunc = mapFunc
+	if m.job != nil && m.job.SkipNonFinite {
+		m.mapFunc = FiniteMapFunc(mapFunc, &m.skippedN)
+	}
+	m.isRaw = c == nil
+	m.chunkSize = chunkSize
+	m.tmin = startingTime
+
+	// raw queries sorted by descending time are read backward from the starting time
+	if m.isRaw && m.job != nil && !m.job.stmt.TimeAscending() {
+		m.desc = true
+		for m.index = len(m.points) - 1; m.index >= 0 && m.points[m.index].Time > startingTime; m.index-- {
+		}
+		return nil
+	}
+
+	// seek to the starting time
+	for m.index = 0; m.index < len(m.points) && m.points[m.index].Time < startingTime; m.index++ {
+	}
+	return nil
+}
+
+func (m *testMapper) NextInterval() (interface{}, error) {
+	m.intervalN++
+	if m.desc {
+		var a []*rawQueryMapOutput
+		for ; m.index >= 0 && len(a) < m.chunkSize; m.index-- {
+			a = append(a, m.points[m.index])
+		}
+		return a, nil
+	}
+	if m.isRaw {
+		if m.index >= len(m.points) {
+			return nil, nil
+		}
+		n := m.index + m.chunkSize
+		if n > len(m.points) {
+			n = len(m.points)
+		}
+		a := m.points[m.index:n]
+		m.index = n
+		return a, nil
+	}
+
+	// Determine the bounds of the interval. The first interval may be partial.
+	m.tmax = math.MaxInt64
+	nextMin := m.tmax
+	if m.interval > 0 {
+		nextMin = IntervalStart(m.tmin, m.interval, m.offset) + m.interval
+		m.tmax = nextMin - 1
+	}
+	val := m.mapFunc(m)
+	m.tmin = nextMin
+	return val, nil
+}
+
+// testIntervalMapper is a mapper of aggregates that returns an interval at each of its times, in
+// seconds, in that order, whatever interval is being reduced. The output of each interval is its
+// time in seconds.
+type testIntervalMapper struct {
+	testMapper
+	times []int64
+	t     int64 // the time of the last interval returned, in nanoseconds
+}
+
+func (m *testIntervalMapper) NextInterval() (interface{}, error) {
+	if len(m.times) == 0 {
+		return nil, nil
+	}
+	m.t = m.times[0] * int64(time.Second)
+	v := float64(m.times[0])
+	m.times = m.times[1:]
+	return v, nil
+}
+
+func (m *testIntervalMapper) IntervalTime() (int64, bool) { return m.t, true }
+
+// Next implements the Iterator interface for the map functions.
+func (m *testMapper) Next() (seriesKey string, timestamp int64, value interface{}) {
+	for ; m.index < len(m.points); m.index++ {
+		p := m.points[m.index]
+		if p.Time < m.tmin {
+			continue
+		} else if p.Time > m.tmax {
+			break
+		}
+		m.index++
+		return "", p.Time, p.Values
+	}
+	return "", 0, nil
+}
+
+// testCloseCheckMapper is a test mapper that records whether it was read after it was closed.
+type testCloseCheckMapper struct {
+	testMapper
+	readAfterClose bool
+}
+
+func (m *testCloseCheckMapper) NextInterval() (interface{}, error) {
+	if m.closed {
+		m.readAfterClose = true
+	}
+	return m.testMapper.NextInterval()
+}
+
+// testCancelMapper is a test mapper that implements Canceler. Once its points are read, reads
+// block until it's cancelled.
+type testCancelMapper struct {
+	testMapper
+	cancel chan struct{}
+}
+
+func (m *testCancelMapper) NextInterval() (interface{}, error) {
+	if m.isRaw && m.index >= len(m.points) {
+		<-m.cancel
+		return nil, nil
+	}
+	return m.testMapper.NextInterval()
+}
+
+func (m *testCancelMapper) Cancel() { close(m.cancel) }
+
+// testGateMapper is a test mapper whose reads after its first gateN intervals block until the
+// gate is closed.
+type testGateMapper struct {
+	testMapper
+	gateN int
+	gate  chan struct{}
+}
+
+func (m *testGateMapper) NextInterval() (interface{}, error) {
+	if m.intervalN == m.gateN {
+		<-m.gate
+	}
+	return m.testMapper.NextInterval()
+}
+
+// testSlowMapper is a test mapper that sleeps before returning each interval, like a mapper
+// reading from a slow disk.
+type testSlowMapper struct {
+	testMapper
+	delay time.Duration
+}
+
+func (m *testSlowMapper) NextInterval() (interface{}, error) {
+	time.Sleep(m.delay)
+	return m.testMapper.NextInterval()
+}
+
+// testBlockingMapper is a test mapper whose Open blocks until the gate is closed, like a mapper
+// waiting on a shard locked by a compaction. The closing channel is closed when it's closed.
+type testBlockingMapper struct {
+	testMapper
+	gate    chan struct{}
+	closing chan struct{}
+}
+
+func (m *testBlockingMapper) Open() error {
+	<-m.gate
+	return m.testMapper.Open()
+}
+
+func (m *testBlockingMapper) Close() {
+	m.testMapper.Close()
+	close(m.closing)
+}
+
+// testMissingMapper is a test mapper whose shard was dropped, so it can't be opened.
+type testMissingMapper struct {
+	testMapper
+}
+
+func (m *testMissingMapper) Open() error { return ErrShardNotFound }
+
+// testPanicMapper is a test mapper that panics on the call to NextInterval numbered panicN, if set,
+// or in Open if panicOpen is set, like a mapper with a bug decoding its points. The closing channel
+// is closed when it's closed.
+type testPanicMapper struct {
+	testMapper
+	panicN    int
+	panicOpen bool
+	closing   chan struct{}
+	once      sync.Once
+}
+
+func newTestPanicMapper(m testMapper, panicN int, panicOpen bool) *testPanicMapper {
+	return &testPanicMapper{testMapper: m, panicN: panicN, panicOpen: panicOpen, closing: make(chan struct{})}
+}
+
+func (m *testPanicMapper) Open() error {
+	if m.panicOpen {
+		panic("decode error")
+	}
+	return m.testMapper.Open()
+}
+
+func (m *testPanicMapper) Close() { m.once.Do(func() { close(m.closing) }) }
+
+func (m *testPanicMapper) NextInterval() (interface{}, error) {
+	if m.panicN > 0 && m.intervalN+1 == m.panicN {
+		panic("decode error")
+	}
+	return m.testMapper.NextInterval()
+}
+
+// testEstimatingMapper is a testMapper that implements PointEstimator.
+type testEstimatingMapper struct {
+	testMapper
+	pointN int
+}
+
+func (m *testEstimatingMapper) EstimatedPointN() int { return m.pointN }
+
+// testSeriesKeyMapper is a testMapper that implements SeriesKeyMapper.
+type testSeriesKeyMapper struct {
+	testMapper
+	keys []string
+}
+
+func (m *testSeriesKeyMapper) SetSeriesKeys(keys []string) error {
+	m.keys = keys
+	return nil
+}
+
+// testResettingMapper is a testMapper that implements Resetter.
+type testResettingMapper struct {
+	testMapper
+	resetTMin, resetTMax int64 // the bounds passed to Reset
+	closeN               int   // the number of calls to Close
+}
+
+func (m *testResettingMapper) Close() {
+	m.closeN++
+	m.testMapper.Close()
+}
+
+func (m *testResettingMapper) Reset(tmin, tmax int64) error {
+	m.resetTMin, m.resetTMax = tmin, tmax
+	return nil
+}
+
+// testNodeMapper is a testMapper for a shard owned by another node.
+type testNodeMapper struct {
+	testMapper
+	nodeID uint64
+}
+
+func (m *testNodeMapper) NodeID() uint64 { return m.nodeID }
+
+// testMultiMapperDB is a testDB that implements MultiMapperTx.
+type testMultiMapperDB struct {
+	testDB
+	newMultiMapper func(job *MapReduceJob, nodeID uint64, shardIDs []uint64) (Mapper, error)
+}
+
+func (db *testMultiMapperDB) Begin() (Tx, error) { return db, nil }
+
+func (db *testMultiMapperDB) NewMultiMapper(job *MapReduceJob, nodeID uint64, shardIDs []uint64) (Mapper, error) {
+	return db.newMultiMapper(job, nodeID, shardIDs)
+}
+
+// testMeasurementDB is a testDB that implements MeasurementTx.
+type testMeasurementDB struct {
+	testDB
+	measurements map[string]bool
+}
+
+func (db *testMeasurementDB) Begin() (Tx, error) { return db, nil }
+
+func (db *testMeasurementDB) MeasurementExists(m *Measurement) (bool, error) {
+	return db.measurements[m.Name], nil
+}
+
+// testSnapshotDB is a testDB that implements SnapshotTx.
+type testSnapshotDB struct {
+	testDB
+	shardGroupIDs []uint64
+}
+
+func (db *testSnapshotDB) Begin() (Tx, error) { return db, nil }
+
+func (db *testSnapshotDB) SetShardGroupIDs(ids []uint64) { db.shardGroupIDs = ids }
+
+// testProductAggregate is a user-defined aggregate that multiplies the float values of an interval.
+type testProductAggregate struct {
+	reducerN int // the number of reducers created
+}
+
+func (a *testProductAggregate) MapFunc(c *Call) (MapFunc, error) {
+	return func(itr Iterator) interface{} {
+		var product interface{}
+		for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
+			if product == nil {
+				product = 1.0
+			}
+			product = product.(float64) * v.(float64)
+		}
+		return product
+	}, nil
+}
+
+func (a *testProductAggregate) NewReducer(c *Call) (Reducer, error) {
+	a.reducerN++
+	return &testProductReducer{}, nil
+}
+
+type testProductReducer struct {
+	product interface{}
+}
+
+func (r *testProductReducer) Combine(partial interface{}) {
+	if partial == nil {
+		return
+	} else if r.product == nil {
+		r.product = 1.0
+	}
+	r.product = r.product.(float64) * partial.(float64)
+}
+
+func (r *testProductReducer) Finalize() interface{} { return r.product }
+
+// testMovingMapper is a testMapper whose shard moves to another node after failAfter calls to
+// NextInterval. The new mapper reads the same points.
+type testMovingMapper struct {
+	testMapper
+	failAfter int
+	maxRemapN int // if negative, remapping fails
+	remapped  *testMapper
+}
+
+func (m *testMovingMapper) NextInterval() (interface{}, error) {
+	if m.failAfter == 0 {
+		return nil, ErrShardMoved
+	}
+	m.failAfter--
+	return m.testMapper.NextInterval()
+}
+
+func (m *testMovingMapper) Remap() (Mapper, error) {
+	if m.maxRemapN < 0 {
+		return nil, ErrShardMoved
+	}
+	m.remapped = &testMapper{points: m.points, interval: m.interval, shardID: m.shardID}
+	return m.remapped, nil
+}
+
+// testTransientError is a transient error, e.g. a connection reset by a remote node.
+type testTransientError struct{}
+
+func (testTransientError) Error() string   { return "connection reset" }
+func (testTransientError) Transient() bool { return true }
+
+// testFlakyMapper is a testMapper whose reads fail with err failN times after failAfter calls to
+// NextInterval. A failing read consumes the interval it was reading, as a read cut short mid-stream
+// does, so the mapper must be sought back to resume.
+type testFlakyMapper struct {
+	testMapper
+	failAfter int
+	failN     int
+	err       error
+	c         *Call
+	seeks     []int64 // the times the mapper was sought to
+}
+
+func (m *testFlakyMapper) Begin(c *Call, startingTime int64, chunkSize int) error {
+	m.c = c
+	return m.testMapper.Begin(c, startingTime, chunkSize)
+}
+
+func (m *testFlakyMapper) NextInterval() (interface{}, error) {
+	if m.failAfter == 0 && m.failN > 0 {
+		m.failN--
+		m.testMapper.NextInterval()
+		return nil, m.err
+	}
+	m.failAfter--
+	return m.testMapper.NextInterval()
+}
+
+func (m *testFlakyMapper) SeekInterval(startingTime int64) error {
+	m.seeks = append(m.seeks, startingTime)
+	return m.testMapper.Begin(m.c, startingTime, m.chunkSize)
+}
@@ -7,8 +7,11 @@ package influxql
 // When adding an aggregate function, define a mapper, a reducer, and add them in the switch statement in the MapReduceFuncs function
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"math"
 	"math/rand"
 	"sort"
@@ -32,6 +35,287 @@ type ReduceFunc func([]interface{}) interface{}
 // server and marshal it into an interface the reduer can use
 type UnmarshalFunc func([]byte) (interface{}, error)
 
+// Reducer combines the outputs of the mappers for a single interval of an aggregate into the
+// value of the aggregate. A new reducer is created for every interval of every series.
+type Reducer interface {
+	// Combine adds the output of a mapper for the interval. It's nil if the mapper had no
+	// points in the interval.
+	Combine(partial interface{})
+
+	// Finalize returns the value of the aggregate for the interval.
+	Finalize() interface{}
+}
+
+// FallibleReducer is implemented by reducers whose aggregate can fail, e.g. once the values they
+// buffer exceed a limit. The series fails with the error once the interval is finalized.
+type FallibleReducer interface {
+	Reducer
+
+	// Err returns the error the aggregate of the interval failed with, if any.
+	Err() error
+}
+
+// Aggregate is an aggregate function. The mappers run its map function over the points of each
+// interval of their shard, and a reducer combines the outputs of the mappers for the interval.
+type Aggregate interface {
+	// MapFunc returns the function the mappers run over the points of each interval of the call.
+	MapFunc(c *Call) (MapFunc, error)
+
+	// NewReducer returns a reducer for a single interval of the call.
+	NewReducer(c *Call) (Reducer, error)
+}
+
+// Aggregates maps function names to the aggregate functions they call.
+type Aggregates map[string]Aggregate
+
+// DefaultAggregates returns the built-in aggregate functions. The returned map can be extended
+// with user-defined aggregates.
+func DefaultAggregates() Aggregates {
+	a := make(Aggregates)
+	for _, name := range []string{
+		"count", "approx_count_distinct", "distinct", "sum", "mean", "median",
+		"min", "max", "spread", "stddev", "first", "last", "percentile",
+	} {
+		a[name] = builtinAggregate{}
+	}
+	a["concat"] = concatAggregate{maxBytes: DefaultMaxConcatBytes}
+	return a
+}
+
+// builtinAggregates are the aggregates of jobs that weren't planned with any.
+var builtinAggregates = DefaultAggregates()
+
+// ErrFunctionNotFound is returned when a query calls an aggregate function that doesn't exist.
+func ErrFunctionNotFound(name string) error { return fmt.Errorf("function not found: %q", name) }
+
+// lookup returns the aggregate called by c, and the call it's applied to. derivative(),
+// difference() and holt_winters() are applied to the aggregate nested in them, e.g. mean()
+// in derivative(mean(value)). The returned call is nil if c is applied to raw values.
+func (a Aggregates) lookup(c *Call) (Aggregate, *Call, error) {
+	switch c.Name {
+	case "derivative", "non_negative_derivative", "difference", "holt_winters":
+		if len(c.Args) == 0 {
+			return nil, nil, fmt.Errorf("expected field name argument for %s()", c.Name)
+		}
+		nested, ok := c.Args[0].(*Call)
+		if !ok {
+			return nil, nil, nil
+		}
+		return a.lookup(nested)
+	}
+
+	agg, ok := a[c.Name]
+	if !ok {
+		return nil, nil, ErrFunctionNotFound(c.Name)
+	}
+	return agg, c, nil
+}
+
+// builtinAggregate is a built-in aggregate, which is implemented by its map and reduce functions.
+type builtinAggregate struct{}
+
+func (builtinAggregate) MapFunc(c *Call) (MapFunc, error) { return InitializeMapFunc(c) }
+
+func (builtinAggregate) NewReducer(c *Call) (Reducer, error) {
+	fn, err := InitializeReduceFunc(c)
+	if err != nil {
+		return nil, err
+	}
+	return &funcReducer{fn: fn}, nil
+}
+
+// funcReducer is a Reducer that collects the mapper outputs of an interval and reduces them with
+// a ReduceFunc once they're all combined.
+type funcReducer struct {
+	fn     ReduceFunc
+	values []interface{}
+}
+
+func (r *funcReducer) Combine(partial interface{}) { r.values = append(r.values, partial) }
+func (r *funcReducer) Finalize() interface{}       { return r.fn(r.values) }
+
+// transformFuncs are the scalar functions applied to each value of a raw query, e.g. abs(value).
+// To add a scalar function of one argument, add it here.
+var transformFuncs = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"ceil":  math.Ceil,
+	"floor": math.Floor,
+	"round": round,
+	"sqrt":  math.Sqrt,
+}
+
+// integerTransformFuncs are the scalar functions whose results are integers for integer values.
+var integerTransformFuncs = map[string]bool{"abs": true, "ceil": true, "floor": true, "round": true}
+
+// binaryTransformFuncs are the scalar functions of two arguments, e.g. pow(value, 2). Their
+// results are always floats.
+var binaryTransformFuncs = map[string]func(float64, float64) float64{
+	"atan2": math.Atan2,
+	"pow":   math.Pow,
+}
+
+// IsTransformCall returns true if the call is a scalar function applied to each value of a raw query
+// rather than an aggregate.
+func IsTransformCall(c *Call) bool {
+	if _, ok := transformFuncs[c.Name]; ok {
+		return true
+	}
+	_, ok := binaryTransformFuncs[c.Name]
+	return ok
+}
+
+// transformArgN returns the number of arguments of the named scalar function.
+func transformArgN(name string) int {
+	if _, ok := binaryTransformFuncs[name]; ok {
+		return 2
+	}
+	return 1
+}
+
+// transformValue applies the named scalar function to a value. Integers stay integers, except for
+// sqrt. Nulls, NaNs and values that aren't numbers are returned as null.
+func transformValue(name string, v interface{}) interface{} {
+	fn := transformFuncs[name]
+	switch v := v.(type) {
+	case float64:
+		return nullNaN(fn(v))
+	case int64:
+		if integerTransformFuncs[name] {
+			return int64(fn(float64(v)))
+		}
+		return nullNaN(fn(float64(v)))
+	}
+	return nil
+}
+
+// binaryTransformValue applies the named scalar function of two arguments to two values. The
+// result is null if either value is null or isn't a number, or if it's NaN.
+func binaryTransformValue(name string, a, b interface{}) interface{} {
+	x, ok := numberValue(a)
+	if !ok {
+		return nil
+	}
+	y, ok := numberValue(b)
+	if !ok {
+		return nil
+	}
+	return nullNaN(binaryTransformFuncs[name](x, y))
+}
+
+// arithmeticValue applies an arithmetic operator to two values. Adding, subtracting or multiplying
+// two integers returns an integer, and every other result is a float. The result is null if either
+// value is null or isn't a number, if it's NaN, or if it divides by zero.
+func arithmeticValue(op Token, a, b interface{}) interface{} {
+	if x, ok := a.(int64); ok {
+		if y, ok := b.(int64); ok {
+			switch op {
+			case ADD:
+				return x + y
+			case SUB:
+				return x - y
+			case MUL:
+				return x * y
+			}
+		}
+	}
+
+	x, ok := numberValue(a)
+	if !ok {
+		return nil
+	}
+	y, ok := numberValue(b)
+	if !ok {
+		return nil
+	}
+	switch op {
+	case ADD:
+		return nullNaN(x + y)
+	case SUB:
+		return nullNaN(x - y)
+	case MUL:
+		return nullNaN(x * y)
+	case DIV:
+		if y == 0 {
+			return nil
+		}
+		return nullNaN(x / y)
+	}
+	return nil
+}
+
+// evalTransform evaluates a field of a raw query against a point: the fields and numbers it refers
+// to, combined by scalar functions and arithmetic, which may be nested, e.g. sqrt(pow(a, 2) + 1).
+func evalTransform(expr Expr, v *rawQueryMapOutput) interface{} {
+	switch expr := expr.(type) {
+	case *VarRef:
+		return rawFieldValue(v, expr.Val)
+	case *NumberLiteral:
+		return expr.Val
+	case *ParenExpr:
+		return evalTransform(expr.Expr, v)
+	case *BinaryExpr:
+		return arithmeticValue(expr.Op, evalTransform(expr.LHS, v), evalTransform(expr.RHS, v))
+	case *Call:
+		if transformArgN(expr.Name) == 2 {
+			return binaryTransformValue(expr.Name, evalTransform(expr.Args[0], v), evalTransform(expr.Args[1], v))
+		}
+		return transformValue(expr.Name, evalTransform(expr.Args[0], v))
+	}
+	return nil
+}
+
+// numberValue returns a float or integer value as a float, and false for any other value.
+func numberValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// nullNaN returns nil for NaN, which isn't returned as a value, and x otherwise.
+func nullNaN(x float64) interface{} {
+	if math.IsNaN(x) {
+		return nil
+	}
+	return x
+}
+
+// round returns the nearest integer to x, rounding half away from zero.
+func round(x float64) float64 {
+	if x < 0 {
+		return math.Ceil(x - 0.5)
+	}
+	return math.Floor(x + 0.5)
+}
+
+// FiniteMapFunc returns a map function that skips NaN and infinite float values before they reach
+// fn. The number of values skipped is added to skippedN.
+func FiniteMapFunc(fn MapFunc, skippedN *int) MapFunc {
+	return func(itr Iterator) interface{} {
+		return fn(&finiteIterator{itr: itr, skippedN: skippedN})
+	}
+}
+
+// finiteIterator wraps an iterator and skips NaN and infinite float values.
+type finiteIterator struct {
+	itr      Iterator
+	skippedN *int
+}
+
+func (itr *finiteIterator) Next() (seriesKey string, time int64, value interface{}) {
+	for {
+		seriesKey, time, value = itr.itr.Next()
+		if f, ok := value.(float64); ok && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			*itr.skippedN++
+			continue
+		}
+		return
+	}
+}
+
 // InitializeMapFunc takes an aggregate call from the query and returns the MapFunc
 func InitializeMapFunc(c *Call) (MapFunc, error) {
 	// see if it's a query for raw data
@@ -49,13 +333,17 @@ func InitializeMapFunc(c *Call) (MapFunc, error) {
 		if len(c.Args) == 0 {
 			return nil, fmt.Errorf("expected field name argument for %s()", c.Name)
 		}
+	} else if c.Name == "holt_winters" {
+		if len(c.Args) != 3 {
+			return nil, fmt.Errorf("expected three arguments for %s()", c.Name)
+		}
 	} else if len(c.Args) != 1 {
 		return nil, fmt.Errorf("expected one argument for %s()", c.Name)
 	}
 
-	// derivative can take a nested aggregate function, everything else expects
-	// a variable reference as the first arg
-	if !strings.HasSuffix(c.Name, "derivative") {
+	// derivative, difference and holt_winters can take a nested aggregate function, everything
+	// else expects a variable reference as the first arg
+	if !strings.HasSuffix(c.Name, "derivative") && c.Name != "difference" && c.Name != "holt_winters" {
 		// Ensure the argument is appropriate for the aggregate function.
 		switch fc := c.Args[0].(type) {
 		case *VarRef:
@@ -84,6 +372,8 @@ func InitializeMapFunc(c *Call) (MapFunc, error) {
 			}
 		}
 		return MapCount, nil
+	case "approx_count_distinct":
+		return MapApproxCountDistinct, nil
 	case "distinct":
 		return MapDistinct, nil
 	case "sum":
@@ -110,13 +400,20 @@ func InitializeMapFunc(c *Call) (MapFunc, error) {
 			return nil, fmt.Errorf("expected float argument in percentile()")
 		}
 		return MapEcho, nil
-	case "derivative", "non_negative_derivative":
+	case "derivative", "non_negative_derivative", "difference":
 		// If the arg is another aggregate e.g. derivative(mean(value)), then
 		// use the map func for that nested aggregate
 		if fn, ok := c.Args[0].(*Call); ok {
 			return InitializeMapFunc(fn)
 		}
 		return MapRawQuery, nil
+	case "holt_winters":
+		// holt_winters is applied to the reduced output of the nested aggregate
+		fn, ok := c.Args[0].(*Call)
+		if !ok {
+			return nil, fmt.Errorf("expected function argument to %s", c.Name)
+		}
+		return InitializeMapFunc(fn)
 	default:
 		return nil, fmt.Errorf("function not found: %q", c.Name)
 	}
@@ -136,6 +433,8 @@ func InitializeReduceFunc(c *Call) (ReduceFunc, error) {
 			}
 		}
 		return ReduceSum, nil
+	case "approx_count_distinct":
+		return ReduceApproxCountDistinct, nil
 	case "distinct":
 		return ReduceDistinct, nil
 	case "sum":
@@ -166,18 +465,71 @@ func InitializeReduceFunc(c *Call) (ReduceFunc, error) {
 			return nil, fmt.Errorf("expected float argument in percentile()")
 		}
 		return ReducePercentile(lit.Val), nil
-	case "derivative", "non_negative_derivative":
+	case "derivative", "non_negative_derivative", "difference":
 		// If the arg is another aggregate e.g. derivative(mean(value)), then
 		// use the map func for that nested aggregate
 		if fn, ok := c.Args[0].(*Call); ok {
 			return InitializeReduceFunc(fn)
 		}
 		return nil, fmt.Errorf("expected function argument to %s", c.Name)
+	case "holt_winters":
+		if fn, ok := c.Args[0].(*Call); ok {
+			return InitializeReduceFunc(fn)
+		}
+		return nil, fmt.Errorf("expected function argument to %s", c.Name)
 	default:
 		return nil, fmt.Errorf("function not found: %q", c.Name)
 	}
 }
 
+// InitializePartialReduceFunc takes an aggregate call from the query and returns a ReduceFunc that
+// combines mapper outputs into the partial state of the aggregate instead of its final value, e.g.
+// the count and mean of a mean rather than the mean. A partial state has the same type as the map
+// output, so partials from several sources can be combined again, or finalized by the ReduceFunc
+// of the call. Partial states are encoded as JSON and decoded by InitializeUnmarshaller.
+func InitializePartialReduceFunc(c *Call) (ReduceFunc, error) {
+	switch c.Name {
+	case "count":
+		if isCountDistinct(c) {
+			return combineCountDistinct, nil
+		}
+		return ReduceSum, nil
+	case "approx_count_distinct":
+		return combineApproxCountDistinct, nil
+	case "distinct":
+		return ReduceDistinct, nil
+	case "sum":
+		return ReduceSum, nil
+	case "mean":
+		return combineMean, nil
+	case "median", "stddev":
+		return combineFloats, nil
+	case "min":
+		return func(values []interface{}) interface{} { return combineMinMax(values, math.Min) }, nil
+	case "max":
+		return func(values []interface{}) interface{} { return combineMinMax(values, math.Max) }, nil
+	case "spread":
+		return combineSpread, nil
+	case "first":
+		return func(values []interface{}) interface{} { return combineFirstLast(values, false) }, nil
+	case "last":
+		return func(values []interface{}) interface{} { return combineFirstLast(values, true) }, nil
+	case "percentile":
+		return combineEcho, nil
+	default:
+		return nil, fmt.Errorf("partial aggregates aren't supported for %s()", c.Name)
+	}
+}
+
+// isCountDistinct returns true if the call is count(distinct(...)) or count(distinct ...).
+func isCountDistinct(c *Call) bool {
+	if _, ok := c.Args[0].(*Distinct); ok {
+		return true
+	}
+	arg, ok := c.Args[0].(*Call)
+	return ok && arg.Name == "distinct"
+}
+
 func InitializeUnmarshaller(c *Call) (UnmarshalFunc, error) {
 	// if c is nil it's a raw data query
 	if c == nil {
@@ -190,6 +542,27 @@ func InitializeUnmarshaller(c *Call) (UnmarshalFunc, error) {
 
 	// Retrieve marshal function by name
 	switch c.Name {
+	case "count":
+		if !isCountDistinct(c) {
+			break
+		}
+		return func(b []byte) (interface{}, error) {
+			var val distinctValues
+			err := json.Unmarshal(b, &val)
+			return val, err
+		}, nil
+	case "approx_count_distinct":
+		return func(b []byte) (interface{}, error) {
+			var o hyperLogLog
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
+	case "min", "max":
+		return func(b []byte) (interface{}, error) {
+			var o minMaxMapOut
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
 	case "mean":
 		return func(b []byte) (interface{}, error) {
 			var o meanMapOutput
@@ -208,6 +581,12 @@ func InitializeUnmarshaller(c *Call) (UnmarshalFunc, error) {
 			err := json.Unmarshal(b, &val)
 			return val, err
 		}, nil
+	case "concat":
+		return func(b []byte) (interface{}, error) {
+			var o concatMapOutput
+			err := json.Unmarshal(b, &o)
+			return &o, err
+		}, nil
 	case "first":
 		return func(b []byte) (interface{}, error) {
 			var o firstLastMapOutput
@@ -232,13 +611,13 @@ func InitializeUnmarshaller(c *Call) (UnmarshalFunc, error) {
 			err := json.Unmarshal(b, &a)
 			return a, err
 		}, nil
-	default:
-		return func(b []byte) (interface{}, error) {
-			var val interface{}
-			err := json.Unmarshal(b, &val)
-			return val, err
-		}, nil
 	}
+
+	return func(b []byte) (interface{}, error) {
+		var val interface{}
+		err := json.Unmarshal(b, &val)
+		return val, err
+	}, nil
 }
 
 // MapCount computes the number of values in an iterator.
@@ -253,6 +632,67 @@ func MapCount(itr Iterator) interface{} {
 	return nil
 }
 
+// ValueBucketTag is the tag of the rows of a query grouped by value_bucket() that has the lower
+// bound of the bin the row counts the values of.
+const ValueBucketTag = "value_bucket"
+
+// MapValueBuckets returns a map function that counts the numeric values of an interval in each bin
+// of the given width, by the index of the bin: the values v of the bin at index i are such that
+// i*width <= v < (i+1)*width. Other values, and NaN and infinite values, aren't counted.
+func MapValueBuckets(width float64) MapFunc {
+	return func(itr Iterator) interface{} {
+		var counts map[int64]int64
+		for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
+			var f float64
+			switch v := v.(type) {
+			case float64:
+				f = v
+			case int64:
+				f = float64(v)
+			default:
+				continue
+			}
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				continue
+			}
+
+			if counts == nil {
+				counts = make(map[int64]int64)
+			}
+			counts[int64(math.Floor(f/width))]++
+		}
+		if counts == nil {
+			return nil
+		}
+		return counts
+	}
+}
+
+// valueBucketReducer adds up the counts of each bin returned by MapValueBuckets.
+type valueBucketReducer struct {
+	counts map[int64]int64
+}
+
+func (r *valueBucketReducer) Combine(partial interface{}) {
+	counts, ok := partial.(map[int64]int64)
+	if !ok {
+		return
+	}
+	if r.counts == nil {
+		r.counts = make(map[int64]int64, len(counts))
+	}
+	for b, n := range counts {
+		r.counts[b] += n
+	}
+}
+
+func (r *valueBucketReducer) Finalize() interface{} {
+	if r.counts == nil {
+		return nil
+	}
+	return r.counts
+}
+
 type distinctValues []interface{}
 
 func (d distinctValues) Len() int      { return len(d) }
@@ -397,24 +837,198 @@ func MapCountDistinct(itr Iterator) interface{} {
 
 // ReduceCountDistinct finds the unique counts of values.
 func ReduceCountDistinct(values []interface{}) interface{} {
+	return len(indexCountDistinct(values))
+}
+
+// combineCountDistinct combines the distinct values of mappers into the sorted distinct values of
+// all of them, which unlike the index of a mapper can be encoded.
+func combineCountDistinct(values []interface{}) interface{} {
+	index := indexCountDistinct(values)
+	if len(index) == 0 {
+		return nil
+	}
+
+	results := make(distinctValues, 0, len(index))
+	for k := range index {
+		results = append(results, k)
+	}
+	sort.Sort(results)
+	return results
+}
+
+// indexCountDistinct indexes the distinct values from each mapper, or from partial states.
+func indexCountDistinct(values []interface{}) map[interface{}]struct{} {
 	var index = make(map[interface{}]struct{})
 
-	// index distinct values from each mapper
+	for _, v := range values {
+		switch d := v.(type) {
+		case nil:
+		case map[interface{}]struct{}:
+			for distinctCountValue, _ := range d {
+				index[distinctCountValue] = struct{}{}
+			}
+		case distinctValues:
+			for _, distinctCountValue := range d {
+				index[distinctCountValue] = struct{}{}
+			}
+		default:
+			msg := fmt.Sprintf("expected map[interface{}]struct{}, got: %T", v)
+			panic(msg)
+		}
+	}
+
+	return index
+}
+
+// MapApproxCountDistinct adds the values in an iterator to a HyperLogLog sketch.
+func MapApproxCountDistinct(itr Iterator) interface{} {
+	var h *hyperLogLog
+	for _, time, value := itr.Next(); time != 0; _, time, value = itr.Next() {
+		if h == nil {
+			h = newHyperLogLog()
+		}
+		h.add(hashValue(value))
+	}
+
+	if h == nil {
+		return nil
+	}
+	return h
+}
+
+// ReduceApproxCountDistinct merges the HyperLogLog sketches of the mappers and estimates the
+// number of distinct values they have seen.
+func ReduceApproxCountDistinct(values []interface{}) interface{} {
+	h, ok := combineApproxCountDistinct(values).(*hyperLogLog)
+	if !ok {
+		return 0
+	}
+	return h.count()
+}
+
+// combineApproxCountDistinct merges the HyperLogLog sketches of the mappers.
+func combineApproxCountDistinct(values []interface{}) interface{} {
+	var out *hyperLogLog
 	for _, v := range values {
 		if v == nil {
 			continue
 		}
-		d, ok := v.(map[interface{}]struct{})
+		h, ok := v.(*hyperLogLog)
 		if !ok {
-			msg := fmt.Sprintf("expected map[interface{}]struct{}, got: %T", v)
+			msg := fmt.Sprintf("expected *hyperLogLog, got: %T", v)
 			panic(msg)
 		}
-		for distinctCountValue, _ := range d {
-			index[distinctCountValue] = struct{}{}
+		if out == nil {
+			out = newHyperLogLog()
+		}
+		out.merge(h)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
+// hllPrecision is the number of hash bits that select a register of a HyperLogLog sketch. The
+// 2^14 registers take 16KB and give a standard error of 1.04/sqrt(2^14), about 0.8%.
+const hllPrecision = 14
+
+// hyperLogLog is a HyperLogLog sketch, which estimates the number of distinct values added to it
+// in constant memory. Each register holds the maximum rank, the position of the first set bit,
+// of the hashes that select it. Sketches are merged by taking the maximum of each register.
+type hyperLogLog struct {
+	Registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{Registers: make([]uint8, 1<<hllPrecision)}
+}
+
+// add adds the hash of a value to the sketch.
+func (h *hyperLogLog) add(x uint64) {
+	i := x >> (64 - hllPrecision)
+
+	// Determine the rank of the remaining bits.
+	w := x << hllPrecision
+	rank := uint8(1)
+	for rank <= 64-hllPrecision && w&(1<<63) == 0 {
+		rank++
+		w <<= 1
+	}
+
+	if rank > h.Registers[i] {
+		h.Registers[i] = rank
+	}
+}
+
+// merge merges another sketch into the sketch.
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, r := range other.Registers {
+		if i < len(h.Registers) && r > h.Registers[i] {
+			h.Registers[i] = r
+		}
+	}
+}
+
+// count returns the estimated number of distinct values added to the sketch. Small counts are
+// estimated from the number of empty registers, which is more accurate for them.
+func (h *hyperLogLog) count() int {
+	m := float64(len(h.Registers))
+
+	var sum float64
+	var zeros int
+	for _, r := range h.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
 		}
 	}
 
-	return len(index)
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int(estimate + 0.5)
+}
+
+// hashValue returns a 64-bit hash of a field value. Values of different types never hash the
+// same, so they're counted as distinct values as they are by count(distinct()).
+func hashValue(v interface{}) uint64 {
+	h := fnv.New64a()
+	var buf [9]byte
+	switch v := v.(type) {
+	case float64:
+		buf[0] = 1
+		binary.BigEndian.PutUint64(buf[1:], math.Float64bits(v))
+		h.Write(buf[:])
+	case int64:
+		buf[0] = 2
+		binary.BigEndian.PutUint64(buf[1:], uint64(v))
+		h.Write(buf[:])
+	case bool:
+		buf[0] = 3
+		if v {
+			buf[1] = 1
+		}
+		h.Write(buf[:2])
+	case string:
+		buf[0] = 4
+		h.Write(buf[:1])
+		h.Write([]byte(v))
+	default:
+		fmt.Fprintf(h, "%T:%v", v, v)
+	}
+
+	// Mix the bits so the high bits that select a register are evenly distributed.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
 }
 
 type NumberType int8
@@ -509,6 +1123,14 @@ type meanMapOutput struct {
 
 // ReduceMean computes the mean of values for each key.
 func ReduceMean(values []interface{}) interface{} {
+	if out, ok := combineMean(values).(*meanMapOutput); ok {
+		return out.Mean
+	}
+	return nil
+}
+
+// combineMean combines the counts and means of mappers into the count and mean of all their values.
+func combineMean(values []interface{}) interface{} {
 	out := &meanMapOutput{}
 	var countSum int
 	for _, v := range values {
@@ -519,9 +1141,12 @@ func ReduceMean(values []interface{}) interface{} {
 		countSum = out.Count + val.Count
 		out.Mean = val.Mean*(float64(val.Count)/float64(countSum)) + out.Mean*(float64(out.Count)/float64(countSum))
 		out.Count = countSum
+		if val.ResultType == Int64Type {
+			out.ResultType = Int64Type
+		}
 	}
 	if out.Count > 0 {
-		return out.Mean
+		return out
 	}
 	return nil
 }
@@ -717,36 +1342,7 @@ func MapMin(itr Iterator) interface{} {
 
 // ReduceMin computes the min of value.
 func ReduceMin(values []interface{}) interface{} {
-	min := &minMaxMapOut{}
-	pointsYielded := false
-
-	for _, value := range values {
-		if value == nil {
-			continue
-		}
-
-		v, ok := value.(*minMaxMapOut)
-		if !ok {
-			continue
-		}
-
-		// Initialize min
-		if !pointsYielded {
-			min.Val = v.Val
-			min.Type = v.Type
-			pointsYielded = true
-		}
-		min.Val = math.Min(min.Val, v.Val)
-	}
-	if pointsYielded {
-		switch min.Type {
-		case Float64Type:
-			return min.Val
-		case Int64Type:
-			return int64(min.Val)
-		}
-	}
-	return nil
+	return minMaxValue(combineMinMax(values, math.Min))
 }
 
 // MapMax collects the values to pass to the reducer
@@ -780,7 +1376,12 @@ func MapMax(itr Iterator) interface{} {
 
 // ReduceMax computes the max of value.
 func ReduceMax(values []interface{}) interface{} {
-	max := &minMaxMapOut{}
+	return minMaxValue(combineMinMax(values, math.Max))
+}
+
+// combineMinMax combines the min or max of mappers into the min or max of all their values.
+func combineMinMax(values []interface{}, fn func(x, y float64) float64) interface{} {
+	out := &minMaxMapOut{}
 	pointsYielded := false
 
 	for _, value := range values {
@@ -793,25 +1394,142 @@ func ReduceMax(values []interface{}) interface{} {
 			continue
 		}
 
-		// Initialize max
+		// Initialize the result
 		if !pointsYielded {
-			max.Val = v.Val
-			max.Type = v.Type
+			out.Val = v.Val
+			out.Type = v.Type
 			pointsYielded = true
 		}
-		max.Val = math.Max(max.Val, v.Val)
+		out.Val = fn(out.Val, v.Val)
 	}
 	if pointsYielded {
-		switch max.Type {
-		case Float64Type:
-			return max.Val
-		case Int64Type:
-			return int64(max.Val)
-		}
+		return out
+	}
+	return nil
+}
+
+// minMaxValue returns the value of a min or max with the type of the values it was computed from.
+func minMaxValue(v interface{}) interface{} {
+	out, ok := v.(*minMaxMapOut)
+	if !ok {
+		return nil
+	}
+	switch out.Type {
+	case Float64Type:
+		return out.Val
+	case Int64Type:
+		return int64(out.Val)
+	}
+	return nil
+}
+
+// Rollup is the summary of the values of a numeric field in a block of points of a series. Storage
+// formats can keep rollups of their blocks so that aggregates over intervals containing whole blocks
+// are computed without reading the points.
+type Rollup struct {
+	Start, End int64 // the times of the first and last points of the block, in nanoseconds
+	Count      int64 // the number of points of the block that have the field
+	Sum        float64
+	Min, Max   float64
+	Int64      bool // if true, the values of the field are integers
+}
+
+// rollupMapFuncs are the map functions of the aggregates that can be computed from rollups. Each
+// returns the same output as the aggregate's map function would over the points summarized by the
+// rollups.
+var rollupMapFuncs = map[string]func(rollups []Rollup) interface{}{
+	"count": mapRollupCount,
+	"sum":   mapRollupSum,
+	"mean":  mapRollupMean,
+	"min":   func(rollups []Rollup) interface{} { return mapRollupMinMax(rollups, true) },
+	"max":   func(rollups []Rollup) interface{} { return mapRollupMinMax(rollups, false) },
+}
+
+// mapRollupCount returns the output of MapCount over the points summarized by rollups.
+func mapRollupCount(rollups []Rollup) interface{} {
+	var n int64
+	for _, r := range rollups {
+		n += r.Count
+	}
+	if n > 0 {
+		return float64(n)
 	}
 	return nil
 }
 
+// mapRollupSum returns the output of MapSum over the points summarized by rollups.
+func mapRollupSum(rollups []Rollup) interface{} {
+	var count int64
+	var sum float64
+	var resultType NumberType
+	for _, r := range rollups {
+		if r.Count == 0 {
+			continue
+		}
+		count += r.Count
+		sum += r.Sum
+		if r.Int64 {
+			resultType = Int64Type
+		}
+	}
+	if count == 0 {
+		return nil
+	} else if resultType == Int64Type {
+		return int64(sum)
+	}
+	return sum
+}
+
+// mapRollupMean returns the output of MapMean over the points summarized by rollups.
+func mapRollupMean(rollups []Rollup) interface{} {
+	out := &meanMapOutput{}
+	var sum float64
+	for _, r := range rollups {
+		if r.Count == 0 {
+			continue
+		}
+		out.Count += int(r.Count)
+		sum += r.Sum
+		if r.Int64 {
+			out.ResultType = Int64Type
+		}
+	}
+	if out.Count == 0 {
+		return nil
+	}
+	out.Mean = sum / float64(out.Count)
+	return out
+}
+
+// mapRollupMinMax returns the output of MapMin, or MapMax if min is false, over the points
+// summarized by rollups.
+func mapRollupMinMax(rollups []Rollup, min bool) interface{} {
+	var out *minMaxMapOut
+	for _, r := range rollups {
+		if r.Count == 0 {
+			continue
+		}
+		val := r.Max
+		if min {
+			val = r.Min
+		}
+		if out == nil {
+			out = &minMaxMapOut{Val: val}
+		} else if min {
+			out.Val = math.Min(out.Val, val)
+		} else {
+			out.Val = math.Max(out.Val, val)
+		}
+		if r.Int64 {
+			out.Type = Int64Type
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return out
+}
+
 type spreadMapOutput struct {
 	Min, Max float64
 	Type     NumberType
@@ -849,6 +1567,21 @@ func MapSpread(itr Iterator) interface{} {
 
 // ReduceSpread computes the spread of values.
 func ReduceSpread(values []interface{}) interface{} {
+	result, ok := combineSpread(values).(*spreadMapOutput)
+	if !ok {
+		return nil
+	}
+	switch result.Type {
+	case Float64Type:
+		return result.Max - result.Min
+	case Int64Type:
+		return int64(result.Max - result.Min)
+	}
+	return nil
+}
+
+// combineSpread combines the min and max of mappers into the min and max of all their values.
+func combineSpread(values []interface{}) interface{} {
 	result := &spreadMapOutput{}
 	pointsYielded := false
 
@@ -868,12 +1601,7 @@ func ReduceSpread(values []interface{}) interface{} {
 		result.Min = math.Min(result.Min, val.Min)
 	}
 	if pointsYielded {
-		switch result.Type {
-		case Float64Type:
-			return result.Max - result.Min
-		case Int64Type:
-			return int64(result.Max - result.Min)
-		}
+		return result
 	}
 	return nil
 }
@@ -960,6 +1688,14 @@ func MapFirst(itr Iterator) interface{} {
 
 // ReduceFirst computes the first of value.
 func ReduceFirst(values []interface{}) interface{} {
+	if out, ok := combineFirstLast(values, false).(*firstLastMapOutput); ok {
+		return out.Val
+	}
+	return nil
+}
+
+// combineFirstLast combines the first or last values of mappers into the first or last of all of them.
+func combineFirstLast(values []interface{}, last bool) interface{} {
 	out := &firstLastMapOutput{}
 	pointsYielded := false
 
@@ -968,19 +1704,19 @@ func ReduceFirst(values []interface{}) interface{} {
 			continue
 		}
 		val := v.(*firstLastMapOutput)
-		// Initialize first
+		// Initialize the result
 		if !pointsYielded {
 			out.Time = val.Time
 			out.Val = val.Val
 			pointsYielded = true
 		}
-		if val.Time < out.Time {
+		if (!last && val.Time < out.Time) || (last && val.Time > out.Time) {
 			out.Time = val.Time
 			out.Val = val.Val
 		}
 	}
 	if pointsYielded {
-		return out.Val
+		return out
 	}
 	return nil
 }
@@ -1010,30 +1746,179 @@ func MapLast(itr Iterator) interface{} {
 
 // ReduceLast computes the last of value.
 func ReduceLast(values []interface{}) interface{} {
-	out := &firstLastMapOutput{}
-	pointsYielded := false
+	if out, ok := combineFirstLast(values, true).(*firstLastMapOutput); ok {
+		return out.Val
+	}
+	return nil
+}
 
-	for _, v := range values {
-		if v == nil {
-			continue
+// DefaultMaxConcatBytes is the default maximum total length of the strings concat() joins in an
+// interval. The values are buffered until the interval is reduced, so the limit bounds the memory
+// it uses. See Planner.MaxConcatBytes.
+const DefaultMaxConcatBytes = 1 << 20
+
+// DefaultConcatSeparator is the separator of concat() calls without one.
+const DefaultConcatSeparator = ","
+
+// ErrConcatTooLarge is returned when the strings concat() joins in an interval exceed its limit.
+func ErrConcatTooLarge(maxBytes int) error {
+	return fmt.Errorf("concat() exceeded %d bytes in an interval", maxBytes)
+}
+
+// concatAggregate is the concat() aggregate, which joins the string values of each interval in
+// time order with a separator, e.g. concat(message, '; '). Values that aren't strings are skipped.
+// The strings of an interval are limited to maxBytes, or DefaultMaxConcatBytes if it isn't set.
+type concatAggregate struct {
+	maxBytes int
+}
+
+func (a concatAggregate) MapFunc(c *Call) (MapFunc, error) {
+	if _, err := concatSeparator(c); err != nil {
+		return nil, err
+	}
+	return MapConcat(a.limit()), nil
+}
+
+func (a concatAggregate) NewReducer(c *Call) (Reducer, error) {
+	sep, err := concatSeparator(c)
+	if err != nil {
+		return nil, err
+	}
+	return &concatReducer{sep: sep, maxBytes: a.limit()}, nil
+}
+
+// limit returns the maximum total length of the strings of an interval.
+func (a concatAggregate) limit() int {
+	if a.maxBytes <= 0 {
+		return DefaultMaxConcatBytes
+	}
+	return a.maxBytes
+}
+
+// concatSeparator returns the separator of a concat() call, which is its optional second argument.
+func concatSeparator(c *Call) (string, error) {
+	switch len(c.Args) {
+	case 1:
+		return DefaultConcatSeparator, nil
+	case 2:
+		if lit, ok := c.Args[1].(*StringLiteral); ok {
+			return lit.Val, nil
 		}
+	}
+	return "", fmt.Errorf("expected string separator argument in concat()")
+}
 
-		val := v.(*firstLastMapOutput)
-		// Initialize last
-		if !pointsYielded {
-			out.Time = val.Time
-			out.Val = val.Val
-			pointsYielded = true
+// concatValue is a string value of a point.
+type concatValue struct {
+	Time int64
+	Val  string
+}
+
+// concatMapOutput is the output of the concat() map function: the string values of an interval
+// in time order, and their total length.
+type concatMapOutput struct {
+	Values   []concatValue
+	N        int  // the total length of the values
+	Overflow bool // true if the values exceeded the limit of concat(), in which case only some are kept
+}
+
+// MapConcat returns a map function collecting the string values of an interval to pass to the
+// reducer. It stops buffering them once they exceed maxBytes.
+func MapConcat(maxBytes int) MapFunc {
+	return func(itr Iterator) interface{} {
+		out := &concatMapOutput{}
+		for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
+			s, ok := v.(string)
+			if !ok || out.Overflow {
+				continue
+			}
+			out.Values = append(out.Values, concatValue{Time: k, Val: s})
+			out.N += len(s)
+			out.Overflow = out.N > maxBytes
 		}
-		if val.Time > out.Time {
-			out.Time = val.Time
-			out.Val = val.Val
+		if len(out.Values) == 0 {
+			return nil
 		}
+		return out
 	}
-	if pointsYielded {
-		return out.Val
+}
+
+// concatReducer joins the string values of the mappers of an interval in time order. Values of
+// the same time are joined in the order of their mappers. Once the values exceed maxBytes, the
+// rest are dropped and the reducer fails with ErrConcatTooLarge.
+type concatReducer struct {
+	sep      string
+	maxBytes int
+	values   []concatValue
+	n        int
+	err      error
+}
+
+func (r *concatReducer) Combine(partial interface{}) {
+	out, ok := partial.(*concatMapOutput)
+	if !ok || r.err != nil {
+		return
 	}
-	return nil
+	if r.n += out.N + len(r.sep)*len(out.Values); out.Overflow || r.n > r.maxBytes {
+		r.values, r.err = nil, ErrConcatTooLarge(r.maxBytes)
+		return
+	}
+	r.values = append(r.values, out.Values...)
+}
+
+func (r *concatReducer) Finalize() interface{} {
+	if len(r.values) == 0 {
+		return nil
+	}
+	sort.Stable(concatValues(r.values))
+
+	var buf bytes.Buffer
+	for i, v := range r.values {
+		if i > 0 {
+			buf.WriteString(r.sep)
+		}
+		buf.WriteString(v.Val)
+	}
+	return buf.String()
+}
+
+func (r *concatReducer) Err() error { return r.err }
+
+// concatValues sorts string values by time.
+type concatValues []concatValue
+
+func (a concatValues) Len() int           { return len(a) }
+func (a concatValues) Less(i, j int) bool { return a[i].Time < a[j].Time }
+func (a concatValues) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// combineFloats concatenates the values collected by mappers, e.g. for a median or stddev.
+func combineFloats(values []interface{}) interface{} {
+	var data []float64
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		data = append(data, value.([]float64)...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// combineEcho concatenates the values emitted by mappers, e.g. for a percentile.
+func combineEcho(values []interface{}) interface{} {
+	var data []interface{}
+	for _, value := range values {
+		if value == nil {
+			continue
+		}
+		data = append(data, value.([]interface{})...)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return data
 }
 
 // MapEcho emits the data points for each group by interval
@@ -1079,10 +1964,102 @@ func ReducePercentile(percentile float64) ReduceFunc {
 	}
 }
 
+// holtWintersParams are the smoothing parameters tried when fitting a Holt-Winters model.
+var holtWintersParams = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9}
+
+// HoltWinters fits an additive Holt-Winters (triple exponential smoothing) model to the
+// evenly-spaced values and returns the one-step-ahead fitted values followed by n forecasted
+// values. The season is the number of values in a season. A season of 0 or 1 fits a model
+// without seasonality. The smoothing parameters are chosen from holtWintersParams to minimize
+// the sum of squared errors of the fitted values.
+func HoltWinters(values []float64, n, season int) (fitted, forecast []float64, err error) {
+	seasonal := season > 1
+	if !seasonal {
+		season = 1
+	}
+	if seasonal && len(values) < 2*season {
+		return nil, nil, fmt.Errorf("holt_winters requires at least two seasons of data, got %d points for a season of %d", len(values), season)
+	} else if len(values) < 2 {
+		return nil, nil, fmt.Errorf("holt_winters requires at least two points, got %d", len(values))
+	}
+
+	gammas := holtWintersParams
+	if !seasonal {
+		gammas = []float64{0}
+	}
+
+	best := math.Inf(1)
+	for _, alpha := range holtWintersParams {
+		for _, beta := range holtWintersParams {
+			for _, gamma := range gammas {
+				f, fc, sse := holtWinters(values, n, season, seasonal, alpha, beta, gamma)
+				if sse < best {
+					best, fitted, forecast = sse, f, fc
+				}
+			}
+		}
+	}
+	return fitted, forecast, nil
+}
+
+// holtWinters runs the additive Holt-Winters model with the given smoothing parameters and
+// returns the fitted values, n forecasted values, and the sum of squared errors of the fit.
+func holtWinters(values []float64, n, season int, seasonal bool, alpha, beta, gamma float64) (fitted, forecast []float64, sse float64) {
+	// Initialize the level, trend, and seasonal components from the first seasons.
+	level := values[0]
+	var trend float64
+	seasonals := make([]float64, season)
+	if seasonal {
+		for i := 0; i < season; i++ {
+			trend += (values[i+season] - values[i]) / float64(season)
+		}
+		trend /= float64(season)
+
+		nSeasons := len(values) / season
+		for i := 0; i < season; i++ {
+			var sum float64
+			for j := 0; j < nSeasons; j++ {
+				var avg float64
+				for _, v := range values[j*season : (j+1)*season] {
+					avg += v
+				}
+				avg /= float64(season)
+				sum += values[j*season+i] - avg
+			}
+			seasonals[i] = sum / float64(nSeasons)
+		}
+	} else {
+		trend = values[1] - values[0]
+	}
+
+	fitted = make([]float64, len(values))
+	fitted[0] = values[0]
+	for i := 1; i < len(values); i++ {
+		v, s := values[i], i%season
+
+		// The fitted value is the forecast for this point made from the previous points.
+		fitted[i] = level + trend + seasonals[s]
+		sse += (v - fitted[i]) * (v - fitted[i])
+
+		prev := level
+		level = alpha*(v-seasonals[s]) + (1-alpha)*(level+trend)
+		trend = beta*(level-prev) + (1-beta)*trend
+		if seasonal {
+			seasonals[s] = gamma*(v-level) + (1-gamma)*seasonals[s]
+		}
+	}
+
+	forecast = make([]float64, n)
+	for i := range forecast {
+		forecast[i] = level + float64(i+1)*trend + seasonals[(len(values)+i)%season]
+	}
+	return fitted, forecast, sse
+}
+
 // IsNumeric returns whether a given aggregate can only be run on numeric fields.
 func IsNumeric(c *Call) bool {
 	switch c.Name {
-	case "count", "first", "last", "distinct":
+	case "count", "approx_count_distinct", "first", "last", "distinct", "concat":
 		return false
 	default:
 		return true
@@ -1092,16 +2069,19 @@ func IsNumeric(c *Call) bool {
 // MapRawQuery is for queries without aggregates
 func MapRawQuery(itr Iterator) interface{} {
 	var values []*rawQueryMapOutput
-	for _, k, v := itr.Next(); k != 0; _, k, v = itr.Next() {
-		val := &rawQueryMapOutput{k, v}
+	for key, k, v := itr.Next(); k != 0; key, k, v = itr.Next() {
+		val := &rawQueryMapOutput{Time: k, Values: v, seriesKey: key}
 		values = append(values, val)
 	}
 	return values
 }
 
 type rawQueryMapOutput struct {
-	Time   int64
-	Values interface{}
+	Time    int64
+	Values  interface{}
+	shardID uint64 // the shard the output was read from, if the job records shard IDs or resolves conflicts
+
+	seriesKey string // the key of the series the output was read from, if the mapper returns it
 }
 
 func (r *rawQueryMapOutput) String() string {
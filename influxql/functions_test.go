@@ -1,7 +1,10 @@
 package influxql
 
 import (
+	"encoding/json"
+	"math"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -510,6 +513,42 @@ func TestGetSortedRange(t *testing.T) {
 	}
 }
 
+func TestHoltWinters(t *testing.T) {
+	// A perfectly linear series should be forecast along the same line.
+	fitted, forecast, err := HoltWinters([]float64{1, 2, 3, 4, 5, 6, 7, 8}, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(fitted) != 8 {
+		t.Fatalf("unexpected fitted length: %d", len(fitted))
+	}
+	for i, exp := range []float64{9, 10, 11} {
+		if math.Abs(forecast[i]-exp) > 1e-9 {
+			t.Fatalf("unexpected forecast: %v", forecast)
+		}
+	}
+
+	// A repeating season should be forecast with the same pattern.
+	values := []float64{1, 5, 3, 1, 5, 3, 1, 5, 3, 1, 5, 3}
+	_, forecast, err = HoltWinters(values, 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, exp := range []float64{1, 5, 3, 1} {
+		if math.Abs(forecast[i]-exp) > 0.5 {
+			t.Fatalf("unexpected seasonal forecast: %v", forecast)
+		}
+	}
+}
+
+func TestHoltWinters_NotEnoughData(t *testing.T) {
+	if _, _, err := HoltWinters([]float64{1, 2, 3}, 1, 2); err == nil || err.Error() != "holt_winters requires at least two seasons of data, got 3 points for a season of 2" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := HoltWinters([]float64{1}, 1, 0); err == nil || err.Error() != "holt_winters requires at least two points, got 1" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
 var benchGetSortedRangeResults []float64
 
 func BenchmarkGetSortedRangeByPivot(b *testing.B) {
@@ -532,3 +571,344 @@ func BenchmarkGetSortedRangeBySort(b *testing.B) {
 	}
 	benchGetSortedRangeResults = results
 }
+
+func TestTransformValue(t *testing.T) {
+	for i, tt := range []struct {
+		name string
+		v    interface{}
+		exp  interface{}
+	}{
+		{name: "abs", v: float64(-1.5), exp: float64(1.5)},
+		{name: "abs", v: float64(2.25), exp: float64(2.25)},
+		{name: "abs", v: int64(-3), exp: int64(3)},
+		{name: "ceil", v: float64(-1.5), exp: float64(-1)},
+		{name: "ceil", v: float64(1.2), exp: float64(2)},
+		{name: "ceil", v: int64(-3), exp: int64(-3)},
+		{name: "floor", v: float64(-1.5), exp: float64(-2)},
+		{name: "floor", v: float64(1.8), exp: float64(1)},
+		{name: "round", v: float64(-1.5), exp: float64(-2)},
+		{name: "round", v: float64(-1.4), exp: float64(-1)},
+		{name: "round", v: float64(2.5), exp: float64(3)},
+		{name: "round", v: float64(2.49), exp: float64(2)},
+		{name: "round", v: int64(7), exp: int64(7)},
+		{name: "abs", v: nil, exp: nil},
+		{name: "round", v: math.NaN(), exp: nil},
+		{name: "floor", v: "foo", exp: nil},
+		{name: "sqrt", v: float64(2.25), exp: float64(1.5)},
+		{name: "sqrt", v: int64(9), exp: float64(3)},
+		{name: "sqrt", v: float64(-1), exp: nil},
+	} {
+		if v := transformValue(tt.name, tt.v); v != tt.exp {
+			t.Errorf("%d. %s(%v): exp=%v, got=%v", i, tt.name, tt.v, tt.exp, v)
+		}
+	}
+}
+
+func TestBinaryTransformValue(t *testing.T) {
+	for i, tt := range []struct {
+		name string
+		a, b interface{}
+		exp  interface{}
+	}{
+		{name: "pow", a: float64(1.5), b: float64(2), exp: float64(2.25)},
+		{name: "pow", a: int64(2), b: int64(3), exp: float64(8)},
+		{name: "pow", a: float64(-8), b: float64(0.5), exp: nil},
+		{name: "atan2", a: float64(1), b: int64(1), exp: math.Pi / 4},
+		{name: "atan2", a: nil, b: float64(1), exp: nil},
+		{name: "pow", a: float64(2), b: "foo", exp: nil},
+	} {
+		if v := binaryTransformValue(tt.name, tt.a, tt.b); v != tt.exp {
+			t.Errorf("%d. %s(%v, %v): exp=%v, got=%v", i, tt.name, tt.a, tt.b, tt.exp, v)
+		}
+	}
+}
+
+func TestArithmeticValue(t *testing.T) {
+	for i, tt := range []struct {
+		op   Token
+		a, b interface{}
+		exp  interface{}
+	}{
+		{op: ADD, a: int64(2), b: int64(3), exp: int64(5)},
+		{op: SUB, a: int64(2), b: int64(3), exp: int64(-1)},
+		{op: MUL, a: int64(2), b: float64(1.5), exp: float64(3)},
+		{op: DIV, a: int64(3), b: int64(2), exp: float64(1.5)},
+		{op: DIV, a: float64(1), b: float64(0), exp: nil},
+		{op: DIV, a: int64(1), b: int64(0), exp: nil},
+		{op: ADD, a: math.Inf(1), b: math.Inf(-1), exp: nil},
+		{op: ADD, a: float64(1), b: nil, exp: nil},
+		{op: MUL, a: true, b: float64(1), exp: nil},
+	} {
+		if v := arithmeticValue(tt.op, tt.a, tt.b); v != tt.exp {
+			t.Errorf("%d. %v %s %v: exp=%v, got=%v", i, tt.a, tt.op, tt.b, tt.exp, v)
+		}
+	}
+}
+
+// Ensure NaN and infinite values are aggregated unless they're skipped.
+func TestMapFuncs_NonFinite(t *testing.T) {
+	input := []point{{"0", 1, 1.0}, {"0", 2, math.NaN()}, {"0", 3, 3.0}, {"0", 4, math.Inf(1)}}
+
+	// value returns the float result of a map function.
+	value := func(v interface{}) float64 {
+		switch v := v.(type) {
+		case float64:
+			return v
+		case *meanMapOutput:
+			return v.Mean
+		case *minMaxMapOut:
+			return v.Val
+		}
+		t.Fatalf("unexpected map output: %#v", v)
+		return 0
+	}
+
+	for _, tt := range []struct {
+		name string
+		fn   MapFunc
+		exp  float64 // the result when non-finite values are skipped
+	}{
+		{name: "mean", fn: MapMean, exp: 2},
+		{name: "sum", fn: MapSum, exp: 4},
+		{name: "min", fn: MapMin, exp: 1},
+		{name: "max", fn: MapMax, exp: 3},
+	} {
+		// By default non-finite values are aggregated and poison the result.
+		if got := value(tt.fn(&testIterator{values: input})); !math.IsNaN(got) && !math.IsInf(got, 0) {
+			t.Errorf("%s: expected a non-finite result, got %v", tt.name, got)
+		}
+
+		var skippedN int
+		if got := value(FiniteMapFunc(tt.fn, &skippedN)(&testIterator{values: input})); got != tt.exp {
+			t.Errorf("%s: unexpected result: %v, exp %v", tt.name, got, tt.exp)
+		} else if skippedN != 2 {
+			t.Errorf("%s: unexpected skipped count: %d", tt.name, skippedN)
+		}
+	}
+}
+
+// Ensure combining the partial states of aggregates, including after encoding them, gives the
+// same result as reducing every mapper output at once.
+func TestInitializePartialReduceFunc(t *testing.T) {
+	// The points of three mappers. Their times interleave so first and last come from different mappers.
+	shards := [][]point{
+		{{"0", 4, 4.0}, {"0", 7, 2.0}, {"0", 9, 8.0}},
+		{{"0", 2, 1.0}, {"0", 5, 4.0}, {"0", 6, 10.0}},
+		{{"0", 1, 6.0}, {"0", 3, 1.0}, {"0", 8, 3.0}},
+	}
+
+	for _, s := range []string{
+		`count(value)`, `count(distinct(value))`, `approx_count_distinct(value)`, `distinct(value)`, `sum(value)`, `mean(value)`,
+		`median(value)`, `stddev(value)`, `min(value)`, `max(value)`, `spread(value)`,
+		`first(value)`, `last(value)`, `percentile(value, 90)`,
+	} {
+		expr, err := ParseExpr(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := expr.(*Call)
+		mapFunc, err := InitializeMapFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		reduceFunc, err := InitializeReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		partialFunc, err := InitializePartialReduceFunc(c)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+		unmarshal, err := InitializeUnmarshaller(c)
+		if err != nil {
+			t.Fatalf("%s: %s", s, err)
+		}
+
+		outputs := make([]interface{}, len(shards))
+		for i, points := range shards {
+			outputs[i] = mapFunc(&testIterator{values: append([]point(nil), points...)})
+		}
+		exp := reduceFunc(outputs)
+
+		// Combine the first two mappers and the last one separately, encode and decode both
+		// partials as a remote node would, then combine and finalize them.
+		partials := []interface{}{partialFunc(outputs[:2]), partialFunc(outputs[2:])}
+		for i, p := range partials {
+			buf, err := json.Marshal(p)
+			if err != nil {
+				t.Fatalf("%s: %s", s, err)
+			}
+			if partials[i], err = unmarshal(buf); err != nil {
+				t.Fatalf("%s: %s", s, err)
+			}
+		}
+		got := reduceFunc([]interface{}{partialFunc(partials)})
+
+		if e, ok := exp.(float64); ok {
+			if g, ok := got.(float64); !ok || math.Abs(g-e) > 1e-9 {
+				t.Errorf("%s: unexpected result: exp=%v, got=%v", s, exp, got)
+			}
+		} else if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: unexpected result: exp=%s, got=%s", s, spew.Sdump(exp), spew.Sdump(got))
+		}
+	}
+}
+
+// Ensure partial states aren't returned for aggregates that can't be combined.
+func TestInitializePartialReduceFunc_NotSupported(t *testing.T) {
+	expr, err := ParseExpr(`derivative(mean(value), 1s)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitializePartialReduceFunc(expr.(*Call)); err == nil || err.Error() != "partial aggregates aren't supported for derivative()" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure concat() joins the string values of its mappers in time order, skipping other values.
+func TestConcat(t *testing.T) {
+	mapConcat := MapConcat(DefaultMaxConcatBytes)
+	outputs := []interface{}{
+		mapConcat(&testIterator{values: []point{{"0", 1, "a"}, {"0", 4, "d"}, {"0", 5, 1.5}}}),
+		nil,
+		mapConcat(&testIterator{values: []point{{"0", 2, "b"}, {"0", 3, "c"}, {"0", 4, "e"}}}),
+		mapConcat(&testIterator{values: []point{{"0", 6, true}}}),
+	}
+	r, err := concatAggregate{}.NewReducer(&Call{Name: "concat", Args: []Expr{&VarRef{Val: "message"}, &StringLiteral{Val: "; "}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range outputs {
+		r.Combine(o)
+	}
+	if v := r.Finalize(); v != "a; b; c; d; e" {
+		t.Fatalf("unexpected value: %v", v)
+	} else if err := r.(FallibleReducer).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the default separator is used without one
+	r, _ = concatAggregate{}.NewReducer(&Call{Name: "concat", Args: []Expr{&VarRef{Val: "message"}}})
+	r.Combine(outputs[0])
+	if v := r.Finalize(); v != "a,d" {
+		t.Fatalf("unexpected value: %v", v)
+	}
+}
+
+// Ensure concat() stops buffering strings and fails once they exceed its limit.
+func TestConcat_TooLarge(t *testing.T) {
+	const maxBytes = 100
+	big := strings.Repeat("x", maxBytes/2)
+	call := &Call{Name: "concat", Args: []Expr{&VarRef{Val: "message"}}}
+	a := concatAggregate{maxBytes: maxBytes}
+	mapConcat, err := a.MapFunc(call)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a mapper past the limit stops buffering its values
+	o := mapConcat(&testIterator{values: []point{{"0", 1, big}, {"0", 2, big}, {"0", 3, big}, {"0", 4, big}}}).(*concatMapOutput)
+	if !o.Overflow || len(o.Values) != 3 {
+		t.Fatalf("unexpected map output: overflow=%v, values=%d", o.Overflow, len(o.Values))
+	}
+	r, _ := a.NewReducer(call)
+	r.Combine(o)
+	if _, err := finalize(r); err == nil || err.Error() != ErrConcatTooLarge(maxBytes).Error() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// mappers within the limit can exceed it together
+	r, _ = a.NewReducer(call)
+	r.Combine(mapConcat(&testIterator{values: []point{{"0", 1, big}}}))
+	r.Combine(mapConcat(&testIterator{values: []point{{"0", 2, big}}}))
+	if _, err := finalize(r); err == nil || err.Error() != ErrConcatTooLarge(maxBytes).Error() {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the limit defaults to DefaultMaxConcatBytes
+	r, _ = concatAggregate{}.NewReducer(call)
+	r.Combine(mapConcat(&testIterator{values: []point{{"0", 1, big}}}))
+	r.Combine(mapConcat(&testIterator{values: []point{{"0", 2, big}}}))
+	if v, err := finalize(r); err != nil {
+		t.Fatal(err)
+	} else if v != big+","+big {
+		t.Fatalf("unexpected value: %v", v)
+	}
+}
+
+// Ensure the map functions of aggregates computed from the rollups of blocks of points return the
+// same output as the map functions reading the points.
+func TestMapRollups(t *testing.T) {
+	for _, blocks := range [][][]interface{}{
+		{{1.5, -2.0, 3.25}, {10.0}, {0.5, 7.0, -4.75, 2.0}},
+		{{int64(3), int64(-8)}, {int64(12), int64(5), int64(1)}},
+		{{int64(3), 1.5}, {-2.5}},
+		{},
+	} {
+		var points []point
+		var rollups []Rollup
+		for _, values := range blocks {
+			r := Rollup{Start: int64(len(points) + 1)}
+			for i, v := range values {
+				var f float64
+				switch v := v.(type) {
+				case float64:
+					f = v
+				case int64:
+					f, r.Int64 = float64(v), true
+				}
+				if i == 0 || f < r.Min {
+					r.Min = f
+				}
+				if i == 0 || f > r.Max {
+					r.Max = f
+				}
+				r.Sum += f
+				r.Count++
+				points = append(points, point{"0", int64(len(points) + 1), v})
+			}
+			r.End = int64(len(points))
+			rollups = append(rollups, r)
+		}
+
+		for name, fn := range map[string]MapFunc{"count": MapCount, "sum": MapSum, "mean": MapMean, "min": MapMin, "max": MapMax} {
+			exp, got := fn(&testIterator{values: points}), rollupMapFuncs[name](rollups)
+			if e, ok := exp.(*meanMapOutput); ok {
+				if g, ok := got.(*meanMapOutput); !ok || g.Count != e.Count || g.ResultType != e.ResultType || math.Abs(g.Mean-e.Mean) > 1e-9 {
+					t.Fatalf("%s of %v: exp=%v, got=%v", name, blocks, e, got)
+				}
+			} else if !reflect.DeepEqual(exp, got) {
+				t.Fatalf("%s of %v: exp=%v, got=%v", name, blocks, exp, got)
+			}
+		}
+	}
+}
+
+// Ensure the approximate distinct count of values across mappers is within the error bound.
+func TestReduceApproxCountDistinct(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		// Three mappers whose values overlap, plus values of other types that must be counted separately.
+		outputs := make([]interface{}, 3)
+		for i := range outputs {
+			var points []point
+			for j := i * n / 4; j < i*n/4+n/2; j++ {
+				points = append(points, point{"0", int64(j + 1), float64(j)})
+			}
+			outputs[i] = MapApproxCountDistinct(&testIterator{values: points})
+		}
+		outputs = append(outputs, MapApproxCountDistinct(&testIterator{values: []point{{"0", 1, "a"}, {"0", 2, int64(0)}, {"0", 3, true}}}))
+		exp := n + 3
+		if n == 1 {
+			exp = 3 // the mappers of a single value are empty
+		}
+
+		got := ReduceApproxCountDistinct(outputs).(int)
+		if diff := math.Abs(float64(got-exp)) / float64(exp); diff > 0.03 {
+			t.Errorf("%d: unexpected count: exp=%d, got=%d", n, exp, got)
+		}
+	}
+
+	if got := ReduceApproxCountDistinct([]interface{}{nil}); got != 0 {
+		t.Fatalf("unexpected count: %v", got)
+	}
+}
@@ -637,6 +637,20 @@ func (p *Parser) parseSelectStatement(tr targetRequirement) (*SelectStatement, e
 	stmt := &SelectStatement{}
 	var err error
 
+	// Parse hints: "/*+ HINT* */". Other comments after SELECT are ignored. The next token is
+	// only scanned if it's a comment, since a field may be a regex, which is scanned differently.
+	if isWhitespace(p.peekRune()) {
+		p.consumeWhitespace()
+	}
+	if p.peekComment() {
+		_, pos, lit := p.scan()
+		if strings.HasPrefix(strings.TrimSpace(lit), "+") {
+			if stmt.Hints, err = ParseHints(lit); err != nil {
+				return nil, &ParseError{Message: err.Error(), Pos: pos}
+			}
+		}
+	}
+
 	// Parse fields: "FIELD+".
 	if stmt.Fields, err = p.parseFields(); err != nil {
 		return nil, err
@@ -655,6 +669,11 @@ func (p *Parser) parseSelectStatement(tr targetRequirement) (*SelectStatement, e
 		return nil, err
 	}
 
+	// Parse joined sources: "[INNER] JOIN SOURCE".
+	if err = p.parseJoin(stmt); err != nil {
+		return nil, err
+	}
+
 	// Parse condition: "WHERE EXPR".
 	if stmt.Condition, err = p.parseCondition(); err != nil {
 		return nil, err
@@ -698,7 +717,7 @@ func (p *Parser) parseSelectStatement(tr targetRequirement) (*SelectStatement, e
 	// Set if the query is a raw data query or one with an aggregate
 	stmt.IsRawQuery = true
 	WalkFunc(stmt.Fields, func(n Node) {
-		if _, ok := n.(*Call); ok {
+		if c, ok := n.(*Call); ok && !IsTransformCall(c) {
 			stmt.IsRawQuery = false
 		}
 	})
@@ -1370,22 +1389,34 @@ func (p *Parser) parseDropContinuousQueryStatement() (*DropContinuousQueryStatem
 func (p *Parser) parseFields() (Fields, error) {
 	var fields Fields
 
-	// Check for "*" (i.e., "all fields")
-	if tok, _, _ := p.scanIgnoreWhitespace(); tok == MUL {
-		fields = append(fields, &Field{&Wildcard{}, ""})
-		return fields, nil
-	}
-	p.unscan()
-
 	for {
-		// Parse the field.
-		f, err := p.parseField()
+		// Parse a regex matching the names of fields, e.g. /bytes_.*/, which is expanded like a
+		// wildcard. It's checked first, as a regex can't be scanned after a token is unscanned.
+		re, err := p.parseRegex()
 		if err != nil {
 			return nil, err
-		}
+		} else if re != nil {
+			fields = append(fields, &Field{Expr: re})
+			p.consumeWhitespace()
+		} else {
+			// Check for "*" (i.e., "all fields")
+			if len(fields) == 0 {
+				if tok, _, _ := p.scanIgnoreWhitespace(); tok == MUL {
+					fields = append(fields, &Field{&Wildcard{}, ""})
+					return fields, nil
+				}
+				p.unscan()
+			}
 
-		// Add new field.
-		fields = append(fields, f)
+			// Parse the field.
+			f, err := p.parseField()
+			if err != nil {
+				return nil, err
+			}
+
+			// Add new field.
+			fields = append(fields, f)
+		}
 
 		// If there's not a comma next then stop parsing fields.
 		if tok, _, _ := p.scan(); tok != COMMA {
@@ -1456,6 +1487,34 @@ func (p *Parser) parseSources() (Sources, error) {
 	return sources, nil
 }
 
+// parseJoin parses any "[INNER] JOIN SOURCE" clauses following the first source of a
+// select statement and appends the joined sources to the statement's sources.
+func (p *Parser) parseJoin(stmt *SelectStatement) error {
+	for {
+		tok, pos, lit := p.scanIgnoreWhitespace()
+		if tok == INNER {
+			if tok, pos, lit = p.scanIgnoreWhitespace(); tok != JOIN {
+				return newParseError(tokstr(tok, lit), []string{"JOIN"}, pos)
+			}
+		} else if tok != JOIN {
+			p.unscan()
+			return nil
+		}
+
+		// Joins combine rows by measurement so they can't be mixed with a list of sources.
+		if stmt.Join == NoJoin && len(stmt.Sources) > 1 {
+			return &ParseError{Message: "JOIN cannot be used with multiple sources", Pos: pos}
+		}
+
+		src, err := p.parseSource()
+		if err != nil {
+			return err
+		}
+		stmt.Sources = append(stmt.Sources, src)
+		stmt.Join = InnerJoin
+	}
+}
+
 // peekRune returns the next rune that would be read by the scanner.
 func (p *Parser) peekRune() rune {
 	r, _, _ := p.s.s.r.ReadRune()
@@ -1466,6 +1525,11 @@ func (p *Parser) peekRune() rune {
 	return r
 }
 
+// peekComment returns true if the next runes that would be read by the scanner start a comment.
+func (p *Parser) peekComment() bool {
+	return p.s.s.peekComment()
+}
+
 func (p *Parser) parseSource() (Source, error) {
 	m := &Measurement{}
 
@@ -1706,13 +1770,28 @@ func (p *Parser) parseSortFields() (SortFields, error) {
 func (p *Parser) parseSortField() (*SortField, error) {
 	field := &SortField{}
 
-	// Next token must be ASC, until other sort orders are supported.
-	tok, _, _ := p.scanIgnoreWhitespace()
-	if tok != ASC {
-		return nil, errors.New("only ORDER BY ASC supported at this time")
+	// Results can only be sorted by time, until sorting by other fields is supported.
+	tok, _, lit := p.scanIgnoreWhitespace()
+	if tok == IDENT {
+		if strings.ToLower(lit) != "time" {
+			return nil, errors.New("only ORDER BY time supported at this time")
+		}
+		field.Name = "time"
+		tok, _, _ = p.scanIgnoreWhitespace()
 	}
 
-	field.Ascending = true
+	// The sort order is optional after the field name and defaults to ascending.
+	switch tok {
+	case ASC:
+		field.Ascending = true
+	case DESC:
+	default:
+		if field.Name == "" {
+			return nil, errors.New("only ORDER BY time ASC or DESC supported at this time")
+		}
+		p.unscan()
+		field.Ascending = true
+	}
 	return field, nil
 }
 
@@ -74,6 +74,37 @@ func TestParser_ParseStatement(t *testing.T) {
 			},
 		},
 
+		// SELECT statement with hints
+		{
+			s: `SELECT /* +no_field_pruning, +NO_PREFETCH */ value FROM cpu`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*influxql.Field{{Expr: &influxql.VarRef{Val: "value"}}},
+				Sources:    []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+				Hints:      influxql.Hints{NoFieldPruning: true, NoPrefetch: true},
+			},
+		},
+
+		// SELECT statement with the alias of a hint
+		{
+			s: `SELECT /*+ no_count_fastpath */ count(value) FROM cpu`,
+			stmt: &influxql.SelectStatement{
+				Fields:  []*influxql.Field{{Expr: &influxql.Call{Name: "count", Args: []influxql.Expr{&influxql.VarRef{Val: "value"}}}}},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+				Hints:   influxql.Hints{NoRollups: true},
+			},
+		},
+
+		// SELECT statement with a comment that isn't a hint
+		{
+			s: `SELECT /* not a hint */ value FROM cpu`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*influxql.Field{{Expr: &influxql.VarRef{Val: "value"}}},
+				Sources:    []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+			},
+		},
+
 		// SELECT statement
 		{
 			skip: true,
@@ -162,6 +193,26 @@ func TestParser_ParseStatement(t *testing.T) {
 			},
 		},
 
+		// SELECT statement sorted by descending time
+		{
+			s: `SELECT field1 FROM myseries ORDER BY time DESC`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*influxql.Field{{Expr: &influxql.VarRef{Val: "field1"}}},
+				Sources:    []influxql.Source{&influxql.Measurement{Name: "myseries"}},
+				SortFields: []*influxql.SortField{{Name: "time"}},
+			},
+		},
+		{
+			s: `SELECT field1 FROM myseries ORDER BY DESC`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: true,
+				Fields:     []*influxql.Field{{Expr: &influxql.VarRef{Val: "field1"}}},
+				Sources:    []influxql.Source{&influxql.Measurement{Name: "myseries"}},
+				SortFields: []*influxql.SortField{{}},
+			},
+		},
+
 		// SELECT statement with multiple ORDER BY fields
 		{
 			skip: true,
@@ -379,6 +430,72 @@ func TestParser_ParseStatement(t *testing.T) {
 			},
 		},
 
+		// SELECT statement with scalar functions
+		{
+			s: `SELECT abs(value), round(value) FROM cpu`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: true,
+				Fields: []*influxql.Field{
+					{Expr: &influxql.Call{Name: "abs", Args: []influxql.Expr{&influxql.VarRef{Val: "value"}}}},
+					{Expr: &influxql.Call{Name: "round", Args: []influxql.Expr{&influxql.VarRef{Val: "value"}}}},
+				},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+			},
+		},
+
+		// SELECT statement with field regexes
+		{
+			s: `SELECT /bytes_.*/, packets, /^err/ FROM net`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: true,
+				Fields: []*influxql.Field{
+					{Expr: &influxql.RegexLiteral{Val: regexp.MustCompile(`bytes_.*`)}},
+					{Expr: &influxql.VarRef{Val: "packets"}},
+					{Expr: &influxql.RegexLiteral{Val: regexp.MustCompile(`^err`)}},
+				},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "net"}},
+			},
+		},
+
+		// SELECT statement with arithmetic and scalar functions of two fields
+		{
+			s: `SELECT value_a / value_b, pow(value_a, 2) FROM cpu`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: true,
+				Fields: []*influxql.Field{
+					{Expr: &influxql.BinaryExpr{Op: influxql.DIV, LHS: &influxql.VarRef{Val: "value_a"}, RHS: &influxql.VarRef{Val: "value_b"}}},
+					{Expr: &influxql.Call{Name: "pow", Args: []influxql.Expr{&influxql.VarRef{Val: "value_a"}, &influxql.NumberLiteral{Val: 2}}}},
+				},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "cpu"}},
+			},
+		},
+
+		// SELECT * FROM cpu JOIN mem
+		{
+			s: `SELECT mean(value) FROM cpu INNER JOIN mem WHERE time > now() - 1h GROUP BY time(5m), host`,
+			stmt: &influxql.SelectStatement{
+				IsRawQuery: false,
+				Fields: []*influxql.Field{
+					{Expr: &influxql.Call{Name: "mean", Args: []influxql.Expr{&influxql.VarRef{Val: "value"}}}},
+				},
+				Sources: []influxql.Source{&influxql.Measurement{Name: "cpu"}, &influxql.Measurement{Name: "mem"}},
+				Join:    influxql.InnerJoin,
+				Condition: &influxql.BinaryExpr{
+					Op:  influxql.GT,
+					LHS: &influxql.VarRef{Val: "time"},
+					RHS: &influxql.BinaryExpr{
+						Op:  influxql.SUB,
+						LHS: &influxql.Call{Name: "now"},
+						RHS: &influxql.DurationLiteral{Val: time.Hour},
+					},
+				},
+				Dimensions: []*influxql.Dimension{
+					{Expr: &influxql.Call{Name: "time", Args: []influxql.Expr{&influxql.DurationLiteral{Val: 5 * time.Minute}}}},
+					{Expr: &influxql.VarRef{Val: "host"}},
+				},
+			},
+		},
+
 		// SELECT * FROM "db"."rp"./<regex>/
 		{
 			s: `SELECT * FROM "db"."rp"./cpu.*/`,
@@ -1194,6 +1311,8 @@ func TestParser_ParseStatement(t *testing.T) {
 		{s: `SELECT`, err: `found EOF, expected identifier, string, number, bool at line 1, char 8`},
 		{s: `blah blah`, err: `found blah, expected SELECT, DELETE, SHOW, CREATE, DROP, GRANT, REVOKE, ALTER, SET at line 1, char 1`},
 		{s: `SELECT field1 X`, err: `found X, expected FROM at line 1, char 15`},
+		{s: `SELECT /*+ no_such_hint */ field1 FROM myseries`, err: `unknown query hint: no_such_hint at line 1, char 8`},
+		{s: `SELECT field1 /*+ no_prefetch */ FROM myseries`, err: `found /*+ no_prefetch */, expected FROM at line 1, char 15`},
 		{s: `SELECT field1 FROM "series" WHERE X +;`, err: `found ;, expected identifier, string, number, bool at line 1, char 38`},
 		{s: `SELECT field1 FROM myseries GROUP`, err: `found EOF, expected BY at line 1, char 35`},
 		{s: `SELECT field1 FROM myseries LIMIT`, err: `found EOF, expected number at line 1, char 35`},
@@ -1201,12 +1320,15 @@ func TestParser_ParseStatement(t *testing.T) {
 		{s: `SELECT field1 FROM myseries OFFSET`, err: `found EOF, expected number at line 1, char 36`},
 		{s: `SELECT field1 FROM myseries OFFSET 10.5`, err: `fractional parts not allowed in OFFSET at line 1, char 36`},
 		{s: `SELECT field1 FROM myseries ORDER`, err: `found EOF, expected BY at line 1, char 35`},
-		{s: `SELECT field1 FROM myseries ORDER BY /`, err: `only ORDER BY ASC supported at this time`},
-		{s: `SELECT field1 FROM myseries ORDER BY 1`, err: `only ORDER BY ASC supported at this time`},
-		{s: `SELECT field1 FROM myseries ORDER BY DESC`, err: `only ORDER BY ASC supported at this time`},
+		{s: `SELECT field1 FROM myseries ORDER BY /`, err: `only ORDER BY time ASC or DESC supported at this time`},
+		{s: `SELECT field1 FROM myseries ORDER BY 1`, err: `only ORDER BY time ASC or DESC supported at this time`},
+		{s: `SELECT field1 FROM myseries ORDER BY field1 DESC`, err: `only ORDER BY time supported at this time`},
+		{s: `SELECT derivative(field1) FROM myseries ORDER BY time DESC`, err: `derivative does not support ORDER BY time DESC`},
 		{s: `SELECT field1 AS`, err: `found EOF, expected identifier at line 1, char 18`},
 		{s: `SELECT field1 FROM foo group by time(1s)`, err: `GROUP BY requires at least one aggregate function`},
 		{s: `SELECT count(value) FROM foo group by time(1s)`, err: `aggregate functions with GROUP BY time require a WHERE time clause`},
+		{s: `SELECT field1 FROM foo group by time(auto)`, err: `GROUP BY requires at least one aggregate function`},
+		{s: `SELECT count(value) FROM foo group by time(auto)`, err: `aggregate functions with GROUP BY time require a WHERE time clause`},
 		{s: `SELECT count(value) FROM foo group by time(1s) where host = 'hosta.influxdb.org'`, err: `aggregate functions with GROUP BY time require a WHERE time clause`},
 		{s: `SELECT field1 FROM 12`, err: `found 12, expected identifier at line 1, char 20`},
 		{s: `SELECT 1000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000000 FROM myseries`, err: `unable to parse number at line 1, char 8`},
@@ -1224,6 +1346,29 @@ func TestParser_ParseStatement(t *testing.T) {
 		{s: `select count() from myseries`, err: `invalid number of arguments for count, expected 1, got 0`},
 		{s: `select derivative() from myseries`, err: `invalid number of arguments for derivative, expected at least 1 but no more than 2, got 0`},
 		{s: `select derivative(mean(value), 1h, 3) from myseries`, err: `invalid number of arguments for derivative, expected at least 1 but no more than 2, got 3`},
+		{s: `SELECT abs() FROM cpu`, err: `invalid number of arguments for abs, expected 1, got 0`},
+		{s: `SELECT abs(1) FROM cpu`, err: `abs requires a field argument`},
+		{s: `SELECT round(mean(value)) FROM cpu`, err: `round cannot be used with aggregate functions`},
+		{s: `SELECT floor(value), mean(value) FROM cpu`, err: `floor cannot be used with aggregate functions`},
+		{s: `SELECT pow(value) FROM cpu`, err: `invalid number of arguments for pow, expected 2, got 1`},
+		{s: `SELECT sqrt(pow(value)) FROM cpu`, err: `invalid number of arguments for pow, expected 2, got 1`},
+		{s: `SELECT concat(message, ',', ';') FROM logs`, err: `invalid number of arguments for concat, expected at least 1 but no more than 2, got 3`},
+		{s: `SELECT concat(message, 1) FROM logs`, err: `expected string separator argument in concat()`},
+		{s: `SELECT atan2(1, 2) FROM cpu`, err: `atan2 requires a field argument`},
+		{s: `SELECT sqrt(mean(value)) FROM cpu`, err: `sqrt cannot be used with aggregate functions`},
+		{s: `SELECT value > 1 FROM cpu`, err: `invalid operator > in field value > 1.000, expected +, -, * or /`},
+		{s: `SELECT value FROM cpu INNER mem`, err: `found mem, expected JOIN at line 1, char 29`},
+		{s: `SELECT value FROM cpu, mem JOIN disk`, err: `JOIN cannot be used with multiple sources at line 1, char 28`},
+		{s: `SELECT value FROM cpu JOIN`, err: `found EOF, expected identifier at line 1, char 28`},
+		{s: `select holt_winters(mean(value), 10) from myseries`, err: `invalid number of arguments for holt_winters, expected 3, got 2`},
+		{s: `select holt_winters(mean(value), 10, 4), max(value) from myseries`, err: `holt_winters cannot be used with other fields`},
+		{s: `select holt_winters(value, 10, 4) from myseries where time > now() - 1d group by time(1h)`, err: `holt_winters requires an aggregate function argument`},
+		{s: `select holt_winters(mean(value), 1.5, 4) from myseries where time > now() - 1d group by time(1h)`, err: `holt_winters number of points must be a non-negative integer`},
+		{s: `select holt_winters(mean(value), 10, 'a') from myseries where time > now() - 1d group by time(1h)`, err: `holt_winters season length must be a non-negative integer`},
+		{s: `select holt_winters(mean(value), 10, 4) from myseries`, err: `holt_winters requires a GROUP BY time interval`},
+		{s: `select difference(value, 1) from myseries`, err: `invalid number of arguments for difference, expected 1, got 2`},
+		{s: `select difference(value), max(value) from myseries`, err: `difference cannot be used with other fields`},
+		{s: `select difference(value) from myseries where time > now() - 1d group by time(1h)`, err: `difference requires an aggregate function argument with GROUP BY time`},
 		{s: `DELETE`, err: `found EOF, expected FROM at line 1, char 8`},
 		{s: `DELETE FROM`, err: `found EOF, expected identifier at line 1, char 13`},
 		{s: `DELETE FROM myseries WHERE`, err: `found EOF, expected identifier, string, number, bool at line 1, char 28`},
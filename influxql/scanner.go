@@ -59,6 +59,10 @@ func (s *Scanner) Scan() (tok Token, pos Pos, lit string) {
 	case '*':
 		return MUL, pos, ""
 	case '/':
+		if ch1, _ := s.r.read(); ch1 == '*' {
+			return s.scanComment(pos)
+		}
+		s.r.unread()
 		return DIV, pos, ""
 	case '=':
 		if ch1, _ := s.r.read(); ch1 == '~' {
@@ -124,6 +128,34 @@ func (s *Scanner) scanWhitespace() (tok Token, pos Pos, lit string) {
 	return WS, pos, buf.String()
 }
 
+// scanComment consumes a block comment up to and including its closing "*/". The literal is the
+// text between the delimiters. An unterminated comment is returned as ILLEGAL.
+func (s *Scanner) scanComment(pos Pos) (Token, Pos, string) {
+	var buf bytes.Buffer
+	for {
+		ch, _ := s.r.read()
+		if ch == eof {
+			return ILLEGAL, pos, "/*" + buf.String()
+		} else if ch == '*' {
+			if ch1, _ := s.r.read(); ch1 == '/' {
+				return COMMENT, pos, buf.String()
+			}
+			s.r.unread()
+		}
+		_, _ = buf.WriteRune(ch)
+	}
+}
+
+// peekComment returns true if the next runes to be scanned start a block comment. The runes
+// are unread so the next scan still returns the comment.
+func (s *Scanner) peekComment() bool {
+	ch0, _ := s.r.read()
+	ch1, _ := s.r.read()
+	s.r.unread()
+	s.r.unread()
+	return ch0 == '/' && ch1 == '*'
+}
+
 func (s *Scanner) scanIdent() (tok Token, pos Pos, lit string) {
 	// Save the starting position of the identifier.
 	_, pos = s.r.read()
@@ -35,6 +35,11 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `*`, tok: influxql.MUL},
 		{s: `/`, tok: influxql.DIV},
 
+		// Comments
+		{s: `/*+ no_prefetch */`, tok: influxql.COMMENT, lit: `+ no_prefetch `},
+		{s: `/* a * b */`, tok: influxql.COMMENT, lit: ` a * b `},
+		{s: `/* foo`, tok: influxql.ILLEGAL, lit: `/* foo`},
+
 		// Logical operators
 		{s: `AND`, tok: influxql.AND},
 		{s: `and`, tok: influxql.AND},
@@ -132,6 +137,7 @@ func TestScanner_Scan(t *testing.T) {
 		{s: `INNER`, tok: influxql.INNER},
 		{s: `INSERT`, tok: influxql.INSERT},
 		{s: `INTO`, tok: influxql.INTO},
+		{s: `JOIN`, tok: influxql.JOIN},
 		{s: `KEY`, tok: influxql.KEY},
 		{s: `KEYS`, tok: influxql.KEYS},
 		{s: `LIMIT`, tok: influxql.LIMIT},
@@ -12,6 +12,7 @@ const (
 	ILLEGAL Token = iota
 	EOF
 	WS
+	COMMENT
 
 	literal_beg
 	// Literals
@@ -86,6 +87,7 @@ const (
 	INNER
 	INSERT
 	INTO
+	JOIN
 	KEY
 	KEYS
 	LIMIT
@@ -128,6 +130,7 @@ var tokens = [...]string{
 	ILLEGAL: "ILLEGAL",
 	EOF:     "EOF",
 	WS:      "WS",
+	COMMENT: "COMMENT",
 
 	IDENT:        "IDENT",
 	NUMBER:       "NUMBER",
@@ -193,6 +196,7 @@ var tokens = [...]string{
 	INNER:        "INNER",
 	INSERT:       "INSERT",
 	INTO:         "INTO",
+	JOIN:         "JOIN",
 	KEY:          "KEY",
 	KEYS:         "KEYS",
 	LIMIT:        "LIMIT",
@@ -274,7 +278,9 @@ func (tok Token) isOperator() bool { return tok > operator_beg && tok < operator
 
 // tokstr returns a literal if provided, otherwise returns the token string.
 func tokstr(tok Token, lit string) string {
-	if lit != "" {
+	if tok == COMMENT {
+		return "/*" + lit + "*/"
+	} else if lit != "" {
 		return lit
 	}
 	return tok.String()
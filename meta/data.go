@@ -874,6 +874,10 @@ func (sgi *ShardGroupInfo) unmarshal(pb *internal.ShardGroupInfo) {
 type ShardInfo struct {
 	ID       uint64
 	OwnerIDs []uint64
+
+	// Format is the version of the on-disk format the shard's points are stored in.
+	// Zero is the original format.
+	Format uint32
 }
 
 // clone returns a deep copy of si.
@@ -893,6 +897,9 @@ func (si ShardInfo) marshal() *internal.ShardInfo {
 	pb := &internal.ShardInfo{
 		ID: proto.Uint64(si.ID),
 	}
+	if si.Format != 0 {
+		pb.Format = proto.Uint32(si.Format)
+	}
 
 	pb.OwnerIDs = make([]uint64, len(si.OwnerIDs))
 	copy(pb.OwnerIDs, si.OwnerIDs)
@@ -905,6 +912,7 @@ func (si *ShardInfo) unmarshal(pb *internal.ShardInfo) {
 	si.ID = pb.GetID()
 	si.OwnerIDs = make([]uint64, len(pb.GetOwnerIDs()))
 	copy(si.OwnerIDs, pb.GetOwnerIDs())
+	si.Format = pb.GetFormat()
 }
 
 // ContinuousQueryInfo represents metadata about a continuous query.
@@ -639,6 +639,7 @@ func TestData_MarshalBinary(t *testing.T) {
 									{
 										ID:       200,
 										OwnerIDs: []uint64{1, 3, 4},
+										Format:   1,
 									},
 								},
 							},
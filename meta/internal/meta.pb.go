@@ -368,6 +368,7 @@ func (m *ShardGroupInfo) GetShards() []*ShardInfo {
 type ShardInfo struct {
 	ID               *uint64  `protobuf:"varint,1,req" json:"ID,omitempty"`
 	OwnerIDs         []uint64 `protobuf:"varint,2,rep" json:"OwnerIDs,omitempty"`
+	Format           *uint32  `protobuf:"varint,3,opt" json:"Format,omitempty"`
 	XXX_unrecognized []byte   `json:"-"`
 }
 
@@ -389,6 +390,13 @@ func (m *ShardInfo) GetOwnerIDs() []uint64 {
 	return nil
 }
 
+func (m *ShardInfo) GetFormat() uint32 {
+	if m != nil && m.Format != nil {
+		return *m.Format
+	}
+	return 0
+}
+
 type ContinuousQueryInfo struct {
 	Name             *string `protobuf:"bytes,1,req" json:"Name,omitempty"`
 	Query            *string `protobuf:"bytes,2,req" json:"Query,omitempty"`
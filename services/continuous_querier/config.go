@@ -47,6 +47,12 @@ type Config struct {
 	// If you have a group by time(5m) then you'll get five computes per interval. Any group by time window larger
 	// than 10m will get computed 10 times for each interval.
 	ComputeNoMoreThan toml.Duration `toml:"compute-no-more-than"`
+
+	// CatchUpNoOlderThan sets how far back the service computes the intervals it missed, e.g. while it
+	// wasn't running or wasn't the leader. Missed intervals are computed oldest first before the current
+	// one. The service only knows which intervals it computed since it started, so after a restart every
+	// interval within this window is computed again. Set to zero to never catch up.
+	CatchUpNoOlderThan toml.Duration `toml:"catch-up-no-older-than"`
 }
 
 // NewConfig returns a new instance of Config with defaults.
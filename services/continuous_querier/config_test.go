@@ -16,6 +16,7 @@ recompute-previous-n = 1
 recompute-no-older-than = "10s"
 compute-runs-per-interval = 2
 compute-no-more-than = "20s"
+catch-up-no-older-than = "1h"
 enabled = true
 `, &c); err != nil {
 		t.Fatal(err)
@@ -30,6 +31,8 @@ enabled = true
 		t.Fatalf("unexpected compute runs per interval: %d", c.ComputeRunsPerInterval)
 	} else if time.Duration(c.ComputeNoMoreThan) != 20*time.Second {
 		t.Fatalf("unexpected compute no more than: %v", c.ComputeNoMoreThan)
+	} else if time.Duration(c.CatchUpNoOlderThan) != time.Hour {
+		t.Fatalf("unexpected catch up no older than: %v", c.CatchUpNoOlderThan)
 	} else if c.Enabled != true {
 		t.Fatalf("unexpected enabled: %v", c.Enabled)
 	}
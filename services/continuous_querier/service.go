@@ -55,8 +55,10 @@ type Service struct {
 	Logger *log.Logger
 	// lastRuns maps CQ name to last time it was run.
 	lastRuns map[string]time.Time
-	stop     chan struct{}
-	wg       *sync.WaitGroup
+	// lastWindows maps CQ name to the end of the last interval it computed.
+	lastWindows map[string]time.Time
+	stop        chan struct{}
+	wg          *sync.WaitGroup
 }
 
 // NewService returns a new instance of Service.
@@ -67,6 +69,7 @@ func NewService(c Config) *Service {
 		RunCh:       make(chan struct{}),
 		Logger:      log.New(os.Stderr, "[continuous_querier] ", log.LstdFlags),
 		lastRuns:    map[string]time.Time{},
+		lastWindows: map[string]time.Time{},
 	}
 	return s
 }
@@ -144,7 +147,8 @@ func (s *Service) Run(database, name string) error {
 	return nil
 }
 
-// backgroundLoop runs on a go routine and periodically executes CQs.
+// backgroundLoop runs on a go routine and periodically executes CQs. CQs are executed one at a
+// time, so runs of the same CQ never overlap.
 func (s *Service) backgroundLoop() {
 	defer s.wg.Done()
 	for {
@@ -230,6 +234,22 @@ func (s *Service) ExecuteContinuousQuery(dbi *meta.DatabaseInfo, cqi *meta.Conti
 		startTime = startTime.Add(-interval)
 	}
 
+	// Compute the intervals that were missed since the last run, oldest first.
+	missed := catchUpWindows(s.lastWindows[cqi.Name], startTime, interval, time.Duration(s.Config.CatchUpNoOlderThan))
+	if len(missed) > 0 {
+		s.Logger.Printf("computing %d missed intervals of %s", len(missed), cqi.Name)
+	}
+	for _, t := range missed {
+		if err := cq.q.SetTimeRange(t, t.Add(interval)); err != nil {
+			s.Logger.Printf("error setting time range: %s\n", err)
+			return err
+		}
+		if err := s.runContinuousQueryAndWriteResult(cq); err != nil {
+			s.Logger.Printf("error during catch up: %s. running: %s\n", err, cq.q.String())
+			return err
+		}
+	}
+
 	if err := cq.q.SetTimeRange(startTime, startTime.Add(interval)); err != nil {
 		s.Logger.Printf("error setting time range: %s\n", err)
 	}
@@ -239,6 +259,7 @@ func (s *Service) ExecuteContinuousQuery(dbi *meta.DatabaseInfo, cqi *meta.Conti
 		s.Logger.Printf("error: %s. running: %s\n", err, cq.q.String())
 		return err
 	}
+	s.lastWindows[cqi.Name] = startTime.Add(interval)
 
 	recomputeNoOlderThan := time.Duration(s.Config.RecomputeNoOlderThan)
 
@@ -264,8 +285,34 @@ func (s *Service) ExecuteContinuousQuery(dbi *meta.DatabaseInfo, cqi *meta.Conti
 	return nil
 }
 
+// catchUpWindows returns the start of every interval between the end of the last computed interval
+// and start, oldest first. Intervals starting more than noOlderThan before start are skipped, and
+// if no interval has been computed yet every interval within noOlderThan is returned.
+func catchUpWindows(lastEnd, start time.Time, interval, noOlderThan time.Duration) []time.Time {
+	if noOlderThan <= 0 || interval <= 0 {
+		return nil
+	}
+
+	// Start at the later of the last computed interval and the oldest interval to catch up.
+	from := start.Add(-noOlderThan)
+	if lastEnd.After(from) {
+		from = lastEnd
+	} else if t := from.Truncate(interval); t.Before(from) {
+		from = t.Add(interval)
+	}
+
+	var windows []time.Time
+	for t := from; t.Before(start); t = t.Add(interval) {
+		windows = append(windows, t)
+	}
+	return windows
+}
+
 // runContinuousQueryAndWriteResult will run the query against the cluster and write the results back in
 func (s *Service) runContinuousQueryAndWriteResult(cq *ContinuousQuery) error {
+	// CQs run in the background, so they give way to interactive queries.
+	cq.q.Priority = influxql.BatchPriority
+
 	// Wrap the CQ's inner SELECT statement in a Query for the QueryExecutor.
 	q := &influxql.Query{
 		Statements: influxql.Statements{cq.q},
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -12,6 +13,7 @@ import (
 	"github.com/influxdb/influxdb/cluster"
 	"github.com/influxdb/influxdb/influxql"
 	"github.com/influxdb/influxdb/meta"
+	"github.com/influxdb/influxdb/toml"
 )
 
 var (
@@ -233,6 +235,70 @@ func TestExecuteContinuousQuery_QueryExecutor_Error(t *testing.T) {
 	}
 }
 
+// Test ExecuteContinuousQuery computes the intervals missed since the last run.
+func TestExecuteContinuousQuery_CatchUp(t *testing.T) {
+	s := NewTestService(t)
+	s.Config.RecomputePreviousN = 0
+	s.Config.CatchUpNoOlderThan = toml.Duration(3 * time.Minute)
+
+	// Record the start of each interval computed.
+	var starts []time.Time
+	qe := s.QueryExecutor.(*QueryExecutor)
+	qe.ExecuteQueryFn = func(query *influxql.Query, database string, chunkSize int) (<-chan *influxql.Result, error) {
+		tmin, _ := influxql.TimeRange(query.Statements[0].(*influxql.SelectStatement).Condition)
+		starts = append(starts, tmin)
+		return nil, nil
+	}
+
+	dbi, _ := s.MetaStore.Database("db2")
+	cqi := dbi.ContinuousQueries[0]
+	if err := s.ExecuteContinuousQuery(dbi, &cqi); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing has been computed yet, so every interval within the last 3m is computed oldest first.
+	if len(starts) != 4 {
+		t.Fatalf("unexpected number of intervals: %v", starts)
+	}
+	for i := 1; i < len(starts); i++ {
+		if d := starts[i].Sub(starts[i-1]); d != time.Minute {
+			t.Fatalf("unexpected intervals: %v", starts)
+		}
+	}
+	if exp := starts[len(starts)-1].Add(time.Minute); !s.lastWindows[cqi.Name].Equal(exp) {
+		t.Fatalf("unexpected last interval end: %v, exp %v", s.lastWindows[cqi.Name], exp)
+	}
+}
+
+// Test the intervals missed since the last computed interval.
+func TestCatchUpWindows(t *testing.T) {
+	start := time.Unix(600, 0)
+	for i, tt := range []struct {
+		lastEnd     time.Time
+		noOlderThan time.Duration
+		exp         []time.Time
+	}{
+		// Catching up is disabled.
+		{lastEnd: time.Unix(300, 0), noOlderThan: 0, exp: nil},
+
+		// The previous interval was computed.
+		{lastEnd: time.Unix(600, 0), noOlderThan: time.Hour, exp: nil},
+
+		// Intervals since the last one computed.
+		{lastEnd: time.Unix(420, 0), noOlderThan: time.Hour, exp: []time.Time{time.Unix(420, 0), time.Unix(480, 0), time.Unix(540, 0)}},
+
+		// Intervals older than the limit are skipped.
+		{lastEnd: time.Unix(120, 0), noOlderThan: 2 * time.Minute, exp: []time.Time{time.Unix(480, 0), time.Unix(540, 0)}},
+
+		// The oldest interval starts within the limit.
+		{lastEnd: time.Time{}, noOlderThan: 150 * time.Second, exp: []time.Time{time.Unix(480, 0), time.Unix(540, 0)}},
+	} {
+		if got := catchUpWindows(tt.lastEnd, start, time.Minute, tt.noOlderThan); !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%d. unexpected intervals: %v, exp %v", i, got, tt.exp)
+		}
+	}
+}
+
 // NewTestService returns a new *Service with default mock object members.
 func NewTestService(t *testing.T) *Service {
 	s := NewService(NewConfig())
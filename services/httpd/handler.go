@@ -29,8 +29,8 @@ import (
 
 const (
 	// With raw data queries, mappers will read up to this amount before sending results back to the engine.
-	// This is the default size in the number of values returned in a raw query. Could be many more bytes depending on fields returned.
-	DefaultChunkSize = 10000
+	// Queries that don't request a chunk size use the default of the query executor.
+	DefaultChunkSize = influxql.UseDefaultChunkSize
 )
 
 // TODO: Standard response headers (see: HeaderHandler)
@@ -201,6 +201,7 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user *meta.
 	}
 
 	epoch := strings.TrimSpace(q.Get("epoch"))
+	rfc3339 := q.Get("rfc3339") == "true"
 
 	p := influxql.NewParser(strings.NewReader(qp))
 	db := q.Get("db")
@@ -212,6 +213,18 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user *meta.
 		return
 	}
 
+	// Set the scheduling class of the select statements.
+	priority, err := influxql.ParsePriority(q.Get("priority"))
+	if err != nil {
+		httpError(w, err.Error(), pretty, http.StatusBadRequest)
+		return
+	}
+	for _, stmt := range query.Statements {
+		if s, ok := stmt.(*influxql.SelectStatement); ok {
+			s.Priority = priority
+		}
+	}
+
 	// Parse chunk size. Use default if not provided or unparsable.
 	chunked := (q.Get("chunked") == "true")
 	chunkSize := DefaultChunkSize
@@ -258,8 +271,11 @@ func (h *Handler) serveQuery(w http.ResponseWriter, r *http.Request, user *meta.
 			continue
 		}
 
-		// if requested, convert result timestamps to epoch
+		// if requested, convert result timestamps to epoch, along with their RFC3339 form
 		if epoch != "" {
+			if rfc3339 {
+				addRFC3339Times(r, epoch)
+			}
 			convertToEpoch(r, epoch)
 		}
 
@@ -496,26 +512,66 @@ func (h *Handler) servePing(w http.ResponseWriter, r *http.Request) {
 
 // convertToEpoch converts result timestamps from time.Time to the specified epoch.
 func convertToEpoch(r *influxql.Result, epoch string) {
-	divisor := int64(1)
+	divisor := epochDivisor(epoch)
+	for _, s := range r.Series {
+		for _, v := range s.Values {
+			if ts, ok := v[0].(time.Time); ok {
+				v[0] = ts.UnixNano() / divisor
+			}
+		}
+	}
+}
 
+// epochDivisor returns the number of nanoseconds in a unit of the specified epoch.
+func epochDivisor(epoch string) int64 {
 	switch epoch {
 	case "u":
-		divisor = int64(time.Microsecond)
+		return int64(time.Microsecond)
 	case "ms":
-		divisor = int64(time.Millisecond)
+		return int64(time.Millisecond)
 	case "s":
-		divisor = int64(time.Second)
+		return int64(time.Second)
 	case "m":
-		divisor = int64(time.Minute)
+		return int64(time.Minute)
 	case "h":
-		divisor = int64(time.Hour)
+		return int64(time.Hour)
+	}
+	return 1
+}
+
+// rfc3339Layouts are the layouts of the RFC3339 times added to results for each epoch, with as
+// many fractional digits as the epoch has. Other epochs are formatted to the nanosecond.
+var rfc3339Layouts = map[string]string{
+	"u":  "2006-01-02T15:04:05.000000Z07:00",
+	"ms": "2006-01-02T15:04:05.000Z07:00",
+	"s":  time.RFC3339,
+	"m":  time.RFC3339,
+	"h":  time.RFC3339,
+}
+
+// addRFC3339Times adds a time_rfc3339 column after the time column of each series, holding the
+// timestamp truncated to the specified epoch and formatted as RFC3339, so clients that read epoch
+// timestamps don't have to format them. It must be called before the timestamps are converted.
+func addRFC3339Times(r *influxql.Result, epoch string) {
+	divisor := epochDivisor(epoch)
+	layout, ok := rfc3339Layouts[epoch]
+	if !ok {
+		layout = "2006-01-02T15:04:05.000000000Z07:00"
 	}
 
 	for _, s := range r.Series {
-		for _, v := range s.Values {
+		if len(s.Columns) == 0 || s.Columns[0] != "time" {
+			continue
+		}
+
+		// the columns may be shared with other series, so they're copied
+		s.Columns = append([]string{"time", "time_rfc3339"}, s.Columns[1:]...)
+		for i, v := range s.Values {
+			var str interface{}
 			if ts, ok := v[0].(time.Time); ok {
-				v[0] = ts.UnixNano() / divisor
+				str = time.Unix(0, ts.UnixNano()/divisor*divisor).UTC().Format(layout)
 			}
+			s.Values[i] = append([]interface{}{v[0], str}, v[1:]...)
 		}
 	}
 }
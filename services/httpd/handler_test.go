@@ -196,6 +196,38 @@ func TestHandler_Query_Chunked(t *testing.T) {
 	}
 }
 
+// Ensure the handler adds the RFC3339 form of epoch timestamps at their precision if requested.
+func TestHandler_Query_RFC3339(t *testing.T) {
+	for _, tt := range []struct {
+		params string
+		body   string
+	}{
+		{params: "epoch=ms", body: `"columns":["time","value"],"values":[[1445000000123,1]]`},
+		{params: "epoch=ns&rfc3339=true", body: `"columns":["time","time_rfc3339","value"],"values":[[1445000000123456789,"2015-10-16T12:53:20.123456789Z",1]]`},
+		{params: "epoch=u&rfc3339=true", body: `"columns":["time","time_rfc3339","value"],"values":[[1445000000123456,"2015-10-16T12:53:20.123456Z",1]]`},
+		{params: "epoch=ms&rfc3339=true", body: `"columns":["time","time_rfc3339","value"],"values":[[1445000000123,"2015-10-16T12:53:20.123Z",1]]`},
+		{params: "epoch=s&rfc3339=true", body: `"columns":["time","time_rfc3339","value"],"values":[[1445000000,"2015-10-16T12:53:20Z",1]]`},
+		{params: "epoch=h&rfc3339=true", body: `"columns":["time","time_rfc3339","value"],"values":[[401388,"2015-10-16T12:00:00Z",1]]`},
+	} {
+		h := NewHandler(false)
+		h.QueryExecutor.ExecuteQueryFn = func(q *influxql.Query, db string, chunkSize int) (<-chan *influxql.Result, error) {
+			return NewResultChan(&influxql.Result{StatementID: 1, Series: influxql.Rows{{
+				Name:    "cpu",
+				Columns: []string{"time", "value"},
+				Values:  [][]interface{}{{time.Unix(0, 1445000000123456789).UTC(), 1.0}},
+			}}}), nil
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+cpu&"+tt.params, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status: %d", tt.params, w.Code)
+		} else if exp := `{"results":[{"series":[{"name":"cpu",` + tt.body + `}]}]}`; w.Body.String() != exp {
+			t.Fatalf("%s: unexpected body: %s", tt.params, w.Body.String())
+		}
+	}
+}
+
 // Ensure the handler returns a status 400 if the query is not passed in.
 func TestHandler_Query_ErrQueryRequired(t *testing.T) {
 	h := NewHandler(false)
@@ -248,6 +280,35 @@ func TestHandler_Query_ErrExecuteQuery(t *testing.T) {
 	}
 }
 
+// Ensure the handler sets the priority of select statements.
+func TestHandler_Query_Priority(t *testing.T) {
+	h := NewHandler(false)
+	h.QueryExecutor.ExecuteQueryFn = func(q *influxql.Query, db string, chunkSize int) (<-chan *influxql.Result, error) {
+		if p := q.Statements[0].(*influxql.SelectStatement).Priority; p != influxql.BatchPriority {
+			t.Fatalf("unexpected priority: %s", p)
+		}
+		return NewResultChan(&influxql.Result{}), nil
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+bar&priority=batch", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", w.Code)
+	}
+}
+
+// Ensure the handler returns a status 400 if the priority is invalid.
+func TestHandler_Query_ErrInvalidPriority(t *testing.T) {
+	h := NewHandler(false)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, MustNewJSONRequest("GET", "/query?db=foo&q=SELECT+*+FROM+bar&priority=urgent", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status: %d", w.Code)
+	} else if w.Body.String() != `{"error":"invalid priority: urgent"}` {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
+
 // Ensure the handler returns a status 200 if an error is returned in the result.
 func TestHandler_Query_ErrResult(t *testing.T) {
 	h := NewHandler(false)
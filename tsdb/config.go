@@ -3,6 +3,7 @@ package tsdb
 import (
 	"time"
 
+	"github.com/influxdb/influxdb/influxql"
 	"github.com/influxdb/influxdb/toml"
 )
 
@@ -26,6 +27,16 @@ const (
 	// DefaultWALFlushInterval is the frequency the WAL will get flushed if
 	// it doesn't reach its size threshold.
 	DefaultWALFlushInterval = 10 * time.Minute
+
+	// DefaultMaxChunkSize is the default maximum number of points read or returned at once by
+	// a raw query, whatever chunk size is requested.
+	DefaultMaxChunkSize = influxql.DefaultMaxChunkSize
+
+	// DefaultQueryChunkSize is the default chunk size of raw queries that don't request one.
+	DefaultQueryChunkSize = influxql.DefaultChunkSize
+
+	// DefaultPrefetchDepth is the default number of chunks each shard of a raw query reads ahead.
+	DefaultPrefetchDepth = influxql.DefaultPrefetchDepth
 )
 
 type Config struct {
@@ -36,6 +47,51 @@ type Config struct {
 	RetentionCheckEnabled bool          `toml:"retention-check-enabled"`
 	RetentionCheckPeriod  toml.Duration `toml:"retention-check-period"`
 	RetentionCreatePeriod toml.Duration `toml:"retention-create-period"`
+
+	// Query options that guard against scanning the entire history of a measurement.
+	QueryRequireTimeBound bool          `toml:"query-require-time-bound"`
+	QueryDefaultWindow    toml.Duration `toml:"query-default-window"`
+	MaxSeriesPerQuery     int           `toml:"max-series-per-query"`
+
+	// The maximum number of points read or returned at once by a raw query.
+	MaxChunkSize int `toml:"max-chunk-size"`
+
+	// The chunk size of raw queries that don't request one, capped at the maximum chunk size.
+	QueryDefaultChunkSize int `toml:"query-default-chunk-size"`
+
+	// The number of chunks each shard of a raw query reads ahead while the current ones are returned.
+	PrefetchDepth int `toml:"prefetch-depth"`
+
+	// If set, the approximate maximum number of bytes of rows returned by a query.
+	MaxResponseBytes int `toml:"max-response-bytes"`
+
+	// If true, NaN and infinite float values are skipped by queries instead of being aggregated.
+	QuerySkipNonFinite bool `toml:"query-skip-non-finite"`
+
+	// If set, the longest a query waits to open a shard, e.g. while it's locked by a compaction.
+	QueryShardOpenTimeout toml.Duration `toml:"query-shard-open-timeout"`
+
+	// If set, the longest a query waits for its client to receive a row before it's killed.
+	QueryIdleTimeout toml.Duration `toml:"query-idle-timeout"`
+
+	// If true, queries skip the shards dropped while they're running rather than failing.
+	QueryTolerateMissingShards bool `toml:"query-tolerate-missing-shards"`
+
+	// If true, raw queries from measurements with different fields return null for the missing ones.
+	QueryUnifyColumns bool `toml:"query-unify-columns"`
+
+	// If set, the most GROUP BY time intervals of a series an aggregate query holds in memory.
+	QueryMaxSeriesIntervals int `toml:"query-max-series-intervals"`
+
+	// If true, queries exceeding query-max-series-intervals return partial results rather than failing.
+	QueryPartialOverBudget bool `toml:"query-partial-over-budget"`
+
+	// If set, the most bytes of strings concat() joins in each interval of a query.
+	QueryMaxConcatBytes int `toml:"query-max-concat-bytes"`
+
+	// Query options that limit concurrent queries, keeping slots free for interactive ones.
+	MaxConcurrentQueries       int `toml:"max-concurrent-queries"`
+	ReservedInteractiveQueries int `toml:"reserved-interactive-queries"`
 }
 
 func NewConfig() Config {
@@ -46,6 +102,9 @@ func NewConfig() Config {
 		RetentionCheckEnabled: DefaultRetentionCheckEnabled,
 		RetentionCheckPeriod:  toml.Duration(DefaultRetentionCheckPeriod),
 		RetentionCreatePeriod: toml.Duration(DefaultRetentionCreatePeriod),
+		MaxChunkSize:          DefaultMaxChunkSize,
+		QueryDefaultChunkSize: DefaultQueryChunkSize,
+		PrefetchDepth:         DefaultPrefetchDepth,
 	}
 }
 
@@ -0,0 +1,173 @@
+package tsdb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/influxdb/influxdb/influxql"
+)
+
+// PointDecoder decodes the field values of points read from a shard. Every on-disk format
+// a shard can be written in has its own decoder, so a query can read shards written by
+// different versions of the storage engine.
+type PointDecoder interface {
+	// FieldIDByName returns the ID of the field with the given name.
+	FieldIDByName(name string) (uint8, error)
+
+	// DecodeByID returns the value of a single field of an encoded point.
+	DecodeByID(id uint8, b []byte) (interface{}, error)
+
+	// DecodeFieldsWithNames returns the values of all the fields of an encoded point by name.
+	DecodeFieldsWithNames(b []byte) (map[string]interface{}, error)
+}
+
+// SelectiveDecoder is implemented by point decoders that can decode only some of the fields of
+// a point. Mappers use it to decode just the fields a query reads, rather than every field of the
+// points of wide measurements.
+type SelectiveDecoder interface {
+	// DecodeSelectedFields returns the values of the fields of an encoded point with the given IDs
+	// by name, skipping the other fields.
+	DecodeSelectedFields(ids []uint8, b []byte) (map[string]interface{}, error)
+}
+
+// RollupReader is implemented by point decoders of formats that keep rollups of the blocks of points
+// of each series. Mappers of aggregates that can be computed from rollups use it to read intervals
+// that only contain whole blocks without decoding the points, and read the points of the others.
+type RollupReader interface {
+	// Rollups returns the rollups of the field with the given ID of the blocks of a series that have
+	// points between tmin and tmax, in time order, as of the read transaction. Every point in the
+	// bucket of the series must be in a block, but points in the cache never are.
+	Rollups(tx *bolt.Tx, seriesKey string, fieldID uint8, tmin, tmax int64) ([]influxql.Rollup, error)
+}
+
+// PointDecoderFunc returns the decoder for the points of a measurement in a shard, or nil if
+// the measurement was never written into the shard.
+type PointDecoderFunc func(sh *Shard, measurement string) PointDecoder
+
+// DefaultShardFormat is the format of shards that don't record one in the meta store.
+const DefaultShardFormat = 0
+
+// ErrUnknownShardFormat is returned when no decoder is registered for the format of a shard.
+func ErrUnknownShardFormat(format uint32) error {
+	return fmt.Errorf("unknown shard format: %d", format)
+}
+
+var (
+	pointDecodersMu sync.RWMutex
+	pointDecoders   = map[uint32]PointDecoderFunc{
+		DefaultShardFormat: fieldCodecDecoder,
+	}
+)
+
+// RegisterPointDecoder registers the decoder for shards written in the given format.
+// It panics if a decoder is already registered for the format.
+func RegisterPointDecoder(format uint32, fn PointDecoderFunc) {
+	pointDecodersMu.Lock()
+	defer pointDecodersMu.Unlock()
+
+	if _, ok := pointDecoders[format]; ok {
+		panic(fmt.Sprintf("point decoder already registered for shard format %d", format))
+	}
+	pointDecoders[format] = fn
+}
+
+// NewPointDecoder returns the decoder for a measurement in a shard written in the given format.
+// It returns nil if the measurement was never written into the shard.
+func NewPointDecoder(format uint32, sh *Shard, measurement string) (PointDecoder, error) {
+	pointDecodersMu.RLock()
+	fn := pointDecoders[format]
+	pointDecodersMu.RUnlock()
+
+	if fn == nil {
+		return nil, ErrUnknownShardFormat(format)
+	}
+	return fn(sh, measurement), nil
+}
+
+// fieldCodecDecoder returns the field codec of the measurement, which decodes the original format.
+func fieldCodecDecoder(sh *Shard, measurement string) PointDecoder {
+	// Don't wrap a nil codec in a non-nil interface.
+	if codec := sh.FieldCodec(measurement); codec != nil {
+		return codec
+	}
+	return nil
+}
+
+// coercingDecoder coerces the values of the fields decoded by a point decoder to the types a
+// query forces them to. The first value that can't be coerced is recorded, and the point it's
+// from is skipped like one that fails to decode. The mapper then fails with the error.
+type coercingDecoder struct {
+	PointDecoder
+	types map[string]influxql.DataType // the forced types of fields by name
+	names map[uint8]string             // the names of the forced fields of the decoder by ID
+	err   error                        // the first value that couldn't be coerced, if any
+}
+
+// newCoercingDecoder returns a decoder that coerces the fields of points decoded by d to types.
+func newCoercingDecoder(d PointDecoder, types map[string]influxql.DataType) *coercingDecoder {
+	names := make(map[uint8]string)
+	for name := range types {
+		if id, err := d.FieldIDByName(name); err == nil {
+			names[id] = name
+		}
+	}
+	return &coercingDecoder{PointDecoder: d, types: types, names: names}
+}
+
+// DecodeByID returns the value of a single field of an encoded point, coerced to its forced type.
+func (d *coercingDecoder) DecodeByID(id uint8, b []byte) (interface{}, error) {
+	v, err := d.PointDecoder.DecodeByID(id, b)
+	if name, ok := d.names[id]; ok && err == nil {
+		v, err = d.coerce(name, v)
+	}
+	return v, err
+}
+
+// DecodeFieldsWithNames returns the values of all the fields of an encoded point by name, coerced
+// to their forced types.
+func (d *coercingDecoder) DecodeFieldsWithNames(b []byte) (map[string]interface{}, error) {
+	fields, err := d.PointDecoder.DecodeFieldsWithNames(b)
+	if err != nil {
+		return nil, err
+	}
+	return d.coerceFields(fields)
+}
+
+// DecodeSelectedFields returns the values of the fields of an encoded point with the given IDs by
+// name, coerced to their forced types. If the decoder isn't selective, it decodes all the fields.
+func (d *coercingDecoder) DecodeSelectedFields(ids []uint8, b []byte) (map[string]interface{}, error) {
+	sd, ok := d.PointDecoder.(SelectiveDecoder)
+	if !ok {
+		return d.DecodeFieldsWithNames(b)
+	}
+	fields, err := sd.DecodeSelectedFields(ids, b)
+	if err != nil {
+		return nil, err
+	}
+	return d.coerceFields(fields)
+}
+
+// coerceFields coerces the forced fields of a decoded point in place.
+func (d *coercingDecoder) coerceFields(fields map[string]interface{}) (map[string]interface{}, error) {
+	for name, v := range fields {
+		if _, ok := d.types[name]; !ok {
+			continue
+		}
+		v, err := d.coerce(name, v)
+		if err != nil {
+			return nil, err
+		}
+		fields[name] = v
+	}
+	return fields, nil
+}
+
+// coerce coerces the value of a field to its forced type, recording the error if it can't be.
+func (d *coercingDecoder) coerce(name string, v interface{}) (interface{}, error) {
+	v, err := influxql.CoerceFieldValue(name, v, d.types[name])
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return v, err
+}
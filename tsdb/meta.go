@@ -46,6 +46,13 @@ func (d *DatabaseIndex) Measurement(name string) *Measurement {
 	return d.measurements[name]
 }
 
+// Series returns the series with the given key from the index, or nil if it doesn't exist.
+func (d *DatabaseIndex) Series(key string) *Series {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.series[key]
+}
+
 // MeasurementSeriesCounts returns the number of measurements and series currently indexed by the database.
 // Useful for reporting and monitoring.
 func (d *DatabaseIndex) MeasurementSeriesCounts() (nMeasurements int, nSeries int) {
@@ -1107,36 +1114,7 @@ type TagFilter struct {
 // used to convert the tag set to bytes for use as a lookup key
 func marshalTags(tags map[string]string) []byte {
 	// Empty maps marshal to empty bytes.
-	if len(tags) == 0 {
-		return nil
-	}
-
-	// Extract keys and determine final size.
-	sz := (len(tags) * 2) - 1 // separators
-	keys := make([]string, 0, len(tags))
-	for k, v := range tags {
-		keys = append(keys, k)
-		sz += len(k) + len(v)
-	}
-	sort.Strings(keys)
-
-	// Generate marshaled bytes.
-	b := make([]byte, sz)
-	buf := b
-	for _, k := range keys {
-		copy(buf, k)
-		buf[len(k)] = '|'
-		buf = buf[len(k)+1:]
-	}
-	for i, k := range keys {
-		v := tags[k]
-		copy(buf, v)
-		if i < len(keys)-1 {
-			buf[len(v)] = '|'
-			buf = buf[len(v)+1:]
-		}
-	}
-	return b
+	return influxql.AppendTagSet(nil, tags)
 }
 
 // timeBetweenInclusive returns true if t is between min and max, inclusive.
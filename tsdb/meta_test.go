@@ -112,6 +112,10 @@ func TestMarshalTags(t *testing.T) {
 			tags:   map[string]string{"baz": "battttt", "foo": "bar"},
 			result: []byte(`baz|foo|battttt|bar`),
 		},
+		{
+			tags:   map[string]string{"foo|baz": "bar"},
+			result: []byte(`foo\|baz|bar`),
+		},
 	} {
 		result := marshalTags(tt.tags)
 		if !bytes.Equal(result, tt.result) {
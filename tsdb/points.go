@@ -4,12 +4,15 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"math"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/influxdb/influxdb/influxql"
 )
 
 // Point defines the values that will be written to the database
@@ -922,6 +925,85 @@ func (p *point) UnixNano() int64 {
 	return p.Time().UnixNano()
 }
 
+// WriteRows writes the rows received from ch to w in line protocol, one point per line, so the
+// results of a query can be written back into the database. Each value of a row becomes a point
+// named after the row, with the row's tags and a field for every column other than time. Rows of
+// aggregate queries are timestamped with the start of their interval. Null fields are omitted,
+// and values without any fields are skipped. If a row has an error, the rest of ch is drained and
+// the error is returned.
+func WriteRows(w io.Writer, ch <-chan *influxql.Row) error {
+	var err error
+	for row := range ch {
+		if err != nil || row.Done {
+			continue
+		} else if row.Err != nil {
+			err = row.Err
+			continue
+		}
+
+		var points []Point
+		if points, err = rowToPoints(row); err != nil {
+			continue
+		}
+		for _, p := range points {
+			if _, err = io.WriteString(w, p.String()+"\n"); err != nil {
+				break
+			}
+		}
+	}
+	return err
+}
+
+// rowToPoints converts a query result row into points.
+func rowToPoints(row *influxql.Row) ([]Point, error) {
+	timeIndex := -1
+	for i, c := range row.Columns {
+		if c == "time" {
+			timeIndex = i
+			break
+		}
+	}
+	if timeIndex == -1 {
+		return nil, fmt.Errorf("row %s has no time column", row.Name)
+	}
+
+	// Series without a tag that's grouped by have an empty value for it, which is written as a
+	// point without the tag so it's the same series again.
+	tags := make(Tags, len(row.Tags))
+	for k, v := range row.Tags {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+
+	points := make([]Point, 0, len(row.Values))
+	for _, v := range row.Values {
+		fields := make(Fields)
+		for i, c := range row.Columns {
+			if i == timeIndex {
+				continue
+			}
+			switch v[i].(type) {
+			case nil:
+			case float64, int64, int, string, bool:
+				fields[c] = v[i]
+			default:
+				return nil, fmt.Errorf("unsupported type %T for column %s of row %s", v[i], c, row.Name)
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		t, ok := v[timeIndex].(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("invalid time %v in row %s", v[timeIndex], row.Name)
+		}
+		points = append(points, NewPoint(row.Name, tags, fields, t))
+	}
+	return points, nil
+}
+
 type Tags map[string]string
 
 func (t Tags) hashKey() []byte {
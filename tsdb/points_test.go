@@ -9,6 +9,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/influxdb/influxdb/influxql"
 )
 
 var (
@@ -1033,3 +1035,90 @@ func TestNewPointEscaped(t *testing.T) {
 		t.Errorf("NewPoint().String() mismatch.\ngot %v\nexp %v", pt.String(), exp)
 	}
 }
+
+// Ensure that query results written in line protocol parse back into the same points.
+func TestWriteRows_RoundTrip(t *testing.T) {
+	ch := make(chan *influxql.Row, 3)
+	ch <- &influxql.Row{
+		Name:    "cpu load",
+		Tags:    map[string]string{"host": "server,A", "region": "us=west"},
+		Columns: []string{"time", "value", "max value", "msg"},
+		Values: [][]interface{}{
+			{time.Unix(0, 10).UTC(), 1.5, int64(2), "a, b"},
+			{time.Unix(0, 20).UTC(), nil, nil, nil},
+			{time.Unix(0, 30).UTC(), 3.0, nil, "c"},
+		},
+	}
+	ch <- &influxql.Row{Name: "mem", Columns: []string{"time", "sum"}, Values: [][]interface{}{{time.Unix(60, 0).UTC(), 4.0}}}
+	ch <- &influxql.Row{Done: true}
+	close(ch)
+
+	var buf bytes.Buffer
+	if err := WriteRows(&buf, ch); err != nil {
+		t.Fatal(err)
+	}
+
+	pts, err := ParsePointsString(buf.String())
+	if err != nil {
+		t.Fatalf("unable to parse %q: %s", buf.String(), err)
+	}
+
+	exp := []Point{
+		NewPoint("cpu load", Tags{"host": "server,A", "region": "us=west"}, Fields{"value": 1.5, "max value": int64(2), "msg": "a, b"}, time.Unix(0, 10)),
+		NewPoint("cpu load", Tags{"host": "server,A", "region": "us=west"}, Fields{"value": 3.0, "msg": "c"}, time.Unix(0, 30)),
+		NewPoint("mem", Tags{}, Fields{"sum": 4.0}, time.Unix(60, 0)),
+	}
+	if len(pts) != len(exp) {
+		t.Fatalf("unexpected point count: %d\n%s", len(pts), buf.String())
+	}
+	for i, p := range pts {
+		if p.Name() != exp[i].Name() {
+			t.Errorf("%d. name mismatch: got %q, exp %q", i, p.Name(), exp[i].Name())
+		}
+		if !reflect.DeepEqual(p.Tags(), exp[i].Tags()) {
+			t.Errorf("%d. tags mismatch: got %v, exp %v", i, p.Tags(), exp[i].Tags())
+		}
+		if !reflect.DeepEqual(p.Fields(), exp[i].Fields()) {
+			t.Errorf("%d. fields mismatch: got %v, exp %v", i, p.Fields(), exp[i].Fields())
+		}
+		if !p.Time().Equal(exp[i].Time()) {
+			t.Errorf("%d. time mismatch: got %v, exp %v", i, p.Time(), exp[i].Time())
+		}
+	}
+}
+
+// Ensure that tags with empty values, from series without a tag that's grouped by, aren't written.
+func TestWriteRows_EmptyTagValue(t *testing.T) {
+	ch := make(chan *influxql.Row, 1)
+	ch <- &influxql.Row{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "", "region": "east"},
+		Columns: []string{"time", "sum"},
+		Values:  [][]interface{}{{time.Unix(0, 0).UTC(), 1.0}},
+	}
+	close(ch)
+
+	var buf bytes.Buffer
+	if err := WriteRows(&buf, ch); err != nil {
+		t.Fatal(err)
+	} else if exp := "cpu,region=east sum=1.0 0\n"; buf.String() != exp {
+		t.Fatalf("unexpected output: exp=%q, got=%q", exp, buf.String())
+	}
+}
+
+// Ensure that the first row error is returned after the rest of the rows are drained.
+func TestWriteRows_Err(t *testing.T) {
+	ch := make(chan *influxql.Row, 2)
+	ch <- &influxql.Row{Err: fmt.Errorf("marker")}
+	ch <- &influxql.Row{Name: "cpu", Columns: []string{"time", "value"}, Values: [][]interface{}{{time.Unix(0, 0).UTC(), 1.0}}}
+	close(ch)
+
+	var buf bytes.Buffer
+	if err := WriteRows(&buf, ch); err == nil || err.Error() != "marker" {
+		t.Fatalf("unexpected error: %v", err)
+	} else if len(ch) != 0 {
+		t.Fatalf("rows weren't drained: %d", len(ch))
+	} else if buf.Len() != 0 {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+}
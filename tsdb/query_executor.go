@@ -7,6 +7,8 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/influxdb/influxdb/influxql"
 	"github.com/influxdb/influxdb/meta"
@@ -26,6 +28,7 @@ type QueryExecutor struct {
 		Authenticate(username, password string) (*meta.UserInfo, error)
 		RetentionPolicy(database, name string) (rpi *meta.RetentionPolicyInfo, err error)
 		UserCount() (int, error)
+		NodeID() uint64
 	}
 
 	// Executes statements relating to meta data.
@@ -35,10 +38,141 @@ type QueryExecutor struct {
 
 	Logger *log.Logger
 
+	// If true, select statements without a lower time bound are rejected.
+	RequireTimeBound bool
+
+	// If set, select statements without a lower time bound only query this far back from now.
+	DefaultQueryWindow time.Duration
+
+	// If set, select statements that would return more series than this are rejected.
+	MaxSeriesPerQuery int
+
+	// If true, NaN and infinite float values are skipped rather than returned or aggregated.
+	SkipNonFinite bool
+
+	// If set, raw select statements read and return at most this many points at once, whatever
+	// chunk size is requested. Zero uses influxql.DefaultMaxChunkSize and a negative value
+	// doesn't cap the chunk size.
+	MaxChunkSize int
+
+	// If set, the chunk size of raw select statements executed with influxql.UseDefaultChunkSize.
+	// Zero uses influxql.DefaultChunkSize.
+	DefaultChunkSize int
+
+	// If set, the number of chunks each shard of a raw select statement reads ahead. Zero uses
+	// influxql.DefaultPrefetchDepth and a negative value reads each chunk only when it's needed.
+	PrefetchDepth int
+
+	// If set, the rows of a select statement are cut off once their approximate size reaches this
+	// many bytes. The last row returned is marked as truncated.
+	MaxResponseBytes int
+
+	// The consistency level of the reads of select statements from shards with several owners.
+	// Without RemoteMapper, the one level only works on the primary owner's node of each shard.
+	ReadConsistency influxql.ReadConsistency
+
+	// If set, creates the mappers of select statements reading a shard from another node, such as
+	// the primary owner of a shard read at the one consistency level. Without it, shards are only read
+	// locally, and statements that must read one from another node fail with ErrNotPrimaryOwner.
+	// influxd doesn't set it yet, as the cluster service can't serve the reads of mappers.
+	RemoteMapper RemoteMapperFunc
+
+	// If set, the longest a select statement waits to open each shard it reads. Statements reading a
+	// shard that's still locked after this return a shard busy error.
+	ShardOpenTimeout time.Duration
+
+	// If set, the longest a select statement waits for its rows to be received, e.g. by a slow HTTP
+	// client. Statements whose rows aren't received within this are killed with an idle timeout error.
+	IdleTimeout time.Duration
+
+	// If true, select statements skip the shards dropped after they were planned, and log them,
+	// rather than failing with a shard not found error.
+	TolerateMissingShards bool
+
+	// If true, raw select statements from several measurements return a column for every selected
+	// field, which is null for the measurements that don't have it, rather than failing.
+	UnifyColumns bool
+
+	// If set, the most GROUP BY time intervals of a series an aggregate select statement holds in
+	// memory, influxql.MaxGroupByPoints otherwise. If PartialOverBudget is true, a statement with a
+	// series that has more returns partial results rather than failing.
+	// See influxql.Planner.PartialOverBudget.
+	MaxSeriesIntervals int
+	PartialOverBudget  bool
+
+	// If set, the most bytes of strings concat() joins in an interval of an aggregate select
+	// statement, influxql.DefaultMaxConcatBytes otherwise. Statements joining more fail.
+	MaxConcatBytes int
+
+	// If true, select statements check that their jobs are in ascending tag set order before they're
+	// run, and fail if they aren't. It's a debugging aid for the creation of jobs.
+	StrictTagSetOrder bool
+
+	// If true, aggregate select statements check that the points each shard reads for an interval
+	// are in the interval, and fail if a shard misbuckets them. See influxql.Planner.StrictIntervals.
+	StrictIntervals bool
+
+	// If set, called with the series key, time and fields of every point read by select statements
+	// before it's aggregated, e.g. to audit or sample the data. See influxql.Planner.OnPoint.
+	OnPoint func(series string, t time.Time, fields map[string]interface{})
+
+	// If set, called with the progress of select statements as they're executed, e.g. to show a
+	// progress bar for long exports. See influxql.Planner.OnProgress.
+	OnProgress func(influxql.Progress)
+
+	// If set, the downsamples of raw measurements written by continuous queries, by the name of the
+	// raw measurement, which aggregates over wide time ranges read their older intervals from.
+	// See influxql.Planner.Downsamples.
+	Downsamples map[string]*influxql.Downsample
+
+	// How raw select statements resolve points of a series at the same time read from different
+	// shards, and the retention policy preferred by influxql.ConflictPreferRetentionPolicy. The
+	// conflicts are counted in the stats of the statement. See influxql.Planner.RawConflicts.
+	RawConflicts             influxql.ConflictResolution
+	PreferredRetentionPolicy string
+
+	// The time of each GROUP BY time interval that select statements send its values at.
+	// See influxql.Planner.IntervalTime.
+	IntervalTime influxql.IntervalTime
+
+	// How select statements handle a mapper that returns points or intervals out of time order.
+	// See influxql.Planner.OutOfOrder.
+	OutOfOrder influxql.OutOfOrderHandling
+
+	// If set, raw select statements reading more shards than this for a series read the shards of
+	// adjacent shard groups with a single mapper, MapperCoalesceFactor of them at a time, to bound
+	// the goroutines and open shards of very wide time ranges. See
+	// influxql.Planner.MapperCoalesceThreshold.
+	MapperCoalesceThreshold int
+	MapperCoalesceFactor    int
+
+	// If set, the types the fields of points read by select statements are coerced to, by field
+	// name, to recover fields whose type differs between shards. See influxql.Planner.FieldTypes.
+	FieldTypes map[string]influxql.DataType
+
+	// If set, at most this many select statements are executed at once. Statements wait for a
+	// free slot before they're planned.
+	MaxConcurrentQueries int
+
+	// The number of concurrent query slots that only interactive statements can use, so batch
+	// statements such as continuous queries can't starve them.
+	ReservedInteractiveQueries int
+
+	slotsOnce sync.Once
+	slots     *querySlots
+
+	registryOnce sync.Once
+	registry     *influxql.QueryRegistry // the select statements being executed
+
 	// the local data store
 	store *Store
 }
 
+// RemoteMapperFunc returns an unopened mapper for a job that reads a shard from another node. The
+// mappers of aggregates must implement influxql.IntervalTimer, so the job can check the intervals
+// the node returns are in time order.
+type RemoteMapperFunc func(job *influxql.MapReduceJob, nodeID uint64, sh meta.ShardInfo) (influxql.Mapper, error)
+
 // NewQueryExecutor returns an initialized QueryExecutor
 func NewQueryExecutor(store *Store) *QueryExecutor {
 	return &QueryExecutor{
@@ -49,7 +183,10 @@ func NewQueryExecutor(store *Store) *QueryExecutor {
 
 // Begin is for influxql/engine.go to use to get a transaction object to start the query
 func (q *QueryExecutor) Begin() (influxql.Tx, error) {
-	return newTx(q.MetaStore, q.store), nil
+	tx := newTx(q.MetaStore, q.store)
+	tx.nodeID = q.MetaStore.NodeID()
+	tx.remoteMapper = q.RemoteMapper
+	return tx, nil
 }
 
 // Authorize user u to execute query q on database.
@@ -209,8 +346,51 @@ func (q *QueryExecutor) executeSelectStatement(statementID int, stmt *influxql.S
 		return err
 	}
 
+	// Wait for an execution slot. It's held until every row has been sent.
+	release := q.querySlots().acquire(stmt.Priority)
+	defer release()
+
 	// Plan statement execution.
 	p := influxql.NewPlanner(q)
+	p.RequireTimeBound = q.RequireTimeBound
+	p.DefaultQueryWindow = q.DefaultQueryWindow
+	p.MaxSeriesPerQuery = q.MaxSeriesPerQuery
+	p.SkipNonFinite = q.SkipNonFinite
+	p.MaxResponseBytes = q.MaxResponseBytes
+	p.Consistency = q.ReadConsistency
+	p.OpenTimeout = q.ShardOpenTimeout
+	p.IdleTimeout = q.IdleTimeout
+	p.TolerateMissingShards = q.TolerateMissingShards
+	p.UnifyColumns = q.UnifyColumns
+	p.MaxSeriesIntervals = q.MaxSeriesIntervals
+	p.PartialOverBudget = q.PartialOverBudget
+	p.StrictTagSetOrder = q.StrictTagSetOrder
+	p.StrictIntervals = q.StrictIntervals
+	p.OnPoint = q.OnPoint
+	p.OnProgress = q.OnProgress
+	p.Downsamples = q.Downsamples
+	p.FieldTypes = q.FieldTypes
+	p.RawConflicts = q.RawConflicts
+	p.PreferredRetentionPolicy = q.PreferredRetentionPolicy
+	p.OutOfOrder = q.OutOfOrder
+	p.IntervalTime = q.IntervalTime
+	p.Registry = q.queryRegistry()
+	p.MapperCoalesceThreshold = q.MapperCoalesceThreshold
+	p.MapperCoalesceFactor = q.MapperCoalesceFactor
+	p.Logger = q.Logger
+	p.ErrorOnMissingMeasurement = true // the store has always rejected selects from missing measurements
+	if q.MaxChunkSize != 0 {
+		p.MaxChunkSize = q.MaxChunkSize
+	}
+	if q.DefaultChunkSize != 0 {
+		p.DefaultChunkSize = q.DefaultChunkSize
+	}
+	if q.PrefetchDepth != 0 {
+		p.PrefetchDepth = q.PrefetchDepth
+	}
+	if q.MaxConcatBytes != 0 {
+		p.MaxConcatBytes = q.MaxConcatBytes
+	}
 	e, err := p.Plan(stmt, chunkSize)
 	if err != nil {
 		return err
@@ -237,6 +417,87 @@ func (q *QueryExecutor) executeSelectStatement(statementID int, stmt *influxql.S
 	return nil
 }
 
+// Warm loads the indexes of the shards of a retention policy of a database, so the first queries
+// reading them don't wait for the indexes to be read from disk. It waits for a batch execution
+// slot like a continuous query, so warming doesn't hold up interactive queries, and stops with
+// influxql.ErrWarmCanceled once closing is closed. See influxql.Planner.Warm.
+func (q *QueryExecutor) Warm(database, retentionPolicy string, closing <-chan struct{}) error {
+	release := q.querySlots().acquire(influxql.BatchPriority)
+	defer release()
+
+	return influxql.NewPlanner(q).Warm(database, retentionPolicy, closing)
+}
+
+// KillAllQueries kills every select statement being executed and returns the number killed. The
+// results of each killed statement end with influxql.ErrQueryKilled.
+func (q *QueryExecutor) KillAllQueries() int {
+	return q.queryRegistry().KillAll()
+}
+
+// queryRegistry returns the registry of the select statements being executed.
+func (q *QueryExecutor) queryRegistry() *influxql.QueryRegistry {
+	q.registryOnce.Do(func() { q.registry = influxql.NewQueryRegistry() })
+	return q.registry
+}
+
+// querySlots returns the execution slots of the executor, or nil if the number of concurrent
+// statements isn't limited.
+func (q *QueryExecutor) querySlots() *querySlots {
+	q.slotsOnce.Do(func() {
+		if q.MaxConcurrentQueries > 0 {
+			q.slots = newQuerySlots(q.MaxConcurrentQueries, q.ReservedInteractiveQueries)
+		}
+	})
+	return q.slots
+}
+
+// querySlots limits the number of statements executed at once. Some of the slots can be
+// reserved for interactive statements.
+type querySlots struct {
+	shared   chan struct{} // slots for statements of any priority
+	reserved chan struct{} // slots for interactive statements only
+}
+
+// newQuerySlots returns n slots, of which reserved are for interactive statements only. At least
+// one slot is always shared so batch statements can run.
+func newQuerySlots(n, reserved int) *querySlots {
+	if reserved >= n {
+		reserved = n - 1
+	}
+	return &querySlots{
+		shared:   make(chan struct{}, n-reserved),
+		reserved: make(chan struct{}, reserved),
+	}
+}
+
+// acquire blocks until a slot is free for a statement of the given priority, and returns a
+// function that frees it. Batch statements only use shared slots. Interactive statements use a
+// reserved slot if one is free, leaving the shared ones to batch statements, and otherwise take
+// whichever slot frees first.
+func (s *querySlots) acquire(p influxql.Priority) (release func()) {
+	if s == nil {
+		return func() {}
+	}
+
+	if p == influxql.BatchPriority {
+		s.shared <- struct{}{}
+		return func() { <-s.shared }
+	}
+
+	select {
+	case s.reserved <- struct{}{}:
+		return func() { <-s.reserved }
+	default:
+	}
+
+	select {
+	case s.reserved <- struct{}{}:
+		return func() { <-s.reserved }
+	case s.shared <- struct{}{}:
+		return func() { <-s.shared }
+	}
+}
+
 // rewriteSelectStatement performs any necessary query re-writing.
 func (q *QueryExecutor) rewriteSelectStatement(stmt *influxql.SelectStatement) (*influxql.SelectStatement, error) {
 	var err error
@@ -276,15 +537,18 @@ func (q *QueryExecutor) expandWildcards(stmt *influxql.SelectStatement) (*influx
 	var fields influxql.Fields
 	var dimensions influxql.Dimensions
 
-	// Iterate measurements in the FROM clause getting the fields & dimensions for each.
+	// Iterate measurements in the FROM clause getting the fields & dimensions for each. The
+	// sources may be in different databases.
+	var indexed bool
 	for _, src := range stmt.Sources {
 		if m, ok := src.(*influxql.Measurement); ok {
 			// Lookup the database. The database may not exist if no data for this database
 			// was ever written to the shard.
 			db := q.store.DatabaseIndex(m.Database)
 			if db == nil {
-				return stmt, nil
+				continue
 			}
+			indexed = true
 
 			// Lookup the measurement in the database.
 			mm := db.measurements[m.Name]
@@ -312,8 +576,18 @@ func (q *QueryExecutor) expandWildcards(stmt *influxql.SelectStatement) (*influx
 		}
 	}
 
-	// Return a new SelectStatement with the wild cards rewritten.
-	return stmt.RewriteWildcards(fields, dimensions), nil
+	// None of the databases have been written to
+	if !indexed {
+		return stmt, nil
+	}
+
+	// Return a new SelectStatement with the wild cards rewritten. Field regexes that don't match
+	// any field can leave nothing to select, which is an error like a missing measurement is.
+	rw := stmt.RewriteWildcards(fields, dimensions)
+	if len(rw.Fields) == 0 {
+		return nil, ErrNoFieldsMatch(stmt.Fields)
+	}
+	return rw, nil
 }
 
 // expandSources expands regex sources and removes duplicates.
@@ -360,7 +634,7 @@ func (q *QueryExecutor) expandSources(sources influxql.Sources) (influxql.Source
 			}
 
 		default:
-			return nil, fmt.Errorf("expandSources: unsuported source type: %T", source)
+			return nil, influxql.NewErrUnsupportedSource(source)
 		}
 	}
 
@@ -494,33 +768,54 @@ func (q *QueryExecutor) executeShowSeriesStatement(stmt *influxql.ShowSeriesStat
 		return &influxql.Result{Err: err}
 	}
 
-	// Create result struct that will be populated and returned.
-	result := &influxql.Result{
-		Series: make(influxql.Rows, 0, len(measurements)),
+	// Series are only returned if they have data in a shard of the database.
+	shards, err := q.databaseShards(database)
+	if err != nil {
+		return &influxql.Result{Err: err}
 	}
 
-	// Loop through measurements to build result. One result row / measurement.
-	for _, m := range measurements {
-		var ids seriesIDs
-
+	// Find the series of each measurement that match the WHERE clause.
+	ids := make([]seriesIDs, len(measurements))
+	var seriesKeys []string
+	for i, m := range measurements {
 		if stmt.Condition != nil {
 			// Get series IDs that match the WHERE clause.
-			ids, _, err = m.walkWhereForSeriesIds(stmt.Condition)
+			ids[i], _, err = m.walkWhereForSeriesIds(stmt.Condition)
 			if err != nil {
 				return &influxql.Result{Err: err}
 			}
 
-			// If no series matched, then go to the next measurement.
-			if len(ids) == 0 {
-				continue
-			}
-
 			// TODO: check return of walkWhereForSeriesIds for fields
 		} else {
 			// No WHERE clause so get all series IDs for this measurement.
-			ids = m.seriesIDs
+			ids[i] = m.seriesIDs
 		}
 
+		for _, id := range ids[i] {
+			if s, ok := m.seriesByID[id]; ok {
+				seriesKeys = append(seriesKeys, s.Key)
+			}
+		}
+	}
+
+	// Find the series with data in any shard, from the shard indexes rather than the points. Each
+	// shard is read by a single mapper for the series of every measurement.
+	mappers := make([]influxql.Mapper, len(shards))
+	for i, sh := range shards {
+		mappers[i] = NewSeriesMapper(q.store.Shard(sh.ID), sh.ID, seriesKeys)
+	}
+	keys, err := mapSeriesKeys(mappers, showSeriesChunkSize)
+	if err != nil {
+		return &influxql.Result{Err: err}
+	}
+
+	// Create result struct that will be populated and returned.
+	result := &influxql.Result{
+		Series: make(influxql.Rows, 0, len(measurements)),
+	}
+
+	// Loop through measurements to build result. One result row / measurement.
+	for i, m := range measurements {
 		// Make a new row for this measurement.
 		r := &influxql.Row{
 			Name:    m.Name,
@@ -528,8 +823,11 @@ func (q *QueryExecutor) executeShowSeriesStatement(stmt *influxql.ShowSeriesStat
 		}
 
 		// Loop through series IDs getting matching tag sets.
-		for _, id := range ids {
+		for _, id := range ids[i] {
 			if s, ok := m.seriesByID[id]; ok {
+				if _, ok := keys[s.Key]; !ok {
+					continue
+				}
 				values := make([]interface{}, 0, len(r.Columns))
 
 				// make the series key the first value
@@ -543,6 +841,12 @@ func (q *QueryExecutor) executeShowSeriesStatement(stmt *influxql.ShowSeriesStat
 				r.Values = append(r.Values, values)
 			}
 		}
+
+		// If no series matched or has data, then go to the next measurement.
+		if len(r.Values) == 0 {
+			continue
+		}
+
 		// make the id the first column
 		r.Columns = append([]string{"_key"}, r.Columns...)
 
@@ -557,6 +861,63 @@ func (q *QueryExecutor) executeShowSeriesStatement(stmt *influxql.ShowSeriesStat
 	return result
 }
 
+// showSeriesChunkSize is the number of series keys read from a series mapper at a time.
+const showSeriesChunkSize = 1000
+
+// mapSeriesKeys returns the set of series keys returned by the series mappers. A series with
+// data in several shards is returned by each of their mappers, but appears once in the set.
+func mapSeriesKeys(mappers []influxql.Mapper, chunkSize int) (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+	for _, m := range mappers {
+		if err := m.Open(); err != nil {
+			return nil, err
+		}
+		err := func() error {
+			defer m.Close()
+			if err := m.Begin(nil, 0, chunkSize); err != nil {
+				return err
+			}
+			for {
+				res, err := m.NextInterval()
+				if err != nil {
+					return err
+				} else if res == nil {
+					return nil
+				}
+				for _, key := range res.([]string) {
+					keys[key] = struct{}{}
+				}
+			}
+		}()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// databaseShards returns the shards of the database that are on this node.
+func (q *QueryExecutor) databaseShards(database string) ([]meta.ShardInfo, error) {
+	di, err := q.MetaStore.Database(database)
+	if err != nil {
+		return nil, err
+	} else if di == nil {
+		return nil, ErrDatabaseNotFound(database)
+	}
+
+	var shards []meta.ShardInfo
+	for _, rp := range di.RetentionPolicies {
+		for _, sg := range rp.ShardGroups {
+			for _, sh := range sg.Shards {
+				if q.store.Shard(sh.ID) != nil {
+					shards = append(shards, sh)
+				}
+			}
+		}
+	}
+	return shards, nil
+}
+
 // filterShowSeriesResult will limit the number of series returned based on the limit and the offset.
 // Unlike limit and offset on SELECT statements, the limit and offset don't apply to the number of Rows, but
 // to the number of total Values returned, since each Value represents a unique series.
@@ -959,3 +1320,21 @@ var (
 func ErrDatabaseNotFound(name string) error { return fmt.Errorf("database not found: %s", name) }
 
 func ErrMeasurementNotFound(name string) error { return fmt.Errorf("measurement not found: %s", name) }
+
+// ErrShardGroupNotFound returns an error for a shard group that doesn't exist or was dropped.
+func ErrShardGroupNotFound(id uint64) error { return fmt.Errorf("shard group not found: %d", id) }
+
+// ErrNoFieldsMatch returns an error for select statements whose field regexes match no fields.
+func ErrNoFieldsMatch(fields influxql.Fields) error {
+	return fmt.Errorf("no fields match %s", fields)
+}
+
+// ErrRemoteIntervals is returned when a RemoteMapperFunc returns a mapper of an aggregate that
+// doesn't implement influxql.IntervalTimer.
+var ErrRemoteIntervals = errors.New("remote mappers of aggregates must report their intervals")
+
+// ErrNotPrimaryOwner returns an error for a shard that must be read from its primary owner, another
+// node, by an executor that can't read from other nodes.
+func ErrNotPrimaryOwner(shardID, nodeID uint64) error {
+	return fmt.Errorf("shard %d must be read from its primary owner, node %d: the one read consistency level only works on the primary owner's node", shardID, nodeID)
+}
@@ -1,13 +1,17 @@
 package tsdb
 
 import (
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/influxdb/influxdb/influxql"
 	"github.com/influxdb/influxdb/meta"
 )
@@ -167,6 +171,63 @@ func TestDropSeriesStatement(t *testing.T) {
 	}
 }
 
+// Ensure that only the series that weren't dropped are returned by a query.
+func TestDropSeriesStatement_Subset(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{"host": "serverA"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{"host": "serverB"}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	got := executeAndGetJSON("drop series from cpu where host = 'serverA'", executor)
+	exepected := `[{}]`
+	if exepected != got {
+		t.Fatalf("exp: %s\ngot: %s", exepected, got)
+	}
+
+	got = executeAndGetJSON("select * from cpu", executor)
+	exepected = `[{"series":[{"name":"cpu","tags":{"host":"serverB"},"columns":["time","value"],"values":[["1970-01-01T00:00:02Z",2]]}]}]`
+	if exepected != got {
+		t.Fatalf("exp: %s\ngot: %s", exepected, got)
+	}
+
+	store.Close()
+}
+
+// Ensure that field value predicates spanning multiple fields are applied by the mapper.
+func TestWritePointsAndExecuteQuery_FieldFilters(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{"host": "server"}, map[string]interface{}{"value": 1.0, "load": 5.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{"host": "server"}, map[string]interface{}{"value": 2.0, "load": 20.0}, time.Unix(2, 0)),
+		NewPoint("cpu", map[string]string{"host": "server"}, map[string]interface{}{"value": 3.0, "load": 5.0}, time.Unix(3, 0)),
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	got := executeAndGetJSON("select value from cpu where value > 1 AND load < 10", executor)
+	exepected := `[{"series":[{"name":"cpu","tags":{"host":"server"},"columns":["time","value"],"values":[["1970-01-01T00:00:03Z",3]]}]}]`
+	if exepected != got {
+		t.Fatalf("exp: %s\ngot: %s", exepected, got)
+	}
+
+	got = executeAndGetJSON("select value from cpu where value > 2 OR load > 10", executor)
+	exepected = `[{"series":[{"name":"cpu","tags":{"host":"server"},"columns":["time","value"],"values":[["1970-01-01T00:00:02Z",2],["1970-01-01T00:00:03Z",3]]}]}]`
+	if exepected != got {
+		t.Fatalf("exp: %s\ngot: %s", exepected, got)
+	}
+
+	store.Close()
+}
+
 func TestDropMeasurementStatement(t *testing.T) {
 	store, executor := testStoreAndExecutor()
 	defer os.RemoveAll(store.path)
@@ -344,103 +405,1570 @@ func TestAuthenticateIfUserCountZeroAndCreateUser(t *testing.T) {
 	}
 }
 
-func testStoreAndExecutor() (*Store, *QueryExecutor) {
-	path, _ := ioutil.TempDir("", "")
+// Ensure a user needs read on every database a select statement reads from.
+func TestAuthorizeMultipleDatabases(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+	executor.MetaStore = &testMetastore{userCount: 1}
 
-	store := NewStore(path)
-	err := store.Open()
-	if err != nil {
-		panic(err)
+	u := &meta.UserInfo{Name: "bob", Privileges: map[string]influxql.Privilege{"foo": influxql.ReadPrivilege}}
+	if err := executor.Authorize(u, mustParseQuery(`select * from cpu`), "foo"); err != nil {
+		t.Fatalf("unexpected error reading the default database: %s", err)
+	}
+	if err := executor.Authorize(u, mustParseQuery(`select * from "foo".."cpu"`), ""); err != nil {
+		t.Fatalf("unexpected error reading a named database: %s", err)
+	}
+	if executor.Authorize(u, mustParseQuery(`select * from "db2".."cpu"`), "foo") == nil {
+		t.Fatal("expected reading another database without read on it to fail")
+	}
+	if executor.Authorize(u, mustParseQuery(`select * from cpu, "db2".."cpu"`), "foo") == nil {
+		t.Fatal("expected reading several databases without read on each of them to fail")
 	}
-	database := "foo"
-	retentionPolicy := "bar"
-	shardID := uint64(1)
-	store.CreateShard(database, retentionPolicy, shardID)
 
-	executor := NewQueryExecutor(store)
-	executor.MetaStore = &testMetastore{}
+	u.Privileges["db2"] = influxql.ReadPrivilege
+	if err := executor.Authorize(u, mustParseQuery(`select * from cpu, "db2".."cpu"`), "foo"); err != nil {
+		t.Fatalf("unexpected error reading several databases: %s", err)
+	}
+}
 
-	return store, executor
+// Ensure that selecting a raw field alongside an aggregate returns an error.
+func TestQueryMixedRawAndAggregate(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{NewPoint(
+		"cpu",
+		map[string]string{"host": "server"},
+		map[string]interface{}{"value": 1.0},
+		time.Now(),
+	)}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	got := executeAndGetJSON("select value, mean(value) from cpu", executor)
+	expected := `[{"error":"cannot select field \"value\" alongside aggregate function \"mean\"; mixing raw fields and aggregates is not supported"}]`
+	if expected != got {
+		t.Fatalf("exp: %s\ngot: %s", expected, got)
+	}
+
+	// Tags can still be used alongside aggregates.
+	got = executeAndGetJSON("select mean(value), host from cpu group by host", executor)
+	if strings.Contains(got, "error") {
+		t.Fatalf("unexpected error: %s", got)
+	}
 }
 
-func executeAndGetJSON(query string, executor *QueryExecutor) string {
-	ch, err := executor.ExecuteQuery(mustParseQuery(query), "foo", 20)
-	if err != nil {
-		panic(err.Error())
+// Ensure series without a tag that's grouped by are grouped together under an empty value.
+func TestQueryGroupByMissingTag(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{"host": "serverA", "region": "east"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{"region": "east"}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+		NewPoint("cpu", map[string]string{"region": "west"}, map[string]interface{}{"value": 4.0}, time.Unix(3, 0)),
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 8.0}, time.Unix(4, 0)),
+	}); err != nil {
+		t.Fatalf(err.Error())
 	}
 
-	var results []*influxql.Result
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{
+			q:   `select sum(value) from cpu group by host`,
+			exp: `[{"series":[{"name":"cpu","tags":{"host":""},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",14]]},{"name":"cpu","tags":{"host":"serverA"},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",1]]}]}]`,
+		},
+		{
+			q:   `select sum(value) from cpu group by host, region`,
+			exp: `[{"series":[{"name":"cpu","tags":{"host":"serverA","region":"east"},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",1]]},{"name":"cpu","tags":{"host":"","region":""},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",8]]},{"name":"cpu","tags":{"host":"","region":"east"},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",2]]},{"name":"cpu","tags":{"host":"","region":"west"},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",4]]}]}]`,
+		},
+		{
+			// no series has the tag
+			q:   `select sum(value) from cpu group by dc`,
+			exp: `[{"series":[{"name":"cpu","tags":{"dc":""},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",15]]}]}]`,
+		},
+		{
+			q:   `select sum(value) from cpu group by value`,
+			exp: `[{"error":"can not use field in group by clause: value"}]`,
+		},
+	} {
+		if got := executeAndGetJSON(tt.q, executor); got != tt.exp {
+			t.Fatalf("%s:\nexp: %s\ngot: %s", tt.q, tt.exp, got)
+		}
+	}
+}
+
+// Ensure the tags of each row are the tags grouped by and selected for its measurement, not the
+// other tags of its series or those selected from another measurement.
+func TestQueryGroupByRowTags(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{"host": "serverA", "region": "east"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{"host": "serverA", "region": "west"}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+		NewPoint("mem", map[string]string{"host": "serverA"}, map[string]interface{}{"value": 4.0}, time.Unix(1, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{
+			q:   `select value from cpu group by host`,
+			exp: `[{"series":[{"name":"cpu","tags":{"host":"serverA"},"columns":["time","value"],"values":[["1970-01-01T00:00:01Z",1],["1970-01-01T00:00:02Z",2]]}]}]`,
+		},
+		{
+			q:   `select sum(value) from cpu group by host`,
+			exp: `[{"series":[{"name":"cpu","tags":{"host":"serverA"},"columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",3]]}]}]`,
+		},
+	} {
+		if got := executeAndGetJSON(tt.q, executor); got != tt.exp {
+			t.Fatalf("%s:\nexp: %s\ngot: %s", tt.q, tt.exp, got)
+		}
+	}
+
+	// region is only a tag of cpu, so only the rows of cpu are grouped by it.
+	executor.UnifyColumns = true
+	ch, err := executor.ExecuteQuery(mustParseQuery(`select value, region from cpu, mem group by host`), "foo", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows influxql.Rows
 	for r := range ch {
-		results = append(results, r)
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+		rows = append(rows, r.Series...)
+	}
+
+	tags := make(map[string][]map[string]string)
+	for _, row := range rows {
+		tags[row.Name] = append(tags[row.Name], row.Tags)
+	}
+	if exp := map[string][]map[string]string{
+		"cpu": {{"host": "serverA", "region": "east"}, {"host": "serverA", "region": "west"}},
+		"mem": {{"host": "serverA"}},
+	}; !reflect.DeepEqual(tags, exp) {
+		t.Fatalf("unexpected tags:\nexp: %v\ngot: %v", exp, tags)
 	}
-	return string(mustMarshalJSON(results))
 }
 
-type testMetastore struct {
-	userCount int
+// Ensure SHOW SERIES returns the series with data in any shard once.
+func TestQueryShowSeriesShards(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+	store.CreateShard("foo", "bar", 2)
+	executor.MetaStore = &testMetastore{shardIDs: []uint64{1, 2}}
+
+	// web01 has data in both shards
+	if err := store.WriteToShard(1, []Point{
+		NewPoint("cpu", map[string]string{"host": "web01"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{"host": "web02"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteToShard(2, []Point{
+		NewPoint("cpu", map[string]string{"host": "web01"}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+		NewPoint("cpu", map[string]string{"host": "web03"}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+		NewPoint("mem", map[string]string{"host": "web01"}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{
+			q:   `show series from cpu`,
+			exp: `[{"series":[{"name":"cpu","columns":["_key","host"],"values":[["cpu,host=web01","web01"],["cpu,host=web02","web02"],["cpu,host=web03","web03"]]}]}]`,
+		},
+		{
+			q:   `show series from cpu where host = 'web01'`,
+			exp: `[{"series":[{"name":"cpu","columns":["_key","host"],"values":[["cpu,host=web01","web01"]]}]}]`,
+		},
+		{
+			q:   `show series where host = 'web01'`,
+			exp: `[{"series":[{"name":"cpu","columns":["_key","host"],"values":[["cpu,host=web01","web01"]]},{"name":"mem","columns":["_key","host"],"values":[["mem,host=web01","web01"]]}]}]`,
+		},
+	} {
+		if got := executeAndGetJSON(tt.q, executor); got != tt.exp {
+			t.Fatalf("%s:\nexp: %s\ngot: %s", tt.q, tt.exp, got)
+		}
+	}
+
+	// a mapper only returns the series with data in its shard, whatever their measurement
+	keys, err := mapSeriesKeys([]influxql.Mapper{NewSeriesMapper(store.Shard(2), 2, []string{"cpu,host=web01", "cpu,host=web02", "cpu,host=web03", "mem,host=web01"})}, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]struct{}{"cpu,host=web01": {}, "cpu,host=web03": {}, "mem,host=web01": {}}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	// a mapper checks its series against its scope
+	m := NewSeriesMapper(store.Shard(2), 2, []string{"cpu,host=web01", "mem,host=web01"})
+	m.Scope = &influxql.Scope{Measurements: []string{"cpu"}}
+	if _, err := mapSeriesKeys([]influxql.Mapper{m}, 1); err == nil || err.Error() != "measurement mem isn't in the scope of the query" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m = NewSeriesMapper(store.Shard(2), 2, []string{"cpu,host=web01", "cpu,host=web03"})
+	m.Scope = &influxql.Scope{Tags: map[string]string{"host": "web01"}}
+	if _, err := mapSeriesKeys([]influxql.Mapper{m}, 1); err == nil || err.Error() != "series cpu,host=web03 isn't in the scope of the query" {
+		t.Fatalf("unexpected error: %v", err)
+	}
 }
 
-func (t *testMetastore) Database(name string) (*meta.DatabaseInfo, error) {
-	return &meta.DatabaseInfo{
-		Name: name,
-		DefaultRetentionPolicy: "foo",
-		RetentionPolicies: []meta.RetentionPolicyInfo{
-			{
-				Name: "bar",
-				ShardGroups: []meta.ShardGroupInfo{
-					{
-						ID:        uint64(1),
-						StartTime: time.Now().Add(-time.Hour),
-						EndTime:   time.Now().Add(time.Hour),
-						Shards: []meta.ShardInfo{
-							{
-								ID:       uint64(1),
-								OwnerIDs: []uint64{1},
-							},
-						},
-					},
-				},
-			},
+// Ensure a select statement reading a shard that stays locked past the open timeout returns a
+// shard busy error rather than waiting for the lock.
+func TestQueryShardOpenTimeout(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+	executor.ShardOpenTimeout = 10 * time.Millisecond
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the shard lock, as a flush of the WAL does.
+	sh := store.Shard(shardID)
+	sh.mu.Lock()
+	got := executeAndGetJSON(`select value from cpu`, executor)
+	sh.mu.Unlock()
+	if exp := `[{"error":"shard busy: shard 1 wasn't opened within 10ms"}]`; got != exp {
+		t.Fatalf("exp: %s\ngot: %s", exp, got)
+	}
+
+	exp := `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:01Z",1]]}]}]`
+	if got := executeAndGetJSON(`select value from cpu`, executor); got != exp {
+		t.Fatalf("exp: %s\ngot: %s", exp, got)
+	}
+}
+
+// Ensure field regexes select the fields whose names match, in order of name.
+func TestQueryFieldRegex(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("net", map[string]string{}, map[string]interface{}{"bytes_out": 2.0, "packets": 3.0, "bytes_in": 1.0, "errors_bytes": 4.0}, time.Unix(1, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{
+			q:   `select /^bytes_/ from net`,
+			exp: `[{"series":[{"name":"net","columns":["time","bytes_in","bytes_out"],"values":[["1970-01-01T00:00:01Z",1,2]]}]}]`,
 		},
-	}, nil
+		{
+			q:   `select packets, /^bytes_/ from net`,
+			exp: `[{"series":[{"name":"net","columns":["time","packets","bytes_in","bytes_out"],"values":[["1970-01-01T00:00:01Z",3,1,2]]}]}]`,
+		},
+		{
+			q:   `select /^drops/ from net`,
+			exp: `[{"error":"no fields match /^drops/"}]`,
+		},
+	} {
+		if got := executeAndGetJSON(tt.q, executor); got != tt.exp {
+			t.Fatalf("%s:\nexp: %s\ngot: %s", tt.q, tt.exp, got)
+		}
+	}
 }
 
-func (t *testMetastore) Databases() ([]meta.DatabaseInfo, error) {
-	db, _ := t.Database("foo")
-	return []meta.DatabaseInfo{*db}, nil
+// Ensure the series of measurements with different fields have the same columns when columns are unified.
+func TestQueryUnifyColumns(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"idle": 1.0, "value": 2.0}, time.Unix(1, 0)),
+		NewPoint("mem", map[string]string{}, map[string]interface{}{"free": 3.0, "value": 4.0}, time.Unix(1, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, exp := executeAndGetJSON(`select * from cpu, mem`, executor), `[{"error":"unknown field or tag name in select clause: free"}]`; got != exp {
+		t.Fatalf("\nexp: %s\ngot: %s", exp, got)
+	}
+
+	executor.UnifyColumns = true
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{
+			q:   `select * from cpu, mem`,
+			exp: `[{"series":[{"name":"cpu","columns":["time","free","idle","value"],"values":[["1970-01-01T00:00:01Z",null,1,2]]},{"name":"mem","columns":["time","free","idle","value"],"values":[["1970-01-01T00:00:01Z",3,null,4]]}]}]`,
+		},
+		{
+			q:   `select free from cpu, mem`,
+			exp: `[{"series":[{"name":"mem","columns":["time","free"],"values":[["1970-01-01T00:00:01Z",3]]}]}]`,
+		},
+		{
+			q:   `select swap from cpu, mem`,
+			exp: `[{"error":"unknown field or tag name in select clause: swap"}]`,
+		},
+	} {
+		if got := executeAndGetJSON(tt.q, executor); got != tt.exp {
+			t.Fatalf("%s:\nexp: %s\ngot: %s", tt.q, tt.exp, got)
+		}
+	}
 }
 
-func (t *testMetastore) User(name string) (*meta.UserInfo, error) { return nil, nil }
+// Ensure points written and flushed into a shard after its mappers are opened aren't returned.
+func TestQuerySnapshot(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
 
-func (t *testMetastore) AdminUserExists() (bool, error) { return false, nil }
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 3.0}, time.Unix(3, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-func (t *testMetastore) Authenticate(username, password string) (*meta.UserInfo, error) {
-	return nil, nil
+	e, err := influxql.NewPlanner(executor).Plan(mustParseQuery(`select value from cpu`).Statements[0].(*influxql.SelectStatement), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The mappers are opened before the first row is sent.
+	ch := e.Execute()
+	rows := []*influxql.Row{<-ch}
+
+	// Write between the points still to be read and flush them into the series bucket. Bolt may
+	// have to wait for the mappers' read transactions to grow the file, so write concurrently.
+	done := make(chan error, 1)
+	go func() {
+		if err := store.WriteToShard(shardID, []Point{
+			NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 100.0}, time.Unix(2, 500000000)),
+			NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 200.0}, time.Unix(4, 0)),
+		}); err != nil {
+			done <- err
+			return
+		}
+		done <- store.Shard(shardID).Flush()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+		done = nil
+	case <-time.After(time.Second):
+	}
+
+	for row := range ch {
+		rows = append(rows, row)
+	}
+	if done != nil {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var values []interface{}
+	for _, row := range rows {
+		if row.Err != nil {
+			t.Fatal(row.Err)
+		}
+		for _, v := range row.Values {
+			values = append(values, v[1])
+		}
+	}
+	if exp := []interface{}{1.0, 2.0, 3.0}; !reflect.DeepEqual(values, exp) {
+		t.Fatalf("exp: %v, got: %v", exp, values)
+	}
+
+	// A query run after the writes sees them.
+	if got, exp := executeAndGetJSON(`select value from cpu`, executor), `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:01Z",1],["1970-01-01T00:00:02Z",2],["1970-01-01T00:00:02.5Z",100],["1970-01-01T00:00:03Z",3],["1970-01-01T00:00:04Z",200]]}]}]`; got != exp {
+		t.Fatalf("\nexp: %s\ngot: %s", exp, got)
+	}
 }
 
-func (t *testMetastore) RetentionPolicy(database, name string) (rpi *meta.RetentionPolicyInfo, err error) {
-	return &meta.RetentionPolicyInfo{
-		Name: "bar",
-		ShardGroups: []meta.ShardGroupInfo{
-			{
-				ID:        uint64(1),
-				StartTime: time.Now().Add(-time.Hour),
-				EndTime:   time.Now().Add(time.Hour),
-				Shards: []meta.ShardInfo{
-					{
-						ID:       uint64(1),
-						OwnerIDs: []uint64{1},
-					},
-				},
+// Ensure the OnPoint hook is called with the series key and fields of every point read.
+func TestQueryOnPoint(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{"host": "serverA"}, map[string]interface{}{"value": 1.0, "idle": 5.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{"host": "serverB"}, map[string]interface{}{"value": 2.0, "idle": 6.0}, time.Unix(2, 0)),
+		NewPoint("cpu", map[string]string{"host": "serverA"}, map[string]interface{}{"value": 3.0, "idle": 7.0}, time.Unix(3, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	type point struct {
+		series string
+		time   int64
+		fields map[string]interface{}
+	}
+	var points []point
+	executor.OnPoint = func(series string, tm time.Time, fields map[string]interface{}) {
+		points = append(points, point{series: series, time: tm.Unix(), fields: fields})
+	}
+
+	for _, tt := range []struct {
+		q   string
+		exp []point
+	}{
+		{
+			q: `select value from cpu`,
+			exp: []point{
+				{series: "cpu,host=serverA", time: 1, fields: map[string]interface{}{"value": 1.0}},
+				{series: "cpu,host=serverB", time: 2, fields: map[string]interface{}{"value": 2.0}},
+				{series: "cpu,host=serverA", time: 3, fields: map[string]interface{}{"value": 3.0}},
 			},
 		},
-	}, nil
+		{
+			q: `select value, idle from cpu where host = 'serverA'`,
+			exp: []point{
+				{series: "cpu,host=serverA", time: 1, fields: map[string]interface{}{"value": 1.0, "idle": 5.0}},
+				{series: "cpu,host=serverA", time: 3, fields: map[string]interface{}{"value": 3.0, "idle": 7.0}},
+			},
+		},
+		{
+			q: `select sum(idle) from cpu group by host`,
+			exp: []point{
+				{series: "cpu,host=serverA", time: 1, fields: map[string]interface{}{"idle": 5.0}},
+				{series: "cpu,host=serverA", time: 3, fields: map[string]interface{}{"idle": 7.0}},
+				{series: "cpu,host=serverB", time: 2, fields: map[string]interface{}{"idle": 6.0}},
+			},
+		},
+	} {
+		points = nil
+		if got := executeAndGetJSON(tt.q, executor); strings.Contains(got, "error") {
+			t.Fatalf("%s: %s", tt.q, got)
+		}
+		if !reflect.DeepEqual(points, tt.exp) {
+			t.Fatalf("%s:\nexp: %v\ngot: %v", tt.q, tt.exp, points)
+		}
+	}
 }
 
-func (t *testMetastore) UserCount() (int, error) {
-	return t.userCount, nil
+// Ensure fields whose type differs between shards are coerced to the types forced by the query.
+func TestQueryFieldTypes(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+	store.CreateShard("foo", "bar", 2)
+	executor.MetaStore = &testMetastore{shardIDs: []uint64{1, 2}}
+
+	// value was written as an integer into the first shard and as a float into the second
+	if err := store.WriteToShard(1, []Point{
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": int64(1), "state": "idle"}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": int64(2), "state": "busy"}, time.Unix(2, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteToShard(2, []Point{
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 2.5, "state": "idle"}, time.Unix(3, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		types map[string]influxql.DataType
+		q     string
+		exp   string
+	}{
+		{
+			types: map[string]influxql.DataType{"value": influxql.Float},
+			q:     `select sum(value) from cpu`,
+			exp:   `[{"series":[{"name":"cpu","columns":["time","sum"],"values":[["1970-01-01T00:00:00Z",5.5]]}]}]`,
+		},
+		{
+			types: map[string]influxql.DataType{"value": influxql.String},
+			q:     `select value from cpu`,
+			exp:   `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:01Z","1"],["1970-01-01T00:00:02Z","2"],["1970-01-01T00:00:03Z","2.5"]]}]}]`,
+		},
+		{
+			types: map[string]influxql.DataType{"value": influxql.Integer},
+			q:     `select value from cpu where value > 1`,
+			exp:   `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:02Z",2],["1970-01-01T00:00:03Z",2]]}]}]`,
+		},
+		{
+			types: map[string]influxql.DataType{"state": influxql.Float},
+			q:     `select value, state from cpu`,
+			exp:   `[{"error":"can't coerce string value \"idle\" of field state to float"}]`,
+		},
+	} {
+		executor.FieldTypes = tt.types
+		if got := executeAndGetJSON(tt.q, executor); got != tt.exp {
+			t.Fatalf("%s:\nexp: %s\ngot: %s", tt.q, tt.exp, got)
+		}
+	}
 }
 
+// Ensure scoped queries only read the series in their scope, and mappers check the scope of their
+// job rather than trusting the planner.
+func TestQueryScope(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{"tenant": "acme"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{"tenant": "other"}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+		NewPoint("mem", map[string]string{"tenant": "acme"}, map[string]interface{}{"value": 3.0}, time.Unix(3, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	scope := &influxql.Scope{Measurements: []string{"cpu"}, Tags: map[string]string{"tenant": "acme"}}
+
+	e, err := influxql.NewPlanner(executor).PlanContext(mustParseQuery(`select value from cpu where tenant = 'other' or value > 0`).Statements[0].(*influxql.SelectStatement), 0, scope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []interface{}
+	for row := range e.Execute() {
+		if row.Err != nil {
+			t.Fatal(row.Err)
+		}
+		for _, v := range row.Values {
+			values = append(values, v[1])
+		}
+	}
+	if exp := []interface{}{1.0}; !reflect.DeepEqual(values, exp) {
+		t.Fatalf("exp: %v, got: %v", exp, values)
+	}
+
+	// a forbidden measurement is rejected by the planner
+	if _, err := influxql.NewPlanner(executor).PlanContext(mustParseQuery(`select value from mem`).Statements[0].(*influxql.SelectStatement), 0, scope); err == nil || err.Error() != "measurement mem isn't in the scope of the query" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the mappers of a job created without the scope's filters don't read the series outside it
+	stmt := mustParseQuery(`select value from cpu`).Statements[0].(*influxql.SelectStatement)
+	jobs, err := newTx(executor.MetaStore, store).CreateMapReduceJobs(stmt, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(jobs) != 1 {
+		t.Fatalf("unexpected jobs: %v", jobs)
+	}
+	jobs[0].Scope = scope
+	if err := jobs[0].Open(); err == nil || err.Error() != "series cpu,tenant=other isn't in the scope of the query" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the mappers of a shard dropped after the query was planned return a shard not found error.
+func TestQueryDroppedShard(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := influxql.NewPlanner(executor).Plan(mustParseQuery(`select value from cpu`).Statements[0].(*influxql.SelectStatement), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteShard(shardID); err != nil {
+		t.Fatal(err)
+	}
+	if row := <-e.Execute(); row.Err != ErrShardNotFound {
+		t.Fatalf("unexpected row: %v", row)
+	}
+}
+
+// Ensure shards are only read from their primary owner at the "one" consistency level.
+func TestQueryReadConsistency(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the remote mapper reads a point of its own from the node
+	var remoteNodeIDs []uint64
+	remoteMapper := func(job *influxql.MapReduceJob, nodeID uint64, sh meta.ShardInfo) (influxql.Mapper, error) {
+		remoteNodeIDs = append(remoteNodeIDs, nodeID)
+		return &testRemoteMapper{shardID: sh.ID, time: int64(2 * time.Second), value: float64(nodeID)}, nil
+	}
+
+	for _, tt := range []struct {
+		consistency influxql.ReadConsistency
+		ownerIDs    []uint64
+		remote      bool // if true, the executor can read shards from other nodes
+		exp         string
+	}{
+		{consistency: influxql.ReadConsistencyAny, ownerIDs: []uint64{2, 1}, exp: `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:01Z",1]]}]}]`},
+		{consistency: influxql.ReadConsistencyOne, ownerIDs: []uint64{1, 2}, remote: true, exp: `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:01Z",1]]}]}]`},
+		{consistency: influxql.ReadConsistencyOne, ownerIDs: []uint64{2, 1}, remote: true, exp: `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:02Z",2]]}]}]`},
+		{consistency: influxql.ReadConsistencyOne, ownerIDs: []uint64{2, 1}, exp: `[{"error":"shard 1 must be read from its primary owner, node 2: the one read consistency level only works on the primary owner's node"}]`},
+		{consistency: influxql.ReadConsistencyQuorum, ownerIDs: []uint64{1, 2}, exp: `[{"error":"read consistency level not supported: quorum"}]`},
+	} {
+		executor.MetaStore = &testMetastore{ownerIDs: tt.ownerIDs}
+		executor.ReadConsistency = tt.consistency
+		executor.RemoteMapper = nil
+		if tt.remote {
+			executor.RemoteMapper = remoteMapper
+		}
+		if got := executeAndGetJSON(`select value from cpu`, executor); got != tt.exp {
+			t.Fatalf("%s %v:\nexp: %s\ngot: %s", tt.consistency, tt.ownerIDs, tt.exp, got)
+		}
+	}
+
+	// only the shard whose primary owner is another node is read remotely
+	if !reflect.DeepEqual(remoteNodeIDs, []uint64{2}) {
+		t.Fatalf("unexpected remote reads: %v", remoteNodeIDs)
+	}
+
+	// the remote mappers of aggregates must report their intervals
+	executor.MetaStore = &testMetastore{ownerIDs: []uint64{2, 1}}
+	executor.ReadConsistency, executor.RemoteMapper = influxql.ReadConsistencyOne, remoteMapper
+	if got, exp := executeAndGetJSON(`select count(value) from cpu`, executor), `[{"error":"remote mappers of aggregates must report their intervals"}]`; got != exp {
+		t.Fatalf("exp: %s\ngot: %s", exp, got)
+	}
+}
+
+// testRemoteMapper is a mapper of a shard on another node, which has a single point.
+type testRemoteMapper struct {
+	shardID uint64
+	time    int64
+	value   interface{}
+	read    bool
+}
+
+func (m *testRemoteMapper) Open() error     { return nil }
+func (m *testRemoteMapper) Close()          {}
+func (m *testRemoteMapper) ShardID() uint64 { return m.shardID }
+
+func (m *testRemoteMapper) Begin(c *influxql.Call, startingTime int64, limit int) error {
+	m.read = false
+	return nil
+}
+
+// NextInterval returns the point of the mapper the first time it's called.
+func (m *testRemoteMapper) NextInterval() (interface{}, error) {
+	if m.read {
+		return nil, nil
+	}
+	m.read = true
+	return influxql.MapRawQuery(&testRemoteIterator{time: m.time, value: m.value}), nil
+}
+
+// testRemoteIterator iterates over the point of a testRemoteMapper.
+type testRemoteIterator struct {
+	time  int64
+	value interface{}
+	done  bool
+}
+
+func (itr *testRemoteIterator) Next() (string, int64, interface{}) {
+	if itr.done {
+		return "", 0, nil
+	}
+	itr.done = true
+	return "", itr.time, itr.value
+}
+
+// Ensure raw queries sorted by descending time read the series backward from the end of the time range.
+func TestQueryOrderByDesc(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{
+		NewPoint("cpu", map[string]string{"host": "serverA"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0)),
+		NewPoint("cpu", map[string]string{"host": "serverB"}, map[string]interface{}{"value": 2.0}, time.Unix(2, 0)),
+		NewPoint("cpu", map[string]string{"host": "serverA"}, map[string]interface{}{"value": 3.0}, time.Unix(3, 0)),
+		NewPoint("cpu", map[string]string{"host": "serverB"}, map[string]interface{}{"value": 4.0}, time.Unix(4, 0)),
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{
+			q:   `select value from cpu order by time desc`,
+			exp: `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:04Z",4],["1970-01-01T00:00:03Z",3],["1970-01-01T00:00:02Z",2],["1970-01-01T00:00:01Z",1]]}]}]`,
+		},
+		{
+			q:   `select value from cpu where time < '1970-01-01T00:00:04Z' order by time desc limit 2`,
+			exp: `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:03Z",3],["1970-01-01T00:00:02Z",2]]}]}]`,
+		},
+		{
+			q:   `select value from cpu group by host order by time desc`,
+			exp: `[{"series":[{"name":"cpu","tags":{"host":"serverA"},"columns":["time","value"],"values":[["1970-01-01T00:00:03Z",3],["1970-01-01T00:00:01Z",1]]},{"name":"cpu","tags":{"host":"serverB"},"columns":["time","value"],"values":[["1970-01-01T00:00:04Z",4],["1970-01-01T00:00:02Z",2]]}]}]`,
+		},
+	} {
+		if got := executeAndGetJSON(tt.q, executor); got != tt.exp {
+			t.Fatalf("%s:\nexp: %s\ngot: %s", tt.q, tt.exp, got)
+		}
+	}
+}
+
+// Ensure the latest value of each series is read backward from the end of the series.
+func TestQueryLastValuePerSeries(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	var points []Point
+	for i := 1; i <= 100; i++ {
+		points = append(points,
+			NewPoint("cpu", map[string]string{"host": "serverA"}, map[string]interface{}{"value": float64(i)}, time.Unix(int64(i), 0)),
+			NewPoint("cpu", map[string]string{"host": "serverB"}, map[string]interface{}{"value": float64(-i)}, time.Unix(int64(i), 0)),
+		)
+	}
+	// The last point of serverB doesn't have the field, so the one before it is the latest value.
+	points = append(points, NewPoint("cpu", map[string]string{"host": "serverB"}, map[string]interface{}{"load": 1.0}, time.Unix(101, 0)))
+	if err := store.WriteToShard(shardID, points); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	got := executeAndGetJSON("select last(value) from cpu group by host", executor)
+	exepected := `[{"series":[{"name":"cpu","tags":{"host":"serverA"},"columns":["time","last"],"values":[["1970-01-01T00:00:00Z",100]]},{"name":"cpu","tags":{"host":"serverB"},"columns":["time","last"],"values":[["1970-01-01T00:00:00Z",-100]]}]}]`
+	if exepected != got {
+		t.Fatalf("exp: %s\ngot: %s", exepected, got)
+	}
+
+	got = executeAndGetJSON("select last(value) from cpu where time < '1970-01-01T00:00:51Z' group by host", executor)
+	exepected = `[{"series":[{"name":"cpu","tags":{"host":"serverA"},"columns":["time","last"],"values":[["1970-01-01T00:00:00Z",50]]},{"name":"cpu","tags":{"host":"serverB"},"columns":["time","last"],"values":[["1970-01-01T00:00:00Z",-50]]}]}]`
+	if exepected != got {
+		t.Fatalf("exp: %s\ngot: %s", exepected, got)
+	}
+
+	// Compare the points read by last() with those read by a full scan.
+	for _, tt := range []struct {
+		s   string
+		exp int
+	}{
+		{s: `SELECT last(value) FROM "foo"."bar".cpu WHERE host = 'serverB'`, exp: 2},
+		{s: `SELECT count(value) FROM "foo"."bar".cpu WHERE host = 'serverB'`, exp: 101},
+		{s: `SELECT /*+ no_last_optimization */ last(value) FROM "foo"."bar".cpu WHERE host = 'serverB'`, exp: 101},
+	} {
+		stmt := mustParseQuery(tt.s).Statements[0].(*influxql.SelectStatement)
+		tx, _ := executor.Begin()
+		jobs, err := tx.CreateMapReduceJobs(stmt, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(jobs) != 1 || len(jobs[0].Mappers) != 1 {
+			t.Fatalf("unexpected jobs: %v", jobs)
+		}
+
+		m := jobs[0].Mappers[0].(*LocalMapper)
+		if err := m.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Begin(stmt.FunctionCalls()[0], jobs[0].TMin, 1); err != nil {
+			t.Fatal(err)
+		} else if _, err := m.NextInterval(); err != nil {
+			t.Fatal(err)
+		}
+		m.Close()
+
+		if m.readN != tt.exp {
+			t.Fatalf("%s: unexpected points read: exp=%d, got=%d", tt.s, tt.exp, m.readN)
+		}
+	}
+}
+
+// Ensure a transaction restricted to a set of shard groups only reads those groups.
+func TestTx_SetShardGroupIDs(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{NewPoint(
+		"cpu",
+		map[string]string{"host": "server"},
+		map[string]interface{}{"value": 1.0},
+		time.Unix(1, 0),
+	)}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	stmt := mustParseQuery(`SELECT value FROM "foo"."bar".cpu`).Statements[0].(*influxql.SelectStatement)
+
+	tx := newTx(executor.MetaStore, store)
+	tx.SetShardGroupIDs([]uint64{1})
+	if jobs, err := tx.CreateMapReduceJobs(stmt, nil); err != nil {
+		t.Fatal(err)
+	} else if len(jobs) != 1 || len(jobs[0].Mappers) != 1 {
+		t.Fatalf("unexpected jobs: %v", jobs)
+	}
+
+	tx = newTx(executor.MetaStore, store)
+	tx.SetShardGroupIDs([]uint64{1, 2})
+	if _, err := tx.CreateMapReduceJobs(stmt, nil); err == nil || err.Error() != "shard group not found: 2" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// Ensure the number of points in a series bucket is estimated from a sample of its first points,
+// and counted exactly for small buckets.
+func TestEstimateKeyN(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tsdb-estimate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, tt := range []struct {
+		n        int   // the number of points written
+		interval int64 // the time between points
+		min, max int   // the range the estimate must be in
+	}{
+		{n: 0, interval: 1, min: 0, max: 0},
+		{n: 10, interval: 7, min: 10, max: 10},
+		{n: estimateKeySampleN, interval: 3, min: estimateKeySampleN, max: estimateKeySampleN},
+		{n: 10000, interval: 10, min: 10000, max: 10000},
+		{n: 50000, interval: 1000, min: 49000, max: 51000},
+	} {
+		var got int
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.CreateBucket([]byte(fmt.Sprintf("series-%d", tt.n)))
+			if err != nil {
+				return err
+			}
+			for i := 0; i < tt.n; i++ {
+				if err := b.Put(u64tob(uint64(int64(i)*tt.interval)), []byte{0}); err != nil {
+					return err
+				}
+			}
+			got = estimateKeyN(b)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if got < tt.min || got > tt.max {
+			t.Fatalf("%d points: unexpected estimate: %d", tt.n, got)
+		}
+	}
+}
+
+// Ensure mappers decode points with the decoder registered for the format of their shard.
+func TestQueryPointDecoder(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{NewPoint(
+		"cpu",
+		map[string]string{"host": "server"},
+		map[string]interface{}{"value": 1.0},
+		time.Unix(1, 0),
+	)}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var decoded int
+	pointDecoders[7] = func(sh *Shard, measurement string) PointDecoder {
+		return &testPointDecoder{FieldCodec: sh.FieldCodec(measurement), decoded: &decoded}
+	}
+	defer delete(pointDecoders, 7)
+
+	executor.MetaStore.(*testMetastore).shardFormat = 7
+	got := executeAndGetJSON("select value from cpu", executor)
+	exepected := `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:01Z",1]]}]}]`
+	if exepected != got {
+		t.Fatalf("exp: %s\ngot: %s", exepected, got)
+	} else if decoded != 1 {
+		t.Fatalf("unexpected points decoded: %d", decoded)
+	}
+
+	executor.MetaStore.(*testMetastore).shardFormat = 8
+	got = executeAndGetJSON("select value from cpu", executor)
+	exepected = `[{"error":"unknown shard format: 8"}]`
+	if exepected != got {
+		t.Fatalf("exp: %s\ngot: %s", exepected, got)
+	}
+}
+
+// Ensure the mappers of a raw query only decode the fields it reads from the points of a wide
+// measurement, and that a wildcard or the no_field_pruning hint still reads every field.
+func TestQuerySelectiveDecoding(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	fields := make(map[string]interface{})
+	for i := 0; i < 50; i++ {
+		fields[fmt.Sprintf("f%02d", i)] = float64(i)
+	}
+	var points []Point
+	for i := 1; i <= 10; i++ {
+		points = append(points, NewPoint("wide", map[string]string{}, fields, time.Unix(int64(i), 0)))
+	}
+	if err := store.WriteToShard(shardID, points); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded int
+	pointDecoders[7] = func(sh *Shard, measurement string) PointDecoder {
+		return &testFieldCountingDecoder{codec: sh.FieldCodec(measurement), decoded: &decoded}
+	}
+	pointDecoders[9] = func(sh *Shard, measurement string) PointDecoder {
+		return &testSelectiveCountingDecoder{&testFieldCountingDecoder{codec: sh.FieldCodec(measurement), decoded: &decoded}}
+	}
+	defer delete(pointDecoders, 7)
+	defer delete(pointDecoders, 9)
+
+	for _, tt := range []struct {
+		format   uint32
+		q        string
+		columnN  int
+		decodedN int
+	}{
+		{format: 7, q: `select f00, f01 from wide`, columnN: 3, decodedN: 500},
+		{format: 9, q: `select f00, f01 from wide`, columnN: 3, decodedN: 20},
+		{format: 9, q: `select f00, f01 from wide where f02 = 2`, columnN: 3, decodedN: 30},
+		{format: 9, q: `select * from wide`, columnN: 51, decodedN: 500},
+		{format: 9, q: `select /*+ no_field_pruning */ f00, f01 from wide`, columnN: 3, decodedN: 500},
+	} {
+		decoded = 0
+		executor.MetaStore.(*testMetastore).shardFormat = tt.format
+		ch, err := executor.ExecuteQuery(mustParseQuery(tt.q), "foo", 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows influxql.Rows
+		for r := range ch {
+			if r.Err != nil {
+				t.Fatalf("%s: %s", tt.q, r.Err)
+			}
+			rows = append(rows, r.Series...)
+		}
+
+		if len(rows) != 1 || len(rows[0].Columns) != tt.columnN || len(rows[0].Values) != 10 {
+			t.Fatalf("%s: unexpected rows: %v", tt.q, rows)
+		} else if rows[0].Values[9][1] != 0.0 || rows[0].Values[9][2] != 1.0 {
+			t.Fatalf("%s: unexpected values: %v", tt.q, rows[0].Values[9])
+		} else if decoded != tt.decodedN {
+			t.Fatalf("%s: format %d: unexpected fields decoded: %d", tt.q, tt.format, decoded)
+		}
+	}
+}
+
+// Ensure aggregates over intervals containing whole blocks of points are computed from the rollups
+// of shards that keep them without decoding the points, and that the results are the same as when
+// the points are read.
+func TestQueryRollups(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	// the points are in the shard group of the test meta store, which starts an hour ago
+	base := time.Now().UTC().Truncate(time.Hour)
+	var points []Point
+	for i := 0; i < 600; i++ {
+		ts := base.Add(time.Duration(i) * time.Second)
+		points = append(points,
+			NewPoint("cpu", map[string]string{"host": "a"}, map[string]interface{}{"value": float64(i % 13)}, ts),
+			NewPoint("cpu", map[string]string{"host": "b"}, map[string]interface{}{"value": float64(i%7) - 3}, ts),
+		)
+	}
+	if err := store.WriteToShard(shardID, points); err != nil {
+		t.Fatal(err)
+	} else if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded int
+	pointDecoders[10] = func(sh *Shard, measurement string) PointDecoder {
+		return &testRollupDecoder{testPointDecoder{FieldCodec: sh.FieldCodec(measurement), decoded: &decoded}, int64(10 * time.Second)}
+	}
+	defer delete(pointDecoders, 10)
+
+	timeRange := func(start, end time.Duration) string {
+		return fmt.Sprintf(`where time >= '%s' and time < '%s'`, base.Add(start).Format(time.RFC3339), base.Add(end).Format(time.RFC3339))
+	}
+	where := timeRange(0, 10*time.Minute)
+	for _, tt := range []struct {
+		q        string
+		decodedN int
+	}{
+		{q: `select count(value), sum(value), mean(value), min(value), max(value) from cpu ` + where + ` group by time(1m)`},
+		{q: `select sum(value) from cpu ` + where + ` group by time(1m), host`},
+		{q: `select max(value) from cpu ` + where},
+		{q: `select derivative(mean(value), 1m) from cpu ` + where + ` group by time(1m)`},
+
+		// the first interval starts in the middle of a block, so its points are read
+		{q: `select sum(value) from cpu ` + timeRange(5*time.Second, 10*time.Minute) + ` group by time(1m)`, decodedN: 110},
+
+		// the intervals are finer than the blocks
+		{q: `select sum(value) from cpu ` + where + ` group by time(5s)`, decodedN: 1200},
+
+		// the points are filtered, or the aggregate can't be computed from rollups
+		{q: `select sum(value) from cpu ` + where + ` and value > 2 group by time(1m)`, decodedN: 1200},
+		{q: `select median(value) from cpu ` + where + ` group by time(1m)`, decodedN: 1200},
+	} {
+		executor.MetaStore.(*testMetastore).shardFormat = 0
+		exp := executeAndGetRows(t, tt.q, executor)
+		if len(exp) == 0 {
+			t.Fatalf("%s: no rows", tt.q)
+		}
+
+		decoded = 0
+		executor.MetaStore.(*testMetastore).shardFormat = 10
+		if got := executeAndGetRows(t, tt.q, executor); !rowsAlmostEqual(exp, got) {
+			t.Fatalf("%s: rows from rollups don't match the points:\nexp: %v\ngot: %v", tt.q, exp, got)
+		} else if decoded != tt.decodedN {
+			t.Fatalf("%s: unexpected points decoded: %d", tt.q, decoded)
+		}
+	}
+
+	// the points still in the cache aren't in any block, so the interval they're in is read
+	if err := store.WriteToShard(shardID, []Point{NewPoint("cpu", map[string]string{"host": "a"}, map[string]interface{}{"value": 100.0}, base.Add(599*time.Second+500))}); err != nil {
+		t.Fatal(err)
+	}
+	q := `select sum(value) from cpu ` + where + ` group by time(1m)`
+	executor.MetaStore.(*testMetastore).shardFormat = 0
+	exp := executeAndGetRows(t, q, executor)
+	decoded = 0
+	executor.MetaStore.(*testMetastore).shardFormat = 10
+	if got := executeAndGetRows(t, q, executor); !rowsAlmostEqual(exp, got) {
+		t.Fatalf("rows from rollups don't match the points:\nexp: %v\ngot: %v", exp, got)
+	} else if decoded != 121 {
+		t.Fatalf("unexpected points decoded: %d", decoded)
+	}
+}
+
+// Ensure the no_rollups hint, and its alias no_count_fastpath, make aggregates read the points of
+// shards that keep rollups, with the same results as reading the rollups.
+func TestQueryRollups_NoRollupsHint(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	base := time.Now().UTC().Truncate(time.Hour)
+	var points []Point
+	for i := 0; i < 600; i++ {
+		points = append(points, NewPoint("cpu", map[string]string{"host": "a"}, map[string]interface{}{"value": float64(i % 13)}, base.Add(time.Duration(i)*time.Second)))
+	}
+	if err := store.WriteToShard(shardID, points); err != nil {
+		t.Fatal(err)
+	} else if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded int
+	pointDecoders[10] = func(sh *Shard, measurement string) PointDecoder {
+		return &testRollupDecoder{testPointDecoder{FieldCodec: sh.FieldCodec(measurement), decoded: &decoded}, int64(10 * time.Second)}
+	}
+	defer delete(pointDecoders, 10)
+	executor.MetaStore.(*testMetastore).shardFormat = 10
+
+	where := fmt.Sprintf(`where time >= '%s' and time < '%s'`, base.Format(time.RFC3339), base.Add(10*time.Minute).Format(time.RFC3339))
+	q := `select count(value), sum(value), mean(value), min(value), max(value) from cpu ` + where + ` group by time(1m)`
+	exp := executeAndGetRows(t, q, executor)
+	if len(exp) == 0 {
+		t.Fatal("no rows")
+	} else if decoded != 0 {
+		t.Fatalf("unexpected points decoded from rollups: %d", decoded)
+	}
+
+	for _, hint := range []string{"no_rollups", "no_count_fastpath"} {
+		decoded = 0
+		hinted := strings.Replace(q, "select ", "select /*+ "+hint+" */ ", 1)
+		if got := executeAndGetRows(t, hinted, executor); !rowsAlmostEqual(exp, got) {
+			t.Fatalf("%s: rows from points don't match the rollups:\nexp: %v\ngot: %v", hint, exp, got)
+		} else if decoded != 600 {
+			t.Fatalf("%s: unexpected points decoded: %d", hint, decoded)
+		}
+	}
+}
+
+// Ensure points exactly at the bounds of the time range of a query are returned only if the bounds
+// are inclusive, and the points a nanosecond inside them always are.
+func TestQueryTimeBounds(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	// points at each bound, and a nanosecond either side of it
+	base := time.Now().UTC().Truncate(time.Hour)
+	start, end := base.Add(time.Second), base.Add(2*time.Second)
+	var points []Point
+	for _, ts := range []time.Time{start, end} {
+		for _, d := range []time.Duration{-1, 0, 1} {
+			points = append(points, NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": 1.0}, ts.Add(d)))
+		}
+	}
+	if err := store.WriteToShard(shardID, points); err != nil {
+		t.Fatal(err)
+	} else if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		cond string
+		exp  []time.Time
+	}{
+		{cond: `time > '%[1]s' and time < '%[2]s'`, exp: []time.Time{start.Add(1), end.Add(-1)}},
+		{cond: `time >= '%[1]s' and time <= '%[2]s'`, exp: []time.Time{start, start.Add(1), end.Add(-1), end}},
+		{cond: `time > '%[1]s' and time <= '%[2]s'`, exp: []time.Time{start.Add(1), end.Add(-1), end}},
+		{cond: `time >= '%[1]s' and time < '%[2]s'`, exp: []time.Time{start, start.Add(1), end.Add(-1)}},
+		{cond: `time = '%[1]s'`, exp: []time.Time{start}},
+	} {
+		cond := fmt.Sprintf(tt.cond, start.Format(time.RFC3339Nano), end.Format(time.RFC3339Nano))
+		var exp, got []int64
+		for _, ts := range tt.exp {
+			exp = append(exp, ts.UnixNano())
+		}
+		for _, row := range executeAndGetRows(t, `select value from cpu where `+cond, executor) {
+			for _, v := range row.Values {
+				got = append(got, v[0].(time.Time).UnixNano())
+			}
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%s: unexpected times:\nexp: %v\ngot: %v", cond, exp, got)
+		}
+	}
+}
+
+// Ensure a statement can select from measurements of several databases, each read from the shard
+// groups of its own database, with the rows of each database tagged with it.
+func TestQueryMultipleDatabases(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	// foo has a single shard group, db2 has a group for the last hour and another for the next, and
+	// db3 only has an older group, outside the time range of the query
+	now := time.Now()
+	store.CreateShard("db2", "bar", 2)
+	store.CreateShard("db2", "bar", 3)
+	store.CreateShard("db3", "bar", 4)
+	executor.MetaStore.(*testMetastore).groups = map[string][]meta.ShardGroupInfo{
+		"foo": {{ID: 1, StartTime: now.Add(-time.Hour), EndTime: now.Add(time.Hour), Shards: []meta.ShardInfo{{ID: 1, OwnerIDs: []uint64{1}}}}},
+		"db2": {
+			{ID: 2, StartTime: now.Add(-time.Hour), EndTime: now, Shards: []meta.ShardInfo{{ID: 2, OwnerIDs: []uint64{1}}}},
+			{ID: 3, StartTime: now, EndTime: now.Add(time.Hour), Shards: []meta.ShardInfo{{ID: 3, OwnerIDs: []uint64{1}}}},
+		},
+		"db3": {{ID: 4, StartTime: now.Add(-3 * time.Hour), EndTime: now.Add(-2 * time.Hour), Shards: []meta.ShardInfo{{ID: 4, OwnerIDs: []uint64{1}}}}},
+	}
+
+	base := now.UTC().Truncate(time.Hour)
+	for _, w := range []struct {
+		shardID uint64
+		ts      time.Time
+		value   float64
+	}{
+		{shardID: 1, ts: base.Add(time.Second), value: 1},
+		{shardID: 2, ts: base.Add(2 * time.Second), value: 2},
+		{shardID: 3, ts: base.Add(time.Hour), value: 3},
+		{shardID: 4, ts: now.Add(-150 * time.Minute), value: 4},
+	} {
+		if err := store.WriteToShard(w.shardID, []Point{NewPoint("cpu", map[string]string{}, map[string]interface{}{"value": w.value}, w.ts)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	cond := fmt.Sprintf(`time >= '%s' and time < '%s'`, base.Format(time.RFC3339Nano), base.Add(2*time.Hour).Format(time.RFC3339Nano))
+	for _, tt := range []struct {
+		q   string
+		exp string
+	}{
+		{
+			q:   `select value from "foo".."cpu", "db2".."cpu", "db3".."cpu" where ` + cond,
+			exp: `db2: [2 3], foo: [1]`,
+		},
+		{
+			q:   `select count(value) from "foo".."cpu", "db2".."cpu", "db3".."cpu" where ` + cond,
+			exp: `db2: [2], foo: [1]`,
+		},
+		{
+			// the rows of a single database aren't tagged with it
+			q:   `select value from "db2".."cpu" where ` + cond,
+			exp: `: [2 3]`,
+		},
+	} {
+		var got []string
+		for _, row := range executeAndGetRows(t, tt.q, executor) {
+			if row.Name != "cpu" {
+				t.Fatalf("%s: unexpected name: %s", tt.q, row.Name)
+			}
+			var values []interface{}
+			for _, v := range row.Values {
+				values = append(values, v[1])
+			}
+			got = append(got, fmt.Sprintf("%s: %v", row.Tags[DatabaseTag], values))
+		}
+		if s := strings.Join(got, ", "); s != tt.exp {
+			t.Fatalf("%s: unexpected rows:\nexp: %s\ngot: %s", tt.q, tt.exp, s)
+		}
+	}
+}
+
+// executeAndGetRows executes a query and returns the series of its results.
+func executeAndGetRows(t *testing.T, q string, executor *QueryExecutor) influxql.Rows {
+	ch, err := executor.ExecuteQuery(mustParseQuery(q), "foo", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rows influxql.Rows
+	for r := range ch {
+		if r.Err != nil {
+			t.Fatalf("%s: %s", q, r.Err)
+		}
+		rows = append(rows, r.Series...)
+	}
+	return rows
+}
+
+// rowsAlmostEqual returns true if the rows are the same, apart from float values within 1e-9.
+func rowsAlmostEqual(a, b influxql.Rows) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || !reflect.DeepEqual(a[i].Tags, b[i].Tags) || len(a[i].Values) != len(b[i].Values) {
+			return false
+		}
+		for j := range a[i].Values {
+			if len(a[i].Values[j]) != len(b[i].Values[j]) {
+				return false
+			}
+			for k, v := range a[i].Values[j] {
+				f, ok := v.(float64)
+				if g, isFloat := b[i].Values[j][k].(float64); ok && isFloat {
+					if math.Abs(f-g) > 1e-9 {
+						return false
+					}
+				} else if !reflect.DeepEqual(v, b[i].Values[j][k]) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// testRollupDecoder is a testPointDecoder whose shards keep rollups of blocks of points spanning
+// the given duration, which it computes from the points of the bucket without counting them.
+type testRollupDecoder struct {
+	testPointDecoder
+	span int64
+}
+
+func (d *testRollupDecoder) Rollups(tx *bolt.Tx, seriesKey string, fieldID uint8, tmin, tmax int64) ([]influxql.Rollup, error) {
+	b := tx.Bucket([]byte(seriesKey))
+	if b == nil {
+		return nil, nil
+	}
+
+	var rollups []influxql.Rollup
+	c := b.Cursor()
+	for k, v := c.Seek(u64tob(uint64(tmin - tmin%d.span))); k != nil; k, v = c.Next() {
+		t := int64(btou64(k))
+		if t > tmax-tmax%d.span+d.span-1 {
+			break
+		}
+		value, err := d.FieldCodec.DecodeByID(fieldID, v)
+		if err != nil {
+			return nil, err
+		}
+		f, ok := value.(float64)
+		if !ok {
+			continue
+		}
+
+		// start a new rollup for the first point of each block
+		if n := len(rollups); n == 0 || rollups[n-1].Start/d.span != t/d.span {
+			rollups = append(rollups, influxql.Rollup{Start: t, Min: f, Max: f})
+		}
+		r := &rollups[len(rollups)-1]
+		r.End = t
+		r.Count++
+		r.Sum += f
+		r.Min = math.Min(r.Min, f)
+		r.Max = math.Max(r.Max, f)
+	}
+	return rollups, nil
+}
+
+// testFieldCountingDecoder is a point decoder that counts the field values it decodes by name. It
+// doesn't implement SelectiveDecoder, so every field of a point is decoded.
+type testFieldCountingDecoder struct {
+	codec   *FieldCodec
+	decoded *int
+}
+
+func (d *testFieldCountingDecoder) FieldIDByName(name string) (uint8, error) {
+	return d.codec.FieldIDByName(name)
+}
+
+func (d *testFieldCountingDecoder) DecodeByID(id uint8, b []byte) (interface{}, error) {
+	*d.decoded++
+	return d.codec.DecodeByID(id, b)
+}
+
+func (d *testFieldCountingDecoder) DecodeFieldsWithNames(b []byte) (map[string]interface{}, error) {
+	values, err := d.codec.DecodeFieldsWithNames(b)
+	*d.decoded += len(values)
+	return values, err
+}
+
+// testSelectiveCountingDecoder is a testFieldCountingDecoder that implements SelectiveDecoder.
+type testSelectiveCountingDecoder struct {
+	*testFieldCountingDecoder
+}
+
+func (d *testSelectiveCountingDecoder) DecodeSelectedFields(ids []uint8, b []byte) (map[string]interface{}, error) {
+	values, err := d.codec.DecodeSelectedFields(ids, b)
+	*d.decoded += len(values)
+	return values, err
+}
+
+// testPointDecoder is a FieldCodec that counts the points it decodes.
+type testPointDecoder struct {
+	*FieldCodec
+	decoded *int
+}
+
+func (d *testPointDecoder) DecodeByID(id uint8, b []byte) (interface{}, error) {
+	*d.decoded++
+	return d.FieldCodec.DecodeByID(id, b)
+}
+
+func testStoreAndExecutor() (*Store, *QueryExecutor) {
+	path, _ := ioutil.TempDir("", "")
+
+	store := NewStore(path)
+	err := store.Open()
+	if err != nil {
+		panic(err)
+	}
+	database := "foo"
+	retentionPolicy := "bar"
+	shardID := uint64(1)
+	store.CreateShard(database, retentionPolicy, shardID)
+
+	executor := NewQueryExecutor(store)
+	executor.MetaStore = &testMetastore{}
+
+	return store, executor
+}
+
+// Ensure the shards of a retention policy can be warmed, and that warming stops once canceled.
+func TestQueryExecutor_Warm(t *testing.T) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	if err := store.WriteToShard(shardID, []Point{NewPoint(
+		"cpu", map[string]string{"host": "serverA"}, map[string]interface{}{"value": 1.0}, time.Unix(1, 0),
+	)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := executor.Warm("foo", "bar", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	closing := make(chan struct{})
+	close(closing)
+	if err := executor.Warm("foo", "bar", closing); err != influxql.ErrWarmCanceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// queries still read the warmed shard
+	got := executeAndGetJSON("select value from cpu", executor)
+	if exp := `[{"series":[{"name":"cpu","columns":["time","value"],"values":[["1970-01-01T00:00:01Z",1]]}]}]`; got != exp {
+		t.Fatalf("exp: %s\ngot: %s", exp, got)
+	}
+}
+
+// Benchmark the first query after the store is opened, with and without warming its shards.
+func BenchmarkQueryExecutor_FirstQuery(b *testing.B)        { benchmarkFirstQuery(b, false) }
+func BenchmarkQueryExecutor_FirstQuery_Warmed(b *testing.B) { benchmarkFirstQuery(b, true) }
+
+func benchmarkFirstQuery(b *testing.B, warm bool) {
+	store, executor := testStoreAndExecutor()
+	defer os.RemoveAll(store.path)
+
+	var points []Point
+	for i := 0; i < 1000; i++ {
+		for j := 0; j < 10; j++ {
+			points = append(points, NewPoint(
+				"cpu", map[string]string{"host": fmt.Sprintf("server%d", i)}, map[string]interface{}{"value": float64(j)}, time.Unix(int64(j), 0),
+			))
+		}
+	}
+	if err := store.WriteToShard(shardID, points); err != nil {
+		b.Fatal(err)
+	}
+	q := mustParseQuery("select last(value) from cpu group by host")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := store.Close(); err != nil {
+			b.Fatal(err)
+		} else if err := store.Open(); err != nil {
+			b.Fatal(err)
+		}
+		if warm {
+			if err := executor.Warm("foo", "bar", nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StartTimer()
+
+		ch, err := executor.ExecuteQuery(q, "foo", 0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for r := range ch {
+			if r.Err != nil {
+				b.Fatal(r.Err)
+			}
+		}
+	}
+}
+
+// Ensure batch statements can't take the slots reserved for interactive statements.
+func TestQuerySlots(t *testing.T) {
+	s := newQuerySlots(2, 1)
+
+	// A batch statement takes the only shared slot, so the next one waits.
+	release := s.acquire(influxql.BatchPriority)
+	acquired := make(chan struct{})
+	go func() {
+		s.acquire(influxql.BatchPriority)()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("batch statement acquired a reserved slot")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// An interactive statement still gets the reserved slot.
+	done := make(chan struct{})
+	go func() {
+		s.acquire(influxql.InteractivePriority)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("interactive statement didn't acquire the reserved slot")
+	}
+
+	// The waiting batch statement runs once the shared slot is freed.
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("batch statement didn't acquire the freed slot")
+	}
+}
+
+func executeAndGetJSON(query string, executor *QueryExecutor) string {
+	ch, err := executor.ExecuteQuery(mustParseQuery(query), "foo", 20)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	var results []*influxql.Result
+	for r := range ch {
+		results = append(results, r)
+	}
+	return string(mustMarshalJSON(results))
+}
+
+type testMetastore struct {
+	userCount   int
+	shardFormat uint32
+	shardIDs    []uint64 // the shards of the shard group, shard 1 if empty
+	ownerIDs    []uint64 // the owners of every shard, node 1 if empty
+
+	groups map[string][]meta.ShardGroupInfo // if set, the shard groups of the databases it has
+}
+
+// shards returns the shards of the shard group.
+func (t *testMetastore) shards() []meta.ShardInfo {
+	ids := t.shardIDs
+	if len(ids) == 0 {
+		ids = []uint64{1}
+	}
+	ownerIDs := t.ownerIDs
+	if len(ownerIDs) == 0 {
+		ownerIDs = []uint64{1}
+	}
+	shards := make([]meta.ShardInfo, len(ids))
+	for i, id := range ids {
+		shards[i] = meta.ShardInfo{ID: id, OwnerIDs: ownerIDs, Format: t.shardFormat}
+	}
+	return shards
+}
+
+// shardGroups returns the shard groups of the retention policy of a database: those set for it,
+// or a single group of the last and next hour.
+func (t *testMetastore) shardGroups(database string) []meta.ShardGroupInfo {
+	if groups, ok := t.groups[database]; ok {
+		return groups
+	}
+	return []meta.ShardGroupInfo{
+		{
+			ID:        uint64(1),
+			StartTime: time.Now().Add(-time.Hour),
+			EndTime:   time.Now().Add(time.Hour),
+			Shards:    t.shards(),
+		},
+	}
+}
+
+func (t *testMetastore) Database(name string) (*meta.DatabaseInfo, error) {
+	return &meta.DatabaseInfo{
+		Name: name,
+		DefaultRetentionPolicy: "foo",
+		RetentionPolicies: []meta.RetentionPolicyInfo{
+			{
+				Name:        "bar",
+				ShardGroups: t.shardGroups(name),
+			},
+		},
+	}, nil
+}
+
+func (t *testMetastore) Databases() ([]meta.DatabaseInfo, error) {
+	db, _ := t.Database("foo")
+	return []meta.DatabaseInfo{*db}, nil
+}
+
+func (t *testMetastore) User(name string) (*meta.UserInfo, error) { return nil, nil }
+
+func (t *testMetastore) AdminUserExists() (bool, error) { return false, nil }
+
+func (t *testMetastore) Authenticate(username, password string) (*meta.UserInfo, error) {
+	return nil, nil
+}
+
+func (t *testMetastore) RetentionPolicy(database, name string) (rpi *meta.RetentionPolicyInfo, err error) {
+	return &meta.RetentionPolicyInfo{
+		Name:        "bar",
+		ShardGroups: t.shardGroups(database),
+	}, nil
+}
+
+func (t *testMetastore) UserCount() (int, error) {
+	return t.userCount, nil
+}
+
+func (t *testMetastore) NodeID() uint64 { return 1 }
+
 // MustParseQuery parses an InfluxQL query. Panic on error.
 func mustParseQuery(s string) *influxql.Query {
 	q, err := influxql.NewParser(strings.NewReader(s)).ParseQuery()
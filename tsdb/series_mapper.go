@@ -0,0 +1,97 @@
+package tsdb
+
+import (
+	"errors"
+
+	"github.com/boltdb/bolt"
+	"github.com/influxdb/influxdb/influxql"
+)
+
+// ErrSeriesMapperAggregate is returned when a series mapper is asked to run an aggregate.
+var ErrSeriesMapperAggregate = errors.New("series mappers don't run aggregates")
+
+// SeriesMapper is a metadata-only mapper. Rather than the points of the series it's created for,
+// it returns the keys of those that have data in its shard, which it finds from the shard's
+// buckets and cache without reading any points. It's used to enumerate series for SHOW SERIES,
+// which creates one for each shard covering the series of every measurement it shows.
+//
+// Each call to NextInterval returns the next chunk of keys as a []string, in the order the
+// mapper was given them, and nil once every key has been returned.
+type SeriesMapper struct {
+	shard      *Shard
+	shardID    uint64
+	seriesKeys []string // the series to look for in the shard
+	keys       []string // the series with data in the shard, found by Open
+	chunkSize  int      // the number of keys returned by each call to NextInterval, all of them if zero
+
+	Scope *influxql.Scope // if set, the scope the series are checked against when the mapper is opened
+}
+
+// NewSeriesMapper returns a mapper that returns those of seriesKeys that have data in the shard.
+func NewSeriesMapper(shard *Shard, shardID uint64, seriesKeys []string) *SeriesMapper {
+	return &SeriesMapper{shard: shard, shardID: shardID, seriesKeys: seriesKeys}
+}
+
+// Open finds the series that have a bucket or cached points in the shard. If the mapper has a
+// scope, an error is returned if the measurement of any of the series, or the series itself, is
+// outside it, as it is by LocalMapper.
+func (m *SeriesMapper) Open() error {
+	if s := m.Scope; s != nil {
+		for _, key := range m.seriesKeys {
+			// a series deleted since the mapper was created isn't returned anyway
+			series := m.shard.index.Series(key)
+			if series == nil {
+				continue
+			} else if !s.AllowsMeasurement(series.measurement.Name) {
+				return influxql.ErrMeasurementNotInScope(series.measurement.Name)
+			} else if !s.AllowsSeries(series.Tags) {
+				return influxql.ErrSeriesNotInScope(key)
+			}
+		}
+	}
+
+	// Obtain shard lock to read the cache.
+	m.shard.mu.RLock()
+	defer m.shard.mu.RUnlock()
+
+	m.keys = nil
+	return m.shard.DB().View(func(tx *bolt.Tx) error {
+		for _, key := range m.seriesKeys {
+			if tx.Bucket([]byte(key)) != nil || len(m.shard.cache[WALPartition([]byte(key))][key]) > 0 {
+				m.keys = append(m.keys, key)
+			}
+		}
+		return nil
+	})
+}
+
+// Close closes the SeriesMapper.
+func (m *SeriesMapper) Close() {}
+
+// ShardID returns the ID of the shard read by the SeriesMapper.
+func (m *SeriesMapper) ShardID() uint64 { return m.shardID }
+
+// Begin sets the number of keys returned by each call to NextInterval. The mapper only returns
+// keys, so c must be nil, as it is for raw queries.
+func (m *SeriesMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int) error {
+	if c != nil {
+		return ErrSeriesMapperAggregate
+	}
+	m.chunkSize = chunkSize
+	return nil
+}
+
+// NextInterval returns the next chunk of series keys, or nil if they've all been returned.
+func (m *SeriesMapper) NextInterval() (interface{}, error) {
+	if len(m.keys) == 0 {
+		return nil, nil
+	}
+
+	n := len(m.keys)
+	if m.chunkSize > 0 && m.chunkSize < n {
+		n = m.chunkSize
+	}
+	keys := m.keys[:n]
+	m.keys = m.keys[n:]
+	return keys, nil
+}
@@ -189,6 +189,38 @@ func (s *Shard) DB() *bolt.DB {
 	return s.db
 }
 
+// WarmIndex opens the shard if it isn't open, which loads its in-memory index, and reads the
+// measurement fields and series index buckets of its store in full, so their pages are cached
+// for the first query. The buckets of the series' points aren't read. It stops with
+// influxql.ErrWarmCanceled once closing is closed.
+func (s *Shard) WarmIndex(closing <-chan struct{}) error {
+	if s.DB() == nil {
+		if err := s.Open(); err != nil {
+			return err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{"fields", "series"} {
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				select {
+				case <-closing:
+					return influxql.ErrWarmCanceled
+				default:
+				}
+			}
+		}
+		return nil
+	})
+}
+
 // TODO: this is temporarily exported to make tx.go work. When the query engine gets refactored
 // into the tsdb package this should be removed. No one outside tsdb should know the underlying field encoding scheme.
 func (s *Shard) FieldCodec(measurementName string) *FieldCodec {
@@ -1018,6 +1050,55 @@ func (f *FieldCodec) DecodeFieldsWithNames(b []byte) (map[string]interface{}, er
 	return m, nil
 }
 
+// DecodeSelectedFields decodes the fields with the given IDs from a byte slice into a set of field
+// names and values. The values of the other fields are skipped over without being decoded.
+func (f *FieldCodec) DecodeSelectedFields(ids []uint8, b []byte) (map[string]interface{}, error) {
+	var selected [256]bool
+	for _, id := range ids {
+		selected[id] = true
+	}
+
+	m := make(map[string]interface{}, len(ids))
+	for len(b) > 0 {
+		// First byte is the field identifier.
+		field := f.fieldsByID[b[0]]
+		if field == nil {
+			// See note in DecodeByID() regarding field-mapping failures.
+			return nil, ErrFieldUnmappedID
+		}
+
+		// Find the size of the value, and decode it if the field is selected.
+		var n int
+		switch field.Type {
+		case influxql.Float, influxql.Integer:
+			n = 9
+		case influxql.Boolean:
+			n = 2
+		case influxql.String:
+			n = int(binary.BigEndian.Uint16(b[1:3])) + 3
+		default:
+			panic(fmt.Sprintf("unsupported value type during decode selected fields: %T", field.Type))
+		}
+
+		if selected[field.ID] {
+			switch field.Type {
+			case influxql.Float:
+				m[field.Name] = math.Float64frombits(binary.BigEndian.Uint64(b[1:9]))
+			case influxql.Integer:
+				m[field.Name] = int64(binary.BigEndian.Uint64(b[1:9]))
+			case influxql.Boolean:
+				m[field.Name] = b[1] == 1
+			case influxql.String:
+				m[field.Name] = string(b[3:n])
+			}
+		}
+
+		// Move bytes forward.
+		b = b[n:]
+	}
+	return m, nil
+}
+
 // DecodeByID scans a byte slice for a field with the given ID, converts it to its
 // expected type, and return that value.
 // TODO: shouldn't be exported. refactor engine
@@ -1200,6 +1281,61 @@ func (sc *shardCursor) Next() (key, value []byte) {
 	return sc.read()
 }
 
+// SeekReverse moves the cursor to the last key/value pair at or before seek and returns it.
+// Subsequent calls to Prev read backward from there.
+func (sc *shardCursor) SeekReverse(seek []byte) (key, value []byte) {
+	// Seek bolt cursor to the key at or before seek.
+	if sc.cursor != nil {
+		k, v := sc.cursor.Seek(seek)
+		if k == nil {
+			k, v = sc.cursor.Last()
+		} else if bytes.Compare(k, seek) == 1 {
+			k, v = sc.cursor.Prev()
+		}
+		sc.buf.key, sc.buf.value = k, v
+	}
+
+	// Seek cache index to the last key at or before seek.
+	sc.index = sort.Search(len(sc.cache), func(i int) bool {
+		return bytes.Compare(sc.cache[i][0:8], seek) == 1
+	}) - 1
+
+	return sc.readReverse()
+}
+
+// Prev returns the previous key/value pair from the cursor.
+func (sc *shardCursor) Prev() (key, value []byte) {
+	// Read previous bolt key/value if not bufferred.
+	if sc.buf.key == nil && sc.cursor != nil {
+		sc.buf.key, sc.buf.value = sc.cursor.Prev()
+	}
+
+	return sc.readReverse()
+}
+
+// readReverse returns the previous key/value in the cursor buffer or cache.
+func (sc *shardCursor) readReverse() (key, value []byte) {
+	// If neither a buffer or cache exists then return nil.
+	if sc.buf.key == nil && sc.index < 0 {
+		return nil, nil
+	}
+
+	// Use the buffer if it exists and there's no cache or if it is higher than the cache.
+	if sc.buf.key != nil && (sc.index < 0 || bytes.Compare(sc.buf.key, sc.cache[sc.index][0:8]) == 1) {
+		key, value = sc.buf.key, sc.buf.value
+		sc.buf.key, sc.buf.value = nil, nil
+		return
+	}
+
+	// Otherwise read from the cache. The last of any duplicate keys in the cache is the one
+	// read going forward, so skip back past the others.
+	key, value = sc.cache[sc.index][0:8], sc.cache[sc.index][8:]
+	for sc.index--; sc.index >= 0 && bytes.Equal(key, sc.cache[sc.index][0:8]); sc.index-- {
+	}
+
+	return
+}
+
 // read returns the next key/value in the cursor buffer or cache.
 func (sc *shardCursor) read() (key, value []byte) {
 	// If neither a buffer or cache exists then return nil.
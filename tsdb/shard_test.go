@@ -9,6 +9,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"github.com/influxdb/influxdb/influxql"
 )
 
 func TestShardWriteAndIndex(t *testing.T) {
@@ -133,6 +135,49 @@ func TestShardWriteAddNewField(t *testing.T) {
 
 }
 
+// Ensure only the selected fields of a point are decoded, whatever their types.
+func TestFieldCodec_DecodeSelectedFields(t *testing.T) {
+	fields := make(map[string]*field)
+	values := make(map[string]interface{})
+	for i := 0; i < 50; i++ {
+		f := &field{ID: uint8(i + 1), Name: fmt.Sprintf("f%02d", i)}
+		switch i % 4 {
+		case 0:
+			f.Type, values[f.Name] = influxql.Float, float64(i)
+		case 1:
+			f.Type, values[f.Name] = influxql.Integer, int64(i)
+		case 2:
+			f.Type, values[f.Name] = influxql.Boolean, i%8 == 2
+		case 3:
+			f.Type, values[f.Name] = influxql.String, fmt.Sprintf("value %d", i)
+		}
+		fields[f.Name] = f
+	}
+	codec := newFieldCodec(fields)
+	b, err := codec.EncodeFields(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := codec.DecodeSelectedFields([]uint8{fields["f02"].ID, fields["f47"].ID}, b)
+	if err != nil {
+		t.Fatal(err)
+	} else if exp := map[string]interface{}{"f02": true, "f47": "value 47"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("unexpected fields: %v", got)
+	}
+
+	// selecting every field decodes the same values as decoding them all
+	ids := make([]uint8, 0, len(fields))
+	for _, f := range fields {
+		ids = append(ids, f.ID)
+	}
+	if got, err := codec.DecodeSelectedFields(ids, b); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got, values) {
+		t.Fatalf("unexpected fields: %v", got)
+	}
+}
+
 // Ensure the shard will automatically flush the WAL after a threshold has been reached.
 func TestShard_Autoflush(t *testing.T) {
 	path, _ := ioutil.TempDir("", "shard_test")
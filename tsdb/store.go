@@ -24,7 +24,9 @@ func NewStore(path string) *Store {
 }
 
 var (
-	ErrShardNotFound = fmt.Errorf("shard not found")
+	// ErrShardNotFound is returned when a shard isn't in the store. It's the same error the
+	// query engine receives from the mappers of dropped shards.
+	ErrShardNotFound = influxql.ErrShardNotFound
 )
 
 type Store struct {
@@ -22,6 +22,22 @@ type tx struct {
 
 	meta  metaStore
 	store localStore
+
+	// the shards that mappers were created for, by database and measurement name
+	shardIDs map[string]map[uint64]bool
+
+	// if set, the only shard groups read by the jobs, whatever the time range of the statement
+	shardGroupIDs []uint64
+
+	// the consistency level of the reads, and the ID of this node which it's checked against
+	consistency influxql.ReadConsistency
+	nodeID      uint64
+
+	// if set, creates the mappers reading shards from other nodes
+	remoteMapper RemoteMapperFunc
+
+	// if true, the selected fields a measurement doesn't have are null rather than an error
+	unifyColumns bool
 }
 
 type metaStore interface {
@@ -37,22 +53,158 @@ type localStore interface {
 // newTx return a new initialized Tx.
 func newTx(meta metaStore, store localStore) *tx {
 	return &tx{
-		meta:  meta,
-		store: store,
-		now:   time.Now(),
+		meta:     meta,
+		store:    store,
+		now:      time.Now(),
+		shardIDs: make(map[string]map[uint64]bool),
 	}
 }
 
 // SetNow sets the current time for the transaction.
 func (tx *tx) SetNow(now time.Time) { tx.now = now }
 
+// SetShardGroupIDs restricts the transaction to the shard groups with the given IDs.
+func (tx *tx) SetShardGroupIDs(ids []uint64) { tx.shardGroupIDs = ids }
+
+// SetReadConsistency sets the consistency level of the reads of the transaction. Shards are read
+// from a single owner, so reads from a majority of the owners aren't supported yet.
+func (tx *tx) SetReadConsistency(c influxql.ReadConsistency) error {
+	switch c {
+	case influxql.ReadConsistencyAny, influxql.ReadConsistencyOne:
+		tx.consistency = c
+		return nil
+	}
+	return influxql.ErrReadConsistencyNotSupported(c)
+}
+
+// SetUnifyColumns makes the jobs of the transaction return null for the selected fields their
+// measurement doesn't have.
+func (tx *tx) SetUnifyColumns() { tx.unifyColumns = true }
+
+// shardOwner returns the node a shard is read from at the consistency level of the transaction:
+// its primary owner, the first of its owners, at the one level, and this node otherwise.
+func (tx *tx) shardOwner(sh meta.ShardInfo) uint64 {
+	if tx.consistency == influxql.ReadConsistencyOne && len(sh.OwnerIDs) > 0 {
+		return sh.OwnerIDs[0]
+	}
+	return tx.nodeID
+}
+
+// newRemoteMapper returns a mapper for the job of stmt reading a shard from another node. It returns
+// ErrNotPrimaryOwner if the transaction can't read from other nodes, and ErrRemoteIntervals if the
+// mapper of an aggregate doesn't report its intervals.
+func (tx *tx) newRemoteMapper(stmt *influxql.SelectStatement, job *influxql.MapReduceJob, nodeID uint64, sh meta.ShardInfo) (influxql.Mapper, error) {
+	if tx.remoteMapper == nil {
+		return nil, ErrNotPrimaryOwner(sh.ID, nodeID)
+	}
+	mapper, err := tx.remoteMapper(job, nodeID, sh)
+	if err != nil {
+		return nil, err
+	} else if _, ok := mapper.(influxql.IntervalTimer); !ok && !stmt.IsRawQuery {
+		return nil, ErrRemoteIntervals
+	}
+	return mapper, nil
+}
+
+// shardGroups returns the shard groups of the retention policy that are read for the time range:
+// the groups that overlap it, or those of the groups set with SetShardGroupIDs that belong to it.
+// The sources of a statement can read different retention policies, so a group set with
+// SetShardGroupIDs only has to belong to one of them, which checkShardGroups checks.
+func (tx *tx) shardGroups(rp *meta.RetentionPolicyInfo, tmin, tmax time.Time) []*meta.ShardGroupInfo {
+	var groups []*meta.ShardGroupInfo
+	if tx.shardGroupIDs == nil {
+		for _, group := range rp.ShardGroups {
+			if group.Overlaps(tmin, tmax) {
+				g := group
+				groups = append(groups, &g)
+			}
+		}
+		return groups
+	}
+
+	for _, id := range tx.shardGroupIDs {
+		for i := range rp.ShardGroups {
+			if rp.ShardGroups[i].ID == id && !rp.ShardGroups[i].Deleted() {
+				g := rp.ShardGroups[i]
+				groups = append(groups, &g)
+				break
+			}
+		}
+	}
+	return groups
+}
+
+// checkShardGroups returns ErrShardGroupNotFound for the first of the groups set with
+// SetShardGroupIDs that isn't a group of any of the retention policies, e.g. because it was dropped.
+func (tx *tx) checkShardGroups(rps []*meta.RetentionPolicyInfo) error {
+	for _, id := range tx.shardGroupIDs {
+		var found bool
+		for _, rp := range rps {
+			for i := range rp.ShardGroups {
+				if rp.ShardGroups[i].ID == id && !rp.ShardGroups[i].Deleted() {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return ErrShardGroupNotFound(id)
+		}
+	}
+	return nil
+}
+
+// sourceKey returns the key of a measurement of a database in the shards the transaction created
+// mappers for.
+func sourceKey(database, name string) string {
+	return database + "\x00" + name
+}
+
+// Warm loads the indexes of the shards of the retention policy stored on this node, one shard at a
+// time, skipping the shard groups that have been deleted. See influxql.Planner.Warm.
+func (tx *tx) Warm(database, retentionPolicy string, closing <-chan struct{}) error {
+	rp, err := tx.meta.RetentionPolicy(database, retentionPolicy)
+	if err != nil {
+		return err
+	} else if rp == nil {
+		return meta.ErrRetentionPolicyNotFound
+	}
+
+	for _, sg := range rp.ShardGroups {
+		if sg.Deleted() {
+			continue
+		}
+		for _, sh := range sg.Shards {
+			// Shards that haven't been written on this node don't have an index to load.
+			shard := tx.store.Shard(sh.ID)
+			if shard == nil {
+				continue
+			}
+			if err := shard.WarmIndex(closing); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // CreateMappers will create a set of mappers that need to be run to execute the map phase of a MapReduceJob.
 func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []string) ([]*influxql.MapReduceJob, error) {
 	jobs := []*influxql.MapReduceJob{}
+
+	// with unified columns, the selected names that some measurement has as a field or tag
+	found := make(map[string]bool)
+
+	// the retention policies of the sources, which the shard groups of a snapshot are found in
+	var rps []*meta.RetentionPolicyInfo
+
+	// Each source is read from the shard groups of its own database and retention policy. The rows
+	// of statements reading several databases are tagged with the database of their series.
+	multiDB := databaseN(stmt.Sources) > 1
+
 	for _, src := range stmt.Sources {
 		mm, ok := src.(*influxql.Measurement)
-		if !ok {
-			return nil, fmt.Errorf("invalid source type: %#v", src)
+		if !ok || mm.Regex != nil {
+			return nil, influxql.NewErrUnsupportedSource(src)
 		}
 
 		// get the index and the retention policy
@@ -64,6 +216,7 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 		if m == nil {
 			return nil, ErrMeasurementNotFound(influxql.QuoteIdent([]string{mm.Database, "", mm.Name}...))
 		}
+		rps = append(rps, rp)
 
 		tx.measurement = m
 
@@ -72,16 +225,37 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 		var whereFields []string
 		var selectTags []string
 
+		// the tags the series of this measurement are grouped by. Selected tags are returned with the
+		// row's tags, so they're grouped by as well, but only for the measurement that has them.
+		dimensions := append([]string{}, tagKeys...)
+
+		// the number of selected fields the measurement has
+		var fieldN int
+
 		for _, n := range stmt.NamesInSelect() {
 			if m.HasField(n) {
 				selectFields = append(selectFields, n)
+				found[n] = true
+				fieldN++
 				continue
 			}
 			if !m.HasTagKey(n) {
+				// The field may belong to another measurement. It's decoded by name like the
+				// others, so it's null for the points of this one.
+				if tx.unifyColumns {
+					selectFields = append(selectFields, n)
+					continue
+				}
 				return nil, fmt.Errorf("unknown field or tag name in select clause: %s", n)
 			}
+			found[n] = true
 			selectTags = append(selectTags, n)
-			tagKeys = append(tagKeys, n)
+			dimensions = append(dimensions, n)
+		}
+
+		// a measurement without any of the fields would only return nulls
+		if tx.unifyColumns && fieldN == 0 {
+			continue
 		}
 		for _, n := range stmt.NamesInWhere() {
 			if n == "time" {
@@ -96,15 +270,26 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 			}
 		}
 
+		// Queries for the latest value of each series, e.g. SELECT last(value) FROM cpu GROUP BY host,
+		// read each series backward from its end rather than reading all of it.
+		calls := stmt.FunctionCalls()
+		lastOnly := len(calls) == 1 && calls[0].Name == "last" && len(whereFields) == 0 && !stmt.Hints.NoLastOptimization
+
 		if len(selectFields) == 0 && len(stmt.FunctionCalls()) == 0 {
 			return nil, fmt.Errorf("select statement must include at least one field or function call")
 		}
 
-		// Validate that group by is not a field
+		// Aggregates return a single value per interval, so there's no raw value to go alongside them.
+		if err := influxql.ValidateAggregateFields(stmt, m.HasField); err != nil {
+			return nil, err
+		}
+
+		// Validate that group by is not a field. Series without a tag that's grouped by, including
+		// when no series of the measurement has it, are grouped under an empty value for the tag.
 		for _, d := range stmt.Dimensions {
 			switch e := d.Expr.(type) {
 			case *influxql.VarRef:
-				if !m.HasTagKey(e.Val) {
+				if m.HasField(e.Val) {
 					return nil, fmt.Errorf("can not use field in group by clause: %s", e.Val)
 				}
 			}
@@ -119,16 +304,10 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 			tmin = time.Unix(0, 0)
 		}
 
-		// Find shard groups within time range.
-		var shardGroups []*meta.ShardGroupInfo
-		for _, group := range rp.ShardGroups {
-			if group.Overlaps(tmin, tmax) {
-				g := group
-				shardGroups = append(shardGroups, &g)
-			}
-		}
+		// Find shard groups within time range. The other sources may still have some.
+		shardGroups := tx.shardGroups(rp, tmin, tmax)
 		if len(shardGroups) == 0 {
-			return nil, nil
+			continue
 		}
 
 		// get the group by interval, if there is one
@@ -139,13 +318,25 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 			interval = d.Nanoseconds()
 		}
 
+		// get the offset of the group by interval boundaries
+		var offset int64
+		if d, err := stmt.GroupByOffset(); err != nil {
+			return nil, err
+		} else {
+			offset = d.Nanoseconds()
+		}
+
 		// get the sorted unique tag sets for this query.
-		tagSets, err := m.TagSets(stmt, tagKeys)
+		tagSets, err := m.TagSets(stmt, dimensions)
 		if err != nil {
 			return nil, err
 		}
 
 		for _, t := range tagSets {
+			if multiDB {
+				t = databaseTagSet(t, mm.Database)
+			}
+
 			// make a job for each tagset
 			job := &influxql.MapReduceJob{
 				MeasurementName: m.Name,
@@ -163,38 +354,68 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 				if len(sg.Shards) != 1 {
 					return nil, fmt.Errorf("distributed queries aren't supported yet. You have a replication policy with RF < # of servers in cluster")
 				}
+
+				// read the shard from another node if it's owned by one at the consistency level
+				if nodeID := tx.shardOwner(sg.Shards[0]); nodeID != tx.nodeID {
+					mapper, err := tx.newRemoteMapper(stmt, job, nodeID, sg.Shards[0])
+					if err != nil {
+						return nil, err
+					}
+					key := sourceKey(mm.Database, m.Name)
+					if tx.shardIDs[key] == nil {
+						tx.shardIDs[key] = make(map[uint64]bool)
+					}
+					tx.shardIDs[key][sg.Shards[0].ID] = true
+					mappers = append(mappers, mapper)
+					continue
+				}
+
 				shard := tx.store.Shard(sg.Shards[0].ID)
 				if shard == nil {
 					// the store returned nil which means we haven't written any data into this shard yet, so ignore it
 					continue
 				}
 
-				// get the codec for this measuremnt. If this is nil it just means this measurement was
+				// If the measurement has no fields in this shard it just means this measurement was
 				// never written into this shard, so we can skip it and continue.
-				codec := shard.FieldCodec(m.Name)
-				if codec == nil {
+				if shard.FieldCodec(m.Name) == nil {
 					continue
 				}
 
+				key := sourceKey(mm.Database, m.Name)
+				if tx.shardIDs[key] == nil {
+					tx.shardIDs[key] = make(map[uint64]bool)
+				}
+				tx.shardIDs[key][sg.Shards[0].ID] = true
+
 				var mapper influxql.Mapper
 
 				mapper = &LocalMapper{
 					seriesKeys:   t.SeriesKeys,
 					shard:        shard,
+					shardID:      sg.Shards[0].ID,
+					rp:           rp.Name,
+					shardStart:   sg.StartTime.UnixNano(),
+					shardEnd:     sg.EndTime.UnixNano(),
 					db:           shard.DB(),
 					job:          job,
-					decoder:      codec,
+					format:       sg.Shards[0].Format,
 					filters:      t.Filters,
 					whereFields:  whereFields,
 					selectFields: selectFields,
 					selectTags:   selectTags,
+					decodeAll:    stmt.Hints.NoFieldPruning,
+					lastOnly:     lastOnly,
+					ascending:    stmt.TimeAscending(),
 					tmin:         tmin.UnixNano(),
 					tmax:         tmax.UnixNano(),
 					interval:     interval,
+					offset:       offset,
 					// multiple mappers may need to be merged together to get the results
 					// for a raw query. So each mapper will have to read at least the
 					// limit plus the offset in data points to ensure we've hit our mark
-					limit: uint64(stmt.Limit) + uint64(stmt.Offset),
+					limit:      uint64(stmt.Limit) + uint64(stmt.Offset),
+					queryLimit: uint64(stmt.Limit) + uint64(stmt.Offset),
 				}
 
 				mappers = append(mappers, mapper)
@@ -206,19 +427,119 @@ func (tx *tx) CreateMapReduceJobs(stmt *influxql.SelectStatement, tagKeys []stri
 		}
 	}
 
+	// every shard group of a snapshot must still exist in one of the retention policies read
+	if err := tx.checkShardGroups(rps); err != nil {
+		return nil, err
+	}
+
+	// a name that no measurement has is still unknown
+	if tx.unifyColumns {
+		for _, n := range stmt.NamesInSelect() {
+			if !found[n] {
+				return nil, fmt.Errorf("unknown field or tag name in select clause: %s", n)
+			}
+		}
+	}
+
 	// always return them in sorted order so the results from running the jobs are returned in a deterministic order
 	sort.Sort(influxql.MapReduceJobs(jobs))
 	return jobs, nil
 }
 
+// DatabaseTag is the tag of the rows of a statement selecting from measurements of several
+// databases that has the database the row's series is read from, so the series of a measurement
+// in each database are returned separately.
+const DatabaseTag = "_database"
+
+// databaseN returns the number of distinct databases of the sources of a statement.
+func databaseN(sources influxql.Sources) int {
+	databases := make(map[string]bool)
+	for _, src := range sources {
+		if mm, ok := src.(*influxql.Measurement); ok {
+			databases[mm.Database] = true
+		}
+	}
+	return len(databases)
+}
+
+// databaseTagSet returns a copy of a tag set of a measurement of the database with DatabaseTag set
+// to the database.
+func databaseTagSet(t *influxql.TagSet, database string) *influxql.TagSet {
+	other := *t
+	other.Tags = make(map[string]string, len(t.Tags)+1)
+	for k, v := range t.Tags {
+		other.Tags[k] = v
+	}
+	other.Tags[DatabaseTag] = database
+	other.Key = marshalTags(other.Tags)
+	return &other
+}
+
+// MeasurementExists returns true if the measurement is in the index of its database.
+func (tx *tx) MeasurementExists(m *influxql.Measurement) (bool, error) {
+	return tx.store.Measurement(m.Database, m.Name) != nil, nil
+}
+
+// ShardSetChanged returns true if the statement reads from a shard that the jobs created by the
+// transaction don't have a mapper for, e.g. because its time range overlaps a new shard group or
+// data has since been written into a shard that was empty when the jobs were created.
+func (tx *tx) ShardSetChanged(stmt *influxql.SelectStatement) (bool, error) {
+	tmin, tmax := influxql.TimeRange(stmt.Condition)
+	if tmax.IsZero() {
+		tmax = tx.now
+	}
+	if tmin.IsZero() {
+		tmin = time.Unix(0, 0)
+	}
+
+	var rps []*meta.RetentionPolicyInfo
+	for _, src := range stmt.Sources {
+		mm, ok := src.(*influxql.Measurement)
+		if !ok || mm.Regex != nil {
+			return false, influxql.NewErrUnsupportedSource(src)
+		}
+
+		rp, err := tx.meta.RetentionPolicy(mm.Database, mm.RetentionPolicy)
+		if err != nil {
+			return false, err
+		}
+		rps = append(rps, rp)
+
+		for _, group := range tx.shardGroups(rp, tmin, tmax) {
+			if len(group.Shards) != 1 {
+				return true, nil
+			}
+
+			// shards without data for the measurement don't get a mapper
+			shard := tx.store.Shard(group.Shards[0].ID)
+			if shard == nil || shard.FieldCodec(mm.Name) == nil {
+				continue
+			}
+			if !tx.shardIDs[sourceKey(mm.Database, mm.Name)][group.Shards[0].ID] {
+				return true, nil
+			}
+		}
+	}
+	if err := tx.checkShardGroups(rps); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
 // LocalMapper implements the influxql.Mapper interface for running map tasks over a shard that is local to this server
 type LocalMapper struct {
 	cursorsEmpty     bool                   // boolean that lets us know if the cursors are empty
-	decoder          *FieldCodec            // decoder for the raw data bytes
+	format           uint32                 // on-disk format of the shard, from the meta store
+	decoder          PointDecoder           // decoder for the raw data bytes, selected by Begin
 	filters          []influxql.Expr        // filters for each series
 	cursors          []*shardCursor         // bolt cursors for each series id
 	seriesKeys       []string               // seriesKeys to be read from this shard
+	selectedKeys     map[string]bool        // if set, the subset of seriesKeys that Begin seeks
 	shard            *Shard                 // original shard
+	shardID          uint64                 // the ID of the shard
+	rp               string                 // the retention policy of the shard
+	shardStart       int64                  // the start of the time range of the shard's group
+	shardEnd         int64                  // the exclusive end of the time range of the shard's group
 	db               *bolt.DB               // bolt store for the shard accessed by this mapper
 	txn              *bolt.Tx               // read transactions by shard id
 	job              *influxql.MapReduceJob // the MRJob this mapper belongs to
@@ -233,22 +554,60 @@ type LocalMapper struct {
 	whereFields      []string               // field names that occur in the where clause
 	selectFields     []string               // field names that occur in the select clause
 	selectTags       []string               // tag keys that occur in the select clause
+	decodeIDs        []uint8                // if set, the IDs of the fields decoded from points whose fields are decoded by name
+	decodeAll        bool                   // if true, every field of points whose fields are decoded by name is decoded
+	coercer          *coercingDecoder       // if set, the decoder coercing fields to the types forced by the query
 	isRaw            bool                   // if the query is a non-aggregate query
+	ascending        bool                   // if false, raw queries read the cursors backward from the end of the time range
+	lastOnly         bool                   // if the only aggregate of the query is last() and there are no field filters
+	readLast         bool                   // if set, the current call reads the last point of each series backward
+	readN            int                    // the number of points read from the cursors
 	interval         int64                  // the group by interval of the query, if any
+	offset           int64                  // the offset of the group by interval boundaries, if any
 	limit            uint64                 // used for raw queries for LIMIT
+	queryLimit       uint64                 // the limit the mapper was created with, restored by Reset
 	perIntervalLimit int                    // used for raw queries to determine how far into a chunk we are
 	chunkSize        int                    // used for raw queries to determine how much data to read before flushing to client
+	skippedN         int                    // the number of NaN and infinite values skipped
+
+	rollups   RollupReader                        // if set, the reader of the rollups the current aggregate is computed from
+	rollupMap func([]influxql.Rollup) interface{} // the map function of the current aggregate over rollups
 }
 
-// Open opens the LocalMapper.
+// Open opens the LocalMapper and pins it to a snapshot of the shard. The snapshot is a bolt read
+// transaction and a copy of the in-cache points of each series, both taken under the shard lock so
+// that no write or WAL flush falls between them. The read transaction keeps the pages it sees until
+// Close releases it, so points written and flushed into the shard while the query runs aren't
+// returned by the mapper. Deleted series are removed from the shard's buckets and cache
+// under the shard lock rather than tombstoned, so the read transaction and the copy of the cache
+// that are taken here never include deleted data. A series deleted since the query was planned
+// has no bucket or cached points, so its cursor is left nil and it isn't read. If the shard was
+// dropped since the query was planned, ErrShardNotFound is returned. If the job has a scope, an
+// error is returned if the measurement or any of the series are outside it.
 func (l *LocalMapper) Open() error {
+	// Check the series against the scope of the query rather than trusting the planner to have
+	// restricted them to it.
+	if s := l.job.Scope; s != nil {
+		if !s.AllowsMeasurement(l.job.MeasurementName) {
+			return influxql.ErrMeasurementNotInScope(l.job.MeasurementName)
+		}
+		for _, key := range l.seriesKeys {
+			// a series deleted since the query was planned isn't read anyway
+			if series := l.shard.index.Series(key); series != nil && !s.AllowsSeries(series.Tags) {
+				return influxql.ErrSeriesNotInScope(key)
+			}
+		}
+	}
+
 	// Obtain shard lock to copy in-cache points.
 	l.shard.mu.Lock()
 	defer l.shard.mu.Unlock()
 
 	// Open the data store
 	txn, err := l.db.Begin(false)
-	if err != nil {
+	if err == bolt.ErrDatabaseNotOpen {
+		return ErrShardNotFound
+	} else if err != nil {
 		return err
 	}
 	l.txn = txn
@@ -281,25 +640,156 @@ func (l *LocalMapper) Open() error {
 	return nil
 }
 
-// Close closes the LocalMapper.
+// ShardID returns the ID of the shard read by the LocalMapper.
+func (l *LocalMapper) ShardID() uint64 { return l.shardID }
+
+// RetentionPolicy returns the retention policy of the shard read by the LocalMapper.
+func (l *LocalMapper) RetentionPolicy() string { return l.rp }
+
+// ShardTimeRange returns the time range of the shard group of the shard read by the LocalMapper.
+func (l *LocalMapper) ShardTimeRange() (start, end int64) { return l.shardStart, l.shardEnd }
+
+// Close closes the LocalMapper and releases the snapshot of the shard taken by Open.
 func (l *LocalMapper) Close() {
 	if l.txn != nil {
 		_ = l.txn.Rollback()
 	}
 }
 
+// EstimatedPointN returns the approximate number of points in the series read by the mapper. It
+// samples the bolt bucket of each series with estimateKeyN and adds the size of the cache, so it
+// must be called after Open.
+func (l *LocalMapper) EstimatedPointN() int {
+	var n int
+	for i, c := range l.cursors {
+		if c == nil || (l.selectedKeys != nil && !l.selectedKeys[l.seriesKeys[i]]) {
+			continue
+		}
+		if c.cursor != nil {
+			n += estimateKeyN(c.cursor.Bucket())
+		}
+		n += len(c.cache)
+	}
+	return n
+}
+
+// estimateKeySampleN is the number of points at the start of a series bucket that estimateKeyN reads.
+const estimateKeySampleN = 64
+
+// estimateKeyN estimates the number of points in the bucket of a series without walking it. The
+// first points of the bucket are read, and their density is extrapolated to the time of its last
+// point, so only the first and last pages of the bucket are read. Buckets with no more points than
+// the sample are counted exactly.
+func estimateKeyN(b *bolt.Bucket) int {
+	cur := b.Cursor()
+	k, _ := cur.First()
+	if k == nil {
+		return 0
+	}
+	first, last := btou64(k), btou64(k)
+	n := 1
+	for ; n < estimateKeySampleN; n++ {
+		if k, _ = cur.Next(); k == nil {
+			return n
+		}
+		last = btou64(k)
+	}
+
+	k, _ = cur.Last()
+	if span := last - first; span > 0 {
+		return int(float64(n-1)*float64(btou64(k)-first)/float64(span)) + 1
+	}
+	return n
+}
+
+// SetSeriesKeys restricts the series that are read by subsequent calls to Begin.
+func (l *LocalMapper) SetSeriesKeys(keys []string) error {
+	l.selectedKeys = make(map[string]bool, len(keys))
+	for _, k := range keys {
+		l.selectedKeys[k] = true
+	}
+	return nil
+}
+
+// Reset sets the time range of the mapper for the next call to Begin, and restores the limit of
+// raw queries that's used up as points are read.
+func (l *LocalMapper) Reset(tmin, tmax int64) error {
+	l.tmin = tmin
+	l.tmax = tmax
+	l.limit = l.queryLimit
+	l.cursorsEmpty = false
+	l.skippedN = 0
+	return nil
+}
+
+// decodeFields decodes the fields of a point that the mapper reads by name, or all of them if its
+// decoder can't decode only some.
+func (l *LocalMapper) decodeFields(b []byte) (map[string]interface{}, error) {
+	if d, ok := l.decoder.(SelectiveDecoder); ok && l.decodeIDs != nil {
+		return d.DecodeSelectedFields(l.decodeIDs, b)
+	}
+	return l.decoder.DecodeFieldsWithNames(b)
+}
+
+// SkippedN returns the number of NaN and infinite values skipped by the LocalMapper.
+func (l *LocalMapper) SkippedN() int { return l.skippedN }
+
 // Begin will set up the mapper to run the map function for a given aggregate call starting at the passed in time
 func (l *LocalMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int) error {
 	// set up the buffers. These ensure that we return data in time order
-	mapFunc, err := influxql.InitializeMapFunc(c)
+	mapFunc, err := l.job.InitializeMapFunc(c)
 	if err != nil {
 		return err
 	}
 	l.mapFunc = mapFunc
+
+	// select the decoder for the format the shard was written in
+	decoder, err := NewPointDecoder(l.format, l.shard, l.job.MeasurementName)
+	if err != nil {
+		return err
+	} else if decoder == nil {
+		return fmt.Errorf("no fields for measurement %s in shard %d", l.job.MeasurementName, l.shardID)
+	}
+	l.decoder = decoder
+
+	// decode only the selected and filtered fields of points, rather than all of them, if the
+	// decoder can skip the others
+	l.decodeIDs = nil
+	if _, ok := decoder.(SelectiveDecoder); ok && !l.decodeAll {
+		l.decodeIDs = []uint8{}
+		for _, names := range [][]string{l.selectFields, l.whereFields} {
+			for _, n := range names {
+				if id, err := decoder.FieldIDByName(n); err == nil {
+					l.decodeIDs = append(l.decodeIDs, id)
+				}
+			}
+		}
+	}
+
+	// coerce the fields whose types are forced by the query as they're decoded
+	l.coercer = nil
+	if l.job.FieldTypes != nil {
+		l.coercer = newCoercingDecoder(decoder, l.job.FieldTypes)
+		l.decoder = l.coercer
+	}
+
+	if l.job.SkipNonFinite {
+		l.mapFunc = influxql.FiniteMapFunc(mapFunc, &l.skippedN)
+	}
+
+	// compute the aggregate from the rollups of the blocks of points, if the shard's format keeps
+	// them and the points don't have to be filtered
+	l.rollups, l.rollupMap = nil, nil
+	if rr, ok := decoder.(RollupReader); ok && !l.hasFilters() {
+		if fn := l.job.RollupMapFunc(c); fn != nil {
+			l.rollups, l.rollupMap = rr, fn
+		}
+	}
+
 	l.keyBuffer = make([]int64, len(l.cursors))
 	l.valueBuffer = make([][]byte, len(l.cursors))
 	l.chunkSize = chunkSize
-	l.tmin = startingTime
+	l.readLast = false
 
 	var isCountDistinct bool
 
@@ -338,6 +828,13 @@ func (l *LocalMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int)
 		isCountDistinct = isCountDistinct || (c.Name == "count" && nested.Name == "distinct")
 	}
 
+	// raw queries sorted by descending time are read backward from the starting time
+	if l.reverse() {
+		l.tmax = startingTime
+	} else {
+		l.tmin = startingTime
+	}
+
 	// set up the field info if a specific field was set for this mapper
 	if fieldName != "" {
 		fid, err := l.decoder.FieldIDByName(fieldName)
@@ -353,15 +850,32 @@ func (l *LocalMapper) Begin(c *influxql.Call, startingTime int64, chunkSize int)
 		l.fieldName = fieldName
 	}
 
+	// The last point of a single interval is found by reading backward from the end of each series,
+	// so the cursors aren't seeked forward. Non-finite values are skipped by the map function, so
+	// there's no telling how far back to read if they're skipped.
+	if l.lastOnly && c != nil && c.Name == "last" && l.interval == 0 && !l.job.SkipNonFinite {
+		if _, ok := c.Args[0].(*influxql.VarRef); ok {
+			l.readLast = true
+			l.cursorsEmpty = false
+			return nil
+		}
+	}
+
 	// seek the bolt cursors and fill the buffers
 	for i, c := range l.cursors {
-		// this series may have never been written in this shard group (time range) so the cursor would be nil
-		if c == nil {
+		// this series may have never been written in this shard group (time range) so the cursor would be nil.
+		// It's also skipped if the series wasn't selected.
+		if c == nil || (l.selectedKeys != nil && !l.selectedKeys[l.seriesKeys[i]]) {
 			l.keyBuffer[i] = 0
 			l.valueBuffer[i] = nil
 			continue
 		}
-		k, v := c.Seek(u64tob(uint64(l.job.TMin)))
+		var k, v []byte
+		if l.reverse() {
+			k, v = c.SeekReverse(u64tob(uint64(l.tmax)))
+		} else {
+			k, v = c.Seek(u64tob(uint64(l.tmin)))
+		}
 		if k == nil {
 			l.keyBuffer[i] = 0
 			l.valueBuffer[i] = nil
@@ -383,6 +897,13 @@ func (l *LocalMapper) NextInterval() (interface{}, error) {
 		return nil, nil
 	}
 
+	// a query without a group by interval has a single interval, so it's read in one go
+	if l.readLast {
+		val := l.mapFunc(l.lastPoints())
+		l.cursorsEmpty = true
+		return val, l.coercionErr()
+	}
+
 	// after we call to the mapper, this will be the tmin for the next interval.
 	nextMin := l.tmin + l.interval
 
@@ -391,17 +912,23 @@ func (l *LocalMapper) NextInterval() (interface{}, error) {
 		l.perIntervalLimit = l.chunkSize
 	} else if l.interval > 0 {
 		// Set tmax to ensure that the interval lands on the boundary of the interval
-		if l.tmin%l.interval != 0 {
+		if (l.tmin-l.offset)%l.interval != 0 {
 			// the first interval in a query with a group by may be smaller than the others. This happens when they have a
 			// where time > clause that is in the middle of the bucket that the group by time creates. That will be the
-			// case on the first interval when the tmin % the interval isn't equal to zero
-			nextMin = l.tmin/l.interval*l.interval + l.interval
+			// case on the first interval when the tmin isn't on the boundary of an interval
+			nextMin = influxql.IntervalStart(l.tmin, l.interval, l.offset) + l.interval
 		}
 		l.tmax = nextMin - 1
 	}
 
-	// Execute the map function. This local mapper acts as the iterator
-	val := l.mapFunc(l)
+	// Execute the map function. This local mapper acts as the iterator, unless the interval can be
+	// computed from rollups.
+	val, ok, err := l.mapRollups()
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		val = l.mapFunc(l)
+	}
 
 	// see if all the cursors are empty
 	l.cursorsEmpty = true
@@ -417,11 +944,81 @@ func (l *LocalMapper) NextInterval() (interface{}, error) {
 		l.tmin = nextMin
 	}
 
-	return val, nil
+	return val, l.coercionErr()
+}
+
+// hasFilters returns true if the points of any series are filtered by the where clause.
+func (l *LocalMapper) hasFilters() bool {
+	for _, f := range l.filters {
+		if f != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// mapRollups computes the map function of the current interval from the rollups of the blocks of
+// points of the series, if the interval contains every block it has points of and none of its
+// points are cached. The cursors are then seeked past the interval without reading the points.
+// It returns false if the points of the interval must be read.
+func (l *LocalMapper) mapRollups() (interface{}, bool, error) {
+	if l.rollups == nil {
+		return nil, false, nil
+	}
+
+	var rollups []influxql.Rollup
+	var read []int
+	for i, c := range l.cursors {
+		// skip the series that weren't selected or have no points in the interval
+		if c == nil || l.keyBuffer[i] == 0 || l.keyBuffer[i] > l.tmax {
+			continue
+		}
+
+		// cached points aren't in any block
+		start := sort.Search(len(c.cache), func(j int) bool { return int64(btou64(c.cache[j][0:8])) >= l.tmin })
+		if start < len(c.cache) && int64(btou64(c.cache[start][0:8])) <= l.tmax {
+			return nil, false, nil
+		}
+
+		blocks, err := l.rollups.Rollups(l.txn, l.seriesKeys[i], l.fieldID, l.tmin, l.tmax)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, b := range blocks {
+			if b.Start < l.tmin || b.End > l.tmax {
+				return nil, false, nil
+			}
+		}
+		rollups = append(rollups, blocks...)
+		read = append(read, i)
+	}
+
+	// move the cursors past the interval
+	seek := u64tob(uint64(l.tmax + 1))
+	for _, i := range read {
+		k, v := l.cursors[i].Seek(seek)
+		if k == nil {
+			l.keyBuffer[i] = 0
+		} else {
+			l.keyBuffer[i] = int64(btou64(k))
+		}
+		l.valueBuffer[i] = v
+	}
+	return l.rollupMap(rollups), true, nil
+}
+
+// coercionErr returns the error of the first value that couldn't be coerced to the type forced
+// by the query, if any.
+func (l *LocalMapper) coercionErr() error {
+	if l.coercer == nil {
+		return nil
+	}
+	return l.coercer.err
 }
 
 // Next returns the next matching timestamped value for the LocalMapper.
 func (l *LocalMapper) Next() (seriesKey string, timestamp int64, value interface{}) {
+	reverse := l.reverse()
 	for {
 		// if it's a raw query and we've hit the limit of the number of points to read in
 		// for either this chunk or for the absolute query, bail
@@ -429,11 +1026,19 @@ func (l *LocalMapper) Next() (seriesKey string, timestamp int64, value interface
 			return "", int64(0), nil
 		}
 
-		// find the minimum timestamp
+		// stop reading once a value couldn't be coerced, since the mapper fails with the error
+		if l.coercionErr() != nil {
+			return "", 0, nil
+		}
+
+		// find the minimum timestamp, or the maximum if the cursors are read backward
 		min := -1
 		minKey := int64(math.MaxInt64)
+		if reverse {
+			minKey = math.MinInt64
+		}
 		for i, k := range l.keyBuffer {
-			if k != 0 && k <= l.tmax && k < minKey && k >= l.tmin {
+			if k != 0 && k <= l.tmax && k >= l.tmin && ((!reverse && k < minKey) || (reverse && k > minKey)) {
 				min = i
 				minKey = k
 			}
@@ -452,7 +1057,7 @@ func (l *LocalMapper) Next() (seriesKey string, timestamp int64, value interface
 		var value interface{}
 		var err error
 		if l.isRaw && len(l.selectFields) > 1 {
-			if fieldsWithNames, err := l.decoder.DecodeFieldsWithNames(l.valueBuffer[min]); err == nil {
+			if fieldsWithNames, err := l.decodeFields(l.valueBuffer[min]); err == nil {
 				value = fieldsWithNames
 
 				// if there's a where clause, make sure we don't need to filter this value
@@ -473,7 +1078,7 @@ func (l *LocalMapper) Next() (seriesKey string, timestamp int64, value interface
 						value = nil
 					}
 				} else { // decode everything
-					fieldsWithNames, err := l.decoder.DecodeFieldsWithNames(l.valueBuffer[min])
+					fieldsWithNames, err := l.decodeFields(l.valueBuffer[min])
 					if err != nil || !matchesWhere(l.filters[min], fieldsWithNames) {
 						value = nil
 					}
@@ -482,7 +1087,13 @@ func (l *LocalMapper) Next() (seriesKey string, timestamp int64, value interface
 		}
 
 		// advance the cursor
-		nextKey, nextVal := l.cursors[min].Next()
+		l.readN++
+		var nextKey, nextVal []byte
+		if reverse {
+			nextKey, nextVal = l.cursors[min].Prev()
+		} else {
+			nextKey, nextVal = l.cursors[min].Next()
+		}
 		if nextKey == nil {
 			l.keyBuffer[min] = 0
 		} else {
@@ -505,6 +1116,72 @@ func (l *LocalMapper) Next() (seriesKey string, timestamp int64, value interface
 	}
 }
 
+// reverse returns true if the cursors are read backward. Only raw queries sorted by descending
+// time are, since the intervals of aggregates are always reduced in time order.
+func (l *LocalMapper) reverse() bool { return l.isRaw && !l.ascending }
+
+// lastPoints returns an iterator over the last point of each series between tmin and tmax that
+// has the field of the mapper. Each cursor is seeked to tmax and read backward until such a point
+// is found, so usually a single point of each series is read.
+func (l *LocalMapper) lastPoints() influxql.Iterator {
+	itr := &lastPointIterator{}
+	seek := u64tob(uint64(l.tmax))
+	for i, c := range l.cursors {
+		if c == nil || (l.selectedKeys != nil && !l.selectedKeys[l.seriesKeys[i]]) {
+			continue
+		}
+
+		for k, v := c.SeekReverse(seek); k != nil; k, v = c.Prev() {
+			l.readN++
+			t := int64(btou64(k))
+			if t < l.tmin {
+				break
+			}
+
+			// keep reading back if this point doesn't have the field
+			value, err := l.decoder.DecodeByID(l.fieldID, v)
+			if err != nil || value == nil {
+				continue
+			}
+			itr.points = append(itr.points, lastPoint{seriesKey: l.seriesKeys[i], time: t, value: value})
+			break
+		}
+	}
+
+	// yield the points in time order, like the cursors are read going forward
+	sort.Stable(itr.points)
+	return itr
+}
+
+// lastPoint is the last point of a series.
+type lastPoint struct {
+	seriesKey string
+	time      int64
+	value     interface{}
+}
+
+// lastPointsByTime sorts the last points of several series by time.
+type lastPointsByTime []lastPoint
+
+func (a lastPointsByTime) Len() int           { return len(a) }
+func (a lastPointsByTime) Less(i, j int) bool { return a[i].time < a[j].time }
+func (a lastPointsByTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// lastPointIterator iterates over the last point of each series in time order.
+type lastPointIterator struct {
+	points lastPointsByTime
+}
+
+// Next returns the next point of the iterator.
+func (itr *lastPointIterator) Next() (seriesKey string, timestamp int64, value interface{}) {
+	if len(itr.points) == 0 {
+		return "", 0, nil
+	}
+	p := itr.points[0]
+	itr.points = itr.points[1:]
+	return p.seriesKey, p.time, p.value
+}
+
 // IsEmpty returns true if either all cursors are nil or all cursors are past the passed in max time
 func (l *LocalMapper) IsEmpty(tmax int64) bool {
 	if l.cursorsEmpty || l.limit == 0 {